@@ -2,59 +2,114 @@ package cleanup
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 )
 
 // Manager handles graceful shutdown and cleanup
 type Manager struct {
-	buildDir    string
+	paths       []string  // Directories removed on cleanup, in the order they were added
+	out         io.Writer // Where status messages are written
 	cleanupDone chan bool
 	interrupted bool
 	mu          sync.Mutex
 }
 
-// New creates a new cleanup manager
+// New creates a new cleanup manager that removes buildDir (none if empty)
 func New(buildDir string) *Manager {
-	return &Manager{
-		buildDir:    buildDir,
+	cm := &Manager{
+		out:         os.Stdout,
 		cleanupDone: make(chan bool, 1),
 	}
+	if buildDir != "" {
+		cm.paths = []string{buildDir}
+	}
+	return cm
+}
+
+// Add registers another directory to remove on cleanup
+func (cm *Manager) Add(path string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.paths = append(cm.paths, path)
 }
 
-// SetupSignalHandling sets up signal handlers for graceful shutdown
-func (cm *Manager) SetupSignalHandling() {
+// SetOutput sets where status messages are written (os.Stdout by default)
+func (cm *Manager) SetOutput(w io.Writer) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.out = w
+}
+
+// SetupSignalHandling sets up signal handlers for graceful shutdown. It returns a function that
+// stops handling the signals, to call once the directories no longer need guarding.
+func (cm *Manager) SetupSignalHandling() (stop func()) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		sig := <-sigChan
+		sig, ok := <-sigChan
+		if !ok {
+			return
+		}
 		cm.mu.Lock()
 		if !cm.interrupted {
 			cm.interrupted = true
-			fmt.Printf("\n\n🛑 Received %s signal, cleaning up...\n", sig)
+			fmt.Fprintf(cm.out, "\n\n🛑 Received %s signal, cleaning up...\n", sig)
 			cm.cleanup()
-			fmt.Println("✅ Cleanup completed")
+			fmt.Fprintln(cm.out, "✅ Cleanup completed")
 			os.Exit(130) // Standard exit code for SIGINT
 		}
 		cm.mu.Unlock()
 	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(sigChan)
+	}
 }
 
 // cleanup performs the cleanup operation
 func (cm *Manager) cleanup() {
-	if cm.buildDir != "" {
-		err := os.RemoveAll(cm.buildDir)
+	for _, path := range cm.paths {
+		err := removeAll(path)
 		if err != nil {
-			fmt.Printf("⚠️  Warning: Failed to clean up temporary directory %s: %v\n", cm.buildDir, err)
+			fmt.Fprintf(cm.out, "⚠️  Warning: Failed to clean up temporary directory %s: %v\n", path, err)
 		} else {
-			fmt.Printf("🗑️  Removed temporary directory: %s\n", cm.buildDir)
+			fmt.Fprintf(cm.out, "🗑️  Removed temporary directory: %s\n", path)
 		}
-		// Clear the buildDir to prevent double cleanup
-		cm.buildDir = ""
 	}
+	// Clear the paths to prevent double cleanup
+	cm.paths = nil
+}
+
+// removeAll removes path and everything below it. If that fails, it gives the owner full
+// permissions on every directory below path, which may have been locked down on purpose
+// (e.g. with --dir-mode), and tries again.
+func removeAll(path string) error {
+	if err := os.RemoveAll(path); err == nil {
+		return nil
+	}
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				os.Chmod(p, info.Mode().Perm()|0700)
+			}
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// Disarm keeps the registered directories: neither GracefulCleanup nor a signal will remove them
+func (cm *Manager) Disarm() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.paths = nil
 }
 
 // GracefulCleanup performs cleanup if not already interrupted
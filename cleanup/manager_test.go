@@ -1,7 +1,9 @@
 package cleanup
 
 import (
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -12,8 +14,13 @@ func TestNew(t *testing.T) {
 		t.Error("Failed to create cleanup manager")
 	}
 
-	if cm.buildDir != "/tmp/test" {
-		t.Errorf("Expected buildDir '/tmp/test', got %s", cm.buildDir)
+	if len(cm.paths) != 1 || cm.paths[0] != "/tmp/test" {
+		t.Errorf("Expected paths [/tmp/test], got %v", cm.paths)
+	}
+
+	// Without a build directory nothing is registered
+	if cm := New(""); len(cm.paths) != 0 {
+		t.Errorf("Expected no paths, got %v", cm.paths)
 	}
 }
 
@@ -41,6 +48,64 @@ func TestGracefulCleanup(t *testing.T) {
 	}
 }
 
+func TestCleanupMultipleDirs(t *testing.T) {
+	buildDir := t.TempDir()
+	stagingDir := t.TempDir()
+
+	// Both the build directory and an added one are removed
+	cm := New(buildDir)
+	cm.SetOutput(io.Discard)
+	cm.Add(stagingDir)
+	cm.GracefulCleanup()
+
+	for _, dir := range []string{buildDir, stagingDir} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Directory should be removed after cleanup: %s", dir)
+		}
+	}
+	if len(cm.paths) != 0 {
+		t.Errorf("Expected paths to be cleared after cleanup, got %v", cm.paths)
+	}
+}
+
+func TestCleanupLockedDir(t *testing.T) {
+	buildDir := filepath.Join(t.TempDir(), "build")
+	lockedDir := filepath.Join(buildDir, "layer1", "locked")
+	if err := os.MkdirAll(lockedDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(lockedDir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// Directories without write or search permission are still removed
+	for _, dir := range []string{lockedDir, filepath.Dir(lockedDir)} {
+		if err := os.Chmod(dir, 0500); err != nil {
+			t.Fatalf("Failed to lock directory: %v", err)
+		}
+	}
+	cm := New(buildDir)
+	cm.SetOutput(io.Discard)
+	cm.GracefulCleanup()
+
+	if _, err := os.Stat(buildDir); !os.IsNotExist(err) {
+		t.Errorf("Build directory should be removed after cleanup: %v", err)
+	}
+}
+
+func TestDisarm(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// A disarmed manager leaves the directory in place
+	cm := New(tempDir)
+	cm.Disarm()
+	cm.GracefulCleanup()
+
+	if _, err := os.Stat(tempDir); err != nil {
+		t.Errorf("Temp directory should be kept after Disarm: %v", err)
+	}
+}
+
 func TestDoubleCleanup(t *testing.T) {
 	// Create a temporary directory for testing
 	tempDir, err := os.MkdirTemp("", "imgmkr-double-cleanup-test-")
@@ -0,0 +1,49 @@
+package content
+
+import (
+	"io"
+	"math/rand"
+)
+
+// NewDict returns n random bytes drawn from rng, to be repeated as file content. Repeating a
+// small dictionary compresses almost perfectly; dictionaries larger than the compressor's
+// window (32KB for gzip) barely compress at all.
+func NewDict(rng *rand.Rand, n int) []byte {
+	if rng == nil {
+		rng = NewRand(0)
+	}
+	dict := make([]byte, n)
+	rng.Read(dict)
+	return dict
+}
+
+// NewDictFiller returns a Filler that fills buffers by repeating dict from its start
+func NewDictFiller(dict []byte) *Filler {
+	return &Filler{dict: dict}
+}
+
+// NewRepeatReader returns an endless reader repeating dict from its start
+func NewRepeatReader(dict []byte) io.Reader {
+	return &repeatReader{dict: dict}
+}
+
+// repeatReader reads dict over and over
+type repeatReader struct {
+	dict   []byte
+	offset int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	r.offset = repeat(p, r.dict, r.offset)
+	return len(p), nil
+}
+
+// repeat fills p with dict repeated from offset and returns the offset to continue from
+func repeat(p, dict []byte, offset int) int {
+	for n := 0; n < len(p); {
+		copied := copy(p[n:], dict[offset:])
+		n += copied
+		offset = (offset + copied) % len(dict)
+	}
+	return offset
+}
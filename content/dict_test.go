@@ -0,0 +1,57 @@
+package content
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestDictFillerRepeats(t *testing.T) {
+	dict := NewDict(NewRand(1), 10)
+	f := NewDictFiller(dict)
+
+	// Filling in odd-sized pieces continues where the last fill left off
+	buf := make([]byte, 35)
+	f.Fill(buf[:7])
+	f.Fill(buf[7:])
+	expected := bytes.Repeat(dict, 4)[:35]
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("Expected the dictionary repeated, got %x", buf)
+	}
+
+	// The reader repeats the same way
+	data, err := io.ReadAll(io.LimitReader(NewRepeatReader(dict), 35))
+	if err != nil || !bytes.Equal(data, expected) {
+		t.Errorf("Expected the reader to repeat the dictionary, got %x (err: %v)", data, err)
+	}
+}
+
+func TestDictCompressionRatio(t *testing.T) {
+	const fileSize = 4 * 1024 * 1024
+
+	// Larger dictionaries compress less
+	var prevRatio float64
+	for i, dictSize := range []int{16, 1024, 16 * 1024, 1024 * 1024} {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err := io.Copy(zw, io.LimitReader(NewRepeatReader(NewDict(NewRand(1), dictSize)), fileSize)); err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+
+		ratio := float64(fileSize) / float64(compressed.Len())
+		t.Logf("dict %d bytes: gzip ratio %.1f", dictSize, ratio)
+		if i > 0 && ratio >= prevRatio {
+			t.Errorf("Expected a %d-byte dictionary to compress less than a smaller one, got ratio %.1f after %.1f", dictSize, ratio, prevRatio)
+		}
+		prevRatio = ratio
+	}
+
+	// A dictionary beyond gzip's window is effectively incompressible
+	if prevRatio > 1.05 {
+		t.Errorf("Expected a 1MB dictionary to be nearly incompressible, got ratio %.2f", prevRatio)
+	}
+}
@@ -0,0 +1,53 @@
+package content
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipChunkSize is how much of the source is compressed at a time
+const gzipChunkSize = 64 * 1024
+
+// NewGzipReader returns a reader of src's data compressed with gzip, for content that is already
+// compressed and won't shrink when compressed again (like jars, images, or zstd blobs). The
+// stream is never closed, so reading part of it gives a truncated gzip stream. An endless src
+// gives an endless reader.
+func NewGzipReader(src io.Reader) io.Reader {
+	r := &gzipReader{src: src, chunk: make([]byte, gzipChunkSize)}
+	r.zw, _ = gzip.NewWriterLevel(&r.buf, gzip.BestSpeed)
+	return r
+}
+
+// gzipReader compresses src a chunk at a time as its output is read
+type gzipReader struct {
+	src   io.Reader
+	zw    *gzip.Writer
+	buf   bytes.Buffer // Compressed data not yet read
+	chunk []byte
+	done  bool // src is exhausted and the stream closed
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	// The compressor holds back data until it has a block's worth
+	for r.buf.Len() == 0 && !r.done {
+		n, err := io.ReadFull(r.src, r.chunk)
+		if _, werr := r.zw.Write(r.chunk[:n]); werr != nil {
+			return 0, werr
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			r.done = true
+			if err := r.zw.Close(); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, err
+		}
+	}
+	if r.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.buf.Read(p)
+}
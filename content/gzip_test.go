@@ -0,0 +1,40 @@
+package content
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestGzipReader(t *testing.T) {
+	// Finite sources give a complete gzip stream
+	src := bytes.Repeat([]byte("imgmkr "), 100000)
+	compressed, err := io.ReadAll(NewGzipReader(bytes.NewReader(src)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Expected a gzip stream: %v", err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, src) {
+		t.Errorf("Expected the stream to decompress to the source (err: %v)", err)
+	}
+
+	// Compressed random data doesn't shrink when compressed again
+	data := make([]byte, 1024*1024)
+	if _, err := io.ReadFull(NewGzipReader(NewFiller(NewRand(1), nil, false)), data); err != nil {
+		t.Fatalf("Unexpected error reading an endless source: %v", err)
+	}
+	if data[0] != 0x1f || data[1] != 0x8b {
+		t.Errorf("Expected the gzip magic number, got %x", data[:2])
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	if ratio := float64(buf.Len()) / float64(len(data)); ratio < 0.99 {
+		t.Errorf("Expected compressed data to gzip to at least 99%% of its size, got %.1f%%", ratio*100)
+	}
+}
@@ -0,0 +1,49 @@
+package content
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// magic maps file extensions to the leading bytes that identify their format
+var magic = map[string][]byte{
+	".png":   {0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'},
+	".so":    {0x7f, 'E', 'L', 'F', 0x02, 0x01, 0x01, 0x00},
+	".zip":   {'P', 'K', 0x03, 0x04},
+	".gz":    {0x1f, 0x8b, 0x08, 0x00},
+	".pdf":   []byte("%PDF-1.7\n"),
+	".jpg":   {0xff, 0xd8, 0xff, 0xe0},
+	".gif":   []byte("GIF89a"),
+	".class": {0xca, 0xfe, 0xba, 0xbe},
+	".wasm":  {0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00},
+}
+
+// MagicExtensions returns the extensions with a known magic number, sorted
+func MagicExtensions() []string {
+	exts := make([]string, 0, len(magic))
+	for ext := range magic {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// RandomMagicExtension returns a random extension with a known magic number, drawn from rng
+// (or the global source if rng is nil)
+func RandomMagicExtension(rng *rand.Rand) string {
+	exts := MagicExtensions()
+	if rng == nil {
+		return exts[rand.Intn(len(exts))]
+	}
+	return exts[rng.Intn(len(exts))]
+}
+
+// MagicHeader returns the magic bytes for ext, truncated so they never exceed fileSize.
+// It returns nil for extensions without a known magic number.
+func MagicHeader(ext string, fileSize int64) []byte {
+	header := magic[ext]
+	if int64(len(header)) > fileSize {
+		header = header[:fileSize]
+	}
+	return header
+}
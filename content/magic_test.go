@@ -0,0 +1,36 @@
+package content
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMagicHeader(t *testing.T) {
+	tests := []struct {
+		ext      string
+		fileSize int64
+		expected []byte
+	}{
+		{".png", 1024, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}},
+		{".zip", 1024, []byte("PK\x03\x04")},
+		{".so", 1024, []byte("\x7fELF\x02\x01\x01\x00")},
+		{".png", 3, []byte{0x89, 'P', 'N'}},
+		{".txt", 1024, nil},
+	}
+
+	for _, test := range tests {
+		header := MagicHeader(test.ext, test.fileSize)
+		if !bytes.Equal(header, test.expected) {
+			t.Errorf("For %s (%d bytes), expected header %q, got %q", test.ext, test.fileSize, test.expected, header)
+		}
+	}
+}
+
+func TestRandomMagicExtension(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		ext := RandomMagicExtension(nil)
+		if len(MagicHeader(ext, 1024)) == 0 {
+			t.Errorf("Random extension %s has no magic number", ext)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package content
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// CacheSize is the default size of the random buffer reused by cached fillers
+const CacheSize = 64 * 1024 * 1024
+
+// MinCacheSize is the smallest random buffer NewCache creates
+const MinCacheSize = 1024 * 1024
+
+// cacheSeed seeds every random buffer. It is fixed so that seeded fillers produce the same data
+// in every run; per-file offsets and salts keep files distinct.
+const cacheSeed = 0x696d676d6b72
+
+// Cache is a buffer of random data that cached fillers read cyclically instead of paying the RNG
+// cost for every byte. Its data depends only on its size, so seeded fillers reproduce the same
+// data with caches of the same size.
+type Cache struct {
+	size int
+	once sync.Once
+	data []byte
+}
+
+// defaultCache is read by fillers not given a cache. It is only generated if one of them reads it.
+var defaultCache = NewCache(CacheSize)
+
+// NewCache returns a random buffer of size bytes (at least MinCacheSize), e.g. sized to fit a
+// memory budget. The buffer is generated on first use and freed with the cache.
+func NewCache(size int) *Cache {
+	return &Cache{size: max(size, MinCacheSize)}
+}
+
+// Size returns the size of the buffer in bytes
+func (c *Cache) Size() int {
+	return c.size
+}
+
+// bytes returns the buffer, generating it on first use
+func (c *Cache) bytes() []byte {
+	c.once.Do(func() {
+		c.data = make([]byte, c.size)
+		rand.New(rand.NewSource(cacheSeed)).Read(c.data)
+	})
+	return c.data
+}
+
+// MixBlockSize is the size of the blocks a Filler with a compressible ratio splits data into:
+// each block starts with its compressible bytes, followed by random ones
+const MixBlockSize = 4096
+
+// Filler fills buffers with random-looking data for a single file
+type Filler struct {
+	rng          *rand.Rand // Source for fresh random data, or nil to read the cache
+	cache        *Cache     // Random buffer read when there is no rng
+	offset       int        // Position in the cache
+	salt         uint64     // Per-file value XORed into cached data so files are not byte-identical
+	saltPos      int        // Position in the salt of the next cached byte
+	dict         []byte     // Dictionary repeated as the file's data, if set
+	compressible int        // Zero bytes at the start of every MixBlockSize block (0 = all random)
+	mixPos       int        // Position in the current block
+}
+
+// NewRand returns a random source seeded with seed, or with a random seed if seed is 0
+func NewRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano() ^ rand.Int63()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// NewFiller returns a Filler for one file. By default it reads cache (or a shared CacheSize one if nil)
+// cyclically from a random offset, XORed with a per-file salt, which avoids paying the RNG
+// cost for every byte. With trueRandom it generates fresh random data instead. The offset,
+// salt, and fresh data are drawn from rng, so a seeded rng gives reproducible content; a nil
+// rng uses a randomly seeded one.
+func NewFiller(rng *rand.Rand, cache *Cache, trueRandom bool) *Filler {
+	if rng == nil {
+		rng = NewRand(0)
+	}
+	rng = rand.New(rand.NewSource(rng.Int63()))
+	if trueRandom {
+		return &Filler{rng: rng}
+	}
+	if cache == nil {
+		cache = defaultCache
+	}
+	return &Filler{
+		cache:  cache,
+		offset: rng.Intn(cache.size),
+		salt:   rng.Uint64(),
+	}
+}
+
+// WithCompressibleRatio makes ratio (0 to 1) of the data compressible: that fraction of every
+// MixBlockSize block is zero bytes and the rest random, so the data compresses to about 1-ratio
+// of its size. It returns f.
+func (f *Filler) WithCompressibleRatio(ratio float64) *Filler {
+	f.compressible = int(ratio * MixBlockSize)
+	return f
+}
+
+// Read fills p like Fill, so a Filler is also an endless reader of the file's data
+func (f *Filler) Read(p []byte) (int, error) {
+	f.Fill(p)
+	return len(p), nil
+}
+
+// Fill fills p with the next bytes of the file's data. The data depends only on the position in
+// the file, not on how the file is split into calls to Fill.
+func (f *Filler) Fill(p []byte) {
+	if f.compressible == 0 {
+		f.fill(p)
+		return
+	}
+
+	// Alternate between the compressible and random parts of each block
+	for len(p) > 0 {
+		var n int
+		if f.mixPos < f.compressible {
+			n = min(len(p), f.compressible-f.mixPos)
+			clear(p[:n])
+		} else {
+			n = min(len(p), MixBlockSize-f.mixPos)
+			f.fill(p[:n])
+		}
+		p = p[n:]
+		f.mixPos = (f.mixPos + n) % MixBlockSize
+	}
+}
+
+// fill fills p with the next bytes of the file's random (or dictionary) data
+func (f *Filler) fill(p []byte) {
+	if f.rng != nil {
+		f.rng.Read(p)
+		return
+	}
+	if f.dict != nil {
+		f.offset = repeat(p, f.dict, f.offset)
+		return
+	}
+
+	f.offset = repeat(p, f.cache.bytes(), f.offset)
+
+	// XOR in the salt, a word at a time once lined up with it
+	var salt [8]byte
+	binary.LittleEndian.PutUint64(salt[:], f.salt)
+	i := 0
+	for ; i < len(p) && f.saltPos != 0; i++ {
+		p[i] ^= salt[f.saltPos]
+		f.saltPos = (f.saltPos + 1) % 8
+	}
+	for ; i+8 <= len(p); i += 8 {
+		binary.LittleEndian.PutUint64(p[i:], binary.LittleEndian.Uint64(p[i:])^f.salt)
+	}
+	for ; i < len(p); i++ {
+		p[i] ^= salt[f.saltPos]
+		f.saltPos = (f.saltPos + 1) % 8
+	}
+}
@@ -0,0 +1,125 @@
+package content
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestFillerFilesDiffer(t *testing.T) {
+	for _, trueRandom := range []bool{false, true} {
+		a, b := make([]byte, 4096), make([]byte, 4096)
+		NewFiller(nil, nil, trueRandom).Fill(a)
+		NewFiller(nil, nil, trueRandom).Fill(b)
+		if bytes.Equal(a, b) {
+			t.Errorf("Expected files to differ (true random %v)", trueRandom)
+		}
+		if bytes.Equal(a, make([]byte, len(a))) {
+			t.Errorf("Expected non-zero data (true random %v)", trueRandom)
+		}
+	}
+}
+
+func TestFillerSeeded(t *testing.T) {
+	for _, trueRandom := range []bool{false, true} {
+		a, b := make([]byte, 4096), make([]byte, 4096)
+		NewFiller(NewRand(42), nil, trueRandom).Fill(a)
+		NewFiller(NewRand(42), nil, trueRandom).Fill(b)
+		if !bytes.Equal(a, b) {
+			t.Errorf("Expected identical data from the same seed (true random %v)", trueRandom)
+		}
+	}
+}
+
+func TestFillerWrapsCache(t *testing.T) {
+	// Reading past the end of the cache wraps around to its start
+	cache := NewCache(MinCacheSize)
+	f := &Filler{cache: cache, offset: MinCacheSize - 3}
+	p := make([]byte, 6)
+	f.Fill(p)
+
+	buf := cache.bytes()
+	expected := append(append([]byte{}, buf[MinCacheSize-3:]...), buf[:3]...)
+	if !bytes.Equal(p, expected) {
+		t.Errorf("Expected %x, got %x", expected, p)
+	}
+	if f.offset != 3 {
+		t.Errorf("Expected offset 3 after wrapping, got %d", f.offset)
+	}
+}
+
+func TestCacheSizes(t *testing.T) {
+	small := NewCache(0)
+	if small.Size() != MinCacheSize {
+		t.Errorf("Expected size %d, got %d", MinCacheSize, small.Size())
+	}
+	large := NewCache(2 * MinCacheSize)
+	if large.Size() != 2*MinCacheSize {
+		t.Errorf("Expected size %d, got %d", 2*MinCacheSize, large.Size())
+	}
+
+	// Seeded fillers reproduce their data with any cache of the same size
+	a, b := make([]byte, 4096), make([]byte, 4096)
+	NewFiller(NewRand(3), small, false).Fill(a)
+	NewFiller(NewRand(3), large, false).Fill(make([]byte, 4096))
+	NewFiller(NewRand(3), NewCache(MinCacheSize), false).Fill(b)
+	if !bytes.Equal(a, b) {
+		t.Error("Expected identical data from the same seed and cache size")
+	}
+}
+
+func TestFillerSplitFills(t *testing.T) {
+	// Filling in odd-sized pieces gives the same data as one fill
+	for _, ratio := range []float64{0, 0.3} {
+		whole, pieces := make([]byte, 3*MixBlockSize+5), make([]byte, 3*MixBlockSize+5)
+		NewFiller(NewRand(7), nil, false).WithCompressibleRatio(ratio).Fill(whole)
+		f := NewFiller(NewRand(7), nil, false).WithCompressibleRatio(ratio)
+		for start, n := 0, 1; start < len(pieces); start, n = start+n, n+3 {
+			f.Fill(pieces[start:min(start+n, len(pieces))])
+		}
+		if !bytes.Equal(whole, pieces) {
+			t.Errorf("Expected the same data however the fills are split (ratio %g)", ratio)
+		}
+	}
+}
+
+func TestFillerCompressibleRatio(t *testing.T) {
+	const fileSize = 4 * 1024 * 1024
+
+	// More compressible data gzips smaller, roughly in proportion to the random part
+	prevSize := fileSize * 2
+	for _, ratio := range []float64{0, 0.25, 0.5, 0.75, 1} {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		f := NewFiller(NewRand(1), nil, false).WithCompressibleRatio(ratio)
+		if _, err := io.Copy(zw, io.LimitReader(f, fileSize)); err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+
+		t.Logf("ratio %g: compressed to %d bytes", ratio, compressed.Len())
+		if compressed.Len() >= prevSize {
+			t.Errorf("Expected ratio %g to compress smaller than the previous ratio, got %d after %d bytes", ratio, compressed.Len(), prevSize)
+		}
+		if expected := (1 - ratio) * fileSize; float64(compressed.Len()) > expected+0.05*fileSize {
+			t.Errorf("Expected ratio %g to compress to about %.0f bytes, got %d", ratio, expected, compressed.Len())
+		}
+		prevSize = compressed.Len()
+	}
+}
+
+func benchmarkFill(b *testing.B, trueRandom bool) {
+	p := make([]byte, 1024*1024)
+	f := NewFiller(nil, nil, trueRandom)
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Fill(p)
+	}
+}
+
+func BenchmarkFillCached(b *testing.B)     { benchmarkFill(b, false) }
+func BenchmarkFillTrueRandom(b *testing.B) { benchmarkFill(b, true) }
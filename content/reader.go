@@ -0,0 +1,59 @@
+package content
+
+import "io"
+
+// Reader reads a file's contents: a header, such as a magic number, followed by data from an
+// endless fill source, exactly size bytes in all
+type Reader struct {
+	header    []byte
+	fill      io.Reader
+	remaining int64
+}
+
+// NewReader returns a Reader of size bytes, starting with as much of header as fits and filled
+// from fill after it. fill is read only as far as needed, so it may be endless.
+func NewReader(header []byte, fill io.Reader, size int64) *Reader {
+	if size < 0 {
+		size = 0
+	}
+	return &Reader{header: header, fill: fill, remaining: size}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	// The header comes first
+	if len(r.header) > 0 {
+		n := copy(p, r.header)
+		r.header = r.header[n:]
+		r.remaining -= int64(n)
+		return n, nil
+	}
+
+	n, err := r.fill.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// NewByteReader returns an endless reader of b repeated, for filling files with zeros or text
+func NewByteReader(b byte) io.Reader {
+	return byteReader(b)
+}
+
+// byteReader is an endless reader of a single repeated byte
+type byteReader byte
+
+func (b byteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
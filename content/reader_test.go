@@ -0,0 +1,83 @@
+package content
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestReaderLength(t *testing.T) {
+	header := []byte("PK\x03\x04")
+	for _, size := range []int64{0, 1, 3, 4, 5, 32*1024 + 7, 3 * 1024 * 1024} {
+		r := NewReader(header, NewFiller(rand.New(rand.NewSource(1)), nil, false), size)
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, r)
+		if err != nil {
+			t.Fatalf("Size %d: unexpected error: %v", size, err)
+		}
+		if n != size {
+			t.Errorf("Size %d: expected %d bytes, got %d", size, size, n)
+		}
+		// As much of the header as fits comes first
+		want := header[:min(int64(len(header)), size)]
+		if !bytes.HasPrefix(buf.Bytes(), want) {
+			t.Errorf("Size %d: expected the data to start with %q, got %q", size, want, buf.Bytes()[:len(want)])
+		}
+		if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Size %d: expected io.EOF after the data, got %v", size, err)
+		}
+	}
+
+	// io.CopyN copies exactly the bytes asked for, leaving the rest for the next copy
+	r := NewReader(nil, NewByteReader('x'), 100)
+	var buf bytes.Buffer
+	if n, err := io.CopyN(&buf, r, 60); n != 60 || err != nil {
+		t.Fatalf("Expected to copy 60 bytes, got %d (err: %v)", n, err)
+	}
+	if n, err := io.CopyN(&buf, r, 60); n != 40 || err != io.EOF {
+		t.Errorf("Expected the last 40 bytes then io.EOF, got %d (err: %v)", n, err)
+	}
+
+	// A fill source that runs out early is an error
+	r = NewReader(nil, strings.NewReader("short"), 10)
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReaderTextFill(t *testing.T) {
+	data, err := io.ReadAll(NewReader([]byte("#!"), NewByteReader('x'), 70*1024))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "#!" + strings.Repeat("x", 70*1024-2)
+	if string(data) != expected {
+		t.Errorf("Expected the header followed by x, got %d bytes starting %q", len(data), data[:min(len(data), 16)])
+	}
+
+	// Zero fill is all zeros
+	data, err = io.ReadAll(NewReader(nil, NewByteReader(0), 4096))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, make([]byte, 4096)) {
+		t.Error("Expected zero fill to be all zeros")
+	}
+}
+
+func TestReaderMatchesFill(t *testing.T) {
+	// Reading through a Reader in small pieces gives the same data as filling one buffer
+	const size = 1024*1024 + 13
+	want := make([]byte, size)
+	NewFiller(rand.New(rand.NewSource(7)), nil, false).WithCompressibleRatio(0.5).Fill(want)
+
+	got, err := io.ReadAll(NewReader(nil, NewFiller(rand.New(rand.NewSource(7)), nil, false).WithCompressibleRatio(0.5), size))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("Expected the Reader to produce the Filler's data")
+	}
+}
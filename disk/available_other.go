@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package disk
+
+// Available is not supported on this platform and always returns ErrUnsupported
+func Available(path string) (int64, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package disk
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// Available returns the bytes available to the current user on the volume holding path
+func Available(path string) (int64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, fmt.Errorf("invalid path %s: %w", path, err)
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &free, &total, &totalFree); err != nil {
+		return 0, fmt.Errorf("failed to query free space for %s: %w", path, err)
+	}
+	return int64(free), nil
+}
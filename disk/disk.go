@@ -0,0 +1,21 @@
+// Package disk checks that a build's layers fit in the free space of the filesystem they are
+// written to
+package disk
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// ErrUnsupported is returned by Available on platforms where free space can't be queried
+var ErrUnsupported = errors.New("querying free disk space is not supported on this platform")
+
+// Check returns an error if need bytes do not fit in free bytes
+func Check(need int64, free int64) error {
+	if need > free {
+		return fmt.Errorf("not enough disk space: need %s, have %s free", size.Format(need), size.Format(free))
+	}
+	return nil
+}
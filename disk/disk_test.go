@@ -0,0 +1,45 @@
+package disk
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestCheck(t *testing.T) {
+	if err := Check(1*size.GB, 2*size.GB); err != nil {
+		t.Errorf("Unexpected error when the layers fit: %v", err)
+	}
+	if err := Check(2*size.GB, 2*size.GB); err != nil {
+		t.Errorf("Unexpected error when the layers fit exactly: %v", err)
+	}
+
+	err := Check(3*size.GB, 512*size.MB)
+	if err == nil {
+		t.Fatal("Expected an error when the layers don't fit")
+	}
+	for _, want := range []string{"need 3.00 GiB", "have 512.00 MiB free"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %q", want, err)
+		}
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	free, err := Available(t.TempDir())
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip("Free space is not supported on this platform")
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if free <= 0 {
+		t.Errorf("Expected some free space in the temp directory, got %d", free)
+	}
+
+	if _, err := Available(t.TempDir() + "/missing"); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Preallocate reserves size bytes of disk space for f with fallocate, so the filesystem can lay the
+// file out contiguously before it is written. The file's size is left unchanged. Filesystems that
+// don't support fallocate are skipped without an error.
+func Preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to preallocate %s: %w", f.Name(), err)
+	}
+	return nil
+}
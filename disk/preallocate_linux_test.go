@@ -0,0 +1,37 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestPreallocate(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "prealloc"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer f.Close()
+
+	if err := Preallocate(f, 8*size.MB); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	// The space is reserved without changing the file's size
+	if info.Size() != 0 {
+		t.Errorf("Expected the file to stay empty, got %d bytes", info.Size())
+	}
+	blocks := info.Sys().(*syscall.Stat_t).Blocks
+	if blocks == 0 {
+		t.Skip("The temp directory's filesystem does not support fallocate")
+	}
+	if blocks*512 < 8*size.MB {
+		t.Errorf("Expected at least 8MB reserved, got %d blocks", blocks)
+	}
+}
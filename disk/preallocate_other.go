@@ -0,0 +1,10 @@
+//go:build !linux
+
+package disk
+
+import "os"
+
+// Preallocate does nothing on platforms without fallocate
+func Preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlbutler/imgmkr/content"
+)
+
+// ErrInjected is returned by writes the injector chose to fail
+var ErrInjected = errors.New("injected write failure")
+
+// Injector makes a fraction of writes fail and delays every write, for testing how imgmkr and
+// the tools around it handle slow or failing storage
+type Injector struct {
+	failRate float64
+	delay    time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// New creates an injector failing each write with probability failRate and delaying each write by
+// delay. Failures are drawn from seed, so the same seed fails the same writes (0 = random).
+func New(failRate float64, delay time.Duration, seed int64) (*Injector, error) {
+	if failRate < 0 || failRate > 1 {
+		return nil, fmt.Errorf("fail rate must be between 0 and 1, got %g", failRate)
+	}
+	if delay < 0 {
+		return nil, fmt.Errorf("delay must not be negative, got %s", delay)
+	}
+	return &Injector{failRate: failRate, delay: delay, rng: content.NewRand(seed)}, nil
+}
+
+// Parse creates an injector from a comma-separated spec of fail=<fraction> and delay=<duration>,
+// e.g. "fail=0.05,delay=10ms"
+func Parse(spec string, seed int64) (*Injector, error) {
+	var failRate float64
+	var delay time.Duration
+	for _, part := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q: expected key=value", part)
+		}
+		var err error
+		switch key {
+		case "fail":
+			failRate, err = strconv.ParseFloat(value, 64)
+		case "delay":
+			delay, err = time.ParseDuration(value)
+		default:
+			return nil, fmt.Errorf("unknown fault %q: expected fail or delay", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %q: %w", part, err)
+		}
+	}
+	return New(failRate, delay, seed)
+}
+
+// Writer wraps w so that writes are delayed and may fail. A nil injector returns w unchanged.
+func (in *Injector) Writer(w io.Writer) io.Writer {
+	if in == nil {
+		return w
+	}
+	return &faultyWriter{w: w, in: in}
+}
+
+// fail reports whether the next write should fail
+func (in *Injector) fail() bool {
+	if in.failRate == 0 {
+		return false
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.rng.Float64() < in.failRate
+}
+
+// faultyWriter delays each write and fails the ones its injector chooses
+type faultyWriter struct {
+	w  io.Writer
+	in *Injector
+}
+
+func (fw *faultyWriter) Write(p []byte) (int, error) {
+	if fw.in.delay > 0 {
+		time.Sleep(fw.in.delay)
+	}
+	if fw.in.fail() {
+		return 0, ErrInjected
+	}
+	return fw.w.Write(p)
+}
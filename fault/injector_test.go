@@ -0,0 +1,85 @@
+package fault
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	in, err := Parse("fail=0.25, delay=10ms", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if in.failRate != 0.25 || in.delay != 10*time.Millisecond {
+		t.Errorf("Expected fail=0.25 and delay=10ms, got fail=%g and delay=%s", in.failRate, in.delay)
+	}
+
+	invalid := []string{"", "fail", "fail=x", "fail=1.5", "fail=-0.1", "delay=soon", "delay=-1s", "drop=0.1"}
+	for _, spec := range invalid {
+		if _, err := Parse(spec, 1); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestWriterFailRate(t *testing.T) {
+	for _, test := range []struct {
+		failRate float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{1, 1000, 1000},
+		{0.5, 400, 600},
+	} {
+		in, err := New(test.failRate, 0, 1)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		w := in.Writer(io.Discard)
+		failed := 0
+		for i := 0; i < 1000; i++ {
+			if _, err := w.Write([]byte("imgmkr")); err != nil {
+				if !errors.Is(err, ErrInjected) {
+					t.Fatalf("Expected ErrInjected, got %v", err)
+				}
+				failed++
+			}
+		}
+		if failed < test.min || failed > test.max {
+			t.Errorf("Fail rate %g: expected %d-%d of 1000 writes to fail, got %d", test.failRate, test.min, test.max, failed)
+		}
+	}
+}
+
+func TestWriterDelay(t *testing.T) {
+	var buf bytes.Buffer
+	in, err := New(0, 20*time.Millisecond, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	w := in.Writer(&buf)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write([]byte("imgmkr")); err != nil {
+			t.Fatalf("Unexpected write error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Expected writes to be delayed, finished in %s", elapsed)
+	}
+	if buf.String() != "imgmkrimgmkrimgmkr" {
+		t.Errorf("Expected data to pass through, got %q", buf.String())
+	}
+}
+
+func TestNilInjector(t *testing.T) {
+	var in *Injector
+	var buf bytes.Buffer
+	if w := in.Writer(&buf); w != &buf {
+		t.Error("Expected a nil injector to return the writer unchanged")
+	}
+}
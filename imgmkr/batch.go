@@ -0,0 +1,167 @@
+package imgmkr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// batchSpec is a --batch spec file: the images to build, each with its own build flags
+type batchSpec struct {
+	Defaults []string     `yaml:"defaults"` // Flags given to every image, before its own
+	Images   []batchImage `yaml:"images"`
+}
+
+// batchImage is one image in a batch spec
+type batchImage struct {
+	Tag  string   `yaml:"tag"`
+	Args []string `yaml:"args"`
+}
+
+// readBatchSpec reads and checks the batch spec file at path
+func readBatchSpec(path string) (*batchSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch spec: %w", err)
+	}
+	var spec batchSpec
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("failed to parse batch spec %s: %w", path, err)
+	}
+	if len(spec.Images) == 0 {
+		return nil, fmt.Errorf("batch spec %s lists no images", path)
+	}
+
+	tags := make(map[string]bool, len(spec.Images))
+	for i, image := range spec.Images {
+		if image.Tag == "" {
+			return nil, fmt.Errorf("image %d in batch spec %s has no tag", i+1, path)
+		}
+		if tags[image.Tag] {
+			return nil, fmt.Errorf("image %s is listed more than once in batch spec %s", image.Tag, path)
+		}
+		tags[image.Tag] = true
+	}
+	return &spec, nil
+}
+
+// buildArgs returns the build command arguments for image: the spec's defaults, then the image's
+// own flags, which override them, then its tag
+func (spec *batchSpec) buildArgs(image batchImage) []string {
+	args := make([]string, 0, len(spec.Defaults)+len(image.Args)+1)
+	args = append(args, spec.Defaults...)
+	args = append(args, image.Args...)
+	return append(args, image.Tag)
+}
+
+// check validates every image's build flags, so a typo fails the batch before anything is built
+func (spec *batchSpec) check() error {
+	var errs []error
+	for _, image := range spec.Images {
+		cfg, _, err := parseBuildFlags(spec.buildArgs(image), flag.ContinueOnError)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", image.Tag, err))
+		case cfg.batch != "" || cfg.listProfiles:
+			errs = append(errs, fmt.Errorf("%s: --batch and --list-profiles cannot be used in a batch spec", image.Tag))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// batchResult is the outcome of building one image in a batch
+type batchResult struct {
+	tag      string
+	duration time.Duration
+	err      error
+}
+
+// runBatch builds every image in the batch spec at path, up to concurrency at a time, reporting
+// to out. SIGINT or SIGTERM stops every build, each cleaning up its own build directory.
+func runBatch(out io.Writer, path string, concurrency int) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return runBatchContext(ctx, out, path, concurrency)
+}
+
+// runBatchContext builds the images in the batch spec at path like runBatch, until ctx is done.
+// Each image is built independently with its own build directory and cleanup; failures are
+// reported per image once every build has finished. The builds leave signals to the batch and
+// print status lines instead of redrawing progress bars, which would overwrite each other.
+func runBatchContext(ctx context.Context, out io.Writer, path string, concurrency int) error {
+	spec, err := readBatchSpec(path)
+	if err != nil {
+		return err
+	}
+	if err := spec.check(); err != nil {
+		return fmt.Errorf("invalid batch spec %s:\n%w", path, err)
+	}
+
+	fmt.Fprintf(out, "Building %d images from %s (max %d concurrent)...\n", len(spec.Images), path, concurrency)
+	stopReport := context.AfterFunc(ctx, func() {
+		fmt.Fprintln(out, "\n🛑 Stopping the batch, cleaning up each image's build...")
+	})
+	defer stopReport()
+	results := make([]batchResult, len(spec.Images))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, image := range spec.Images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, image batchImage) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			err := buildBatchImage(ctx, spec.buildArgs(image))
+			results[i] = batchResult{tag: image.Tag, duration: time.Since(start), err: err}
+		}(i, image)
+	}
+	wg.Wait()
+
+	return reportBatch(out, results)
+}
+
+// buildBatchImage builds one image in a batch from its build arguments, until ctx is done
+func buildBatchImage(ctx context.Context, args []string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("not built: %w", err)
+	}
+	cfg, repoTag, err := parseBuildFlags(args, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+	cfg.noSignals = true
+	cfg.noProgressBar = true
+	return runBuild(ctx, cfg, repoTag)
+}
+
+// reportBatch writes the outcome of each image in a batch to out and returns an error if any failed
+func reportBatch(out io.Writer, results []batchResult) error {
+	fmt.Fprintln(out, "\nBatch results:")
+	var failed []string
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Fprintf(out, "  ❌ %s: %v\n", result.tag, result.err)
+			failed = append(failed, result.tag)
+			continue
+		}
+		fmt.Fprintf(out, "  ✅ %s (%s)\n", result.tag, result.duration.Round(time.Millisecond))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d images failed: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
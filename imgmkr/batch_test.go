@@ -0,0 +1,163 @@
+package imgmkr
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// writeBatchSpec writes a batch spec file with the given contents
+func writeBatchSpec(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "specs.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write batch spec: %v", err)
+	}
+	return path
+}
+
+func TestRunBatch(t *testing.T) {
+	basePath := writeBaseTarball(t, 1)
+	outDir := t.TempDir()
+	specPath := writeBatchSpec(t, `
+defaults: ["--append-to-tar", "`+basePath+`", "--deterministic", "--max-concurrent", "2"]
+images:
+  - tag: small:v1
+    args: ["--layer-sizes", "4KB", "--output", "`+filepath.Join(outDir, "small.tar")+`"]
+  - tag: tree:v1
+    args: ["--layer-sizes", "16KB,32KB", "--mock-fs", "--output", "`+filepath.Join(outDir, "tree.tar")+`"]
+`)
+
+	if err := runBatch(io.Discard, specPath, 2); err != nil {
+		t.Fatalf("Unexpected error running batch: %v", err)
+	}
+
+	// Each image is built on top of the one-layer base
+	for name, layers := range map[string]int{"small.tar": 2, "tree.tar": 3} {
+		img, err := tarball.ImageFromPath(filepath.Join(outDir, name), nil)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		got, err := img.Layers()
+		if err != nil || len(got) != layers {
+			t.Errorf("Expected %d layers in %s, got %d (err: %v)", layers, name, len(got), err)
+		}
+	}
+}
+
+func TestRunBatchFailure(t *testing.T) {
+	basePath := writeBaseTarball(t, 1)
+	outDir := t.TempDir()
+
+	// One image fails at build time without affecting the other
+	specPath := writeBatchSpec(t, `
+images:
+  - tag: missing-base:v1
+    args: ["--layer-sizes", "4KB", "--append-to-tar", "`+filepath.Join(outDir, "missing.tar")+`", "--output", "`+filepath.Join(outDir, "a.tar")+`"]
+  - tag: ok:v1
+    args: ["--layer-sizes", "4KB", "--append-to-tar", "`+basePath+`", "--output", "`+filepath.Join(outDir, "b.tar")+`"]
+`)
+	err := runBatch(io.Discard, specPath, 1)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 images failed: missing-base:v1") {
+		t.Errorf("Expected the failed image to be reported, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "b.tar")); err != nil {
+		t.Errorf("Expected the other image to be built: %v", err)
+	}
+
+	// Invalid flags fail the batch before anything is built
+	specPath = writeBatchSpec(t, `
+images:
+  - tag: ok:v1
+    args: ["--layer-sizes", "4KB", "--append-to-tar", "`+basePath+`", "--output", "`+filepath.Join(outDir, "c.tar")+`"]
+  - tag: typo:v1
+    args: ["--layer-size", "4KB"]
+`)
+	err = runBatch(io.Discard, specPath, 1)
+	if err == nil || !strings.Contains(err.Error(), "typo:v1") {
+		t.Errorf("Expected an error naming the invalid image, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "c.tar")); !os.IsNotExist(err) {
+		t.Error("Expected no image to be built from an invalid batch spec")
+	}
+}
+
+func TestRunBatchCancel(t *testing.T) {
+	// Anything left of the build directories would be in TMPDIR
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	outDir := t.TempDir()
+	specPath := writeBatchSpec(t, `
+defaults: ["--layer-sizes", "1GB", "--fill", "text", "--quiet"]
+images:
+  - tag: first:v1
+    args: ["--output", "`+filepath.Join(outDir, "first.tar")+`"]
+  - tag: second:v1
+    args: ["--output", "`+filepath.Join(outDir, "second.tar")+`"]
+  - tag: third:v1
+    args: ["--output", "`+filepath.Join(outDir, "third.tar")+`"]
+`)
+
+	// Stopping the batch stops the concurrent builds, which each clean up after themselves, and
+	// the image not started yet is never built
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	var out bytes.Buffer
+	err := runBatchContext(ctx, &out, specPath, 2)
+	if err == nil || !strings.Contains(err.Error(), "3 of 3 images failed") {
+		t.Errorf("Expected every image to fail, got %v", err)
+	}
+	if !strings.Contains(out.String(), "third:v1: not built") {
+		t.Errorf("Expected the last image not to be built, got %q", out.String())
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read TMPDIR: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected every build directory to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestReadBatchSpecInvalid(t *testing.T) {
+	invalid := []string{
+		``,
+		`images: []`,
+		"images:\n  - args: [\"--layer-sizes\", \"1MB\"]",
+		"images:\n  - tag: a:v1\n  - tag: a:v1",
+		"images:\n  - tag: a:v1\n    flags: [\"--mock-fs\"]",
+	}
+	for _, contents := range invalid {
+		if _, err := readBatchSpec(writeBatchSpec(t, contents)); err == nil {
+			t.Errorf("Expected an error for spec %q", contents)
+		}
+	}
+}
+
+func TestParseBuildArgsBatch(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--batch", "specs.yaml", "--batch-concurrency", "3"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.batch != "specs.yaml" || cfg.batchConcurrency != 3 {
+		t.Errorf("Expected batch specs.yaml with concurrency 3, got %q and %d", cfg.batch, cfg.batchConcurrency)
+	}
+
+	invalid := [][]string{
+		{"--batch", "specs.yaml", "--mock-fs"},
+		{"--batch", "specs.yaml", "test:v1"},
+		{"--batch", "specs.yaml", "--batch-concurrency", "0"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
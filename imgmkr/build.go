@@ -0,0 +1,557 @@
+package imgmkr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlbutler/imgmkr/cleanup"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/pause"
+	"github.com/jlbutler/imgmkr/throttle"
+)
+
+// imageTags returns every tag the built image gets: repoTag followed by any extra tags
+func (cfg *buildConfig) imageTags(repoTag string) []string {
+	return append([]string{repoTag}, cfg.extraTags...)
+}
+
+// fixedTime is the timestamp given to every file and history entry with --deterministic
+var fixedTime = time.Unix(0, 0).UTC()
+
+// RunBuild implements the build command: generate the layers and build the image
+func RunBuild(args []string) error {
+	cfg, repoTag, err := parseBuildArgs(args)
+	if err != nil {
+		return err
+	}
+	if cfg.listProfiles {
+		writeProfiles(os.Stdout)
+		return nil
+	}
+	if cfg.batch != "" {
+		return runBatch(os.Stdout, cfg.batch, cfg.batchConcurrency)
+	}
+	return runBuild(context.Background(), cfg, repoTag)
+}
+
+// runBuild builds repoTag as cfg says, bounded by --timeout, until parent is done
+func runBuild(parent context.Context, cfg *buildConfig, repoTag string) error {
+	ctx, cancel := cfg.buildContext(parent)
+	defer cancel()
+	err := build(ctx, cfg, repoTag)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("build timed out after %s: %w", cfg.timeout, err)
+	}
+	return err
+}
+
+// buildContext returns the context bounding a build, which ends with parent or after --timeout
+// if one was given
+func (cfg *buildConfig) buildContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if cfg.timeout == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, cfg.timeout)
+}
+
+// build creates repoTag's layers and builds, writes, or pushes the image as cfg says, stopping
+// layer creation and killing the builder once ctx is done
+func build(ctx context.Context, cfg *buildConfig, repoTag string) (err error) {
+	cfg.started = time.Now()
+
+	// Check the base image before any work starts
+	if cfg.appendToTar != "" {
+		if _, err := readBaseTarball(cfg.appendToTar); err != nil {
+			return fmt.Errorf("error reading base image: %w", err)
+		}
+	}
+
+	// Parse layer sizes, refusing more than --max-total-size before anything is written
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		return err
+	}
+	if err := cfg.checkTotalSize(sizes); err != nil {
+		return err
+	}
+
+	// Print the image's digest and summarize the build once it succeeds, naming the builder if one
+	// is used
+	var builder, digest string
+	defer func() {
+		if err != nil {
+			return
+		}
+		if cfg.printDigest {
+			fmt.Fprintln(cfg.resultOut(), digest)
+		}
+		if cfg.summaryJSON != "" {
+			err = writeBuildSummary(cfg.resultOut(), cfg.summaryJSON, newBuildSummary(cfg, repoTag, sizes, builder, digest, time.Since(cfg.started)))
+		}
+	}()
+
+	// Cap the write rate
+	var limiter *throttle.Limiter
+	if cfg.writeRate > 0 {
+		limiter = throttle.NewLimiter(cfg.writeRate)
+	}
+
+	// Record how the image is made in a label
+	if cfg.buildInfo {
+		infoJSON, err := newBuildInfo(cfg, repoTag, sizes, time.Now()).JSON()
+		if err != nil {
+			return err
+		}
+		cfg.labels = append(cfg.labels, keyValue{key: buildInfoLabel, value: infoJSON})
+	}
+
+	// Fit buffer allocations into the memory budget
+	if err := cfg.applyMemoryBudget(); err != nil {
+		return err
+	}
+
+	// The random data cache and zero run hashes belong to this build, and are freed with it
+	cfg.cache, cfg.zeroRuns = cfg.randomCache(), newZeroRuns()
+	defer func() { cfg.cache, cfg.zeroRuns = nil, nil }()
+
+	// Number of layers is inferred from the layer sizes
+	numLayers := len(sizes)
+
+	// Check every layer can be generated before starting
+	if cfg.hasLayerMode(contentModeMockFS) {
+		if err := cfg.checkLayerSizes(sizes); err != nil {
+			return err
+		}
+	}
+
+	// Whiteouts can only delete paths from earlier layers
+	for _, spec := range cfg.deletes {
+		if spec.Layer < 2 || spec.Layer > numLayers {
+			return fmt.Errorf("invalid --delete %s: layer must be between 2 and %d", spec, numLayers)
+		}
+	}
+
+	// Generate single-file layers straight into the image
+	if cfg.streamLayers {
+		digest, err = streamBuild(cfg, repoTag, sizes)
+		return err
+	}
+
+	// Check the requested builder is installed before writing any layers
+	if cfg.builder != "" {
+		if _, err := selectBuilder(cfg.builder); err != nil {
+			return err
+		}
+	}
+
+	// Start the builder's log, so a bad path fails before any layers are written
+	var buildLog *os.File
+	if cfg.buildLog != "" {
+		if buildLog, err = os.Create(cfg.buildLog); err != nil {
+			return fmt.Errorf("error creating build log: %w", err)
+		}
+		defer buildLog.Close()
+	}
+
+	// Check the layers fit on disk before writing any of them
+	if err := cfg.checkDiskSpace(sizes); err != nil {
+		return err
+	}
+
+	// Create a temporary build directory
+	out := cfg.statusOut()
+	fmt.Fprintln(out, "Creating temporary build directory...")
+	buildDir, err := createTempDir(cfg.tmpdirPrefix, repoTag)
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+
+	// Setup cleanup manager and signal handling
+	cleanupManager := cleanup.New(buildDir)
+	cleanupManager.SetOutput(out)
+	if !cfg.noSignals {
+		defer cleanupManager.SetupSignalHandling()()
+	}
+	defer cleanupManager.GracefulCleanup()
+
+	// Leave a failed build's directory for debugging (deferred after the cleanup so it runs first)
+	if cfg.keepOnFailure {
+		defer func() {
+			if err != nil {
+				keepBuildDir(cfg, cleanupManager, repoTag, buildDir)
+			}
+		}()
+	}
+
+	// Allow layer creation to be paused with SIGUSR1 and resumed with SIGUSR2
+	gate := pause.New()
+	gate.SetOutput(out)
+	if !cfg.noSignals {
+		defer gate.SetupSignalHandling()()
+	}
+
+	// Zero fill makes sparse files, which hardly take up space anywhere
+	if cfg.fill == fillZero {
+		fmt.Fprintln(out, "⚠️  Warning: --fill zero layers are created as sparse files and compress to almost nothing, so the built image will be far smaller than the requested sizes")
+	}
+
+	// Create layer files
+	fmt.Fprintf(out, "Creating layer files (max %d concurrent)...\n", cfg.maxConcurrent)
+	layers, err := createLayersConcurrently(ctx, buildDir, sizes, cfg, gate, limiter)
+	if err != nil {
+		return fmt.Errorf("error creating layer files: %w", err)
+	}
+
+	// Check the layers on disk against the requested sizes
+	if cfg.verifySizes {
+		if err := verifyLayerSizes(out, buildDir, sizes, cfg.layerSizeTolerance()); err != nil {
+			return fmt.Errorf("error verifying layer sizes: %w", err)
+		}
+	}
+
+	// Add whiteouts for deleted paths
+	if err := addWhiteouts(buildDir, layers, cfg.deletes); err != nil {
+		return fmt.Errorf("error creating whiteouts: %w", err)
+	}
+	if cfg.hasLayerMode(contentModeMockFS) && cfg.mockWhiteouts > 0 {
+		if err := addMockWhiteouts(buildDir, layers, cfg.mockWhiteouts, cfg.layerSeed); err != nil {
+			return fmt.Errorf("error creating whiteouts: %w", err)
+		}
+	}
+
+	// Set the requested ownership on the generated files
+	if cfg.uid >= 0 || cfg.gid >= 0 {
+		if err := applyOwnership(out, buildDir, layers, cfg.uid, cfg.gid); err != nil {
+			return fmt.Errorf("error setting file ownership: %w", err)
+		}
+	}
+
+	// Merge the layers into one directory for a single-layer image
+	dirs := layerDirs(buildDir, numLayers)
+	if cfg.squash {
+		squashed, err := squashLayers(buildDir, numLayers)
+		if err != nil {
+			return fmt.Errorf("error squashing layers: %w", err)
+		}
+		dirs = []string{squashed}
+		fmt.Fprintf(out, "Squashed %d layers into one\n", numLayers)
+	}
+
+	// Give every file the same timestamp so builders produce identical layers
+	if cfg.deterministic {
+		if err := setFixedTimes(buildDir, fixedTime); err != nil {
+			return fmt.Errorf("error setting file timestamps: %w", err)
+		}
+	}
+
+	// Write the layer manifest
+	err = writeLayerManifest(buildDir, layers, cfg.manifestFile)
+	if err != nil {
+		return fmt.Errorf("error writing layer manifest: %w", err)
+	}
+
+	// Describe the layer directories for other tools
+	if cfg.manifestOut != "" {
+		m, err := newContextManifest(ctx, buildDir, layers, cfg.tarOptions(), cfg.manifestOutDigests, cfg.maxConcurrent)
+		if err != nil {
+			return fmt.Errorf("error describing layers: %w", err)
+		}
+		if err := writeContextManifest(cfg.manifestOut, m); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Wrote layer descriptions to %s\n", cfg.manifestOut)
+	}
+
+	// Write a script that recreates the build without imgmkr
+	if cfg.emitScript != "" {
+		if err := emitScript(cfg.emitScript, buildDir, repoTag, layers, cfg.fillMode(), cfg.dockerfileOptions()); err != nil {
+			return fmt.Errorf("error writing build script: %w", err)
+		}
+		fmt.Fprintf(out, "Wrote build script to %s\n", cfg.emitScript)
+	}
+
+	// Write the layers into an image tarball instead of building
+	if cfg.writesTarball() {
+		if cfg.appendToTar != "" {
+			fmt.Fprintf(out, "Appending %d layers to %s...\n", len(dirs), cfg.appendToTar)
+		} else {
+			fmt.Fprintf(out, "Writing %d layers to %s...\n", len(dirs), cfg.output)
+		}
+		opts, err := cfg.appendOptions(layers, dirs)
+		if err != nil {
+			return fmt.Errorf("error writing image tarball: %w", err)
+		}
+		digest, err = appendToTarball(cfg.appendToTar, cfg.output, repoTag, dirs, opts)
+		if err != nil {
+			return fmt.Errorf("error writing image tarball: %w", err)
+		}
+		fmt.Fprintf(out, "Successfully wrote image %s to %s\n", repoTag, cfg.output)
+		if cfg.keepBuildDir {
+			keepBuildDir(cfg, cleanupManager, repoTag, buildDir)
+		}
+		return nil
+	}
+
+	// Push the layers straight to the registry instead of building
+	if cfg.pushMode == pushModeDirect {
+		fmt.Fprintf(out, "Pushing %d layers to %s...\n", len(dirs), repoTag)
+		opts, err := cfg.appendOptions(layers, dirs)
+		if err != nil {
+			return fmt.Errorf("error pushing image: %w", err)
+		}
+		digest, err = pushToRegistry(ctx, repoTag, dirs, opts)
+		if err == nil {
+			fmt.Fprintf(out, "Successfully pushed image %s\n", repoTag)
+		}
+		if err := pushResult(out, repoTag, err, cfg.expectPushFail); err != nil {
+			return fmt.Errorf("error pushing image: %w", err)
+		}
+		if cfg.keepBuildDir {
+			keepBuildDir(cfg, cleanupManager, repoTag, buildDir)
+		}
+		return nil
+	}
+
+	// Keep everything but the layers out of the build context
+	if !cfg.noDockerignore {
+		if err := createDockerignore(buildDir, numLayers, cfg.squash); err != nil {
+			return fmt.Errorf("error creating .dockerignore: %w", err)
+		}
+	}
+
+	// Create Dockerfile (unless it will be piped to the builder)
+	if !cfg.dockerfileStdin {
+		fmt.Fprintln(out, "Creating Dockerfile...")
+		err = createDockerfile(buildDir, numLayers, cfg.dockerfileOptions())
+		if err != nil {
+			return fmt.Errorf("error creating Dockerfile: %w", err)
+		}
+	}
+
+	// Keep the build context for another tool instead of building
+	if cfg.output == outputNone {
+		keepBuildDir(cfg, cleanupManager, repoTag, buildDir)
+		return nil
+	}
+
+	// Build the image, logging the builder's output and retrying transient failures if asked to
+	var runner Runner = execRunner{ctx: ctx, out: out, errOut: cfg.errOut()}
+	if buildLog != nil {
+		runner = execRunner{ctx: ctx, out: io.MultiWriter(out, buildLog), errOut: io.MultiWriter(cfg.errOut(), buildLog)}
+		if cfg.quiet {
+			runner = execRunner{ctx: ctx, out: buildLog, errOut: buildLog}
+		}
+	}
+	if cfg.retries > 0 {
+		runner = retryRunner{runner: runner, ctx: ctx, out: out, retries: cfg.retries}
+	}
+	tags := cfg.imageTags(repoTag)
+	builder, err = buildImage(runner, cfg, buildDir, tags, numLayers)
+	if err != nil {
+		return fmt.Errorf("error building image: %w", err)
+	}
+
+	fmt.Fprintf(out, "Successfully built image %s\n", strings.Join(tags, ", "))
+
+	// Ask the builder for the ID of the image it built
+	if cfg.printDigest {
+		if digest, err = imageID(ctx, builder, repoTag, cfg.errOut()); err != nil {
+			return fmt.Errorf("error reading image digest: %w", err)
+		}
+	}
+
+	// Push the image, without retrying a push that is expected to fail
+	if cfg.push {
+		if r, ok := runner.(retryRunner); ok && cfg.expectPushFail {
+			runner = r.runner
+		}
+		if err := pushImage(runner, out, builder, tags, cfg.platforms, cfg.expectPushFail); err != nil {
+			return fmt.Errorf("error pushing image: %w", err)
+		}
+	}
+	if cfg.keepBuildDir {
+		keepBuildDir(cfg, cleanupManager, repoTag, buildDir)
+	}
+	return nil
+}
+
+// layerDirs returns the paths of the numLayers layer directories in buildDir
+func layerDirs(buildDir string, numLayers int) []string {
+	dirs := make([]string, numLayers)
+	for i := range dirs {
+		dirs[i] = filepath.Join(buildDir, fmt.Sprintf("layer%d", i+1))
+	}
+	return dirs
+}
+
+// squashDir is the directory in the build directory that squashLayers merges the layers into
+const squashDir = "squashed"
+
+// squashLayers moves the numLayers layer directories in buildDir into squashDir, each keeping its
+// name so files from different layers cannot collide, and returns the path of squashDir
+func squashLayers(buildDir string, numLayers int) (string, error) {
+	squashed := filepath.Join(buildDir, squashDir)
+	if err := os.Mkdir(squashed, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", squashed, err)
+	}
+	for _, dir := range layerDirs(buildDir, numLayers) {
+		if err := os.Rename(dir, filepath.Join(squashed, filepath.Base(dir))); err != nil {
+			return "", fmt.Errorf("failed to move %s: %w", dir, err)
+		}
+	}
+	return squashed, nil
+}
+
+// keepBuildDir stops cleanupManager from removing buildDir and tells the user where it is. With
+// --quiet only the path is printed, since it is the result a script needs.
+func keepBuildDir(cfg *buildConfig, cleanupManager *cleanup.Manager, repoTag string, buildDir string) {
+	cleanupManager.Disarm()
+	if absDir, err := filepath.Abs(buildDir); err == nil {
+		buildDir = absDir
+	}
+	out := cfg.resultOut()
+	if cfg.quiet {
+		fmt.Fprintln(out, buildDir)
+		return
+	}
+	fmt.Fprintf(out, "Kept build context for %s at %s\n", repoTag, buildDir)
+	fmt.Fprintf(out, "imgmkr will not remove it; delete the directory when you are done with it\n")
+}
+
+// maxTagDirLen caps how much of the image tag is embedded in the temp directory name
+const maxTagDirLen = 64
+
+// sanitizeTag turns repoTag into a filesystem-safe directory name component, replacing runs
+// of characters other than letters, digits, '.', '_' and '-' with a single '-'
+func sanitizeTag(repoTag string) string {
+	var b strings.Builder
+	for _, r := range repoTag {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_':
+			b.WriteRune(r)
+		case !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	name := b.String()
+	if len(name) > maxTagDirLen {
+		name = name[:maxTagDirLen]
+	}
+	return strings.Trim(name, "-.")
+}
+
+// appendOptions returns the options for appending the generated layers to the base image. The
+// layers are read from layerDirs, or streamed if layerDirs is nil, in which case each holds a file.
+func (cfg *buildConfig) appendOptions(layers []manifest.Layer, layerDirs []string) (appendOptions, error) {
+	opts := appendOptions{
+		tarOptions:    cfg.tarOptions(),
+		maxConcurrent: cfg.maxConcurrent,
+		labels:        cfg.labels.Map(),
+		env:           cfg.env,
+		entrypoint:    cfg.entrypoint,
+		cmd:           cfg.cmd,
+	}
+	if cfg.manifestAnnotations {
+		// Streamed layers' digests are only known once the layers are created
+		opts.annotations = func() map[string]string { return layerAnnotations(layers) }
+	}
+	if cfg.ociHistory {
+		created := time.Now()
+		if cfg.deterministic {
+			created = fixedTime
+		}
+		var empty []bool
+		if layerDirs != nil {
+			var err error
+			if empty, err = emptyLayerDirs(layerDirs); err != nil {
+				return appendOptions{}, err
+			}
+		}
+		opts.history = layerHistory(layers, empty, created)
+	}
+	return opts, nil
+}
+
+// tarOptions returns how the layer directories are written as tar streams
+func (cfg *buildConfig) tarOptions() tarOptions {
+	return tarOptions{deterministic: cfg.deterministic, keepModes: cfg.setsModes(), uid: optionalID(cfg.uid), gid: optionalID(cfg.gid)}
+}
+
+// setsModes reports whether the mock filesystem's permissions were set explicitly
+func (cfg *buildConfig) setsModes() bool {
+	return cfg.hasLayerMode(contentModeMockFS) && (cfg.fileMode != 0 || cfg.dirMode != 0 || cfg.specialModes > 0)
+}
+
+// streamBuild generates each single-file layer directly into a layer blob of the derived image,
+// without writing the layer files to disk, and returns the digest of the image's manifest. Each
+// layer's digest is taken from the file's contents as they are first streamed into its tar.
+func streamBuild(cfg *buildConfig, repoTag string, sizes []int64) (string, error) {
+	files := make([]layerFile, len(sizes))
+	layers := make([]manifest.Layer, len(sizes))
+	for i, layerSize := range sizes {
+		files[i] = newLayerFile(layerSize, cfg.layerFileOptions(cfg.contentLayer(sizes, i+1)))
+		layers[i] = manifest.Layer{
+			Number:        i + 1,
+			RequestedSize: layerSize,
+			ActualSize:    files[i].size,
+			FileCount:     1,
+			ContentMode:   cfg.contentMode(),
+			UID:           optionalID(cfg.uid),
+			GID:           optionalID(cfg.gid),
+		}
+	}
+
+	// Every read of a layer generates the same data, so only the first is recorded
+	recorded := make([]sync.Once, len(files))
+	onSum := func(i int, sum []byte) {
+		recorded[i].Do(func() {
+			stats := manifest.NewLayerStats()
+			stats.AddFile(files[i].name, files[i].size, sum)
+			layers[i].Digest = stats.Digest()
+		})
+	}
+
+	modTime := time.Now()
+	if cfg.deterministic {
+		modTime = fixedTime
+	}
+	out := cfg.statusOut()
+	fmt.Fprintf(out, "Streaming %d layers into %s (max %d concurrent)...\n", len(files), cfg.output, cfg.maxConcurrent)
+	opts, err := cfg.appendOptions(layers, nil)
+	if err != nil {
+		return "", fmt.Errorf("error writing image tarball: %w", err)
+	}
+	digest, err := streamToTarball(cfg.appendToTar, cfg.output, repoTag, files, modTime, opts, onSum)
+	if err != nil {
+		return "", fmt.Errorf("error writing image tarball: %w", err)
+	}
+	fmt.Fprintf(out, "Successfully wrote image %s to %s\n", repoTag, cfg.output)
+
+	if cfg.manifestFile != "" {
+		if err := manifest.Write(cfg.manifestFile, layers); err != nil {
+			return "", fmt.Errorf("error writing layer manifest: %w", err)
+		}
+	}
+	return digest, nil
+}
+
+// createTempDir creates a temporary directory for building the image, named after repoTag
+// (e.g. imgmkr-myrepo-v1-123456) so concurrent builds are easy to tell apart
+func createTempDir(prefix string, repoTag string) (string, error) {
+	pattern := "imgmkr-"
+	if name := sanitizeTag(repoTag); name != "" {
+		pattern += name + "-"
+	}
+	tempDir, err := os.MkdirTemp(prefix, pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	return tempDir, nil
+}
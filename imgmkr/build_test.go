@@ -0,0 +1,436 @@
+package imgmkr
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestOutputNone(t *testing.T) {
+	// No builder is looked up, let alone run
+	origLookPath := lookPath
+	defer func() { lookPath = origLookPath }()
+	lookPath = func(name string) (string, error) {
+		t.Errorf("Unexpected builder lookup for %s", name)
+		return "", fmt.Errorf("not found")
+	}
+
+	tmpdir := t.TempDir()
+	err := RunBuild([]string{"--layer-sizes", "4KB,8KB", "--output", "none", "--tmpdir-prefix", tmpdir, "context:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The build context is kept
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one kept build directory, got %v (err: %v)", entries, err)
+	}
+	buildDir := filepath.Join(tmpdir, entries[0].Name())
+	for _, name := range []string{"Dockerfile", "layer1", "layer2"} {
+		if _, err := os.Stat(filepath.Join(buildDir, name)); err != nil {
+			t.Errorf("Expected %s in the build context: %v", name, err)
+		}
+	}
+}
+
+// fakeDocker puts a docker on PATH, alone so it is the builder found, that answers --version
+// and otherwise runs the shell commands in body
+func fakeDocker(t *testing.T, body string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	binDir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = --version ] && exit 0\n" + body + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake builder: %v", err)
+	}
+	t.Setenv("PATH", binDir)
+}
+
+func TestTimeout(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not available")
+	}
+
+	// The builder hangs far longer than the timeout
+	fakeDocker(t, "exec "+sleep+" 30")
+
+	tmpdir := t.TempDir()
+	start := time.Now()
+	err = RunBuild([]string{"--layer-sizes", "4KB", "--timeout", "500ms", "--quiet", "--tmpdir-prefix", tmpdir, "slow:v1"})
+	if err == nil || !strings.Contains(err.Error(), "build timed out after 500ms") {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected the builder to be killed at the timeout, took %v", elapsed)
+	}
+
+	// The build directory is cleaned up
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatalf("Failed to read temp directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected the build directory to be cleaned up, found %v", entries)
+	}
+
+	// Without a timeout the same build is left to run
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "4KB", "slow:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx, cancel := cfg.buildContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("Expected no deadline without --timeout")
+	}
+	if _, _, err := parseBuildArgs([]string{"--layer-sizes", "4KB", "--timeout", "-1s", "slow:v1"}); err == nil {
+		t.Error("Expected an error for a negative --timeout")
+	}
+}
+
+func TestBuildLog(t *testing.T) {
+	fakeDocker(t, `echo "Step 1/2 : FROM scratch"; echo "warning: no cache" >&2; echo "Successfully tagged $3"`)
+
+	for _, quiet := range []bool{false, true} {
+		logPath := filepath.Join(t.TempDir(), "build.log")
+		if err := os.WriteFile(logPath, []byte("stale log from an earlier build\n"), 0644); err != nil {
+			t.Fatalf("Failed to write stale log: %v", err)
+		}
+		args := []string{"--layer-sizes", "4KB", "--build-log", logPath, "--tmpdir-prefix", t.TempDir(), "logged:v1"}
+		if quiet {
+			args = append([]string{"--quiet"}, args...)
+		}
+		var err error
+		stdout := captureStdout(t, func() { err = RunBuild(args) })
+		if err != nil {
+			t.Fatalf("Unexpected error (quiet %v): %v", quiet, err)
+		}
+
+		// The log has all of the builder's output, and nothing from before
+		data, err := os.ReadFile(logPath)
+		if err != nil {
+			t.Fatalf("Failed to read build log: %v", err)
+		}
+		for _, want := range []string{"Step 1/2 : FROM scratch", "warning: no cache", "Successfully tagged logged:v1"} {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("Expected the build log to contain %q (quiet %v), got %q", want, quiet, data)
+			}
+		}
+		if strings.Contains(string(data), "stale") {
+			t.Errorf("Expected the build log to be truncated, got %q", data)
+		}
+
+		// The console gets the builder's output too, unless it is quiet
+		if got := strings.Contains(stdout, "Step 1/2"); got == quiet {
+			t.Errorf("Expected builder output on stdout to be %v with quiet %v, got %q", !quiet, quiet, stdout)
+		}
+	}
+}
+
+func TestKeepOnFailure(t *testing.T) {
+	fakeDocker(t, "exit 1")
+
+	// A failed build removes its directory by default
+	tmpdir := t.TempDir()
+	err := RunBuild([]string{"--layer-sizes", "4KB", "--quiet", "--tmpdir-prefix", tmpdir, "broken:v1"})
+	if err == nil || !strings.Contains(err.Error(), "error building image") {
+		t.Fatalf("Expected a build error, got %v", err)
+	}
+	if entries, err := os.ReadDir(tmpdir); err != nil || len(entries) != 0 {
+		t.Errorf("Expected the build directory to be cleaned up, got %v (err: %v)", entries, err)
+	}
+
+	// With --keep-on-failure it is kept, with its Dockerfile, and its path printed
+	tmpdir = t.TempDir()
+	stdout := captureStdout(t, func() {
+		err = RunBuild([]string{"--layer-sizes", "4KB", "--quiet", "--keep-on-failure", "--tmpdir-prefix", tmpdir, "broken:v1"})
+	})
+	if err == nil {
+		t.Fatal("Expected a build error")
+	}
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one kept build directory, got %v (err: %v)", entries, err)
+	}
+	buildDir := filepath.Join(tmpdir, entries[0].Name())
+	if _, err := os.Stat(filepath.Join(buildDir, "Dockerfile")); err != nil {
+		t.Errorf("Expected the Dockerfile in the kept build directory: %v", err)
+	}
+	if strings.TrimSpace(stdout) != buildDir {
+		t.Errorf("Expected the kept directory's path %s to be printed, got %q", buildDir, stdout)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	// No builder is looked up, let alone run
+	origLookPath := lookPath
+	defer func() { lookPath = origLookPath }()
+	lookPath = func(name string) (string, error) {
+		t.Errorf("Unexpected builder lookup for %s", name)
+		return "", fmt.Errorf("not found")
+	}
+
+	tmpdir := t.TempDir()
+	err := RunBuild([]string{"--layer-sizes", "4KB", "--dry-run", "--tmpdir-prefix", tmpdir, "dry:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The build directory survives the deferred cleanup
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one kept build directory, got %v (err: %v)", entries, err)
+	}
+	buildDir := filepath.Join(tmpdir, entries[0].Name())
+	for _, name := range []string{"Dockerfile", "layer1"} {
+		if _, err := os.Stat(filepath.Join(buildDir, name)); err != nil {
+			t.Errorf("Expected %s in the build context: %v", name, err)
+		}
+	}
+
+	invalid := [][]string{
+		{"--layer-sizes", "1MB", "--dry-run", "--push", "test:v1"},
+		{"--layer-sizes", "1MB", "--dry-run", "--output", "out.tar", "--append-to-tar", "base.tar", "test:v1"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+// captureStdout runs f with os.Stdout redirected and returns what f wrote to it
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestQuiet(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "image.tar")
+	var err error
+	stdout := captureStdout(t, func() {
+		err = RunBuild([]string{"--layer-sizes", "4KB,8KB", "--mock-fs", "--quiet", "--output", outPath,
+			"--tmpdir-prefix", t.TempDir(), "quiet:v1"})
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stdout != "" {
+		t.Errorf("Expected no output with --quiet, got %q", stdout)
+	}
+	if _, err := os.Stat(outPath); err != nil {
+		t.Errorf("Expected the image tarball to be written: %v", err)
+	}
+
+	// Without --quiet the same build reports its progress
+	stdout = captureStdout(t, func() {
+		err = RunBuild([]string{"--layer-sizes", "4KB,8KB", "--mock-fs", "--output", outPath,
+			"--tmpdir-prefix", t.TempDir(), "quiet:v1"})
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(stdout, "Successfully wrote image") {
+		t.Errorf("Expected status output without --quiet, got %q", stdout)
+	}
+
+	// A kept build context's path is still printed, alone, for scripts to use
+	tmpdir := t.TempDir()
+	stdout = captureStdout(t, func() {
+		err = RunBuild([]string{"--layer-sizes", "4KB", "--quiet", "--dry-run", "--tmpdir-prefix", tmpdir, "quiet:v1"})
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one kept build directory, got %v (%v)", entries, err)
+	}
+	if want := filepath.Join(tmpdir, entries[0].Name()) + "\n"; stdout != want {
+		t.Errorf("Expected only the kept directory %q, got %q", want, stdout)
+	}
+}
+
+func TestPrintDigest(t *testing.T) {
+	// The builder is asked for the ID of the image it built
+	id := strings.Repeat("0123456789abcdef", 4)
+	saved := t.TempDir()
+	fakeDocker(t, `[ "$1" = inspect ] && echo "$@" > `+saved+`/inspect && echo sha256:`+id+`; exit 0`)
+	stdout := captureStdout(t, func() {
+		if err := RunBuild([]string{"--layer-sizes", "4KB", "--quiet", "--print-digest", "--tmpdir-prefix", t.TempDir(), "digest:v1"}); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+	if stdout != "sha256:"+id+"\n" {
+		t.Errorf("Expected only the image ID to be printed, got %q", stdout)
+	}
+	if args, _ := os.ReadFile(filepath.Join(saved, "inspect")); string(args) != "inspect --format {{.Id}} digest:v1\n" {
+		t.Errorf("Unexpected inspect arguments %q", args)
+	}
+
+	// A builder that prints something else fails the build
+	fakeDocker(t, `[ "$1" = inspect ] && echo "no such image"; exit 0`)
+	err := RunBuild([]string{"--layer-sizes", "4KB", "--quiet", "--print-digest", "--tmpdir-prefix", t.TempDir(), "digest:v1"})
+	if err == nil || !strings.Contains(err.Error(), "unexpected image ID") {
+		t.Errorf("Expected an error for a bad image ID, got %v", err)
+	}
+
+	// A written image's manifest digest is printed and summarized
+	summaryPath := filepath.Join(t.TempDir(), "summary.json")
+	stdout = captureStdout(t, func() {
+		err = RunBuild([]string{"--layer-sizes", "4KB,8KB", "--output", filepath.Join(t.TempDir(), "image.tar"), "--summary-json", summaryPath, "--quiet", "--print-digest", "digest:v1"})
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	digest := strings.TrimSpace(stdout)
+	if _, err := parseImageID(digest); err != nil || !strings.HasPrefix(digest, "sha256:") {
+		t.Errorf("Expected a manifest digest to be printed, got %q", stdout)
+	}
+	data, err := os.ReadFile(summaryPath)
+	if err != nil {
+		t.Fatalf("Expected a summary to be written: %v", err)
+	}
+	if !strings.Contains(string(data), `"digest": "`+digest+`"`) {
+		t.Errorf("Expected the summary to include digest %s, got:\n%s", digest, data)
+	}
+}
+
+func TestKeepBuildDir(t *testing.T) {
+	basePath := writeBaseTarball(t, 1)
+	for _, keep := range []bool{false, true} {
+		tmpdir := t.TempDir()
+		args := []string{"--layer-sizes", "4KB", "--tmpdir-prefix", tmpdir, "--append-to-tar", basePath,
+			"--output", filepath.Join(t.TempDir(), "out.tar")}
+		if keep {
+			args = append(args, "--keep-build-dir")
+		}
+		if err := RunBuild(append(args, "kept:v1")); err != nil {
+			t.Fatalf("Unexpected error (keep %v): %v", keep, err)
+		}
+
+		entries, err := os.ReadDir(tmpdir)
+		if err != nil {
+			t.Fatalf("Failed to read temp directory: %v", err)
+		}
+		if keep {
+			if len(entries) != 1 {
+				t.Fatalf("Expected the build directory to be kept with --keep-build-dir, got %v", entries)
+			}
+			if _, err := os.Stat(filepath.Join(tmpdir, entries[0].Name(), "layer1")); err != nil {
+				t.Errorf("Expected the kept build directory to hold the layers: %v", err)
+			}
+		}
+		if !keep && len(entries) != 0 {
+			t.Errorf("Expected the build directory to be removed, got %v", entries)
+		}
+	}
+}
+
+func TestDeterministicBuild(t *testing.T) {
+	// buildLayers generates two mock filesystem layers and returns their digests and diff IDs
+	buildLayers := func(repoTag string) ([]string, []string) {
+		cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "64KB,256KB", "--mock-fs", "--magic-headers", "--deterministic", repoTag})
+		if err != nil {
+			t.Fatalf("Unexpected error parsing arguments: %v", err)
+		}
+		buildDir := t.TempDir()
+		layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{64 * size.KB, 256 * size.KB}, cfg, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create layers: %v", err)
+		}
+
+		var digests, diffIDs []string
+		for _, layer := range layers {
+			digests = append(digests, layer.Digest)
+			tarLayer, err := layerFromDir(filepath.Join(buildDir, fmt.Sprintf("layer%d", layer.Number)), tarOptions{deterministic: true})
+			if err != nil {
+				t.Fatalf("Failed to create layer tarball: %v", err)
+			}
+			diffID, err := tarLayer.DiffID()
+			if err != nil {
+				t.Fatalf("Failed to compute diff ID: %v", err)
+			}
+			diffIDs = append(diffIDs, diffID.String())
+		}
+		return digests, diffIDs
+	}
+
+	digests1, diffIDs1 := buildLayers("test:v1")
+	digests2, diffIDs2 := buildLayers("test:v1")
+	if strings.Join(digests1, ",") != strings.Join(digests2, ",") {
+		t.Errorf("Expected identical layer digests across builds, got %v and %v", digests1, digests2)
+	}
+	if strings.Join(diffIDs1, ",") != strings.Join(diffIDs2, ",") {
+		t.Errorf("Expected identical diff IDs across builds, got %v and %v", diffIDs1, diffIDs2)
+	}
+
+	// The seed comes from the tag, so another tag gives other content
+	digests3, _ := buildLayers("test:v2")
+	if digests3[0] == digests1[0] {
+		t.Error("Expected a different tag to produce different layer content")
+	}
+}
+
+func TestCreateTempDirTagged(t *testing.T) {
+	tests := []struct {
+		repoTag  string
+		expected string
+	}{
+		{"myrepo:v1", "imgmkr-myrepo-v1-"},
+		{"registry.example.com:5000/team/app:1.0_rc", "imgmkr-registry.example.com-5000-team-app-1.0_rc-"},
+		{"my--repo@@:v1", "imgmkr-my-repo-v1-"},
+		{"", "imgmkr-"},
+	}
+
+	prefix := t.TempDir()
+	for _, test := range tests {
+		first, err := createTempDir(prefix, test.repoTag)
+		if err != nil {
+			t.Fatalf("Unexpected error creating temp dir for %q: %v", test.repoTag, err)
+		}
+		second, err := createTempDir(prefix, test.repoTag)
+		if err != nil {
+			t.Fatalf("Unexpected error creating temp dir for %q: %v", test.repoTag, err)
+		}
+
+		name := filepath.Base(first)
+		if !strings.HasPrefix(name, test.expected) || len(name) == len(test.expected) {
+			t.Errorf("Expected %q followed by a unique suffix for %q, got %q", test.expected, test.repoTag, name)
+		}
+		if first == second {
+			t.Errorf("Expected distinct directories for repeated builds of %q, got %s twice", test.repoTag, first)
+		}
+	}
+
+	if name := sanitizeTag(strings.Repeat("a", 200) + ":v1"); len(name) > maxTagDirLen {
+		t.Errorf("Expected sanitized tag to be capped at %d bytes, got %d", maxTagDirLen, len(name))
+	}
+}
@@ -0,0 +1,369 @@
+package imgmkr
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// builderPreference lists the builders buildImage will use, in order of preference
+var builderPreference = []string{"finch", "docker"}
+
+// probeCandidates lists every builder reported by the probe command, and accepted by --builder
+var probeCandidates = []string{"finch", "docker", "podman", "nerdctl"}
+
+// lookPath and builderVersion wrap os/exec so builder detection can be stubbed in tests
+var (
+	lookPath       = exec.LookPath
+	builderVersion = func(path string) (string, error) {
+		out, err := exec.Command(path, "--version").Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+)
+
+// BuilderInfo describes a builder found (or not) on PATH
+type BuilderInfo struct {
+	Name    string
+	Path    string
+	Version string
+	Found   bool
+}
+
+// detectBuilders checks PATH for each of the named builders and queries the version of those found
+func detectBuilders(names []string) []BuilderInfo {
+	infos := make([]BuilderInfo, 0, len(names))
+	for _, name := range names {
+		info := BuilderInfo{Name: name}
+		path, err := lookPath(name)
+		if err == nil {
+			info.Found = true
+			info.Path = path
+			if version, err := builderVersion(path); err == nil {
+				info.Version = version
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// checkBuilderName checks that a --builder value is one of the supported builders
+func checkBuilderName(builder string) error {
+	for _, name := range probeCandidates {
+		if builder == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown builder %q: expected one of %s", builder, strings.Join(probeCandidates, ", "))
+}
+
+// selectBuilder returns builder if it is on PATH, or the preferred builder available on PATH if
+// builder is empty. Only PATH is searched: versions are queried by the probe command alone.
+func selectBuilder(builder string) (string, error) {
+	if builder != "" {
+		if _, err := lookPath(builder); err != nil {
+			return "", fmt.Errorf("builder %s not found on PATH", builder)
+		}
+		return builder, nil
+	}
+	for _, name := range builderPreference {
+		if _, err := lookPath(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("neither finch nor docker command found")
+}
+
+// probeBuilders writes a report of the available builders to w
+func probeBuilders(w io.Writer) {
+	for _, info := range detectBuilders(probeCandidates) {
+		if !info.Found {
+			fmt.Fprintf(w, "%-8s not found\n", info.Name)
+			continue
+		}
+		version := info.Version
+		if version == "" {
+			version = "unknown version"
+		}
+		fmt.Fprintf(w, "%-8s %s (%s)\n", info.Name, info.Path, version)
+	}
+
+	if cmdName, err := selectBuilder(""); err == nil {
+		fmt.Fprintf(w, "imgmkr will build with %s\n", cmdName)
+	} else {
+		fmt.Fprintf(w, "imgmkr cannot build: %v\n", err)
+	}
+}
+
+// RunProbe implements the probe command: report available builders without building
+func RunProbe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: imgmkr probe\n\nReport which image builders are available on PATH and which one build would use.\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("probe takes no arguments")
+	}
+
+	probeBuilders(os.Stdout)
+	return nil
+}
+
+// stdinDockerfileBuilders lists the builders known to accept a Dockerfile on stdin via "-f -"
+var stdinDockerfileBuilders = map[string]bool{
+	"docker": true,
+	"podman": true,
+}
+
+// buildxBuilders lists the builders that build multi-platform images with buildx, which must
+// push them as part of the build because they can't be loaded into the local image store
+var buildxBuilders = map[string]bool{
+	"docker": true,
+}
+
+// parsePlatforms parses a comma-separated list of platforms like "linux/amd64,linux/arm64/v8"
+func parsePlatforms(spec string) ([]string, error) {
+	var platforms []string
+	seen := make(map[string]bool)
+	for _, platform := range strings.Split(spec, ",") {
+		platform = strings.TrimSpace(platform)
+		parts := strings.Split(platform, "/")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid platform %q: expected os/arch or os/arch/variant", platform)
+		}
+		for _, part := range parts {
+			if part == "" || strings.ContainsAny(part, " \t") {
+				return nil, fmt.Errorf("invalid platform %q: expected os/arch or os/arch/variant", platform)
+			}
+		}
+		if seen[platform] {
+			return nil, fmt.Errorf("platform %s is listed more than once", platform)
+		}
+		seen[platform] = true
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
+
+// pushedByBuild reports whether cmdName pushes the image while building it for platforms
+func pushedByBuild(cmdName string, platforms []string) bool {
+	return len(platforms) > 1 && buildxBuilders[cmdName]
+}
+
+// Runner runs an external command in dir, with stdin as its input (nil for none)
+type Runner interface {
+	Run(name string, args []string, dir string, stdin io.Reader) error
+}
+
+// execRunner runs commands with os/exec, passing their output through
+type execRunner struct {
+	ctx    context.Context // Kills the command once done (nil = never)
+	out    io.Writer       // Where the command's standard output goes (nil = os.Stdout)
+	errOut io.Writer       // Where the command's standard error goes (nil = os.Stderr)
+}
+
+// killWait is how long a killed command's output may stay open, e.g. held by its children
+const killWait = time.Second
+
+func (r execRunner) Run(name string, args []string, dir string, stdin io.Reader) error {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = killWait
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	cmd.Stdout = r.out
+	if r.out == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = r.errOut
+	if r.errOut == nil {
+		cmd.Stderr = os.Stderr
+	}
+	return cmd.Run()
+}
+
+// retryDelay is how long retryRunner waits before its first retry, doubling before each one after
+// (a variable for testing)
+var retryDelay = time.Second
+
+// retryRunner runs commands with runner, retrying a failed command up to retries times with
+// exponential backoff
+type retryRunner struct {
+	runner  Runner
+	ctx     context.Context // Stops retrying once done (nil = never)
+	out     io.Writer       // Where retries are reported
+	retries int
+}
+
+func (r retryRunner) Run(name string, args []string, dir string, stdin io.Reader) error {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Read stdin up front so every attempt gets all of it
+	var input []byte
+	if stdin != nil {
+		var err error
+		if input, err = io.ReadAll(stdin); err != nil {
+			return err
+		}
+	}
+
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		var in io.Reader
+		if stdin != nil {
+			in = bytes.NewReader(input)
+		}
+		err := r.runner.Run(name, args, dir, in)
+		if err == nil || attempt > r.retries || ctx.Err() != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "%s %s failed (%v), retrying in %s (retry %d of %d)...\n", name, args[0], err, delay, attempt, r.retries)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// buildArgs returns cmdName's arguments for building the context in the current directory,
+// tagged with each of tags, for platforms (none for the builder's default). With dockerfileStdin
+// the Dockerfile is read from stdin instead of the build directory. Multi-platform builds use
+// buildx where the builder needs it, pushing the image as they build it.
+func buildArgs(cmdName string, tags []string, dockerfileStdin bool, platforms []string) []string {
+	args := []string{"build"}
+	if pushedByBuild(cmdName, platforms) {
+		args = []string{"buildx", "build", "--push"}
+	}
+	if len(platforms) > 0 {
+		args = append(args, "--platform", strings.Join(platforms, ","))
+	}
+	for _, tag := range tags {
+		args = append(args, "-t", tag)
+	}
+	if dockerfileStdin {
+		args = append(args, "-f", "-")
+	}
+	return append(args, ".")
+}
+
+// buildImage builds the Docker image, tagged with each of tags, using the --builder builder or else
+// finch or docker, returning the builder's name. With --dockerfile-stdin the Dockerfile is piped to builders that support
+// it, and written to buildDir for those that don't.
+func buildImage(runner Runner, cfg *buildConfig, buildDir string, tags []string, numLayers int) (string, error) {
+	// Use the requested builder, or try finch first and fall back to docker if not available
+	cmdName, err := selectBuilder(cfg.builder)
+	if err != nil {
+		return "", err
+	}
+
+	var stdin io.Reader
+	if cfg.dockerfileStdin {
+		if stdinDockerfileBuilders[cmdName] {
+			stdin = strings.NewReader(renderDockerfile(numLayers, cfg.dockerfileOptions()))
+		} else {
+			fmt.Fprintf(cfg.statusOut(), "%s does not support reading the Dockerfile from stdin, writing it to the build directory\n", cmdName)
+			if err := createDockerfile(buildDir, numLayers, cfg.dockerfileOptions()); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Build the image
+	fmt.Fprintf(cfg.statusOut(), "Building image with %s...\n", cmdName)
+	err = runner.Run(cmdName, buildArgs(cmdName, tags, stdin != nil, cfg.platforms), buildDir, stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to build image: %w", err)
+	}
+
+	return cmdName, nil
+}
+
+// pushImage pushes each of tags, built for platforms, with builder (or the preferred builder if
+// empty), writing status messages to out. With expectFailure the result is inverted: a rejected push is reported as
+// success, and an accepted push as an error.
+func pushImage(runner Runner, out io.Writer, builder string, tags []string, platforms []string, expectFailure bool) error {
+	cmdName, err := selectBuilder(builder)
+	if err != nil {
+		return err
+	}
+	if pushedByBuild(cmdName, platforms) {
+		fmt.Fprintf(out, "Image %s was pushed by %s buildx during the build\n", strings.Join(tags, ", "), cmdName)
+		return nil
+	}
+
+	for _, repoTag := range tags {
+		args := []string{"push", repoTag}
+		if len(platforms) > 1 {
+			args = []string{"push", "--all-platforms", repoTag}
+		}
+		fmt.Fprintf(out, "Pushing image %s with %s...\n", repoTag, cmdName)
+		if err := pushResult(out, repoTag, runner.Run(cmdName, args, "", nil), expectFailure); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inspectArgs returns the arguments for a builder to print the ID of the image tagged tag
+func inspectArgs(tag string) []string {
+	return []string{"inspect", "--format", "{{.Id}}", tag}
+}
+
+// parseImageID parses the image ID printed by a builder's inspect command into a digest. Podman
+// prints the ID without its algorithm, which is always sha256.
+func parseImageID(output string) (string, error) {
+	id := strings.TrimSpace(output)
+	digest := id
+	if !strings.Contains(digest, ":") {
+		digest = "sha256:" + digest
+	}
+	if _, err := v1.NewHash(digest); err != nil {
+		return "", fmt.Errorf("unexpected image ID %q: %w", id, err)
+	}
+	return digest, nil
+}
+
+// imageID asks builder for the ID of the image tagged tag: the digest of the image's config,
+// which unlike a manifest digest is known before the image is pushed. The builder's errors go to
+// errOut.
+func imageID(ctx context.Context, builder string, tag string, errOut io.Writer) (string, error) {
+	var out bytes.Buffer
+	if err := (execRunner{ctx: ctx, out: &out, errOut: errOut}).Run(builder, inspectArgs(tag), "", nil); err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", tag, err)
+	}
+	return parseImageID(out.String())
+}
+
+// pushResult returns the outcome of pushing repoTag given the push error err, inverted with
+// expectFailure as for --expect-push-failure
+func pushResult(out io.Writer, repoTag string, err error, expectFailure bool) error {
+	switch {
+	case expectFailure && err != nil:
+		fmt.Fprintf(out, "Push of %s failed as expected: %v\n", repoTag, err)
+		return nil
+	case expectFailure:
+		return fmt.Errorf("push of %s succeeded, but --expect-push-failure was set", repoTag)
+	case err != nil:
+		return fmt.Errorf("failed to push image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,492 @@
+package imgmkr
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stubBuilders(t *testing.T, available map[string]string) {
+	origLookPath, origVersion := lookPath, builderVersion
+	t.Cleanup(func() {
+		lookPath, builderVersion = origLookPath, origVersion
+	})
+
+	lookPath = func(name string) (string, error) {
+		if _, ok := available[name]; ok {
+			return "/usr/bin/" + name, nil
+		}
+		return "", fmt.Errorf("%s: not found", name)
+	}
+	builderVersion = func(path string) (string, error) {
+		name := strings.TrimPrefix(path, "/usr/bin/")
+		return available[name], nil
+	}
+}
+
+func TestDetectBuilders(t *testing.T) {
+	stubBuilders(t, map[string]string{
+		"docker":  "Docker version 24.0.7",
+		"nerdctl": "nerdctl version 1.7.0",
+	})
+
+	infos := detectBuilders(probeCandidates)
+	if len(infos) != len(probeCandidates) {
+		t.Fatalf("Expected %d builders, got %d", len(probeCandidates), len(infos))
+	}
+
+	expected := map[string]bool{"finch": false, "docker": true, "podman": false, "nerdctl": true}
+	for _, info := range infos {
+		if info.Found != expected[info.Name] {
+			t.Errorf("Builder %s: expected found=%v, got %v", info.Name, expected[info.Name], info.Found)
+		}
+		if info.Found && info.Version == "" {
+			t.Errorf("Builder %s: expected a version", info.Name)
+		}
+	}
+}
+
+func TestSelectBuilder(t *testing.T) {
+	stubBuilders(t, map[string]string{"finch": "finch version v1.0.0", "docker": "Docker version 24.0.7"})
+	cmdName, err := selectBuilder("")
+	if err != nil || cmdName != "finch" {
+		t.Errorf("Expected finch to be preferred, got %q (err: %v)", cmdName, err)
+	}
+
+	stubBuilders(t, map[string]string{"podman": "podman version 4.9.0"})
+	if _, err := selectBuilder(""); err == nil {
+		t.Error("Expected an error when neither finch nor docker is available")
+	}
+
+	// A requested builder is used even when it isn't preferred
+	if cmdName, err := selectBuilder("podman"); err != nil || cmdName != "podman" {
+		t.Errorf("Expected the requested podman, got %q (err: %v)", cmdName, err)
+	}
+	// Selecting a builder never runs it
+	stubBuilders(t, map[string]string{"docker": "Docker version 24.0.7"})
+	builderVersion = func(path string) (string, error) {
+		t.Errorf("Unexpected version query of %s", path)
+		return "", nil
+	}
+	if cmdName, err := selectBuilder(""); err != nil || cmdName != "docker" {
+		t.Errorf("Expected docker, got %q (err: %v)", cmdName, err)
+	}
+}
+
+func TestProbeBuilders(t *testing.T) {
+	stubBuilders(t, map[string]string{"docker": "Docker version 24.0.7"})
+
+	var buf bytes.Buffer
+	probeBuilders(&buf)
+	output := buf.String()
+
+	for _, want := range []string{"finch    not found", "Docker version 24.0.7", "podman   not found", "imgmkr will build with docker"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected probe output to contain %q, got:\n%s", want, output)
+		}
+	}
+}
+
+// runCall records one command run by fakeRunner
+type runCall struct {
+	name  string
+	args  []string
+	dir   string
+	stdin string
+}
+
+// fakeRunner records the commands it is asked to run instead of running them
+type fakeRunner struct {
+	calls []runCall
+	err   error
+	fails int // If set, only the first fails calls return err
+}
+
+func (r *fakeRunner) Run(name string, args []string, dir string, stdin io.Reader) error {
+	call := runCall{name: name, args: args, dir: dir}
+	if stdin != nil {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		call.stdin = string(data)
+	}
+	r.calls = append(r.calls, call)
+	if r.fails > 0 && len(r.calls) > r.fails {
+		return nil
+	}
+	return r.err
+}
+
+func TestBuildImage(t *testing.T) {
+	tests := []struct {
+		name            string
+		builders        map[string]string
+		dockerfileStdin bool
+		platforms       []string
+		expectedCmd     string
+		expectStdin     bool
+	}{
+		{"finch preferred", map[string]string{"finch": "v1", "docker": "v24"}, false, nil, "finch build -t test:v1 .", false},
+		{"docker fallback", map[string]string{"docker": "v24"}, false, nil, "docker build -t test:v1 .", false},
+		{"docker stdin", map[string]string{"docker": "v24"}, true, nil, "docker build -t test:v1 -f - .", true},
+		{"finch stdin falls back to a file", map[string]string{"finch": "v1"}, true, nil, "finch build -t test:v1 .", false},
+		{"docker single platform", map[string]string{"docker": "v24"}, false, []string{"linux/arm64"}, "docker build --platform linux/arm64 -t test:v1 .", false},
+		{"docker multi-platform uses buildx", map[string]string{"docker": "v24"}, false, []string{"linux/amd64", "linux/arm64"}, "docker buildx build --push --platform linux/amd64,linux/arm64 -t test:v1 .", false},
+		{"docker multi-platform stdin", map[string]string{"docker": "v24"}, true, []string{"linux/amd64", "linux/arm64"}, "docker buildx build --push --platform linux/amd64,linux/arm64 -t test:v1 -f - .", true},
+		{"finch multi-platform", map[string]string{"finch": "v1"}, false, []string{"linux/amd64", "linux/arm64"}, "finch build --platform linux/amd64,linux/arm64 -t test:v1 .", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubBuilders(t, test.builders)
+			buildDir := t.TempDir()
+			runner := &fakeRunner{}
+			cfg := &buildConfig{dockerfileStdin: test.dockerfileStdin, platforms: test.platforms}
+
+			builder, err := buildImage(runner, cfg, buildDir, []string{"test:v1"}, 2)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if builder != strings.Fields(test.expectedCmd)[0] {
+				t.Errorf("Expected the builder used to be returned, got %q", builder)
+			}
+			if len(runner.calls) != 1 {
+				t.Fatalf("Expected one builder invocation, got %d", len(runner.calls))
+			}
+			call := runner.calls[0]
+			if got := call.name + " " + strings.Join(call.args, " "); got != test.expectedCmd {
+				t.Errorf("Expected %q, got %q", test.expectedCmd, got)
+			}
+			if call.dir != buildDir {
+				t.Errorf("Expected build context %s, got %s", buildDir, call.dir)
+			}
+			if test.expectStdin && call.stdin != renderDockerfile(2, dockerfileOptions{}) {
+				t.Errorf("Expected the Dockerfile on stdin, got %q", call.stdin)
+			}
+			if !test.expectStdin && call.stdin != "" {
+				t.Errorf("Expected no stdin, got %q", call.stdin)
+			}
+
+			// Stdin fallback writes the Dockerfile to the build directory instead
+			_, err = os.Stat(filepath.Join(buildDir, "Dockerfile"))
+			if fellBack := test.dockerfileStdin && !test.expectStdin; fellBack != (err == nil) {
+				t.Errorf("Expected Dockerfile written: %v, got stat error %v", fellBack, err)
+			}
+		})
+	}
+}
+
+func TestBuildImageTags(t *testing.T) {
+	stubBuilders(t, map[string]string{"docker": "v24"})
+	cfg, repoTag, err := parseBuildArgs([]string{"--layer-sizes", "1MB", "--push", "registry.example.com/app:v1.2.3", "registry.example.com/app:latest"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tags := cfg.imageTags(repoTag)
+
+	// One build tags the image with every tag, and each tag is pushed
+	runner := &fakeRunner{}
+	if _, err := buildImage(runner, cfg, t.TempDir(), tags, 1); err != nil {
+		t.Fatalf("Unexpected error building: %v", err)
+	}
+	if err := pushImage(runner, io.Discard, "", tags, nil, false); err != nil {
+		t.Fatalf("Unexpected error pushing: %v", err)
+	}
+	expected := []string{
+		"build -t registry.example.com/app:v1.2.3 -t registry.example.com/app:latest .",
+		"push registry.example.com/app:v1.2.3",
+		"push registry.example.com/app:latest",
+	}
+	if len(runner.calls) != len(expected) {
+		t.Fatalf("Expected %d builder invocations, got %+v", len(expected), runner.calls)
+	}
+	for i, call := range runner.calls {
+		if got := strings.Join(call.args, " "); got != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], got)
+		}
+	}
+
+	// Every tag must be valid, and only builders can apply several
+	invalid := [][]string{
+		{"--layer-sizes", "1MB", "test:v1", "Not A Tag"},
+		{"--layer-sizes", "1MB", "--output", "out.tar", "test:v1", "test:latest"},
+		{"--layer-sizes", "1MB", "--push", "--push-mode", "direct", "test:v1", "test:latest"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestBuildImageBuilderFlag(t *testing.T) {
+	all := map[string]string{"finch": "v1", "docker": "v24", "podman": "v4", "nerdctl": "v1.7"}
+	for _, builder := range probeCandidates {
+		t.Run(builder, func(t *testing.T) {
+			stubBuilders(t, all)
+			cfg, repoTag, err := parseBuildArgs([]string{"--layer-sizes", "1MB", "--builder", builder, "--push", "test:v1"})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			runner := &fakeRunner{}
+			used, err := buildImage(runner, cfg, t.TempDir(), cfg.imageTags(repoTag), 1)
+			if err != nil {
+				t.Fatalf("Unexpected error building: %v", err)
+			}
+			if used != builder {
+				t.Errorf("Expected to build with %s, got %s", builder, used)
+			}
+			if err := pushImage(runner, io.Discard, used, cfg.imageTags(repoTag), nil, false); err != nil {
+				t.Fatalf("Unexpected error pushing: %v", err)
+			}
+			expected := []string{builder + " build -t test:v1 .", builder + " push test:v1"}
+			if len(runner.calls) != len(expected) {
+				t.Fatalf("Expected %d builder invocations, got %+v", len(expected), runner.calls)
+			}
+			for i, call := range runner.calls {
+				if got := call.name + " " + strings.Join(call.args, " "); got != expected[i] {
+					t.Errorf("Expected %q, got %q", expected[i], got)
+				}
+			}
+		})
+	}
+
+	// A requested builder that isn't installed is an error, even if another builder is
+	stubBuilders(t, map[string]string{"docker": "v24"})
+	runner := &fakeRunner{}
+	_, err := buildImage(runner, &buildConfig{builder: "podman"}, t.TempDir(), []string{"test:v1"}, 1)
+	if err == nil || !strings.Contains(err.Error(), "podman not found") || len(runner.calls) != 0 {
+		t.Errorf("Expected a not found error without running anything, got %v", err)
+	}
+	tmpdir := t.TempDir()
+	err = RunBuild([]string{"--layer-sizes", "1MB", "--builder", "podman", "--tmpdir-prefix", tmpdir, "test:v1"})
+	if err == nil || !strings.Contains(err.Error(), "podman not found") {
+		t.Errorf("Expected the build to fail, got %v", err)
+	}
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Errorf("Expected no layers to be generated, found %d entries", len(entries))
+	}
+
+	invalid := [][]string{
+		{"--layer-sizes", "1MB", "--builder", "buildah", "test:v1"},
+		{"--layer-sizes", "1MB", "--builder", "docker", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--builder", "docker", "--push", "--push-mode", "direct", "test:v1"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestRetryRunner(t *testing.T) {
+	origDelay := retryDelay
+	defer func() { retryDelay = origDelay }()
+	retryDelay = time.Millisecond
+
+	// A builder that fails twice then succeeds is run three times, with the same stdin each time
+	stubBuilders(t, map[string]string{"docker": "v24"})
+	fake := &fakeRunner{err: fmt.Errorf("exit status 1"), fails: 2}
+	var out bytes.Buffer
+	runner := retryRunner{runner: fake, out: &out, retries: 3}
+	cfg := &buildConfig{dockerfileStdin: true}
+	if _, err := buildImage(runner, cfg, t.TempDir(), []string{"test:v1"}, 1); err != nil {
+		t.Fatalf("Expected the third attempt to succeed, got %v", err)
+	}
+	if len(fake.calls) != 3 {
+		t.Fatalf("Expected 3 builder invocations, got %d", len(fake.calls))
+	}
+	for i, call := range fake.calls {
+		if call.stdin != renderDockerfile(1, cfg.dockerfileOptions()) {
+			t.Errorf("Attempt %d: expected the Dockerfile on stdin, got %q", i+1, call.stdin)
+		}
+	}
+	if !strings.Contains(out.String(), "retry 1 of 3") || !strings.Contains(out.String(), "retry 2 of 3") || strings.Contains(out.String(), "retry 3") {
+		t.Errorf("Expected two retries to be reported, got %q", out.String())
+	}
+
+	// A successful attempt returns at once
+	fake = &fakeRunner{}
+	if err := (retryRunner{runner: fake, out: io.Discard, retries: 3}).Run("docker", []string{"push", "test:v1"}, "", nil); err != nil || len(fake.calls) != 1 {
+		t.Errorf("Expected one successful attempt, got %d (err: %v)", len(fake.calls), err)
+	}
+
+	// Retries run out
+	fake = &fakeRunner{err: fmt.Errorf("exit status 1")}
+	if err := (retryRunner{runner: fake, out: io.Discard, retries: 2}).Run("docker", []string{"push", "test:v1"}, "", nil); err == nil || len(fake.calls) != 3 {
+		t.Errorf("Expected a failure after 3 attempts, got %d (err: %v)", len(fake.calls), err)
+	}
+
+	// Retrying stops once the context is done, e.g. at the --timeout
+	retryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fake = &fakeRunner{err: fmt.Errorf("exit status 1")}
+	start := time.Now()
+	if err := (retryRunner{runner: fake, ctx: ctx, out: io.Discard, retries: 5}).Run("docker", []string{"build", "."}, "", nil); err == nil || len(fake.calls) != 1 {
+		t.Errorf("Expected to give up after 1 attempt, got %d (err: %v)", len(fake.calls), err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected retrying to stop at the timeout, took %s", elapsed)
+	}
+
+	if _, _, err := parseBuildArgs([]string{"--layer-sizes", "1MB", "--retries", "-1", "test:v1"}); err == nil {
+		t.Error("Expected an error for --retries -1")
+	}
+}
+
+func TestBuildImageErrors(t *testing.T) {
+	stubBuilders(t, map[string]string{"docker": "v24"})
+	runner := &fakeRunner{err: fmt.Errorf("exit status 1")}
+	if _, err := buildImage(runner, &buildConfig{}, t.TempDir(), []string{"test:v1"}, 1); err == nil {
+		t.Error("Expected builder failures to be reported")
+	}
+
+	stubBuilders(t, map[string]string{})
+	runner = &fakeRunner{}
+	if _, err := buildImage(runner, &buildConfig{}, t.TempDir(), []string{"test:v1"}, 1); err == nil || len(runner.calls) != 0 {
+		t.Errorf("Expected an error without running anything when no builder is found, got %v", err)
+	}
+}
+
+func TestPushImageExpectFailure(t *testing.T) {
+	stubBuilders(t, map[string]string{"docker": "v24"})
+	rejected := fmt.Errorf("blob upload invalid: layer exceeds size limit")
+
+	tests := []struct {
+		pushErr       error
+		expectFailure bool
+		wantErr       bool
+	}{
+		{nil, false, false},
+		{rejected, false, true},
+		// With --expect-push-failure the result is inverted
+		{rejected, true, false},
+		{nil, true, true},
+	}
+
+	for _, test := range tests {
+		runner := &fakeRunner{err: test.pushErr}
+		err := pushImage(runner, io.Discard, "", []string{"registry.example.com/big:v1"}, nil, test.expectFailure)
+		if (err != nil) != test.wantErr {
+			t.Errorf("push error %v, expect failure %v: expected error %v, got %v", test.pushErr, test.expectFailure, test.wantErr, err)
+		}
+		if len(runner.calls) != 1 || strings.Join(runner.calls[0].args, " ") != "push registry.example.com/big:v1" {
+			t.Errorf("Expected a single push of the image, got %+v", runner.calls)
+		}
+	}
+}
+
+func TestPushImagePlatforms(t *testing.T) {
+	tests := []struct {
+		builders    map[string]string
+		platforms   []string
+		expectedCmd string // Empty if the build already pushed the image
+	}{
+		{map[string]string{"docker": "v24"}, []string{"linux/arm64"}, "docker push registry.example.com/multi:v1"},
+		{map[string]string{"docker": "v24"}, []string{"linux/amd64", "linux/arm64"}, ""},
+		{map[string]string{"finch": "v1"}, []string{"linux/amd64", "linux/arm64"}, "finch push --all-platforms registry.example.com/multi:v1"},
+	}
+
+	for _, test := range tests {
+		stubBuilders(t, test.builders)
+		runner := &fakeRunner{}
+		if err := pushImage(runner, io.Discard, "", []string{"registry.example.com/multi:v1"}, test.platforms, false); err != nil {
+			t.Fatalf("Unexpected error pushing for %v: %v", test.platforms, err)
+		}
+		if test.expectedCmd == "" {
+			if len(runner.calls) != 0 {
+				t.Errorf("Expected no separate push after a buildx build, got %+v", runner.calls)
+			}
+			continue
+		}
+		if len(runner.calls) != 1 {
+			t.Fatalf("Expected one push, got %+v", runner.calls)
+		}
+		if got := runner.calls[0].name + " " + strings.Join(runner.calls[0].args, " "); got != test.expectedCmd {
+			t.Errorf("Expected %q, got %q", test.expectedCmd, got)
+		}
+	}
+}
+
+func TestParseImageID(t *testing.T) {
+	if args := strings.Join(inspectArgs("registry.example.com/app:v1"), " "); args != "inspect --format {{.Id}} registry.example.com/app:v1" {
+		t.Errorf("Unexpected inspect arguments %q", args)
+	}
+
+	id := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		output   string
+		expected string
+		hasError bool
+	}{
+		{"sha256:" + id + "\n", "sha256:" + id, false},
+		{id + "\n", "sha256:" + id, false}, // podman leaves out the algorithm
+		{"", "", true},
+		{"sha256:1234\n", "", true},
+		{"md5:" + id + "\n", "", true},
+		{"Error: no such image\n", "", true},
+	}
+	for _, test := range tests {
+		digest, err := parseImageID(test.output)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected an error for %q, got %s", test.output, digest)
+			}
+			continue
+		}
+		if err != nil || digest != test.expected {
+			t.Errorf("For %q, expected %s, got %s (%v)", test.output, test.expected, digest, err)
+		}
+	}
+}
+
+func TestParsePlatforms(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		hasError bool
+	}{
+		{"linux/amd64", []string{"linux/amd64"}, false},
+		{"linux/amd64,linux/arm64", []string{"linux/amd64", "linux/arm64"}, false},
+		{"linux/amd64, linux/arm/v7", []string{"linux/amd64", "linux/arm/v7"}, false},
+		{"", nil, true},
+		{"linux", nil, true},
+		{"linux/", nil, true},
+		{"linux/arm/v7/extra", nil, true},
+		{"linux/amd64,", nil, true},
+		{"linux/amd64,linux/amd64", nil, true},
+	}
+
+	for _, test := range tests {
+		platforms, err := parsePlatforms(test.input)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected an error for %q, got %v", test.input, platforms)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.input, err)
+		}
+		if strings.Join(platforms, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("For %q, expected %v, got %v", test.input, test.expected, platforms)
+		}
+	}
+
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1MB", "--platform", "linux/amd64,linux/arm64", "--push", "registry.example.com/multi:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(cfg.platforms) != 2 {
+		t.Errorf("Expected 2 platforms, got %v", cfg.platforms)
+	}
+}
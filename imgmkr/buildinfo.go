@@ -0,0 +1,62 @@
+package imgmkr
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Version is the imgmkr version recorded in build info. The imgmkr command sets it to its own
+// version, which is set at build time with -ldflags "-X main.version=...".
+var Version = "dev"
+
+// buildInfoLabel is the image label carrying the build info
+const buildInfoLabel = "dev.imgmkr.build-info"
+
+// buildInfo records how an image was made, so a test image can be traced back to its build
+type buildInfo struct {
+	Version    string            `json:"version"`
+	Args       []string          `json:"args"`              // Arguments exactly as given
+	Flags      map[string]string `json:"flags"`             // Resolved values of the flags that were set
+	RepoTag    string            `json:"repo_tag"`          // Image reference that was built
+	LayerSizes []int64           `json:"layer_sizes"`       // Resolved size of each layer in bytes
+	Seed       int64             `json:"seed,omitempty"`    // Base content seed, if the build was seeded
+	Created    *time.Time        `json:"created,omitempty"` // Build time, omitted with --deterministic
+}
+
+// setFlags returns the resolved values of the flags explicitly set on fs
+func setFlags(fs *flag.FlagSet) map[string]string {
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	return flags
+}
+
+// newBuildInfo collects the build info for a build of repoTag with the given resolved layer sizes.
+// The creation time is left out of deterministic builds so the info is reproducible.
+func newBuildInfo(cfg *buildConfig, repoTag string, sizes []int64, now time.Time) buildInfo {
+	info := buildInfo{
+		Version:    Version,
+		Args:       cfg.args,
+		Flags:      cfg.setFlags,
+		RepoTag:    repoTag,
+		LayerSizes: sizes,
+		Seed:       cfg.seed,
+	}
+	if !cfg.deterministic {
+		created := now.UTC()
+		info.Created = &created
+	}
+	return info
+}
+
+// JSON returns the build info as compact JSON, suitable for an image label
+func (info buildInfo) JSON() (string, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode build info: %w", err)
+	}
+	return string(data), nil
+}
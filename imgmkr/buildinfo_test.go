@@ -0,0 +1,83 @@
+package imgmkr
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestNewBuildInfo(t *testing.T) {
+	args := []string{"--random-layers", "3", "--random-max", "2MB", "--deterministic", "--build-info", "test:v1"}
+	cfg, repoTag, err := parseBuildArgs(args)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error generating layer sizes: %v", err)
+	}
+
+	info := newBuildInfo(cfg, repoTag, sizes, time.Now())
+	if info.Version != Version || info.RepoTag != "test:v1" || len(info.Args) != len(args) {
+		t.Errorf("Unexpected build info %+v", info)
+	}
+	if info.Flags["random-layers"] != "3" || info.Flags["random-max"] != "2MB" || info.Flags["deterministic"] != "true" {
+		t.Errorf("Expected the set flags to be recorded, got %v", info.Flags)
+	}
+	if _, ok := info.Flags["max-concurrent"]; ok {
+		t.Errorf("Expected flags left at their defaults to be omitted, got %v", info.Flags)
+	}
+	if len(info.LayerSizes) != 3 || info.LayerSizes[0] != sizes[0] {
+		t.Errorf("Expected the resolved layer sizes %v, got %v", sizes, info.LayerSizes)
+	}
+	if info.Seed == 0 || info.Seed != seedFromTag("test:v1") {
+		t.Errorf("Expected the seed derived from the tag, got %d", info.Seed)
+	}
+
+	// Deterministic builds leave out the time, so the info is reproducible
+	first, err := info.JSON()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding build info: %v", err)
+	}
+	second, _ := newBuildInfo(cfg, repoTag, sizes, time.Now().Add(time.Hour)).JSON()
+	if first != second || info.Created != nil {
+		t.Errorf("Expected identical build info for deterministic builds, got %s and %s", first, second)
+	}
+
+	cfg.deterministic = false
+	if info := newBuildInfo(cfg, repoTag, sizes, time.Now()); info.Created == nil {
+		t.Error("Expected a creation time for non-deterministic builds")
+	}
+}
+
+func TestBuildInfoLabel(t *testing.T) {
+	basePath := writeBaseTarball(t, 1)
+	outPath := filepath.Join(t.TempDir(), "labeled.tar")
+	err := RunBuild([]string{"--layer-sizes", "1KB+1KB,4KB", "--build-info", "--deterministic",
+		"--append-to-tar", basePath, "--output", outPath, "labeled:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error building: %v", err)
+	}
+
+	img, err := tarball.ImageFromPath(outPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to read image tarball: %v", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to read image config: %v", err)
+	}
+	var info buildInfo
+	if err := json.Unmarshal([]byte(cfg.Config.Labels[buildInfoLabel]), &info); err != nil {
+		t.Fatalf("Failed to decode %s label %q: %v", buildInfoLabel, cfg.Config.Labels[buildInfoLabel], err)
+	}
+	if info.RepoTag != "labeled:v1" || info.Flags["layer-sizes"] != "1KB+1KB,4KB" || info.Flags["output"] != outPath {
+		t.Errorf("Expected the label to record the build's spec, got %+v", info)
+	}
+	if len(info.LayerSizes) != 2 || info.LayerSizes[0] != 2048 || info.LayerSizes[1] != 4096 {
+		t.Errorf("Expected resolved layer sizes [2048 4096], got %v", info.LayerSizes)
+	}
+}
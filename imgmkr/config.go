@@ -0,0 +1,331 @@
+package imgmkr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/jlbutler/imgmkr/mockfs"
+	"github.com/jlbutler/imgmkr/size"
+	"github.com/jlbutler/imgmkr/whiteout"
+	"gopkg.in/yaml.v3"
+)
+
+// rawSize is a size as written in a config file, kept as a string until the file is checked so
+// a bad size is reported with the file's other errors
+type rawSize struct {
+	value string
+	line  int
+}
+
+// UnmarshalYAML decodes a size written as a scalar
+func (s *rawSize) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: expected a size, got a %s", node.Line, kindName(node.Kind))}}
+	}
+	*s = rawSize{value: node.Value, line: node.Line}
+	return nil
+}
+
+// rawSizes is a config file's layer_sizes: a list of sizes, or a comma-separated string of them,
+// in any form --layer-sizes accepts (e.g. 512MB or "512MB x 4")
+type rawSizes struct {
+	sizes []rawSize
+	list  bool // Whether the sizes were written as a list rather than a single string
+}
+
+// UnmarshalYAML decodes sizes written as a list or a comma-separated string
+func (s *rawSizes) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*s = rawSizes{sizes: []rawSize{{value: node.Value, line: node.Line}}}
+		return nil
+	case yaml.SequenceNode:
+		var sizes []rawSize
+		if err := node.Decode(&sizes); err != nil {
+			return err
+		}
+		*s = rawSizes{sizes: sizes, list: true}
+		return nil
+	}
+	return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: layer_sizes: expected a list of sizes, got a %s", node.Line, kindName(node.Kind))}}
+}
+
+// path returns the field path of the size at index i, for errors
+func (s rawSizes) path(i int) string {
+	if !s.list {
+		return "layer_sizes"
+	}
+	return fmt.Sprintf("layer_sizes[%d]", i)
+}
+
+// configLayer is an entry in a config file's layers list, giving one or more layers' size and
+// content mode
+type configLayer struct {
+	Size rawSize `yaml:"size"` // In any form --layer-sizes accepts, so "1GB x 2" gives two layers
+	Mode string  `yaml:"mode"` // "file" or "mockfs" ("" = per mock_fs)
+}
+
+// kindName returns a readable name for a YAML node kind, for errors
+func kindName(kind yaml.Kind) string {
+	switch kind {
+	case yaml.MappingNode:
+		return "mapping"
+	case yaml.SequenceNode:
+		return "list"
+	default:
+		return "scalar"
+	}
+}
+
+// configFile is a --config file: a Config, with the fields written as the build command's flags
+// take them decoded as strings and parsed when the file is checked
+type configFile struct {
+	Config       `yaml:",inline"`
+	LayerSizes   rawSizes      `yaml:"layer_sizes"`
+	Layers       []configLayer `yaml:"layers"`    // Instead of layer_sizes and layer_modes
+	SizeBase     string        `yaml:"size_base"` // binary or decimal, for the file's sizes and the command line's
+	MaxTotalSize string        `yaml:"max_total_size"`
+	MaxMemory    string        `yaml:"max_memory"`
+	WriteRate    string        `yaml:"write_rate"`
+	DictSize     string        `yaml:"dict_size"`
+	FileMode     string        `yaml:"file_mode"`
+	DirMode      string        `yaml:"dir_mode"`
+	Deletes      []string      `yaml:"deletes"` // As <layer>:<path>
+}
+
+// check parses the file's string fields into its Config and validates it, reporting every bad
+// field by its path, e.g. layers[2].size
+func (f *configFile) check() error {
+	var errs []error
+	bad := func(field string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", field, err))
+	}
+	badSize := func(field string, raw rawSize, err error) {
+		errs = append(errs, fmt.Errorf("line %d: %s: %w", raw.line, field, err))
+	}
+
+	// Read the file's sizes in its size base
+	base := int64(size.Binary)
+	if f.SizeBase != "" {
+		parsed, err := size.ParseBase(f.SizeBase)
+		if err != nil {
+			bad("size_base", err)
+		} else {
+			base, f.Config.SizeBase = parsed, parsed
+		}
+	}
+	sizeField := func(field, value string, dst *int64) {
+		if value == "" {
+			return
+		}
+		parsed, err := size.ParseWithBase(value, base)
+		if err != nil {
+			bad(field, err)
+			return
+		}
+		*dst = parsed
+	}
+	modeField := func(field, value string, dst *os.FileMode) {
+		if value == "" {
+			return
+		}
+		mode, err := mockfs.ParseMode(value)
+		if err != nil {
+			bad(field, err)
+			return
+		}
+		*dst = mode
+	}
+
+	// Parse the layer sizes, leaving them unset if any is bad so only the bad ones are reported
+	var sizes []int64
+	var modes []string
+	sizesOK := true
+	switch {
+	case len(f.Layers) > 0 && (len(f.LayerSizes.sizes) > 0 || len(f.Config.LayerModes) > 0):
+		bad("layers", fmt.Errorf("cannot be combined with layer_sizes or layer_modes"))
+		sizesOK = false
+	case len(f.Layers) > 0:
+		for i, layer := range f.Layers {
+			path := fmt.Sprintf("layers[%d]", i)
+			mode := layer.Mode
+			if _, ok := layerModeSuffixes[mode]; !ok && mode != "" {
+				bad(path+".mode", fmt.Errorf("unknown layer mode %q: must be file or mockfs", mode))
+				mode = ""
+			}
+			if layer.Size.value == "" {
+				bad(path+".size", fmt.Errorf("required"))
+				sizesOK = false
+				continue
+			}
+			parsed, err := size.ParseListWithBase(layer.Size.value, base)
+			if err != nil {
+				badSize(path+".size", layer.Size, err)
+				sizesOK = false
+				continue
+			}
+			for range parsed {
+				modes = append(modes, mode)
+			}
+			sizes = append(sizes, parsed...)
+		}
+	default:
+		for i, raw := range f.LayerSizes.sizes {
+			parsed, err := size.ParseListWithBase(raw.value, base)
+			if err != nil {
+				badSize(f.LayerSizes.path(i), raw, err)
+				sizesOK = false
+				continue
+			}
+			sizes = append(sizes, parsed...)
+		}
+		modes = f.Config.LayerModes
+	}
+	if sizesOK {
+		f.Config.LayerSizes, f.Config.LayerModes = sizes, modes
+	} else {
+		f.Config.LayerSizes, f.Config.LayerModes = nil, nil
+	}
+
+	sizeField("max_total_size", f.MaxTotalSize, &f.Config.MaxTotalSize)
+	sizeField("max_memory", f.MaxMemory, &f.Config.MaxMemory)
+	sizeField("dict_size", f.DictSize, &f.Config.DictSize)
+	if f.WriteRate != "" {
+		rate, err := size.ParseRateWithBase(f.WriteRate, base)
+		if err != nil {
+			bad("write_rate", err)
+		}
+		f.Config.WriteRate = rate
+	}
+	modeField("file_mode", f.FileMode, &f.Config.FileMode)
+	modeField("dir_mode", f.DirMode, &f.Config.DirMode)
+	for i, value := range f.Deletes {
+		spec, err := whiteout.ParseSpec(value)
+		if err != nil {
+			bad(fmt.Sprintf("deletes[%d]", i), err)
+			continue
+		}
+		f.Config.Deletes = append(f.Config.Deletes, spec)
+	}
+	return errors.Join(append(errs, f.Config.check())...)
+}
+
+// readConfigFile reads the --config file at path, which may be YAML or JSON, and checks its fields
+func readConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var file configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	// Fields of the wrong type or unknown to imgmkr are reported with the bad values, so every
+	// error in the file is reported at once
+	var errs []error
+	var typeErr *yaml.TypeError
+	err = dec.Decode(&file)
+	switch {
+	case errors.As(err, &typeErr):
+		for _, msg := range typeErr.Errors {
+			errs = append(errs, errors.New(msg))
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := errors.Join(append(errs, file.check())...); err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%w", path, err)
+	}
+	cfg := file.Config
+	cfg.path = path
+	return &cfg, nil
+}
+
+// check validates the fields of a config read from a file, naming each bad field. Combinations
+// of settings are checked once they are merged with the command line.
+func (c *Config) check() error {
+	var errs []error
+	bad := func(field string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", field, err))
+	}
+	for _, tag := range append([]string{c.Tag}, c.ExtraTags...) {
+		if _, err := name.NewTag(tag); tag != "" && err != nil {
+			bad("tag", fmt.Errorf("invalid tag %q: %w", tag, err))
+		}
+	}
+	if c.Tag == "" && len(c.ExtraTags) > 0 {
+		bad("extra_tags", fmt.Errorf("requires tag"))
+	}
+	if len(c.LayerSizes) > 0 && len(c.LayerModes) > len(c.LayerSizes) {
+		bad("layer_modes", fmt.Errorf("has %d modes for %d layers", len(c.LayerModes), len(c.LayerSizes)))
+	}
+	for _, mode := range c.LayerModes {
+		if _, ok := layerModeSuffixes[mode]; !ok && mode != "" {
+			bad("layer_modes", fmt.Errorf("unknown layer mode %q: must be file or mockfs", mode))
+		}
+	}
+	if c.SizeBase != 0 && c.SizeBase != size.Binary && c.SizeBase != size.Decimal {
+		bad("size_base", fmt.Errorf("must be %d (binary) or %d (decimal), got %d", size.Binary, size.Decimal, c.SizeBase))
+	}
+	caps := []struct {
+		field string
+		value int64
+	}{{"max_total_size", c.MaxTotalSize}, {"max_memory", c.MaxMemory}, {"write_rate", c.WriteRate}}
+	for _, limit := range caps {
+		if limit.value < 0 {
+			bad(limit.field, fmt.Errorf("must be at least 0 (no cap), got %d", limit.value))
+		}
+	}
+	if c.DictSize < 0 || c.DictSize > maxDictSize {
+		bad("dict_size", fmt.Errorf("must be between 0 (random data) and %s, got %d", size.Format(maxDictSize), c.DictSize))
+	}
+	if c.MaxConcurrent < 0 {
+		bad("max_concurrent", fmt.Errorf("must be at least 0 (automatic), got %d", c.MaxConcurrent))
+	}
+	if c.Timeout < 0 {
+		bad("timeout", fmt.Errorf("must be at least 0 (no limit), got %s", c.Timeout))
+	}
+	if c.Retries < 0 {
+		bad("retries", fmt.Errorf("must be at least 0, got %d", c.Retries))
+	}
+	if c.Profile != "" {
+		if _, err := mockfs.LookupProfile(c.Profile); err != nil {
+			bad("profile", err)
+		}
+	}
+	switch c.Fill {
+	case "", fillRandom, fillPrecompressed, fillZero, fillText:
+	default:
+		bad("fill", fmt.Errorf("invalid fill %q: must be %s, %s, %s, or %s", c.Fill, fillRandom, fillPrecompressed, fillZero, fillText))
+	}
+	if c.BaseImage != "" {
+		if err := checkBaseImage(c.BaseImage); err != nil {
+			bad("base_image", fmt.Errorf("invalid base image %q: %w", c.BaseImage, err))
+		}
+	}
+	if c.Builder != "" {
+		if err := checkBuilderName(c.Builder); err != nil {
+			bad("builder", err)
+		}
+	}
+	if len(c.Platforms) > 0 {
+		if _, err := parsePlatforms(strings.Join(c.Platforms, ",")); err != nil {
+			bad("platforms", err)
+		}
+	}
+	for key := range c.Labels {
+		if key == "" {
+			bad("labels", fmt.Errorf("label keys cannot be empty"))
+		}
+	}
+	for key := range c.Env {
+		if key == "" {
+			bad("env", fmt.Errorf("variable names cannot be empty"))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,224 @@
+package imgmkr
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// writeConfig writes a config file with the given contents and returns its path
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+const sampleConfig = `
+tag: app:v1
+extra_tags: [app:latest]
+layer_sizes: [10MB, "1KB x 2", 512]
+max_concurrent: 3
+mock_fs: true
+max_depth: 4
+base_image: alpine:3.20
+builder: docker
+labels:
+  tier: test
+  owner: ci
+retries: 2
+max_memory: 256MB
+file_mode: "0600"
+deletes: ["2:/layer1/a"]
+`
+
+func TestConfigFile(t *testing.T) {
+	path := writeConfig(t, "build.yaml", sampleConfig)
+	cfg, repoTag, err := parseBuildFlags([]string{"--config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if repoTag != "app:v1" || !reflect.DeepEqual(cfg.extraTags, []string{"app:latest"}) {
+		t.Errorf("Expected tags app:v1 and app:latest, got %s and %v", repoTag, cfg.extraTags)
+	}
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error parsing layer sizes: %v", err)
+	}
+	if !reflect.DeepEqual(sizes, []int64{10 << 20, 1024, 1024, 512}) {
+		t.Errorf("Unexpected layer sizes %v", sizes)
+	}
+	if cfg.maxConcurrent != 3 || !cfg.mockFS || cfg.maxDepth != 4 || cfg.baseImage != "alpine:3.20" || cfg.builder != "docker" || cfg.retries != 2 {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+	if labels := cfg.labels.Map(); !reflect.DeepEqual(labels, map[string]string{"tier": "test", "owner": "ci"}) {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if cfg.maxMemory != 256<<20 || cfg.fileMode != 0600 || len(cfg.deletes) != 1 || cfg.deletes[0].Layer != 2 {
+		t.Errorf("Expected the sizes, modes, and deletes written as strings to be parsed, got %+v", cfg)
+	}
+
+	// Flags on the command line override the file, and tags replace its tags
+	cfg, repoTag, err = parseBuildFlags([]string{"--config", path, "--max-depth", "2", "--label", "tier=prod", "--random-layers", "2", "other:v2"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if repoTag != "other:v2" || len(cfg.extraTags) != 0 {
+		t.Errorf("Expected only the tag other:v2, got %s and %v", repoTag, cfg.extraTags)
+	}
+	if cfg.maxDepth != 2 || cfg.randomLayers != 2 || cfg.sizeList != nil {
+		t.Errorf("Expected the command line's depth and random layers, got %+v", cfg)
+	}
+	if cfg.maxConcurrent != 3 || cfg.baseImage != "alpine:3.20" {
+		t.Errorf("Expected the file's other settings to be kept, got %+v", cfg)
+	}
+	if labels := cfg.labels.Map(); labels["tier"] != "prod" || labels["owner"] != "ci" {
+		t.Errorf("Expected the command line's label to override the file's, got %v", labels)
+	}
+}
+
+func TestConfigFileJSON(t *testing.T) {
+	path := writeConfig(t, "build.json", `{"tag": "app:v1", "layer_sizes": "4KB,8KB", "layer_modes": ["", "mockfs"], "fill": "zero", "output": "none"}`)
+	cfg, repoTag, err := parseBuildFlags([]string{"--config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if repoTag != "app:v1" || !reflect.DeepEqual(cfg.sizeList, []int64{4096, 8192}) || cfg.fill != fillZero || cfg.output != outputNone {
+		t.Errorf("Unexpected config %+v for %s", cfg, repoTag)
+	}
+	if cfg.layerMode(1) != contentModeSingleFile || cfg.layerMode(2) != contentModeMockFS {
+		t.Errorf("Expected a single-file layer and a mock filesystem layer, got modes %q", cfg.layerModes)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		contents string
+		args     []string
+		want     []string
+	}{
+		{"tag: app:v1\nlayer_size: [1MB]\n", nil, []string{"line 2", "layer_size not found"}},
+		{"tag: app:v1\nlayer_sizes:\n  - 1MB\n  - 2XB\n", nil, []string{"line 4: layer_sizes[1]: invalid size format: 2XB"}},
+		{"tag: app:v1\nlayer_sizes: 1MB,2XB\n", nil, []string{"line 2: layer_sizes: invalid size format: 2XB"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nlayers: [{size: 1MB}]\n", nil, []string{"layers: cannot be combined with layer_sizes"}},
+		{"tag: app:v1\nlayers: [{mode: file}]\n", nil, []string{"layers[0].size: required"}},
+		{"tag: app:v1\nlayer_sizes: {a: 1}\n", nil, []string{"line 2", "expected a list of sizes"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nfill: ones\nmax_concurrent: -1\n", nil, []string{"fill: invalid fill", "max_concurrent: must be at least 0"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nbuilder: kaniko\nbase_image: ':'\n", nil, []string{"builder:", "base_image:"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nlayer_modes: [tree, file]\n", nil, []string{"layer_modes: has 2 modes for 1 layers", `layer_modes: unknown layer mode "tree"`}},
+		{"tag: App:V1\nlayer_sizes: [1MB]\n", nil, []string{"tag: invalid tag"}},
+		{"layer_sizes: [1MB]\n", nil, []string{"tag in config file"}},
+		{"tag: app:v1\n", nil, []string{"layer_sizes in config file"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nflags: [--retries, 2]\n", nil, []string{"field flags not found"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nmax_memory: lots\nfile_mode: rw\ndeletes: [/a]\n", nil, []string{"max_memory: invalid size format: lots", "file_mode: invalid mode", "deletes[0]:"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nretries: -1\nplatforms: [linux]\n", nil, []string{"retries: must be at least 0", "platforms: invalid platform"}},
+		{"tag: app:v1\nlayer_sizes: [1MB]\nsize_base: si\n", nil, []string{`size_base: unknown size base "si"`}},
+	}
+	for _, test := range tests {
+		path := writeConfig(t, "build.yaml", test.contents)
+		_, _, err := parseBuildFlags(append([]string{"--config", path}, test.args...), flag.ContinueOnError)
+		if err == nil {
+			t.Errorf("Config %q: expected an error", test.contents)
+			continue
+		}
+		for _, want := range append(test.want, path) {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Config %q: expected %q in error %q", test.contents, want, err)
+			}
+		}
+	}
+
+	if _, _, err := parseBuildFlags([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}, flag.ContinueOnError); err == nil {
+		t.Error("Expected an error for a missing config file")
+	}
+}
+
+func TestConfigFileLayers(t *testing.T) {
+	path := writeConfig(t, "build.yaml", `
+tag: app:v1
+layers:
+  - size: 1GB
+    mode: file
+  - size: "4KB x 2"
+    mode: mockfs
+  - size: 512
+`)
+	cfg, _, err := parseBuildFlags([]string{"--config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.sizeList, []int64{1 << 30, 4096, 4096, 512}) {
+		t.Errorf("Unexpected layer sizes %v", cfg.sizeList)
+	}
+	if !reflect.DeepEqual(cfg.layerModes, []string{contentModeSingleFile, contentModeMockFS, contentModeMockFS, ""}) {
+		t.Errorf("Unexpected layer modes %q", cfg.layerModes)
+	}
+}
+
+func TestConfigFileSizeBase(t *testing.T) {
+	path := writeConfig(t, "build.yaml", "tag: app:v1\nsize_base: decimal\nlayer_sizes: [1MB, 1MiB]\nmax_memory: 1GB\n")
+	cfg, _, err := parseBuildFlags([]string{"--config", path, "--write-rate", "10MB/s"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.sizeList, []int64{1000000, 1 << 20}) || cfg.maxMemory != 1000000000 {
+		t.Errorf("Expected the file's sizes to be decimal, got %v and max_memory %d", cfg.sizeList, cfg.maxMemory)
+	}
+	if cfg.writeRate != 10000000 {
+		t.Errorf("Expected the command line's sizes to follow the file's base, got --write-rate %d", cfg.writeRate)
+	}
+
+	// --size-base overrides the file's base for the command line's sizes only
+	cfg, _, err = parseBuildFlags([]string{"--write-rate", "10MB/s", "--config", path, "--size-base", "binary"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.writeRate != 10<<20 || cfg.maxMemory != 1000000000 {
+		t.Errorf("Expected a binary --write-rate and the file's decimal max_memory, got %d and %d", cfg.writeRate, cfg.maxMemory)
+	}
+}
+
+func TestConfigFileReportsAllErrors(t *testing.T) {
+	path := writeConfig(t, "build.yaml", `
+tag: app:v1
+layers:
+  - size: 1MB
+  - size: 2MB
+  - size: 5XB
+  - size: 1MB
+    mode: tree
+max_concurrent: many
+fill: ones
+max_memory: 12QB
+no_such_field: true
+`)
+	_, _, err := parseBuildFlags([]string{"--config", path}, flag.ContinueOnError)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{
+		"line 6: layers[2].size: invalid size format: 5XB",
+		`layers[3].mode: unknown layer mode "tree"`,
+		"line 9: cannot unmarshal !!str `many` into int",
+		"line 12: field no_such_field not found",
+		`fill: invalid fill "ones"`,
+		"max_memory: invalid size format: 12QB",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in error:\n%v", want, err)
+		}
+	}
+
+	// The size errors keep their type
+	if !errors.Is(err, size.ErrUnknownUnit) {
+		t.Errorf("Expected the size errors to wrap size.ErrUnknownUnit, got %v", err)
+	}
+}
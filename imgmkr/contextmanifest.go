@@ -0,0 +1,113 @@
+package imgmkr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/jlbutler/imgmkr/manifest"
+)
+
+// contextLayerMediaType is the OCI media type of an uncompressed layer tar
+const contextLayerMediaType = "application/vnd.oci.image.layer.v1.tar"
+
+// contextManifest describes the layer directories of a build context for --manifest-out, shaped
+// like an OCI image manifest. Unlike the layer manifest written by --manifest-file, which digests
+// the generated files, it describes each layer as the tar an image would hold.
+type contextManifest struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	Layers        []contextLayer `json:"layers"`
+}
+
+// contextLayer describes one layer directory like an OCI layer descriptor, with the sizes it was
+// generated with
+type contextLayer struct {
+	MediaType     string `json:"mediaType"`
+	Digest        string `json:"digest,omitempty"` // sha256 of the layer's tar, as --output writes it (omitted without digests)
+	Size          int64  `json:"size,omitempty"`   // Size of the layer's tar in bytes (omitted without digests)
+	Directory     string `json:"directory"`        // Layer directory, relative to the build context
+	RequestedSize int64  `json:"requestedSize"`
+	ActualSize    int64  `json:"actualSize"` // Total size of the layer's generated files
+}
+
+// newContextManifest describes the directory in buildDir of each generated layer. With digests,
+// each directory is tarred as --output would write it and digested, up to maxWorkers at once,
+// stopping once ctx is done.
+func newContextManifest(ctx context.Context, buildDir string, layers []manifest.Layer, opts tarOptions, digests bool, maxWorkers int) (contextManifest, error) {
+	dirs := layerDirs(buildDir, len(layers))
+	m := contextManifest{SchemaVersion: 2, Layers: make([]contextLayer, len(layers))}
+	for i, layer := range layers {
+		m.Layers[i] = contextLayer{
+			MediaType:     contextLayerMediaType,
+			Directory:     filepath.Base(dirs[i]),
+			RequestedSize: layer.RequestedSize,
+			ActualSize:    layer.ActualSize,
+		}
+	}
+	if !digests {
+		return m, nil
+	}
+
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	errs := make([]error, len(layers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < maxWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if errs[i] = ctx.Err(); errs[i] != nil {
+					continue
+				}
+				digest, size, err := tarDigest(dirs[i], opts)
+				if err != nil {
+					errs[i] = fmt.Errorf("failed to digest %s: %w", dirs[i], err)
+					continue
+				}
+				m.Layers[i].Digest, m.Layers[i].Size = digest.String(), size
+			}
+		}()
+	}
+	for i := range layers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return contextManifest{}, err
+		}
+	}
+	return m, nil
+}
+
+// tarDigest streams layerDir through writeLayerTar and returns the sha256 and size of the tar
+func tarDigest(layerDir string, opts tarOptions) (v1.Hash, int64, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(writeLayerTar(pw, layerDir, opts))
+	}()
+	return v1.SHA256(pr)
+}
+
+// writeContextManifest writes m as indented JSON to path
+func writeContextManifest(path string, m contextManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode layer descriptions: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write layer descriptions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package imgmkr
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+func TestContextManifest(t *testing.T) {
+	cfg := &buildConfig{maxConcurrent: 2, maxDepth: 3}
+	buildDir := t.TempDir()
+	sizes := []int64{4 * size.KB, 64 * size.KB, 1 * size.MB}
+	layers, err := createLayersConcurrently(context.Background(), buildDir, sizes, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating layers: %v", err)
+	}
+
+	m, err := newContextManifest(context.Background(), buildDir, layers, cfg.tarOptions(), true, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.SchemaVersion != 2 || len(m.Layers) != len(sizes) {
+		t.Fatalf("Expected a schema 2 manifest with %d layers, got %+v", len(sizes), m)
+	}
+	for i, layer := range m.Layers {
+		if layer.MediaType != contextLayerMediaType || layer.Directory != filepath.Base(layerDirs(buildDir, len(sizes))[i]) {
+			t.Errorf("Layer %d: unexpected media type or directory in %+v", i+1, layer)
+		}
+		if layer.RequestedSize != sizes[i] || layer.ActualSize == 0 {
+			t.Errorf("Layer %d: expected requested size %d and a nonzero actual size, got %+v", i+1, sizes[i], layer)
+		}
+		// A tar holds its files plus headers and padding
+		if !digestPattern.MatchString(layer.Digest) || layer.Size <= layer.ActualSize {
+			t.Errorf("Layer %d: expected a sha256 digest and a tar larger than its files, got %+v", i+1, layer)
+		}
+	}
+
+	// The digest is the diff ID of the layer an --output image would hold
+	image, err := layerFromDir(filepath.Join(buildDir, "layer1"), cfg.tarOptions())
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	if diffID, err := image.DiffID(); err != nil || diffID.String() != m.Layers[0].Digest {
+		t.Errorf("Expected digest %s to match the layer's diff ID %s", m.Layers[0].Digest, diffID)
+	}
+
+	// Without digests the layers aren't read back
+	m, err = newContextManifest(context.Background(), buildDir, layers, cfg.tarOptions(), false, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(m.Layers) != len(sizes) || m.Layers[0].Digest != "" || m.Layers[0].Size != 0 {
+		t.Errorf("Expected layers without digests, got %+v", m.Layers)
+	}
+
+	// Digesting stops once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := newContextManifest(ctx, buildDir, layers, cfg.tarOptions(), true, 2); err == nil {
+		t.Error("Expected an error with a canceled context")
+	}
+}
+
+func TestManifestOutFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layers.json")
+	stdout := captureStdout(t, func() {
+		if err := RunBuild([]string{"--layer-sizes", "4KB,8KB:mockfs", "--manifest-out", path, "--dry-run", "--quiet", "--tmpdir-prefix", t.TempDir(), "described:v1"}); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+	if stdout == "" {
+		t.Error("Expected the build directory to be printed")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected --manifest-out to be written: %v", err)
+	}
+	var m contextManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("--manifest-out is not valid JSON: %v", err)
+	}
+	if len(m.Layers) != 2 || m.Layers[1].Directory != "layer2" || m.Layers[1].RequestedSize != 8*size.KB {
+		t.Fatalf("Unexpected layers in %s", data)
+	}
+	for i, layer := range m.Layers {
+		if layer.ActualSize == 0 || layer.Size == 0 || !digestPattern.MatchString(layer.Digest) {
+			t.Errorf("Layer %d: expected nonzero sizes and a digest, got %+v", i+1, layer)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package imgmkr
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// scratchImage is the empty base image generated layers are built on by default
+const scratchImage = "scratch"
+
+// Instructions for adding each layer directory, as given to --copy-instruction
+const (
+	instructionCopy = "copy"
+	instructionAdd  = "add" // Also extracts local tarballs and fetches URLs
+)
+
+// dockerfileOptions controls the generated Dockerfile
+type dockerfileOptions struct {
+	baseImage   string     // Image the layers are added on top of (empty = scratch)
+	instruction string     // Instruction adding each layer: instructionCopy or instructionAdd (empty = copy)
+	labels      []keyValue // Labels to set on the image, in order
+	env         []keyValue // Environment variables to set in the image, in order
+	entrypoint  []string   // Entrypoint in exec form (nil = inherited from the base image)
+	cmd         []string   // Default command in exec form (nil = inherited, unless entrypoint is set)
+	squash      bool       // Add the single squashDir directory instead of each layer
+}
+
+// keyValue is a key=value pair given as a --label or --env
+type keyValue struct {
+	key   string
+	value string
+}
+
+// String returns the pair as key=value
+func (kv keyValue) String() string {
+	return kv.key + "=" + kv.value
+}
+
+// parseKeyValue parses a --label or --env value of the form key=value; the value may be empty
+func parseKeyValue(s string) (keyValue, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return keyValue{}, fmt.Errorf("expected key=value, got %q", s)
+	}
+	if key == "" {
+		return keyValue{}, fmt.Errorf("key cannot be empty in %q", s)
+	}
+	if strings.ContainsAny(key, " \t\r\n\"'\\$") {
+		return keyValue{}, fmt.Errorf("key in %q cannot contain whitespace, quotes, backslashes, or '$'", s)
+	}
+	return keyValue{key: key, value: value}, nil
+}
+
+// parseCommand parses a --cmd or --entrypoint value, either a JSON array of arguments or a
+// command line split on whitespace
+func parseCommand(s string) ([]string, error) {
+	var args []string
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		if err := json.Unmarshal([]byte(s), &args); err != nil {
+			return nil, fmt.Errorf("invalid JSON array %q: %w", s, err)
+		}
+	} else {
+		args = strings.Fields(s)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("command cannot be empty")
+	}
+	return args, nil
+}
+
+// execForm returns args as a JSON array, the exec form of CMD and ENTRYPOINT
+func execForm(args []string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	// Encoding a []string cannot fail
+	_ = enc.Encode(args)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// dockerfileOptions returns the Dockerfile options for the build
+func (cfg *buildConfig) dockerfileOptions() dockerfileOptions {
+	return dockerfileOptions{
+		baseImage:   cfg.baseImage,
+		instruction: cfg.copyInstruction,
+		labels:      cfg.labels,
+		env:         cfg.env,
+		entrypoint:  cfg.entrypoint,
+		cmd:         cfg.cmd,
+		squash:      cfg.squash,
+	}
+}
+
+// checkBaseImage checks that a --base-image value is scratch or parses as an image reference
+func checkBaseImage(baseImage string) error {
+	if baseImage == "" {
+		return fmt.Errorf("base image cannot be empty")
+	}
+	if baseImage == scratchImage {
+		return nil
+	}
+	if _, err := name.ParseReference(baseImage); err != nil {
+		return err
+	}
+	return nil
+}
+
+// renderDockerfile returns the contents of a Dockerfile that copies each layer on top of the base
+// image and sets the given labels, environment, entrypoint, and command
+func renderDockerfile(numLayers int, opts dockerfileOptions) string {
+	var b strings.Builder
+
+	// Start with the base image, scratch unless another was given
+	baseImage := opts.baseImage
+	if baseImage == "" {
+		baseImage = scratchImage
+	}
+	fmt.Fprintf(&b, "FROM %s\n", baseImage)
+
+	// Label the image, in the order the labels were given, quoting values so they can hold spaces
+	for _, label := range opts.labels {
+		fmt.Fprintf(&b, "LABEL %s=\"%s\"\n", label.key, dockerfileEscaper.Replace(label.value))
+	}
+
+	// Set the environment the same way
+	for _, env := range opts.env {
+		fmt.Fprintf(&b, "ENV %s=\"%s\"\n", env.key, dockerfileEscaper.Replace(env.value))
+	}
+
+	// Add each layer, or the squashed layers as one, with COPY unless ADD was asked for
+	instruction := "COPY"
+	if opts.instruction == instructionAdd {
+		instruction = "ADD"
+	}
+	if opts.squash {
+		fmt.Fprintf(&b, "%s %s /\n", instruction, squashDir)
+	} else {
+		for i := 1; i <= numLayers; i++ {
+			fmt.Fprintf(&b, "%s layer%d /\n", instruction, i)
+		}
+	}
+
+	// Set what the image runs, in exec form so arguments are passed as given without a shell
+	if opts.entrypoint != nil {
+		fmt.Fprintf(&b, "ENTRYPOINT %s\n", execForm(opts.entrypoint))
+	}
+	if opts.cmd != nil {
+		fmt.Fprintf(&b, "CMD %s\n", execForm(opts.cmd))
+	}
+
+	return b.String()
+}
+
+// dockerfileEscaper escapes a value for a double-quoted Dockerfile string, including '$' so the
+// builder does not expand it as a variable
+var dockerfileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+
+// createDockerfile creates a Dockerfile in buildDir as renderDockerfile describes
+func createDockerfile(buildDir string, numLayers int, opts dockerfileOptions) error {
+	dockerfilePath := filepath.Join(buildDir, "Dockerfile")
+	err := os.WriteFile(dockerfilePath, []byte(renderDockerfile(numLayers, opts)), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create Dockerfile: %w", err)
+	}
+	return nil
+}
+
+// renderDockerignore returns the contents of a .dockerignore that leaves everything but the layer
+// directories (or the squashed directory) out of the build context, so the Dockerfile, layer
+// manifest, and anything else in the build directory aren't sent to the builder
+func renderDockerignore(numLayers int, squash bool) string {
+	var b strings.Builder
+	b.WriteString("# Generated by imgmkr: only the layer directories are part of the build context\n*\n")
+	if squash {
+		fmt.Fprintf(&b, "!%s\n", squashDir)
+	} else {
+		for i := 1; i <= numLayers; i++ {
+			fmt.Fprintf(&b, "!layer%d\n", i)
+		}
+	}
+	return b.String()
+}
+
+// createDockerignore creates a .dockerignore in buildDir as renderDockerignore describes
+func createDockerignore(buildDir string, numLayers int, squash bool) error {
+	err := os.WriteFile(filepath.Join(buildDir, ".dockerignore"), []byte(renderDockerignore(numLayers, squash)), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create .dockerignore: %w", err)
+	}
+	return nil
+}
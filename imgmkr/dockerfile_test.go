@@ -0,0 +1,257 @@
+package imgmkr
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderDockerfile(t *testing.T) {
+	expected := "FROM scratch\nCOPY layer1 /\nCOPY layer2 /\n"
+	if dockerfile := renderDockerfile(2, dockerfileOptions{}); dockerfile != expected {
+		t.Errorf("Expected Dockerfile %q, got %q", expected, dockerfile)
+	}
+}
+
+func TestRenderDockerfileInstruction(t *testing.T) {
+	for _, test := range []struct {
+		flag     string
+		expected string
+	}{
+		{instructionCopy, "COPY"},
+		{instructionAdd, "ADD"},
+	} {
+		cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1KB,1KB,1KB", "--copy-instruction", test.flag, "test:v1"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(renderDockerfile(3, cfg.dockerfileOptions())), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("Expected FROM and 3 layer lines, got %q", lines)
+		}
+		for i, line := range lines[1:] {
+			if want := fmt.Sprintf("%s layer%d /", test.expected, i+1); line != want {
+				t.Errorf("For --copy-instruction %s, expected %q, got %q", test.flag, want, line)
+			}
+		}
+	}
+
+	if _, _, err := parseBuildArgs([]string{"--layer-sizes", "1KB", "--copy-instruction", "move", "test:v1"}); err == nil {
+		t.Error("Expected an error for --copy-instruction move")
+	}
+}
+
+func TestRenderDockerfileSquash(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1KB,2KB,3KB", "--squash", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dockerfile := renderDockerfile(3, cfg.dockerfileOptions())
+	if expected := "FROM scratch\nCOPY squashed /\n"; dockerfile != expected {
+		t.Errorf("Expected Dockerfile %q, got %q", expected, dockerfile)
+	}
+	adds := 0
+	for _, line := range strings.Split(dockerfile, "\n") {
+		if strings.HasPrefix(line, "COPY ") || strings.HasPrefix(line, "ADD ") {
+			adds++
+		}
+	}
+	if adds != 1 {
+		t.Errorf("Expected exactly one COPY or ADD, got %d", adds)
+	}
+}
+
+func TestRenderDockerfileLabels(t *testing.T) {
+	labels := []keyValue{
+		{key: "b.label", value: `{"args":["--write-rate","$RATE"],"note":"a \"quoted\" \\ value"}`},
+		{key: "a.label", value: "plain"},
+	}
+	expected := "FROM scratch\n" +
+		`LABEL b.label="{\"args\":[\"--write-rate\",\"\$RATE\"],\"note\":\"a \\\"quoted\\\" \\\\ value\"}"` + "\n" +
+		"LABEL a.label=\"plain\"\n" +
+		"COPY layer1 /\n"
+	if dockerfile := renderDockerfile(1, dockerfileOptions{labels: labels}); dockerfile != expected {
+		t.Errorf("Expected Dockerfile %q, got %q", expected, dockerfile)
+	}
+}
+
+func TestCreateDockerfileLabelFlags(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1KB", "--label", "purpose=load test", "--label", "imgmkr.version=1.2", "--label", "empty=", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dir := t.TempDir()
+	if err := createDockerfile(dir, 1, cfg.dockerfileOptions()); err != nil {
+		t.Fatalf("Failed to create Dockerfile: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "Dockerfile"))
+	if err != nil {
+		t.Fatalf("Failed to read Dockerfile: %v", err)
+	}
+	expected := "FROM scratch\n" +
+		"LABEL purpose=\"load test\"\n" +
+		"LABEL imgmkr.version=\"1.2\"\n" +
+		"LABEL empty=\"\"\n" +
+		"COPY layer1 /\n"
+	if string(data) != expected {
+		t.Errorf("Expected Dockerfile %q, got %q", expected, data)
+	}
+
+	for _, label := range []string{"novalue", "=value", "has space=value", `quote"d=value`} {
+		if _, _, err := parseBuildFlags([]string{"--layer-sizes", "1KB", "--label", label, "test:v1"}, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for --label %q", label)
+		}
+	}
+}
+
+func TestRenderDockerfileConfig(t *testing.T) {
+	opts := dockerfileOptions{
+		baseImage:  "alpine:3.19",
+		env:        []keyValue{{key: "GREETING", value: "hello $USER"}, {key: "EMPTY"}},
+		entrypoint: []string{"/bin/sh", "-c"},
+		cmd:        []string{`echo "quoted" \ <done> & $HOME`},
+	}
+	expected := "FROM alpine:3.19\n" +
+		"ENV GREETING=\"hello \\$USER\"\n" +
+		"ENV EMPTY=\"\"\n" +
+		"COPY layer1 /\n" +
+		`ENTRYPOINT ["/bin/sh","-c"]` + "\n" +
+		`CMD ["echo \"quoted\" \\ <done> & $HOME"]` + "\n"
+	dockerfile := renderDockerfile(1, opts)
+	if dockerfile != expected {
+		t.Errorf("Expected Dockerfile %q, got %q", expected, dockerfile)
+	}
+
+	// The exec form must decode back to the original arguments
+	for _, line := range strings.Split(dockerfile, "\n") {
+		instruction, array, ok := strings.Cut(line, " ")
+		if !ok || (instruction != "ENTRYPOINT" && instruction != "CMD") {
+			continue
+		}
+		var args []string
+		if err := json.Unmarshal([]byte(array), &args); err != nil {
+			t.Fatalf("%s is not a JSON array: %v", instruction, err)
+		}
+		want := opts.cmd
+		if instruction == "ENTRYPOINT" {
+			want = opts.entrypoint
+		}
+		if !reflect.DeepEqual(args, want) {
+			t.Errorf("Expected %s %q, got %q", instruction, want, args)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{"sleep 3600", []string{"sleep", "3600"}},
+		{"  /bin/true  ", []string{"/bin/true"}},
+		{`["sh", "-c", "echo hello world"]`, []string{"sh", "-c", "echo hello world"}},
+		{` ["a\"b"]`, []string{`a"b`}},
+	}
+	for _, test := range tests {
+		args, err := parseCommand(test.value)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.value, args)
+		}
+	}
+
+	for _, value := range []string{"", "   ", "[]", `["unterminated`, `[1, 2]`} {
+		if _, err := parseCommand(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestCreateDockerfileBaseImage(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1KB,1KB", "--base-image", "alpine:3.20", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buildDir := t.TempDir()
+	if err := createDockerfile(buildDir, 2, cfg.dockerfileOptions()); err != nil {
+		t.Fatalf("Unexpected error creating Dockerfile: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(buildDir, "Dockerfile"))
+	if err != nil {
+		t.Fatalf("Failed to read Dockerfile: %v", err)
+	}
+
+	// The layers are still added on top of the base
+	expected := "FROM alpine:3.20\nCOPY layer1 /\nCOPY layer2 /\n"
+	if string(data) != expected {
+		t.Errorf("Expected Dockerfile %q, got %q", expected, data)
+	}
+}
+
+func TestCheckBaseImage(t *testing.T) {
+	tests := []struct {
+		baseImage string
+		hasError  bool
+	}{
+		{"scratch", false},
+		{"alpine", false},
+		{"ubuntu:24.04", false},
+		{"registry.example.com:5000/team/base:v1", false},
+		{"alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000", false},
+		{"", true},
+		{"Alpine", true},
+		{"not a reference", true},
+	}
+
+	for _, test := range tests {
+		err := checkBaseImage(test.baseImage)
+		if test.hasError && err == nil {
+			t.Errorf("Expected an error for base image %q", test.baseImage)
+		}
+		if !test.hasError && err != nil {
+			t.Errorf("Unexpected error for base image %q: %v", test.baseImage, err)
+		}
+	}
+}
+
+func TestCreateDockerignore(t *testing.T) {
+	// keptBuildDir builds with --output none and returns the kept build directory
+	keptBuildDir := func(args ...string) string {
+		tmpdir := t.TempDir()
+		args = append([]string{"--layer-sizes", "4KB,8KB", "--output", "none", "--quiet", "--tmpdir-prefix", tmpdir}, args...)
+		if err := RunBuild(append(args, "context:v1")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		entries, err := os.ReadDir(tmpdir)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("Expected one kept build directory, got %v (err: %v)", entries, err)
+		}
+		return filepath.Join(tmpdir, entries[0].Name())
+	}
+
+	data, err := os.ReadFile(filepath.Join(keptBuildDir(), ".dockerignore"))
+	if err != nil {
+		t.Fatalf("Expected a .dockerignore: %v", err)
+	}
+	expected := "# Generated by imgmkr: only the layer directories are part of the build context\n*\n!layer1\n!layer2\n"
+	if string(data) != expected {
+		t.Errorf("Expected .dockerignore %q, got %q", expected, data)
+	}
+
+	// A squashed build context has the one squashed directory
+	if dockerignore := renderDockerignore(2, true); !strings.HasSuffix(dockerignore, "\n*\n!squashed\n") {
+		t.Errorf("Expected only the squashed directory to be included, got %q", dockerignore)
+	}
+
+	if _, err := os.Stat(filepath.Join(keptBuildDir("--no-dockerignore"), ".dockerignore")); !os.IsNotExist(err) {
+		t.Errorf("Expected no .dockerignore with --no-dockerignore, got %v", err)
+	}
+}
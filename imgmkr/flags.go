@@ -0,0 +1,855 @@
+package imgmkr
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/fault"
+	"github.com/jlbutler/imgmkr/mockfs"
+	"github.com/jlbutler/imgmkr/progress"
+	"github.com/jlbutler/imgmkr/size"
+	"github.com/jlbutler/imgmkr/whiteout"
+)
+
+// buildConfig holds the options for the build command
+type buildConfig struct {
+	layerSizes          string
+	sizeList            []int64 // Layer sizes given by a Config rather than a flag (nil = from the flags)
+	layerSizesFile      string
+	randomLayers        int
+	randomMin           string
+	randomMax           string
+	layerSizeRange      string
+	sizeBase            int64 // Base for the KB, MB, ... suffixes in sizes, from --size-base (0 = size.Binary)
+	noZeroLayers        bool
+	tmpdirPrefix        string
+	maxConcurrent       int
+	timeout             time.Duration
+	retries             int
+	buildLog            string
+	mockFS              bool
+	layerModes          []string // Content mode of each layer, from --layer-sizes suffixes ("" = per --mock-fs; nil if none)
+	profile             string
+	fileProfile         string
+	listProfiles        bool
+	maxDepth            int
+	maxDepthSet         bool // Whether the directory depth was given, so --profile doesn't replace it
+	targetFiles         int
+	exactFileCount      bool
+	minSubdirs          int
+	maxSubdirs          int
+	trickyNames         float64
+	mockLinks           float64
+	mockWhiteouts       float64
+	identicalLayers     bool
+	fileMode            os.FileMode // Mode set on every mock filesystem file, from --file-mode (0 = as created)
+	dirMode             os.FileMode // Mode set on every mock filesystem subdirectory, from --dir-mode (0 = as created)
+	specialModes        float64
+	flatFiles           int
+	sizeTolerance       float64
+	uniqueContents      int
+	pruneEmptyDirs      bool
+	strictSize          bool
+	verifyWrites        bool
+	verifySizes         bool
+	preallocate         bool
+	dockerfileStdin     bool
+	noDockerignore      bool
+	baseImage           string
+	copyInstruction     string
+	platforms           []string // Platforms to build for, from --platform (nil = the builder's default)
+	builder             string   // Builder to build and push with (empty = finch, else docker)
+	magicHeaders        bool
+	trueRandom          bool
+	fill                string
+	compressibleRatio   float64
+	dictSize            int // Size of the dictionary repeated as file content, from --content dict:<size> (0 = default content)
+	appendToTar         string
+	streamLayers        bool
+	squash              bool
+	push                bool
+	pushMode            string
+	expectPushFail      bool
+	ociHistory          bool
+	manifestAnnotations bool
+	output              string
+	dryRun              bool
+	keepBuildDir        bool
+	keepOnFailure       bool
+	quiet               bool
+	progress            string
+	progressFormat      progress.Format // Parsed --progress
+	noProgressBar       bool
+	writeRate           int64 // Cap on the bytes written per second across all layers, from --write-rate (0 = no cap)
+	faultInject         string
+	faults              *fault.Injector // Fault injector wrapping layer file writes, from --fault-inject (may be nil)
+	maxMemory           int64           // Cap on the memory used by data buffers, from --max-memory (0 = no cap)
+	cacheSize           int64           // Size of the random data cache, shrunk to fit --max-memory (0 = content.CacheSize)
+	cache               *content.Cache  // The build's random data cache, while it runs (nil = content's shared default)
+	zeroRuns            *zeroRuns       // Hashes of zero runs shared by the build's sparse layers, while it runs (nil = none kept)
+	maxTotalSize        int64           // Largest total of the layer sizes a build may request, from --max-total-size (0 = no cap)
+	manifestFile        string
+	manifestOut         string
+	manifestOutDigests  bool
+	summaryJSON         string
+	printDigest         bool
+	emitScript          string
+	deletes             whiteoutFlag
+	deterministic       bool
+	uid                 int   // Owner for generated files (-1 = unchanged)
+	gid                 int   // Group for generated files (-1 = unchanged)
+	seed                int64 // Base seed for layer content and random sizes, from --seed or the tag with --deterministic (0 = random)
+	buildInfo           bool
+	args                []string          // Arguments as given, for build info
+	setFlags            map[string]string // Resolved values of the flags that were set, for build info
+	labels              keyValueFlag      // Labels to add to the image, in the order given
+	env                 keyValueFlag      // Environment variables to set in the image, in the order given
+	entrypoint          commandFlag       // Entrypoint to set on the image (nil = inherited)
+	cmd                 commandFlag       // Default command to set on the image (nil = inherited, unless entrypoint is set)
+	extraTags           []string          // Tags for the built image after the first, from the arguments after repo:tag
+	started             time.Time         // When the build started, shared with the progress tracker
+	noSignals           bool              // Leave signals to the caller rather than handling them (set by Build)
+	stdout              io.Writer         // Where results and status messages are written (nil = os.Stdout)
+	stderr              io.Writer         // Where the builder's errors are written (nil = os.Stderr)
+	batch               string
+	batchConcurrency    int
+	configFile          string
+}
+
+// whiteoutFlag collects repeated --delete specs
+type whiteoutFlag []whiteout.Spec
+
+func (f *whiteoutFlag) String() string {
+	specs := make([]string, len(*f))
+	for i, spec := range *f {
+		specs[i] = spec.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *whiteoutFlag) Set(value string) error {
+	spec, err := whiteout.ParseSpec(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// keyValueFlag collects repeated key=value flags, such as --label, in order
+type keyValueFlag []keyValue
+
+func (f *keyValueFlag) String() string {
+	pairs := make([]string, len(*f))
+	for i, kv := range *f {
+		pairs[i] = kv.String()
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *keyValueFlag) Set(value string) error {
+	kv, err := parseKeyValue(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, kv)
+	return nil
+}
+
+// commandFlag holds a --cmd or --entrypoint command; a later flag replaces an earlier one
+type commandFlag []string
+
+func (f *commandFlag) String() string {
+	if *f == nil {
+		return ""
+	}
+	return execForm(*f)
+}
+
+func (f *commandFlag) Set(value string) error {
+	args, err := parseCommand(value)
+	if err != nil {
+		return err
+	}
+	*f = args
+	return nil
+}
+
+// sizeBaseFlag holds the base from --size-base, given as binary or decimal
+type sizeBaseFlag int64
+
+func (f *sizeBaseFlag) String() string {
+	return size.BaseName(int64(*f))
+}
+
+func (f *sizeBaseFlag) Set(value string) error {
+	base, err := size.ParseBase(value)
+	if err != nil {
+		return err
+	}
+	*f = sizeBaseFlag(base)
+	return nil
+}
+
+// sizeFlag holds a size in bytes, such as --max-memory, given in any form size.Parse accepts and
+// read in the build's --size-base
+type sizeFlag struct {
+	bytes *int64
+	cfg   *buildConfig
+}
+
+func (f sizeFlag) String() string {
+	if f.bytes == nil || *f.bytes == 0 {
+		return ""
+	}
+	return strconv.FormatInt(*f.bytes, 10)
+}
+
+func (f sizeFlag) Set(value string) error {
+	bytes, err := size.ParseWithBase(value, f.cfg.base())
+	if err != nil {
+		return err
+	}
+	*f.bytes = bytes
+	return nil
+}
+
+// rateFlag holds a rate in bytes per second, such as --write-rate, given as e.g. 50MB/s and read
+// in the build's --size-base
+type rateFlag struct {
+	bytesPerSecond *int64
+	cfg            *buildConfig
+}
+
+func (f rateFlag) String() string {
+	if f.bytesPerSecond == nil || *f.bytesPerSecond == 0 {
+		return ""
+	}
+	return strconv.FormatInt(*f.bytesPerSecond, 10) + "/s"
+}
+
+func (f rateFlag) Set(value string) error {
+	bytesPerSecond, err := size.ParseRateWithBase(value, f.cfg.base())
+	if err != nil {
+		return err
+	}
+	*f.bytesPerSecond = bytesPerSecond
+	return nil
+}
+
+// modeFlag holds the permissions from --file-mode or --dir-mode, given in octal
+type modeFlag os.FileMode
+
+func (f *modeFlag) String() string {
+	if *f == 0 {
+		return ""
+	}
+	return formatMode(os.FileMode(*f))
+}
+
+func (f *modeFlag) Set(value string) error {
+	mode, err := mockfs.ParseMode(value)
+	if err != nil {
+		return err
+	}
+	*f = modeFlag(mode)
+	return nil
+}
+
+// formatMode returns mode's permissions in the octal form mockfs.ParseMode accepts
+func formatMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// contentFlag holds the dictionary size from --content dict:<size>, read in the build's --size-base
+type contentFlag struct {
+	dictSize *int
+	cfg      *buildConfig
+}
+
+func (f contentFlag) String() string {
+	if f.dictSize == nil || *f.dictSize == 0 {
+		return ""
+	}
+	return "dict:" + strconv.Itoa(*f.dictSize)
+}
+
+func (f contentFlag) Set(value string) error {
+	dictSize, err := parseContent(value, f.cfg.base())
+	if err != nil {
+		return err
+	}
+	*f.dictSize = dictSize
+	return nil
+}
+
+// platformsFlag holds the comma-separated platforms from --platform
+type platformsFlag []string
+
+func (f *platformsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *platformsFlag) Set(value string) error {
+	platforms, err := parsePlatforms(value)
+	if err != nil {
+		return err
+	}
+	*f = platforms
+	return nil
+}
+
+// Map returns the pairs as a map, later pairs replacing earlier ones with the same key
+func (f keyValueFlag) Map() map[string]string {
+	if len(f) == 0 {
+		return nil
+	}
+	pairs := make(map[string]string, len(f))
+	for _, kv := range f {
+		pairs[kv.key] = kv.value
+	}
+	return pairs
+}
+
+// addLayerFlags registers the flags describing layer sizes and content, shared by build and plan
+func addLayerFlags(fs *flag.FlagSet, cfg *buildConfig) {
+	fs.StringVar(&cfg.layerSizes, "layer-sizes", "", "Comma-separated list of layer sizes (e.g., 512KB,1MB,2GB,8150), each optionally ending in :file or :mockfs to pick that layer's content (e.g., 1GB:file,500MB:mockfs)")
+	fs.StringVar(&cfg.layerSizesFile, "layer-sizes-file", "", "File of layer sizes, one per line (blank lines and # comments are ignored), instead of --layer-sizes")
+	fs.IntVar(&cfg.randomLayers, "random-layers", 0, "Generate this many layers of random sizes between --random-min and --random-max instead of using --layer-sizes")
+	fs.StringVar(&cfg.randomMin, "random-min", "1MB", "Minimum layer size with --random-layers")
+	fs.StringVar(&cfg.randomMax, "random-max", "1GB", "Maximum layer size with --random-layers")
+	fs.IntVar(&cfg.randomLayers, "num-layers", 0, "Alias for --random-layers")
+	fs.StringVar(&cfg.layerSizeRange, "layer-size-range", "", "Range of random layer sizes with --random-layers, as min-max (e.g., 1MB-5MB); overrides --random-min and --random-max")
+	fs.Var((*sizeBaseFlag)(&cfg.sizeBase), "size-base", "Read KB, MB, GB, TB, and PB in sizes as powers of 1024 (binary) or 1000 (decimal); KiB, MiB, and so on are always powers of 1024")
+	fs.Int64Var(&cfg.seed, "seed", 0, "Seed random layer sizes and layer content so runs are reproducible whatever --max-concurrent is; layer N's content is seeded with seed+N (0 = random; overrides the seed from --deterministic)")
+	fs.BoolVar(&cfg.noZeroLayers, "no-zero-layers", false, "Reject any layer size of 0, which usually means a miscomputed size")
+	fs.BoolVar(&cfg.identicalLayers, "identical-layers", false, "Give every layer the same files and content as the first layer of its size, to test registry deduplication")
+	fs.BoolVar(&cfg.mockFS, "mock-fs", false, "Create mock filesystem structure instead of single files")
+	fs.StringVar(&cfg.profile, "profile", "", "Shape the mock filesystem like a common kind of image (implies --mock-fs; see --list-profiles)")
+	fs.BoolVar(&cfg.listProfiles, "list-profiles", false, "List the available --profile and --file-profile names and exit")
+	fs.StringVar(&cfg.fileProfile, "file-profile", "", "Give mock filesystem files extensions picked by size like a kind of image: generic, python, java, or node (only used with --mock-fs)")
+	fs.IntVar(&cfg.maxDepth, "max-depth", 3, "Maximum directory depth for mock filesystem (only used with --mock-fs)")
+	fs.IntVar(&cfg.targetFiles, "target-files", 0, "Target number of files per layer for mock filesystem (default: calculated based on layer size)")
+	fs.BoolVar(&cfg.exactFileCount, "exact-file-count", false, "Create exactly --target-files files (or the calculated number) in each mock filesystem layer instead of about that many (only used with --mock-fs)")
+	fs.IntVar(&cfg.minSubdirs, "min-subdirs", mockfs.DefaultMinSubdirs, "Minimum subdirectories per level for mock filesystem (only used with --mock-fs)")
+	fs.IntVar(&cfg.maxSubdirs, "max-subdirs", mockfs.DefaultMaxSubdirs, "Maximum subdirectories per level for mock filesystem (only used with --mock-fs)")
+	fs.Float64Var(&cfg.sizeTolerance, "size-tolerance", 0, "Percentage a mock filesystem layer may fall short of its requested size instead of adding a corrective file (0 = exact; only used with --mock-fs)")
+	fs.IntVar(&cfg.uniqueContents, "unique-contents", 0, "Limit each mock filesystem layer to this many distinct file contents, copying them to the remaining files (only used with --mock-fs)")
+	fs.IntVar(&cfg.flatFiles, "flat-files", 0, "Create exactly this many files directly in each layer's root instead of a directory tree (only used with --mock-fs)")
+}
+
+// newBuildFlagSet creates the flag set for the build command, handling invalid flags as errorHandling says
+func newBuildFlagSet(cfg *buildConfig, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet("build", errorHandling)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: imgmkr build (--layer-sizes [sizes] | --random-layers N) [flags] repo:tag\n")
+		fmt.Fprintf(fs.Output(), "       imgmkr build --config build.yaml [flags] [repo:tag]\n")
+		fmt.Fprintf(fs.Output(), "       imgmkr build --batch specs.yaml [--batch-concurrency N]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	addLayerFlags(fs, cfg)
+	fs.StringVar(&cfg.tmpdirPrefix, "tmpdir-prefix", "", "Directory prefix for temporary build files (default: system temp dir)")
+	fs.IntVar(&cfg.maxConcurrent, "max-concurrent", 0, "Maximum number of layers to create concurrently (0 = automatic, from the number of CPUs)")
+	fs.StringVar(&cfg.buildLog, "build-log", "", "Also write the container builder's output to this file (only to the file with --quiet)")
+	fs.IntVar(&cfg.retries, "retries", 0, "Retry a failed build or push by the container builder up to this many times, with exponential backoff starting at 1s")
+	fs.DurationVar(&cfg.timeout, "timeout", 0, "Abort the build, killing the builder, if it takes longer than this (e.g. 10m; 0 = no limit)")
+	fs.BoolVar(&cfg.strictSize, "strict-size", false, "Fail unless each mock filesystem layer's files add up to exactly the requested size (only used with --mock-fs)")
+	fs.Float64Var(&cfg.trickyNames, "tricky-names", 0, "Fraction of mock filesystem files (0-1) given Unicode, whitespace, or shell-unfriendly names (only used with --mock-fs)")
+	fs.Float64Var(&cfg.mockLinks, "mock-links", 0, "Links to add per mock filesystem file (0-1), each a symlink or hardlink to another file in the layer (only used with --mock-fs)")
+	fs.Float64Var(&cfg.mockWhiteouts, "mock-whiteouts", 0, "Fraction of each mock filesystem layer's files (0-1) the next layer deletes with whiteouts, and of its directories it makes opaque (only used with --mock-fs)")
+	fs.Var((*modeFlag)(&cfg.fileMode), "file-mode", "Octal permissions (`mode`) to set on every mock filesystem file, overriding the umask (e.g. 0600 or 4755; only used with --mock-fs)")
+	fs.Var((*modeFlag)(&cfg.dirMode), "dir-mode", "Octal permissions (`mode`) to set on every mock filesystem subdirectory, overriding the umask (e.g. 0700; only used with --mock-fs)")
+	fs.Float64Var(&cfg.specialModes, "special-modes", 0, "Fraction of mock filesystem files (0-1) made executable (0755) or setuid executable (4755) instead (only used with --mock-fs)")
+	fs.BoolVar(&cfg.pruneEmptyDirs, "prune-empty-dirs", false, "Remove directories left without files in the mock filesystem (only used with --mock-fs)")
+	fs.BoolVar(&cfg.verifyWrites, "verify-writes", false, "Re-read each file after writing and verify its checksum (doubles I/O)")
+	fs.BoolVar(&cfg.preallocate, "preallocate", false, "Reserve each single-file layer's disk space with fallocate before writing it, to reduce fragmentation (Linux only)")
+	fs.BoolVar(&cfg.verifySizes, "verify-sizes", false, "After creating the layers, fail unless each layer's files on disk add up to within 1% of its requested size")
+	fs.StringVar(&cfg.baseImage, "base-image", scratchImage, "Image to add the generated layers on top of in the Dockerfile (e.g., alpine:3.20)")
+	fs.StringVar(&cfg.copyInstruction, "copy-instruction", instructionCopy, "Dockerfile instruction adding each layer: copy, or add to test ADD's semantics")
+	fs.BoolVar(&cfg.noDockerignore, "no-dockerignore", false, "Don't write a .dockerignore limiting the build context to the layer directories")
+	fs.BoolVar(&cfg.dockerfileStdin, "dockerfile-stdin", false, "Pipe the Dockerfile to the builder on stdin instead of writing it to the build directory (falls back to a file for builders without support)")
+	fs.BoolVar(&cfg.magicHeaders, "magic-headers", false, "Give generated files an extension and start them with that format's magic number (e.g. PNG, ELF, ZIP)")
+	fs.StringVar(&cfg.fill, "fill", fillRandom, "Data to fill single-file layers with: random (incompressible), precompressed (gzipped random data), zero (sparse files, created without writing the zeros), or text (repeated 'x')")
+	fs.Float64Var(&cfg.compressibleRatio, "compressible-ratio", 0, "Fraction (0 to 1) of random layer data to write as compressible zero bytes instead, from 0 (fully random) to 1 (fully compressible)")
+	fs.Var(contentFlag{&cfg.dictSize, cfg}, "content", "Fill files by repeating a random dictionary of the given size, as dict:`size` (e.g., dict:4KB), for tunable compressibility")
+	fs.BoolVar(&cfg.trueRandom, "true-random", false, "Generate fresh random data for every file instead of reusing a shared random buffer (slower; only used with --mock-fs)")
+	fs.Var((*platformsFlag)(&cfg.platforms), "platform", "Comma-separated `platforms` to build the image for (e.g., linux/amd64,linux/arm64); more than one requires --push")
+	fs.StringVar(&cfg.builder, "builder", "", "Container builder to build and push with: docker, finch, podman, or nerdctl (default: finch if installed, else docker)")
+	fs.BoolVar(&cfg.push, "push", false, "Push the image with the builder after building it")
+	fs.StringVar(&cfg.pushMode, "push-mode", pushModeDaemon, "How --push pushes the image: daemon (push with the builder) or direct (push the generated layers to the registry without a builder)")
+	fs.BoolVar(&cfg.expectPushFail, "expect-push-failure", false, "Exit successfully only if the push fails, e.g. to check a registry rejects oversized layers (requires --push)")
+	fs.BoolVar(&cfg.streamLayers, "stream-layers", false, "Generate single-file layers straight into the --output image tarball without writing a build directory")
+	fs.BoolVar(&cfg.squash, "squash", false, "Merge the generated layers into a single layer, with each layer's files under its own /layerN directory")
+	fs.StringVar(&cfg.appendToTar, "append-to-tar", "", "Append the generated layers to the image in this tarball instead of building with a container builder (requires --output)")
+	fs.BoolVar(&cfg.ociHistory, "oci-history", false, "Record a config history entry for each generated layer (only used when writing an --output image tarball)")
+	fs.BoolVar(&cfg.manifestAnnotations, "manifest-annotations", false, "Record each generated layer's size and content digest as image manifest annotations (only used when writing an --output image tarball)")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "Generate the layers and Dockerfile but build nothing, keeping the build context (same as --output none)")
+	fs.BoolVar(&cfg.keepBuildDir, "keep-build-dir", false, "Keep the temporary build directory after a successful build instead of removing it")
+	fs.BoolVar(&cfg.keepOnFailure, "keep-on-failure", false, "Keep the temporary build directory, with its Dockerfile, when the build fails, and print its path for debugging")
+	fs.BoolVar(&cfg.noProgressBar, "no-progress-bar", false, "Print a status line per update instead of redrawing the progress bar, even on a terminal")
+	fs.BoolVar(&cfg.quiet, "quiet", false, "Print nothing but errors (on stderr), for scripts that only check the exit status")
+	fs.StringVar(&cfg.progress, "progress", string(progress.FormatBar), "How to report layer progress: bar (a progress bar) or json (one JSON object per line, for CI logs)")
+	fs.StringVar(&cfg.output, "output", "", "Write the image to this tarball (loadable with docker load) instead of building with a container builder, or \"none\" to keep the generated build context without building an image")
+	fs.Var(sizeFlag{&cfg.maxTotalSize, cfg}, "max-total-size", "Refuse to build if the layer sizes add up to more than this `size`, e.g. 100GB, to catch a mistyped size before anything is written (default: no cap)")
+	fs.Var(sizeFlag{&cfg.maxMemory, cfg}, "max-memory", "Cap the memory used by data buffers at this `size`, e.g. 256MB, by lowering --max-concurrent and then the random cache size")
+	fs.Var(rateFlag{&cfg.writeRate, cfg}, "write-rate", "Cap aggregate write throughput across all layers at this `rate` (e.g., 50MB/s)")
+	fs.StringVar(&cfg.faultInject, "fault-inject", "", "Testing only: fail a fraction of file writes and/or delay every write, e.g. fail=0.05,delay=10ms")
+	fs.BoolVar(&cfg.deterministic, "deterministic", false, "Generate bit-identical layers for the same tag and flags: seed content from the tag, fix timestamps, and normalize tar entries")
+	fs.IntVar(&cfg.uid, "uid", -1, "Owner UID for generated files and directories (chown requires root; always set in --output tarball headers)")
+	fs.IntVar(&cfg.gid, "gid", -1, "Owner GID for generated files and directories (chown requires root; always set in --output tarball headers)")
+	fs.Var(&cfg.deletes, "delete", "Add a whiteout to a layer deleting a path created in an earlier layer, as <layer>:<path> (repeatable)")
+	fs.Var(&cfg.labels, "label", "Set a label on the image, as key=value (repeatable)")
+	fs.Var(&cfg.env, "env", "Set an environment variable in the image, as KEY=value (repeatable)")
+	fs.Var(&cfg.entrypoint, "entrypoint", "Set the image's entrypoint, as a JSON array (e.g. '[\"/bin/sh\",\"-c\"]') or a command split on whitespace")
+	fs.Var(&cfg.cmd, "cmd", "Set the image's default command, as a JSON array (e.g. '[\"echo\",\"hello world\"]') or a command split on whitespace")
+	fs.BoolVar(&cfg.buildInfo, "build-info", false, "Record the imgmkr version, arguments, layer sizes, and seed as JSON in the image's "+buildInfoLabel+" label")
+	fs.StringVar(&cfg.emitScript, "emit-script", "", "Also write a standalone shell script to this path that recreates the layers and builds the image with docker")
+	fs.StringVar(&cfg.manifestFile, "manifest-file", "", "Also write the JSON layer manifest to this path (it is always written to the build directory)")
+	fs.StringVar(&cfg.manifestOut, "manifest-out", "", "Write a JSON description of each layer directory to this path, shaped like an OCI manifest's layers")
+	fs.BoolVar(&cfg.manifestOutDigests, "manifest-out-digests", true, "Include the sha256 and size of each layer's tar in --manifest-out (set to false to skip reading the layers back)")
+	fs.StringVar(&cfg.summaryJSON, "summary-json", "", "After a successful build, write a JSON summary of it to this path (- for stdout)")
+	fs.BoolVar(&cfg.printDigest, "print-digest", false, "After a successful build, print the image's digest: its manifest digest when written or pushed directly, or its image ID from the builder")
+	fs.StringVar(&cfg.configFile, "config", "", "Read build settings from this YAML or JSON file; flags given on the command line override them")
+	fs.StringVar(&cfg.batch, "batch", "", "Build every image listed in this YAML spec file instead of a single image")
+	fs.IntVar(&cfg.batchConcurrency, "batch-concurrency", 1, "Maximum number of --batch images to build at once")
+	return fs
+}
+
+// parseBuildArgs parses and validates the build command's flags, returning the config and repository:tag
+func parseBuildArgs(args []string) (*buildConfig, string, error) {
+	return parseBuildFlags(args, flag.ExitOnError)
+}
+
+// parseBuildFlags parses and validates the build command's flags, handling invalid flags as
+// errorHandling says, and returns the config and repository:tag
+func parseBuildFlags(args []string, errorHandling flag.ErrorHandling) (*buildConfig, string, error) {
+	cfg := &buildConfig{}
+	fs := newBuildFlagSet(cfg, errorHandling)
+	if errorHandling == flag.ContinueOnError {
+		fs.SetOutput(io.Discard)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+
+	// Settings from a config file come first, so the command line overrides them
+	var file *Config
+	if cfg.configFile != "" {
+		var err error
+		file, err = readConfigFile(cfg.configFile)
+		if err != nil {
+			return nil, "", err
+		}
+		// Layer sizes from the command line replace the file's, however they are given
+		if cfg.layerSizes != "" || cfg.layerSizesFile != "" || cfg.randomLayers != 0 {
+			file.LayerSizes, file.LayerModes = nil, nil
+		}
+	}
+
+	// Parse again over the config file's settings, and with the size base known from the start,
+	// since --size-base may come after the sizes it applies to
+	if file != nil || cfg.base() != size.Binary {
+		_, baseSet := setFlags(fs)["size-base"]
+		sizeBase := cfg.sizeBase
+		cfg = &buildConfig{}
+		fs = newBuildFlagSet(cfg, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		if file != nil {
+			file.apply(cfg)
+		}
+		if baseSet {
+			cfg.sizeBase = sizeBase
+		}
+		if err := fs.Parse(args); err != nil {
+			return nil, "", err
+		}
+	}
+	if cfg.listProfiles {
+		return cfg, "", nil
+	}
+	cfg.args = args
+	cfg.setFlags = setFlags(fs)
+
+	// A batch takes each image's flags from its spec file
+	if cfg.batch != "" {
+		for name := range cfg.setFlags {
+			if name != "batch" && name != "batch-concurrency" {
+				return nil, "", fmt.Errorf("--batch takes build flags from the spec file and cannot be combined with --%s (use the spec's defaults)", name)
+			}
+		}
+		if fs.NArg() != 0 {
+			return nil, "", fmt.Errorf("--batch takes image tags from the spec file, not arguments")
+		}
+		if cfg.batchConcurrency < 1 {
+			return nil, "", fmt.Errorf("--batch-concurrency must be at least 1, got %d", cfg.batchConcurrency)
+		}
+		return cfg, "", nil
+	}
+
+	if _, ok := cfg.setFlags["max-total-size"]; ok && cfg.maxTotalSize == 0 {
+		return nil, "", fmt.Errorf("--max-total-size must be greater than 0")
+	}
+	if _, ok := cfg.setFlags["max-depth"]; ok {
+		cfg.maxDepthSet = true
+	}
+
+	// Take the layer sizes and tags the command line doesn't give from the config file
+	tags := fs.Args()
+	if file != nil {
+		if err := cfg.checkLayerSizeSource(); err != nil {
+			return nil, "", fmt.Errorf("%w (or layer_sizes in config file %s)", err, file.path)
+		}
+		if len(tags) == 0 && file.Tag == "" {
+			return nil, "", fmt.Errorf("repository:tag argument (or tag in config file %s) is required", file.path)
+		}
+		if len(tags) == 0 {
+			tags = append([]string{file.Tag}, file.ExtraTags...)
+		}
+	}
+
+	repoTag, err := cfg.validate(tags)
+	if err != nil {
+		return nil, "", err
+	}
+	return cfg, repoTag, nil
+}
+
+// validate checks the combination of build options in cfg, which may come from flags, a config
+// file, or a Config, and fills in the settings derived from them. tags are the image's tags,
+// the first being its repository:tag.
+func (cfg *buildConfig) validate(tags []string) (string, error) {
+	// Validate required flags
+	if err := cfg.checkLayerSizeSource(); err != nil {
+		return "", err
+	}
+	if err := cfg.applyProfile(); err != nil {
+		return "", err
+	}
+	if err := cfg.parseLayerModes(); err != nil {
+		return "", err
+	}
+
+	// Pick the concurrency from the machine unless it was given
+	switch {
+	case cfg.maxConcurrent < 0:
+		return "", fmt.Errorf("--max-concurrent must be at least 0 (automatic), got %d", cfg.maxConcurrent)
+	case cfg.maxConcurrent == 0:
+		cfg.maxConcurrent = autoConcurrency(runtime.NumCPU())
+	}
+	if cfg.timeout < 0 {
+		return "", fmt.Errorf("--timeout must be at least 0 (no limit), got %s", cfg.timeout)
+	}
+	if cfg.retries < 0 {
+		return "", fmt.Errorf("--retries must be at least 0, got %d", cfg.retries)
+	}
+	if cfg.maxTotalSize < 0 {
+		return "", fmt.Errorf("--max-total-size must be at least 0 (no cap), got %d", cfg.maxTotalSize)
+	}
+
+	// Validate mock filesystem options
+	if cfg.hasLayerMode(contentModeMockFS) {
+		if err := cfg.mockfsOptions().Validate(); err != nil {
+			return "", fmt.Errorf("invalid mock filesystem options: %w", err)
+		}
+	}
+	if cfg.mockWhiteouts < 0 || cfg.mockWhiteouts > 1 {
+		return "", fmt.Errorf("--mock-whiteouts must be between 0 and 1 (got %g)", cfg.mockWhiteouts)
+	}
+
+	// Validate output options
+	if cfg.dryRun {
+		if cfg.output != "" && cfg.output != outputNone {
+			return "", fmt.Errorf("--dry-run builds no image and cannot be combined with --output %s", cfg.output)
+		}
+		cfg.output = outputNone
+	}
+	switch {
+	case cfg.output == outputNone && cfg.appendToTar != "":
+		return "", fmt.Errorf("--output none (or --dry-run) builds no image and cannot be combined with --append-to-tar")
+	case cfg.output == outputNone && (cfg.push || cfg.dockerfileStdin):
+		return "", fmt.Errorf("--output none (or --dry-run) builds no image and cannot be combined with --push or --dockerfile-stdin")
+	case cfg.appendToTar != "" && cfg.output == "":
+		return "", fmt.Errorf("--output is required with --append-to-tar")
+	case cfg.writesTarball() && cfg.dockerfileStdin:
+		return "", fmt.Errorf("--output %s writes the image without a builder and cannot be combined with --dockerfile-stdin", cfg.output)
+	}
+
+	progressFormat, err := progress.ParseFormat(cfg.progress)
+	if err != nil {
+		return "", fmt.Errorf("invalid --progress: %w", err)
+	}
+	cfg.progressFormat = progressFormat
+
+	// A squashed image has one layer, so options that add to or describe each generated layer don't apply
+	if cfg.squash {
+		switch {
+		case cfg.streamLayers:
+			return "", fmt.Errorf("--squash merges the layer directories and cannot be combined with --stream-layers")
+		case len(cfg.deletes) > 0 || cfg.mockWhiteouts > 0:
+			return "", fmt.Errorf("--squash cannot be combined with --delete or --mock-whiteouts, since there are no lower layers to delete from")
+		case cfg.emitScript != "" || cfg.ociHistory || cfg.manifestAnnotations || cfg.manifestOut != "":
+			return "", fmt.Errorf("--squash cannot be combined with --emit-script, --oci-history, --manifest-annotations, or --manifest-out")
+		}
+	}
+
+	// Streamed layers never touch the disk, so options that work on the build directory don't apply
+	if cfg.streamLayers {
+		switch {
+		case !cfg.writesTarball():
+			return "", fmt.Errorf("--stream-layers requires --output <path> (or --append-to-tar)")
+		case cfg.hasLayerMode(contentModeMockFS):
+			return "", fmt.Errorf("--stream-layers only supports single-file layers and cannot be combined with --mock-fs or :mockfs layers")
+		case len(cfg.deletes) > 0 || cfg.emitScript != "" || cfg.manifestOut != "" || cfg.verifyWrites || cfg.verifySizes || cfg.preallocate || cfg.writeRate > 0 || cfg.faultInject != "" || cfg.keepBuildDir || cfg.keepOnFailure:
+			return "", fmt.Errorf("--stream-layers writes no build directory and cannot be combined with --delete, --emit-script, --manifest-out, --verify-writes, --verify-sizes, --preallocate, --write-rate, --fault-inject, --keep-build-dir, or --keep-on-failure")
+		}
+	}
+
+	// Validate content options
+	switch cfg.fill {
+	case fillRandom:
+	case fillPrecompressed, fillZero, fillText:
+		if !cfg.hasLayerMode(contentModeSingleFile) {
+			return "", fmt.Errorf("--fill %s only applies to single-file layers and cannot be combined with --mock-fs", cfg.fill)
+		}
+		if cfg.dictSize > 0 {
+			return "", fmt.Errorf("--fill %s cannot be combined with --content", cfg.fill)
+		}
+	default:
+		return "", fmt.Errorf("invalid --fill %q: must be %s, %s, %s, or %s", cfg.fill, fillRandom, fillPrecompressed, fillZero, fillText)
+	}
+	if cfg.compressibleRatio < 0 || cfg.compressibleRatio > 1 {
+		return "", fmt.Errorf("--compressible-ratio must be between 0 and 1 (got %g)", cfg.compressibleRatio)
+	}
+	if cfg.compressibleRatio > 0 && (cfg.fill != fillRandom || cfg.dictSize > 0) {
+		return "", fmt.Errorf("--compressible-ratio only applies to random data and cannot be combined with --fill %s or --content", cfg.fill)
+	}
+	if cfg.dictSize > 0 {
+		if cfg.trueRandom {
+			return "", fmt.Errorf("--content cannot be combined with --true-random")
+		}
+		if cfg.emitScript != "" {
+			return "", fmt.Errorf("--content cannot be combined with --emit-script")
+		}
+	}
+
+	// Validate the base image, which only the Dockerfile uses
+	if err := checkBaseImage(cfg.baseImage); err != nil {
+		return "", fmt.Errorf("invalid --base-image %q: %w", cfg.baseImage, err)
+	}
+	if cfg.baseImage != scratchImage && cfg.writesTarball() {
+		return "", fmt.Errorf("--base-image cannot be combined with --output %s, which builds on an empty image or the --append-to-tar image", cfg.output)
+	}
+	if cfg.copyInstruction != instructionCopy && cfg.copyInstruction != instructionAdd {
+		return "", fmt.Errorf("invalid --copy-instruction %q: must be %s or %s", cfg.copyInstruction, instructionCopy, instructionAdd)
+	}
+
+	// Validate push options
+	if cfg.push && cfg.writesTarball() {
+		return "", fmt.Errorf("--push cannot be combined with --output %s or --append-to-tar", cfg.output)
+	}
+	if cfg.expectPushFail && !cfg.push {
+		return "", fmt.Errorf("--expect-push-failure requires --push")
+	}
+	switch {
+	case cfg.pushMode != pushModeDaemon && cfg.pushMode != pushModeDirect:
+		return "", fmt.Errorf("invalid --push-mode %q: must be %s or %s", cfg.pushMode, pushModeDaemon, pushModeDirect)
+	case cfg.pushMode == pushModeDirect && !cfg.push:
+		return "", fmt.Errorf("--push-mode %s requires --push", pushModeDirect)
+	case cfg.pushMode == pushModeDirect && (cfg.baseImage != scratchImage || len(cfg.platforms) > 0 || cfg.dockerfileStdin):
+		return "", fmt.Errorf("--push-mode %s pushes the generated layers without a builder and cannot be combined with --base-image, --platform, or --dockerfile-stdin", pushModeDirect)
+	}
+
+	// Validate the builder, which must be one imgmkr knows how to drive
+	if cfg.builder != "" {
+		if err := checkBuilderName(cfg.builder); err != nil {
+			return "", fmt.Errorf("invalid --builder: %w", err)
+		}
+		if cfg.output != "" || cfg.pushMode == pushModeDirect {
+			return "", fmt.Errorf("--builder only applies to images built with a container builder and cannot be combined with --output, --append-to-tar, or --push-mode %s", pushModeDirect)
+		}
+	}
+
+	if cfg.buildLog != "" && (cfg.output != "" || cfg.pushMode == pushModeDirect) {
+		return "", fmt.Errorf("--build-log records the container builder's output and cannot be combined with --output, --append-to-tar, or --push-mode %s", pushModeDirect)
+	}
+
+	// Validate platforms, which are passed to the builder
+	if len(cfg.platforms) > 0 {
+		switch {
+		case cfg.output != "":
+			return "", fmt.Errorf("--platform only applies to images built with finch or docker and cannot be combined with --output or --append-to-tar")
+		case len(cfg.platforms) > 1 && !cfg.push:
+			return "", fmt.Errorf("building for multiple platforms (%s) requires --push: multi-platform images can't be loaded into the local image store", strings.Join(cfg.platforms, ","))
+		case len(cfg.platforms) > 1 && cfg.expectPushFail:
+			return "", fmt.Errorf("--expect-push-failure cannot be combined with multiple platforms, which may be pushed during the build")
+		}
+	}
+
+	// The digest is read from the image that was written, pushed, or loaded into the builder's store
+	switch {
+	case cfg.printDigest && cfg.output == outputNone:
+		return "", fmt.Errorf("--print-digest cannot be combined with --output none (or --dry-run), which builds no image")
+	case cfg.printDigest && len(cfg.platforms) > 1:
+		return "", fmt.Errorf("--print-digest cannot be combined with multiple platforms, whose image is pushed without being loaded locally")
+	case cfg.printDigest && cfg.expectPushFail:
+		return "", fmt.Errorf("--print-digest cannot be combined with --expect-push-failure")
+	}
+
+	// The first tag is the repository:tag argument, and any more are tags for the same image
+	if len(tags) == 0 {
+		return "", fmt.Errorf("repository:tag argument is required")
+	}
+	for _, tag := range tags {
+		if _, err := name.NewTag(tag); err != nil {
+			return "", fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+	}
+	repoTag := tags[0]
+	cfg.extraTags = tags[1:]
+	if len(cfg.extraTags) > 0 && (cfg.writesTarball() || cfg.pushMode == pushModeDirect) {
+		return "", fmt.Errorf("multiple tags are only supported when building with a container builder, not with --output, --append-to-tar, or --push-mode direct")
+	}
+
+	if cfg.deterministic && cfg.seed == 0 {
+		cfg.seed = seedFromTag(repoTag)
+	}
+
+	// Identical layers are generated from the same seed, so they need one
+	if cfg.identicalLayers && cfg.seed == 0 {
+		cfg.seed = rand.Int63n(math.MaxInt32) + 1
+	}
+
+	// Set up fault injection, failing the same writes for the same seed
+	if cfg.faultInject != "" {
+		faults, err := fault.Parse(cfg.faultInject, cfg.seed)
+		if err != nil {
+			return "", fmt.Errorf("invalid --fault-inject: %w", err)
+		}
+		cfg.faults = faults
+	}
+	return repoTag, nil
+}
+
+// maxDictSize is the largest dictionary --content accepts; dictionaries beyond gzip's 32KB window
+// are already effectively incompressible
+const maxDictSize = 64 * size.MB
+
+// parseContent parses a --content value of the form dict:<size>, returning the dictionary size
+// read in base
+func parseContent(spec string, base int64) (int, error) {
+	sizeStr, ok := strings.CutPrefix(spec, "dict:")
+	if !ok {
+		return 0, fmt.Errorf("unknown content %q: expected dict:<size>", spec)
+	}
+	dictSize, err := size.ParseWithBase(sizeStr, base)
+	if err != nil {
+		return 0, err
+	}
+	if dictSize < 1 || dictSize > maxDictSize {
+		return 0, fmt.Errorf("dictionary size must be between 1 byte and %s, got %s", size.Format(maxDictSize), size.Format(dictSize))
+	}
+	return int(dictSize), nil
+}
+
+// Bounds for the automatic --max-concurrent. Writers mostly wait on the disk, so a couple share a
+// small machine well, but beyond a point more writers only make a slow disk seek between files.
+const (
+	minAutoConcurrency = 2
+	maxAutoConcurrency = 16
+)
+
+// autoConcurrency returns the number of layers to create at once on a machine with numCPU CPUs:
+// one writer per CPU, within minAutoConcurrency and maxAutoConcurrency
+func autoConcurrency(numCPU int) int {
+	return min(max(numCPU, minAutoConcurrency), maxAutoConcurrency)
+}
+
+// outputNone is the --output value that keeps the generated build context without building an image
+const outputNone = "none"
+
+// Values for --push-mode
+const (
+	pushModeDaemon = "daemon" // Push with the builder that built the image
+	pushModeDirect = "direct" // Push the generated layers straight to the registry
+)
+
+// statusOut returns where informational messages and progress are written: stdout, or nowhere
+// with --quiet
+func (cfg *buildConfig) statusOut() io.Writer {
+	if cfg.quiet {
+		return io.Discard
+	}
+	return cfg.resultOut()
+}
+
+// resultOut returns where the results a script needs, such as the image's digest, are written,
+// even with --quiet
+func (cfg *buildConfig) resultOut() io.Writer {
+	if cfg.stdout == nil {
+		return os.Stdout
+	}
+	return cfg.stdout
+}
+
+// errOut returns where the builder's errors are written
+func (cfg *buildConfig) errOut() io.Writer {
+	if cfg.stderr == nil {
+		return os.Stderr
+	}
+	return cfg.stderr
+}
+
+// writesTarball reports whether the image is written to an --output tarball rather than built
+// with a container builder
+func (cfg *buildConfig) writesTarball() bool {
+	return cfg.output != "" && cfg.output != outputNone
+}
+
+// applyProfile turns on the mock filesystem for --profile and uses the profile's directory depth
+// unless --max-depth was given
+func (cfg *buildConfig) applyProfile() error {
+	if cfg.profile == "" {
+		return nil
+	}
+	profile, err := mockfs.LookupProfile(cfg.profile)
+	if err != nil {
+		return err
+	}
+	cfg.mockFS = true
+	if !cfg.maxDepthSet {
+		cfg.maxDepth = profile.MaxDepth
+	}
+	return nil
+}
+
+// writeProfiles lists the available mock filesystem profiles and file profiles to w
+func writeProfiles(w io.Writer) {
+	for _, p := range mockfs.Profiles() {
+		fmt.Fprintf(w, "%-10s %s\n", p.Name, p.Description)
+	}
+	fmt.Fprintln(w, "\nFile profiles (--file-profile):")
+	for _, p := range mockfs.FileProfiles() {
+		fmt.Fprintf(w, "%-10s %s\n", p.Name, p.Description)
+	}
+}
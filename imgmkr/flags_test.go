@@ -0,0 +1,149 @@
+package imgmkr
+
+import (
+	"flag"
+	"runtime"
+	"testing"
+)
+
+func TestParseBuildArgs(t *testing.T) {
+	cfg, repoTag, err := parseBuildArgs([]string{"--layer-sizes", "1MB,2MB", "--mock-fs", "--max-concurrent", "3", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if repoTag != "test:v1" || cfg.layerSizes != "1MB,2MB" || !cfg.mockFS || cfg.maxConcurrent != 3 || cfg.maxDepth != 3 {
+		t.Errorf("Unexpected config %+v for %s", cfg, repoTag)
+	}
+
+	invalid := [][]string{
+		{"test:v1"},
+		{"--layer-sizes", "1MB"},
+		{"--layer-sizes", "1MB", "--output", "out.tar", "--push", "test:v1"},
+		{"--layer-sizes", "1MB", "--output", "out.tar", "--base-image", "alpine", "test:v1"},
+		{"--layer-sizes", "1MB", "--output", "out.tar", "--platform", "linux/arm64", "test:v1"},
+		{"--layer-sizes", "1MB", "--output", "out.tar", "--dockerfile-stdin", "test:v1"},
+		{"--layer-sizes", "1MB", "--append-to-tar", "base.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--output", "none", "--append-to-tar", "base.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--output", "none", "--push", "test:v1"},
+		{"--layer-sizes", "1MB", "--content", "dict:0", "test:v1"},
+		{"--layer-sizes", "1MB", "--content", "random", "test:v1"},
+		{"--layer-sizes", "1MB", "--content", "dict:4KB", "--mock-fs", "--true-random", "test:v1"},
+		{"--layer-sizes", "1MB", "--fault-inject", "fail=2", "test:v1"},
+		{"--layer-sizes", "1MB", "--fill", "ones", "test:v1"},
+		{"--layer-sizes", "1MB", "--progress", "plain", "test:v1"},
+		{"--layer-sizes", "1MB", "--platform", "amd64", "test:v1"},
+		{"--layer-sizes", "1MB", "--platform", "linux/amd64,linux/arm64", "test:v1"},
+		{"--layer-sizes", "1MB", "--platform", "linux/amd64,linux/arm64", "--push", "--expect-push-failure", "test:v1"},
+		{"--layer-sizes", "1MB", "--platform", "linux/arm64", "--output", "none", "test:v1"},
+		{"--layer-sizes", "1MB", "--base-image", "", "test:v1"},
+		{"--layer-sizes", "1MB", "--base-image", "not a reference", "test:v1"},
+		{"--layer-sizes", "1MB", "--base-image", "alpine", "--append-to-tar", "base.tar", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--compressible-ratio", "1.5", "test:v1"},
+		{"--layer-sizes", "1MB", "--compressible-ratio", "-0.1", "test:v1"},
+		{"--layer-sizes", "1MB", "--compressible-ratio", "0.5", "--fill", "zero", "test:v1"},
+		{"--layer-sizes", "1MB", "--compressible-ratio", "0.5", "--content", "dict:4KB", "test:v1"},
+		{"--layer-sizes", "1MB", "--fill", "zero", "--mock-fs", "test:v1"},
+		{"--layer-sizes", "1MB", "--fill", "text", "--content", "dict:4KB", "test:v1"},
+		{"--layer-sizes", "1MB", "--mock-fs", "--min-subdirs", "5", "--max-subdirs", "2", "test:v1"},
+		{"--layer-sizes", "1MB", "--mock-fs", "--file-mode", "0999", "test:v1"},
+		{"--layer-sizes", "1MB", "--mock-fs", "--dir-mode", "17777", "test:v1"},
+		{"--layer-sizes", "1MB", "--mock-fs", "--exact-file-count", "--size-tolerance", "1", "test:v1"},
+		{"--layer-sizes", "1MB,1MB", "--mock-fs", "--mock-whiteouts", "1.5", "test:v1"},
+		{"--layer-sizes", "1MB", "--mock-fs", "--special-modes", "2", "test:v1"},
+		{"--layer-sizes", "1MB", "--expect-push-failure", "test:v1"},
+		{"--layer-sizes", "1MB", "--push-mode", "direct", "test:v1"},
+		{"--layer-sizes", "1MB", "--push-mode", "docker", "--push", "test:v1"},
+		{"--layer-sizes", "1MB", "--push-mode", "direct", "--push", "--base-image", "alpine", "test:v1"},
+		{"--layer-sizes", "1MB", "--push-mode", "direct", "--push", "--platform", "linux/arm64", "test:v1"},
+		{"--layer-sizes", "1MB", "--push", "--append-to-tar", "base.tar", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--stream-layers", "test:v1"},
+		{"--layer-sizes", "1MB", "--stream-layers", "--mock-fs", "--append-to-tar", "base.tar", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--stream-layers", "--verify-writes", "--append-to-tar", "base.tar", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--stream-layers", "--verify-sizes", "--append-to-tar", "base.tar", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB", "--stream-layers", "--preallocate", "--append-to-tar", "base.tar", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB,1MB:mockfs", "--stream-layers", "--append-to-tar", "base.tar", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB:tree", "test:v1"},
+		{"--layer-sizes", "1MB", "--max-total-size", "lots", "test:v1"},
+		{"--layer-sizes", "1MB", "--max-total-size", "0", "test:v1"},
+		{"--layer-sizes", "1MB", "--print-digest", "--dry-run", "test:v1"},
+		{"--layer-sizes", "1MB", "--print-digest", "--push", "--platform", "linux/amd64,linux/arm64", "test:v1"},
+		{"--layer-sizes", "1MB", "--print-digest", "--push", "--expect-push-failure", "test:v1"},
+		{"--layer-sizes", "1MB:mockfs", "--fill", "zero", "test:v1"},
+		{"--layer-sizes", "1MB", "--squash", "--stream-layers", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB,1MB", "--squash", "--delete", "2:1.00 MiB-file", "test:v1"},
+		{"--layer-sizes", "1MB,1MB", "--squash", "--mock-fs", "--mock-whiteouts", "0.5", "test:v1"},
+		{"--layer-sizes", "1MB", "--squash", "--oci-history", "--output", "out.tar", "test:v1"},
+		{"--layer-sizes", "1MB,1MB", "--squash", "--manifest-out", "layers.json", "test:v1"},
+		{"--layer-sizes", "1MB", "--stream-layers", "--manifest-out", "layers.json", "--output", "out.tar", "test:v1"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestAutoConcurrency(t *testing.T) {
+	tests := []struct {
+		numCPU   int
+		expected int
+	}{
+		{1, 2},
+		{2, 2},
+		{4, 4},
+		{8, 8},
+		{16, 16},
+		{32, 16},
+		{128, 16},
+	}
+	for _, test := range tests {
+		if got := autoConcurrency(test.numCPU); got != test.expected {
+			t.Errorf("For %d CPUs, expected %d concurrent layers, got %d", test.numCPU, test.expected, got)
+		}
+	}
+
+	// Automatic is the default, and explicit values are honored
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1MB", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := autoConcurrency(runtime.NumCPU()); cfg.maxConcurrent != want {
+		t.Errorf("Expected %d concurrent layers by default, got %d", want, cfg.maxConcurrent)
+	}
+	cfg, _, err = parseBuildArgs([]string{"--layer-sizes", "1MB", "--max-concurrent", "1", "test:v1"})
+	if err != nil || cfg.maxConcurrent != 1 {
+		t.Errorf("Expected an explicit --max-concurrent 1 to be kept, got %d (%v)", cfg.maxConcurrent, err)
+	}
+	if _, _, err := parseBuildArgs([]string{"--layer-sizes", "1MB", "--max-concurrent", "-1", "test:v1"}); err == nil {
+		t.Error("Expected an error for a negative --max-concurrent")
+	}
+}
+
+func TestParseBuildArgsProfile(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1GB", "--profile", "ml-model", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !cfg.mockFS || cfg.maxDepth != 1 || cfg.mockfsOptions().Profile != "ml-model" {
+		t.Errorf("Expected --profile to enable the mock filesystem with the profile's depth, got %+v", cfg)
+	}
+
+	// An explicit --max-depth wins over the profile's
+	cfg, _, err = parseBuildArgs([]string{"--layer-sizes", "1GB", "--profile", "ml-model", "--max-depth", "5", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.maxDepth != 5 {
+		t.Errorf("Expected --max-depth 5 to be kept, got %d", cfg.maxDepth)
+	}
+
+	if _, _, err := parseBuildArgs([]string{"--layer-sizes", "1GB", "--profile", "missing", "test:v1"}); err == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+
+	// Listing profiles needs no other arguments
+	cfg, _, err = parseBuildArgs([]string{"--list-profiles"})
+	if err != nil || !cfg.listProfiles {
+		t.Errorf("Expected --list-profiles to parse on its own, got %+v (err: %v)", cfg, err)
+	}
+}
@@ -0,0 +1,271 @@
+// Package imgmkr generates container images with layers of chosen sizes, for testing registries,
+// builders, and runtimes. It implements the imgmkr command, and Build runs the same build from Go.
+package imgmkr
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jlbutler/imgmkr/whiteout"
+)
+
+// Config describes an image for Build to generate. Each field matches a build command flag, and
+// fields left at their zero value take the command's defaults. A Config can also be read from a
+// YAML or JSON file with the build command's --config flag, using the field names in its tags;
+// sizes, rates, modes, and deletes are written there as the flags take them (e.g. 512MB).
+type Config struct {
+	Tag             string   `yaml:"tag"`              // Repository:tag of the image (required)
+	ExtraTags       []string `yaml:"extra_tags"`       // More tags for the same image
+	LayerSizes      []int64  `yaml:"-"`                // Size of each layer in bytes (required)
+	LayerModes      []string `yaml:"layer_modes"`      // Content of each layer by position: "file" or "mockfs" ("" or missing = per MockFS)
+	NoZeroLayers    bool     `yaml:"no_zero_layers"`   // Reject any layer size of 0
+	MaxTotalSize    int64    `yaml:"-"`                // Refuse to build if the layer sizes add up to more than this (0 = no cap)
+	IdenticalLayers bool     `yaml:"identical_layers"` // Give every layer the same content as the first layer of its size
+	SizeBase        int64    `yaml:"-"`                // Base for KB, MB, and so on in sizes given as strings: size.Binary or size.Decimal (0 = Binary)
+
+	MaxConcurrent int           `yaml:"max_concurrent"` // Layers created at once (0 = automatic, from the number of CPUs)
+	MaxMemory     int64         `yaml:"-"`              // Cap on the memory used by data buffers in bytes (0 = no cap)
+	WriteRate     int64         `yaml:"-"`              // Cap on the bytes written per second across all layers (0 = no cap)
+	Timeout       time.Duration `yaml:"timeout"`        // Abort the build if it takes longer than this (0 = no limit)
+	Retries       int           `yaml:"retries"`        // Retry a failed build or push by the builder up to this many times
+
+	MockFS         bool        `yaml:"mock_fs"`          // Fill each layer with a mock filesystem instead of a single file
+	Profile        string      `yaml:"profile"`          // Shape the mock filesystem like a common kind of image (implies MockFS)
+	FileProfile    string      `yaml:"file_profile"`     // Give mock filesystem files extensions picked by size like a kind of image
+	MaxDepth       int         `yaml:"max_depth"`        // Maximum mock filesystem directory depth (0 = the default)
+	TargetFiles    int         `yaml:"target_files"`     // Target number of files per mock filesystem layer (0 = from the layer size)
+	ExactFileCount bool        `yaml:"exact_file_count"` // Create exactly TargetFiles files in each mock filesystem layer
+	MinSubdirs     int         `yaml:"min_subdirs"`      // Minimum subdirectories per mock filesystem level (0 = the default)
+	MaxSubdirs     int         `yaml:"max_subdirs"`      // Maximum subdirectories per mock filesystem level (0 = the default)
+	FlatFiles      int         `yaml:"flat_files"`       // Create exactly this many files in each layer's root instead of a tree
+	SizeTolerance  float64     `yaml:"size_tolerance"`   // Percentage a mock filesystem layer may fall short of its size
+	UniqueContents int         `yaml:"unique_contents"`  // Limit each mock filesystem layer to this many distinct file contents
+	StrictSize     bool        `yaml:"strict_size"`      // Fail unless each mock filesystem layer adds up to exactly its size
+	TrickyNames    float64     `yaml:"tricky_names"`     // Fraction of mock filesystem files given awkward names
+	MockLinks      float64     `yaml:"mock_links"`       // Links to add per mock filesystem file
+	MockWhiteouts  float64     `yaml:"mock_whiteouts"`   // Fraction of each mock filesystem layer's files the next layer deletes
+	FileMode       os.FileMode `yaml:"-"`                // Mode set on every mock filesystem file (0 = as created)
+	DirMode        os.FileMode `yaml:"-"`                // Mode set on every mock filesystem subdirectory (0 = as created)
+	SpecialModes   float64     `yaml:"special_modes"`    // Fraction of mock filesystem files made executable or setuid
+	PruneEmptyDirs bool        `yaml:"prune_empty_dirs"` // Remove mock filesystem directories left without files
+	TrueRandom     bool        `yaml:"true_random"`      // Generate fresh random data for every mock filesystem file
+
+	Fill              string  `yaml:"fill"`               // Data to fill single-file layers with: random, precompressed, zero, or text
+	CompressibleRatio float64 `yaml:"compressible_ratio"` // Fraction of random data written as compressible zeros instead
+	DictSize          int64   `yaml:"-"`                  // Fill files by repeating a random dictionary of this size (0 = random data)
+	MagicHeaders      bool    `yaml:"magic_headers"`      // Start generated files with a file format's magic number
+	Preallocate       bool    `yaml:"preallocate"`        // Reserve each single-file layer's disk space before writing it
+	Seed              int64   `yaml:"seed"`               // Content seed, so builds are reproducible (0 = random)
+	Deterministic     bool    `yaml:"deterministic"`      // Generate bit-identical layers for the same tag and config
+	UID               *int    `yaml:"uid"`                // Owner UID for generated files (nil = unchanged)
+	GID               *int    `yaml:"gid"`                // Owner GID for generated files (nil = unchanged)
+	VerifyWrites      bool    `yaml:"verify_writes"`      // Re-read each file after writing it and verify its checksum
+	VerifySizes       bool    `yaml:"verify_sizes"`       // Fail unless each layer's files add up to within 1% of its size
+
+	BaseImage       string            `yaml:"base_image"`       // Image to build on in the Dockerfile (default scratch)
+	CopyInstruction string            `yaml:"copy_instruction"` // Dockerfile instruction adding each layer: copy or add (default copy)
+	NoDockerignore  bool              `yaml:"no_dockerignore"`  // Don't write a .dockerignore limiting the build context
+	DockerfileStdin bool              `yaml:"dockerfile_stdin"` // Pipe the Dockerfile to the builder instead of writing it
+	Builder         string            `yaml:"builder"`          // Container builder: docker, finch, podman, or nerdctl (default: the first found)
+	Platforms       []string          `yaml:"platforms"`        // Platforms to build for, as os/arch[/variant] (nil = the builder's default)
+	BuildLog        string            `yaml:"build_log"`        // Also write the builder's output to this file
+	Labels          map[string]string `yaml:"labels"`           // Labels set on the image, in key order
+	Env             map[string]string `yaml:"env"`              // Environment variables set in the image, in key order
+	Entrypoint      []string          `yaml:"entrypoint"`       // Entrypoint set on the image (nil = inherited)
+	Cmd             []string          `yaml:"cmd"`              // Default command set on the image (nil = inherited)
+	Deletes         []whiteout.Spec   `yaml:"-"`                // Whiteouts deleting paths created in earlier layers
+	BuildInfo       bool              `yaml:"build_info"`       // Record how the image was made in a label
+
+	Output              string `yaml:"output"`               // Write the image to this tarball instead of using a builder, or "none" to build nothing
+	AppendToTar         string `yaml:"append_to_tar"`        // Append the layers to the image in this tarball (requires Output)
+	StreamLayers        bool   `yaml:"stream_layers"`        // Generate single-file layers straight into the Output tarball
+	Squash              bool   `yaml:"squash"`               // Merge the generated layers into a single layer
+	OCIHistory          bool   `yaml:"oci_history"`          // Record a config history entry for each generated layer
+	ManifestAnnotations bool   `yaml:"manifest_annotations"` // Record each layer's size and digest as manifest annotations
+	Push                bool   `yaml:"push"`                 // Push the image after building it
+	PushMode            string `yaml:"push_mode"`            // How to push: daemon (with the builder) or direct (default daemon)
+	ExpectPushFailure   bool   `yaml:"expect_push_failure"`  // Succeed only if the push fails
+
+	ManifestFile         string `yaml:"manifest_file"`           // Also write the JSON layer manifest to this path
+	ManifestOut          string `yaml:"manifest_out"`            // Write a JSON description of each layer directory to this path
+	NoManifestOutDigests bool   `yaml:"no_manifest_out_digests"` // Leave the tar digests out of ManifestOut
+	SummaryJSON          string `yaml:"summary_json"`            // After a successful build, write a JSON summary to this path (- for Stdout)
+	PrintDigest          bool   `yaml:"print_digest"`            // After a successful build, write the image's digest to Stdout
+	EmitScript           string `yaml:"emit_script"`             // Also write a shell script recreating the layers to this path
+	KeepBuildDir         bool   `yaml:"keep_build_dir"`          // Keep the build directory after a successful build
+	KeepOnFailure        bool   `yaml:"keep_on_failure"`         // Keep the build directory when the build fails
+
+	TmpdirPrefix  string `yaml:"tmpdir_prefix"`   // Directory to create the build directory in (default: the system temp dir)
+	Progress      string `yaml:"progress"`        // How to report layer progress: bar or json (default bar)
+	NoProgressBar bool   `yaml:"no_progress_bar"` // Write a status line per update instead of redrawing a progress bar
+	Quiet         bool   `yaml:"quiet"`           // Write nothing but results and errors
+
+	Stdout io.Writer `yaml:"-"` // Where status messages and results are written (nil = os.Stdout)
+	Stderr io.Writer `yaml:"-"` // Where the builder's errors are written (nil = os.Stderr)
+
+	path string // File the config was read from, for errors
+}
+
+// setIf sets *dst to value unless value is the zero value, which leaves the default in *dst
+func setIf[T comparable](dst *T, value T) {
+	var zero T
+	if value != zero {
+		*dst = value
+	}
+}
+
+// apply sets the options c gives on cfg, which holds the build command's defaults
+func (c *Config) apply(cfg *buildConfig) {
+	if len(c.LayerSizes) > 0 {
+		cfg.sizeList = c.LayerSizes
+		if len(c.LayerModes) > 0 {
+			cfg.layerModes = make([]string, len(c.LayerSizes))
+			for i, mode := range c.LayerModes {
+				cfg.layerModes[i] = layerModeSuffixes[mode]
+			}
+		}
+	}
+	setIf(&cfg.noZeroLayers, c.NoZeroLayers)
+	setIf(&cfg.sizeBase, c.SizeBase)
+	setIf(&cfg.maxTotalSize, c.MaxTotalSize)
+	setIf(&cfg.identicalLayers, c.IdenticalLayers)
+
+	setIf(&cfg.maxConcurrent, c.MaxConcurrent)
+	setIf(&cfg.maxMemory, c.MaxMemory)
+	setIf(&cfg.writeRate, c.WriteRate)
+	setIf(&cfg.timeout, c.Timeout)
+	setIf(&cfg.retries, c.Retries)
+
+	setIf(&cfg.mockFS, c.MockFS)
+	setIf(&cfg.profile, c.Profile)
+	setIf(&cfg.fileProfile, c.FileProfile)
+	setIf(&cfg.maxDepth, c.MaxDepth)
+	setIf(&cfg.maxDepthSet, c.MaxDepth != 0)
+	setIf(&cfg.targetFiles, c.TargetFiles)
+	setIf(&cfg.exactFileCount, c.ExactFileCount)
+	setIf(&cfg.minSubdirs, c.MinSubdirs)
+	setIf(&cfg.maxSubdirs, c.MaxSubdirs)
+	setIf(&cfg.flatFiles, c.FlatFiles)
+	setIf(&cfg.sizeTolerance, c.SizeTolerance)
+	setIf(&cfg.uniqueContents, c.UniqueContents)
+	setIf(&cfg.strictSize, c.StrictSize)
+	setIf(&cfg.trickyNames, c.TrickyNames)
+	setIf(&cfg.mockLinks, c.MockLinks)
+	setIf(&cfg.mockWhiteouts, c.MockWhiteouts)
+	setIf(&cfg.fileMode, c.FileMode)
+	setIf(&cfg.dirMode, c.DirMode)
+	setIf(&cfg.specialModes, c.SpecialModes)
+	setIf(&cfg.pruneEmptyDirs, c.PruneEmptyDirs)
+	setIf(&cfg.trueRandom, c.TrueRandom)
+
+	setIf(&cfg.fill, c.Fill)
+	setIf(&cfg.compressibleRatio, c.CompressibleRatio)
+	setIf(&cfg.dictSize, int(c.DictSize))
+	setIf(&cfg.magicHeaders, c.MagicHeaders)
+	setIf(&cfg.preallocate, c.Preallocate)
+	setIf(&cfg.seed, c.Seed)
+	setIf(&cfg.deterministic, c.Deterministic)
+	if c.UID != nil {
+		cfg.uid = *c.UID
+	}
+	if c.GID != nil {
+		cfg.gid = *c.GID
+	}
+	setIf(&cfg.verifyWrites, c.VerifyWrites)
+	setIf(&cfg.verifySizes, c.VerifySizes)
+
+	setIf(&cfg.baseImage, c.BaseImage)
+	setIf(&cfg.copyInstruction, c.CopyInstruction)
+	setIf(&cfg.noDockerignore, c.NoDockerignore)
+	setIf(&cfg.dockerfileStdin, c.DockerfileStdin)
+	setIf(&cfg.builder, c.Builder)
+	if len(c.Platforms) > 0 {
+		cfg.platforms = c.Platforms
+	}
+	setIf(&cfg.buildLog, c.BuildLog)
+	cfg.labels = append(cfg.labels, sortedKeyValues(c.Labels)...)
+	cfg.env = append(cfg.env, sortedKeyValues(c.Env)...)
+	if c.Entrypoint != nil {
+		cfg.entrypoint = c.Entrypoint
+	}
+	if c.Cmd != nil {
+		cfg.cmd = c.Cmd
+	}
+	cfg.deletes = append(cfg.deletes, c.Deletes...)
+	setIf(&cfg.buildInfo, c.BuildInfo)
+
+	setIf(&cfg.output, c.Output)
+	setIf(&cfg.appendToTar, c.AppendToTar)
+	setIf(&cfg.streamLayers, c.StreamLayers)
+	setIf(&cfg.squash, c.Squash)
+	setIf(&cfg.ociHistory, c.OCIHistory)
+	setIf(&cfg.manifestAnnotations, c.ManifestAnnotations)
+	setIf(&cfg.push, c.Push)
+	setIf(&cfg.pushMode, c.PushMode)
+	setIf(&cfg.expectPushFail, c.ExpectPushFailure)
+
+	setIf(&cfg.manifestFile, c.ManifestFile)
+	setIf(&cfg.manifestOut, c.ManifestOut)
+	if c.NoManifestOutDigests {
+		cfg.manifestOutDigests = false
+	}
+	setIf(&cfg.summaryJSON, c.SummaryJSON)
+	setIf(&cfg.printDigest, c.PrintDigest)
+	setIf(&cfg.emitScript, c.EmitScript)
+	setIf(&cfg.keepBuildDir, c.KeepBuildDir)
+	setIf(&cfg.keepOnFailure, c.KeepOnFailure)
+
+	setIf(&cfg.tmpdirPrefix, c.TmpdirPrefix)
+	setIf(&cfg.progress, c.Progress)
+	setIf(&cfg.noProgressBar, c.NoProgressBar)
+	setIf(&cfg.quiet, c.Quiet)
+
+	setIf(&cfg.stdout, c.Stdout)
+	setIf(&cfg.stderr, c.Stderr)
+}
+
+// sortedKeyValues returns the pairs in m in key order
+func sortedKeyValues(m map[string]string) []keyValue {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]keyValue, len(keys))
+	for i, key := range keys {
+		pairs[i] = keyValue{key: key, value: m[key]}
+	}
+	return pairs
+}
+
+// Build generates the image cfg describes and builds, writes, or pushes it exactly as the build
+// command would, stopping once ctx is done. cfg is validated like a --config file and the
+// command's flags. Unlike the command, Build installs no signal handlers: cancel ctx to stop a
+// build and clean up after it.
+func Build(ctx context.Context, cfg Config) error {
+	if len(cfg.LayerSizes) == 0 {
+		return fmt.Errorf("no layer sizes given")
+	}
+	if cfg.Tag == "" {
+		return fmt.Errorf("no image tag given")
+	}
+	if err := cfg.check(); err != nil {
+		return err
+	}
+
+	// Defining the build command's flags gives bcfg their defaults
+	bcfg := &buildConfig{}
+	newBuildFlagSet(bcfg, flag.ContinueOnError)
+	cfg.apply(bcfg)
+	repoTag, err := bcfg.validate(append([]string{cfg.Tag}, cfg.ExtraTags...))
+	if err != nil {
+		return err
+	}
+	bcfg.noSignals = true
+	return runBuild(ctx, bcfg, repoTag)
+}
@@ -0,0 +1,170 @@
+package imgmkr
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/whiteout"
+)
+
+func TestConfigApply(t *testing.T) {
+	uid := 0
+	c := Config{
+		LayerSizes:    []int64{4096, 1 << 20},
+		LayerModes:    []string{"", "mockfs"},
+		MaxConcurrent: 2,
+		MaxMemory:     256 << 20,
+		WriteRate:     50 << 20,
+		Profile:       "node-app",
+		MaxDepth:      4,
+		FileMode:      0600,
+		DictSize:      4096,
+		Seed:          7,
+		UID:           &uid,
+		Platforms:     []string{"linux/amd64"},
+		Labels:        map[string]string{"tier": "test", "owner": "ci"},
+		Deletes:       []whiteout.Spec{{Layer: 2, Path: "/layer1/a"}},
+		Quiet:         true,
+	}
+	cfg := &buildConfig{}
+	newBuildFlagSet(cfg, flag.ContinueOnError)
+	c.apply(cfg)
+
+	if !reflect.DeepEqual(cfg.sizeList, []int64(c.LayerSizes)) || !reflect.DeepEqual(cfg.layerModes, []string{"", contentModeMockFS}) {
+		t.Errorf("Expected the layer sizes and modes to be set, got %v and %q", cfg.sizeList, cfg.layerModes)
+	}
+	if cfg.maxConcurrent != 2 || cfg.maxMemory != 256<<20 || cfg.writeRate != 50<<20 || cfg.fileMode != 0600 || cfg.dictSize != 4096 || cfg.seed != 7 || cfg.uid != 0 || !cfg.quiet {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.platforms, c.Platforms) || len(cfg.deletes) != 1 {
+		t.Errorf("Expected the platforms and deletes to be set, got %v and %v", cfg.platforms, cfg.deletes)
+	}
+	if labels := cfg.labels.String(); labels != "owner=ci,tier=test" {
+		t.Errorf("Expected the labels in key order, got %s", labels)
+	}
+
+	// Fields left at their zero value keep the build command's defaults
+	if cfg.gid != -1 || cfg.baseImage != scratchImage || cfg.pushMode != pushModeDaemon || !cfg.manifestOutDigests {
+		t.Errorf("Expected the defaults to be kept, got %+v", cfg)
+	}
+
+	// The depth given is kept over the profile's
+	if _, err := cfg.validate([]string{"test:v1"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.maxDepth != 4 || !cfg.mockFS {
+		t.Errorf("Expected the profile to turn on the mock filesystem with depth 4, got %+v", cfg)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	cp, err := exec.LookPath("cp")
+	if err != nil {
+		t.Skip("cp not available")
+	}
+
+	// The stub builder saves its arguments and the Dockerfile it was given
+	saved := t.TempDir()
+	fakeDocker(t, `echo "$@" > `+saved+`/args; `+cp+` Dockerfile `+saved+`/Dockerfile`)
+
+	tmpdir := t.TempDir()
+	err = Build(context.Background(), Config{
+		Tag:          "lib:v1",
+		LayerSizes:   []int64{4096, 8192},
+		Builder:      "docker",
+		Labels:       map[string]string{"suite": "harness"},
+		TmpdirPrefix: tmpdir,
+		Quiet:        true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	args, err := os.ReadFile(filepath.Join(saved, "args"))
+	if err != nil {
+		t.Fatalf("Expected the builder to run: %v", err)
+	}
+	if !strings.HasPrefix(string(args), "build -t lib:v1") {
+		t.Errorf("Expected a build of lib:v1, got %q", args)
+	}
+	dockerfile, err := os.ReadFile(filepath.Join(saved, "Dockerfile"))
+	if err != nil {
+		t.Fatalf("Failed to read Dockerfile: %v", err)
+	}
+	for _, want := range []string{`LABEL suite="harness"`, "COPY layer1 /", "COPY layer2 /"} {
+		if !strings.Contains(string(dockerfile), want) {
+			t.Errorf("Expected %q in the Dockerfile, got:\n%s", want, dockerfile)
+		}
+	}
+
+	// The build directory is cleaned up afterwards
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Errorf("Expected the build directory to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestBuildInvalid(t *testing.T) {
+	fakeDocker(t, "exit 1")
+
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{LayerSizes: []int64{4096}}, "no image tag"},
+		{Config{Tag: "bad:v1"}, "no layer sizes"},
+		{Config{Tag: "bad:v1", LayerSizes: []int64{4096}, Builder: "kaniko"}, "builder: unknown builder"},
+		{Config{Tag: "bad:v1", LayerSizes: []int64{4096}, Fill: "ones"}, "fill: invalid fill"},
+		{Config{Tag: "bad:v1", LayerSizes: []int64{4096}, LayerModes: []string{"file", "file"}}, "layer_modes: has 2 modes for 1 layers"},
+		{Config{Tag: "bad:v1", LayerSizes: []int64{4096}, Platforms: []string{"linux"}}, "platforms: invalid platform"},
+		{Config{Tag: "bad:v1", LayerSizes: []int64{4096}, MaxMemory: -1}, "max_memory: must be at least 0"},
+		{Config{Tag: "bad:v1", LayerSizes: []int64{4096}, SizeBase: 10}, "size_base: must be 1024 (binary) or 1000 (decimal)"},
+		{Config{Tag: "bad:v1", LayerSizes: []int64{4096}, Squash: true, StreamLayers: true, Output: "out.tar"}, "--squash merges the layer directories"},
+	}
+	for _, test := range tests {
+		err := Build(context.Background(), test.cfg)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Build(%+v): expected an error containing %q, got %v", test.cfg, test.want, err)
+		}
+	}
+}
+
+func TestBuildOutput(t *testing.T) {
+	var stdout bytes.Buffer
+	err := Build(context.Background(), Config{
+		Tag:          "kept:v1",
+		LayerSizes:   []int64{4096},
+		Output:       outputNone,
+		TmpdirPrefix: t.TempDir(),
+		Stdout:       &stdout,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Creating Dockerfile...") || !strings.Contains(stdout.String(), "Kept build context for kept:v1") {
+		t.Errorf("Expected the build's status and kept directory on Stdout, got:\n%s", stdout.String())
+	}
+
+	// With Quiet only the kept directory is written
+	stdout.Reset()
+	err = Build(context.Background(), Config{
+		Tag:          "kept:v1",
+		LayerSizes:   []int64{4096},
+		Output:       outputNone,
+		TmpdirPrefix: t.TempDir(),
+		Quiet:        true,
+		Stdout:       &stdout,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout.String()), "\n"); len(lines) != 1 || !filepath.IsAbs(lines[0]) {
+		t.Errorf("Expected only the build directory on Stdout, got %q", stdout.String())
+	}
+}
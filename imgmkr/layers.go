@@ -0,0 +1,637 @@
+package imgmkr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/disk"
+	"github.com/jlbutler/imgmkr/fault"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/mockfs"
+	"github.com/jlbutler/imgmkr/pause"
+	"github.com/jlbutler/imgmkr/progress"
+	"github.com/jlbutler/imgmkr/size"
+	"github.com/jlbutler/imgmkr/throttle"
+	"github.com/jlbutler/imgmkr/verify"
+)
+
+// mockfsOptions returns the mock filesystem options selected by the flags
+func (cfg *buildConfig) mockfsOptions() mockfs.Options {
+	return mockfs.Options{
+		MaxDepth:       cfg.maxDepth,
+		TargetFiles:    cfg.targetFiles,
+		ExactFileCount: cfg.exactFileCount,
+		MinSubdirs:     cfg.minSubdirs,
+		MaxSubdirs:     cfg.maxSubdirs,
+		VerifyWrites:   cfg.verifyWrites,
+		MagicHeaders:   cfg.magicHeaders,
+		PruneEmpty:     cfg.pruneEmptyDirs,
+		FlatFiles:      cfg.flatFiles,
+		TrickyNames:    cfg.trickyNames,
+		Links:          cfg.mockLinks,
+		FileMode:       cfg.fileMode,
+		DirMode:        cfg.dirMode,
+		SpecialModes:   cfg.specialModes,
+		SizeTolerance:  cfg.sizeTolerance,
+		UniqueContents: cfg.uniqueContents,
+		TrueRandom:     cfg.trueRandom,
+		Cache:          cfg.cache,
+		DictSize:       cfg.dictSize,
+		Compressible:   cfg.compressibleRatio,
+		Profile:        cfg.profile,
+		FileProfile:    cfg.fileProfile,
+		StrictSize:     cfg.strictSize,
+	}
+}
+
+// LayerJob represents a layer creation job
+type LayerJob struct {
+	layerNum int
+	layerDir string
+	size     int64
+	mode     string // Content mode: contentModeSingleFile or contentModeMockFS
+}
+
+// LayerResult represents the result of a layer creation job
+type LayerResult struct {
+	layerNum int
+	mode     string
+	duration time.Duration
+	stats    *manifest.LayerStats
+	err      error
+}
+
+// Content modes recorded in the layer manifest
+const (
+	contentModeSingleFile = "single-file"
+	contentModeMockFS     = "mock-fs"
+)
+
+// Fill modes for single-file layers
+const (
+	fillRandom        = "random"        // Incompressible data from the shared random cache
+	fillPrecompressed = "precompressed" // Random data compressed with gzip, like already-compressed artifacts
+	fillZero          = "zero"          // Zero bytes
+	fillText          = "text"          // The byte 'x' repeated
+)
+
+// fillMode returns the data single-file layers are filled with, which is random by default
+func (cfg *buildConfig) fillMode() string {
+	if cfg.fill == "" {
+		return fillRandom
+	}
+	return cfg.fill
+}
+
+// contentMode returns the content mode used for generated layers that don't pick their own
+func (cfg *buildConfig) contentMode() string {
+	if cfg.mockFS {
+		return contentModeMockFS
+	}
+	return contentModeSingleFile
+}
+
+// createLayersConcurrently creates multiple layers concurrently using a worker pool,
+// returning a manifest entry for each layer in order. Cancelling ctx stops the layers in
+// progress between chunks and skips the rest.
+func createLayersConcurrently(ctx context.Context, buildDir string, sizes []int64, cfg *buildConfig, gate *pause.Gate, limiter *throttle.Limiter) ([]manifest.Layer, error) {
+	// Calculate total size for progress tracking
+	var totalSize int64
+	for _, size := range sizes {
+		totalSize += size
+	}
+
+	// Create progress tracker
+	tracker := progress.New(len(sizes), totalSize)
+	tracker.SetFormat(cfg.progressFormat)
+	tracker.SetOutput(cfg.statusOut())
+	if cfg.noProgressBar {
+		tracker.DisableBar()
+	}
+	if !cfg.started.IsZero() {
+		tracker.SetStartTime(cfg.started)
+	}
+	jobs := make(chan LayerJob, len(sizes))
+	results := make(chan LayerResult, len(sizes))
+
+	// Closed on the first error so workers skip the layers not yet started
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	// Start workers
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.maxConcurrent; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				layerNum := job.layerNum
+				reportProgress := func(n int64) { tracker.Advance(layerNum, n) }
+				tracker.Start(job.layerNum, job.size)
+				startTime := time.Now()
+				var stats *manifest.LayerStats
+				var err error
+				switch job.mode {
+				case contentModeMockFS:
+					opts := cfg.mockfsOptions()
+					opts.Pause = gate
+					opts.Progress = reportProgress
+					opts.RateLimit = limiter
+					opts.Faults = cfg.faults
+					opts.Seed = cfg.layerSeed(cfg.contentLayer(sizes, job.layerNum))
+					stats, err = mockfs.Create(ctx, job.layerDir, job.size, opts)
+				default:
+					opts := cfg.layerFileOptions(cfg.contentLayer(sizes, job.layerNum))
+					opts.pause = gate
+					opts.progress = reportProgress
+					opts.rateLimit = limiter
+					stats, err = createLayerFile(ctx, job.layerDir, job.size, opts)
+				}
+				if err != nil {
+					stopOnce.Do(func() { close(stop) })
+				}
+				results <- LayerResult{
+					layerNum: job.layerNum,
+					mode:     job.mode,
+					duration: time.Since(startTime),
+					stats:    stats,
+					err:      err,
+				}
+			}
+		}()
+	}
+
+	// Send jobs
+	go func() {
+		defer close(jobs)
+		for i, size := range sizes {
+			layerDir := filepath.Join(buildDir, fmt.Sprintf("layer%d", i+1))
+			jobs <- LayerJob{
+				layerNum: i + 1,
+				layerDir: layerDir,
+				size:     size,
+				mode:     cfg.layerMode(i + 1),
+			}
+		}
+	}()
+
+	// Collect results
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Process results and report progress. After an error, wait for the layers in progress to
+	// finish so nothing is still writing to the build directory when it is cleaned up.
+	layers := make([]manifest.Layer, len(sizes))
+	var firstErr error
+	for result := range results {
+		if firstErr != nil {
+			continue
+		}
+		if result.err != nil {
+			firstErr = fmt.Errorf("error creating layer %d: %w", result.layerNum, result.err)
+			continue
+		}
+		layers[result.layerNum-1] = manifest.Layer{
+			Number:        result.layerNum,
+			RequestedSize: sizes[result.layerNum-1],
+			ActualSize:    result.stats.Bytes(),
+			FileCount:     result.stats.FileCount(),
+			ContentMode:   result.mode,
+			Digest:        result.stats.Digest(),
+		}
+		if result.mode == contentModeMockFS && cfg.uniqueContents > 0 {
+			layers[result.layerNum-1].UniqueContents = result.stats.UniqueContents()
+		}
+		tracker.Update(result.layerNum, sizes[result.layerNum-1], result.duration)
+	}
+
+	// Stop the progress display so the error isn't printed inside it
+	if firstErr != nil {
+		tracker.Stop()
+		return nil, firstErr
+	}
+
+	// Finish progress display
+	tracker.Finish()
+
+	return layers, nil
+}
+
+// beforeVerify is called between writing a layer file and verifying it (used by tests to simulate corruption)
+var beforeVerify = func(filePath string) {}
+
+// layerFileOptions controls how createLayerFile writes a single-file layer
+type layerFileOptions struct {
+	verifyWrites bool              // Re-read the file after writing and compare checksums
+	preallocate  bool              // Reserve the file's disk space with fallocate before writing it
+	magicHeaders bool              // Give the file an extension and start it with that format's magic number
+	fill         string            // Fill mode for the file's data: fillRandom, fillPrecompressed, fillZero, or fillText
+	compressible float64           // Fraction of random fill written as compressible zero bytes
+	cache        *content.Cache    // Random data cache read by random fill (nil = default size)
+	zeroRuns     *zeroRuns         // Zero runs already hashed by other sparse files (may be nil)
+	dictSize     int               // Size of the random dictionary repeated as the file's data, instead of fill (0 = none)
+	pause        *pause.Gate       // Gate checked between chunks so writes can be paused (may be nil)
+	progress     func(int64)       // Called with the number of bytes written after each chunk (may be nil)
+	rateLimit    *throttle.Limiter // Shared limiter capping write throughput (may be nil)
+	faults       *fault.Injector   // Fault injector wrapping the file's writes (may be nil)
+	seed         int64             // Seed for the file's extension (0 = random)
+}
+
+// layerFileOptions returns the options for writing layer layerNum's file, without the shared
+// pause gate, progress callback, or rate limiter
+func (cfg *buildConfig) layerFileOptions(layerNum int) layerFileOptions {
+	return layerFileOptions{
+		verifyWrites: cfg.verifyWrites,
+		preallocate:  cfg.preallocate,
+		magicHeaders: cfg.magicHeaders,
+		fill:         cfg.fillMode(),
+		compressible: cfg.compressibleRatio,
+		cache:        cfg.cache,
+		zeroRuns:     cfg.zeroRuns,
+		dictSize:     cfg.dictSize,
+		faults:       cfg.faults,
+		seed:         cfg.layerSeed(layerNum),
+	}
+}
+
+// layerFile describes the single file generated for a layer without --mock-fs
+type layerFile struct {
+	name         string
+	size         int64
+	header       []byte         // Magic number the file starts with, if any
+	dict         []byte         // Dictionary repeated after the header, if any
+	fill         string         // Fill mode after the header when there is no dictionary
+	fillSeed     int64          // Seed for random fill, so every read of the file gives the same data
+	compressible float64        // Fraction of random fill that is compressible
+	cache        *content.Cache // Random data cache read by random fill (nil = default size)
+}
+
+// newLayerFile names the file for a single-file layer of fileSize bytes, choosing a seeded format
+// extension and its magic header if opts.magicHeaders is set, and a seeded dictionary of
+// opts.dictSize bytes to fill it with if that is set. Otherwise the file is filled as opts.fill
+// says, with random data seeded from opts.seed.
+func newLayerFile(fileSize int64, opts layerFileOptions) layerFile {
+	f := layerFile{
+		name:         fmt.Sprintf("%s-file", size.Format(fileSize)),
+		size:         fileSize,
+		fill:         opts.fill,
+		compressible: opts.compressible,
+		cache:        opts.cache,
+	}
+	rng := content.NewRand(opts.seed)
+	if opts.magicHeaders {
+		ext := content.RandomMagicExtension(rng)
+		f.name += ext
+		f.header = content.MagicHeader(ext, fileSize)
+	}
+	if opts.dictSize > 0 {
+		f.dict = content.NewDict(rng, int(min(int64(opts.dictSize), fileSize)))
+	} else if f.fill != fillZero && f.fill != fillText {
+		// Random, the default
+		f.fillSeed = rng.Int63()
+	}
+	return f
+}
+
+// reader returns a reader for the file's contents: its magic header followed by filler data
+func (f layerFile) reader() io.Reader {
+	var fill io.Reader
+	switch {
+	case len(f.dict) > 0:
+		fill = content.NewRepeatReader(f.dict)
+	case f.fill == fillZero:
+		fill = content.NewByteReader(0)
+	case f.fill == fillText:
+		fill = content.NewByteReader('x')
+	case f.fill == fillPrecompressed:
+		fill = content.NewGzipReader(content.NewFiller(rand.New(rand.NewSource(f.fillSeed)), f.cache, false))
+	default:
+		fill = content.NewFiller(rand.New(rand.NewSource(f.fillSeed)), f.cache, false).WithCompressibleRatio(f.compressible)
+	}
+	return content.NewReader(f.header, fill, f.size)
+}
+
+// sparse reports whether the file can be created sparse, by extending it past its header instead
+// of writing zeros: it is zero filled, and no writes need to be throttled or faulted
+func (f layerFile) sparse(opts layerFileOptions) bool {
+	return f.fill == fillZero && len(f.dict) == 0 && opts.rateLimit == nil && opts.faults == nil
+}
+
+// stats hashes the file's contents and returns the stats of a layer holding only this file
+func (f layerFile) stats() (*manifest.LayerStats, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f.reader()); err != nil {
+		return nil, err
+	}
+	stats := manifest.NewLayerStats()
+	stats.AddFile(f.name, f.size, h.Sum(nil))
+	return stats, nil
+}
+
+// zeroChunkSize is the length of the zero runs whose hash states zeroRuns keeps
+const zeroChunkSize = 10 * size.MB
+
+// zeroRuns holds, for each header a sparse file starts with, the SHA-256 state after the header
+// and each whole number of zeroChunkSize runs of zeros hashed so far, so a build's sparse files
+// after the same header only hash the zeros past the longest run any of them has hashed before
+type zeroRuns struct {
+	mu     sync.Mutex
+	states map[string][][]byte // Marshaled states by header; states[k] follows k+1 runs
+}
+
+// newZeroRuns returns an empty set of zero runs
+func newZeroRuns() *zeroRuns {
+	return &zeroRuns{states: make(map[string][][]byte)}
+}
+
+// get returns the states hashed after header. Existing states are never changed, so the list can
+// be read without the lock.
+func (z *zeroRuns) get(header []byte) [][]byte {
+	if z == nil {
+		return nil
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.states[string(header)]
+}
+
+// add records state as the one after header and runs runs of zeros, unless another file got there
+// first
+func (z *zeroRuns) add(header []byte, runs int64, state []byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if int64(len(z.states[string(header)])) == runs-1 {
+		z.states[string(header)] = append(z.states[string(header)], state)
+	}
+}
+
+// hashZeroRun returns the SHA-256 of header followed by zeros up to fileSize bytes, resuming from
+// the longest run of zeros in opts.zeroRuns already hashed after the same header. Hashing waits while opts.pause
+// is paused, reports the zeros to opts.progress as they are hashed (or skipped), and stops if ctx
+// is cancelled.
+func hashZeroRun(ctx context.Context, header []byte, fileSize int64, opts layerFileOptions) ([]byte, error) {
+	hash := sha256.New()
+	hash.Write(header)
+	remaining := fileSize - int64(len(header))
+
+	states := opts.zeroRuns.get(header)
+	runs := min(int64(len(states)), remaining/zeroChunkSize)
+	if runs > 0 {
+		if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(states[runs-1]); err != nil {
+			return nil, fmt.Errorf("failed to resume hashing zeros: %w", err)
+		}
+		remaining -= runs * zeroChunkSize
+		if opts.progress != nil {
+			opts.progress(runs * zeroChunkSize)
+		}
+	}
+
+	zeros := content.NewByteReader(0)
+	for remaining > 0 {
+		if err := opts.pause.WaitContext(ctx); err != nil {
+			return nil, fmt.Errorf("layer creation cancelled: %w", err)
+		}
+		n, err := io.CopyN(hash, zeros, min(remaining, zeroChunkSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash data: %w", err)
+		}
+		remaining -= n
+		if opts.progress != nil {
+			opts.progress(n)
+		}
+
+		// Record the state after each whole run
+		if n == zeroChunkSize && opts.zeroRuns != nil {
+			runs++
+			state, err := hash.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				return nil, fmt.Errorf("failed to save hashing state: %w", err)
+			}
+			opts.zeroRuns.add(header, runs, state)
+		}
+	}
+	return hash.Sum(nil), nil
+}
+
+// createLayerFile creates a file of the specified size filled as opts.fill says, optionally verifying it after writing.
+// Cancelling ctx stops the writes between chunks and returns an error wrapping ctx.Err().
+func createLayerFile(ctx context.Context, layerDir string, fileSize int64, opts layerFileOptions) (*manifest.LayerStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("layer creation cancelled: %w", err)
+	}
+
+	// Create the layer directory if it doesn't exist
+	if err := os.MkdirAll(layerDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create layer directory: %w", err)
+	}
+
+	// Create a file with the size as part of the name
+	f := newLayerFile(fileSize, opts)
+	fileName := f.name
+	filePath := filepath.Join(layerDir, fileName)
+	file, err := os.Create(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	// Reserve the file's space up front so it can be laid out contiguously. Sparse files are left
+	// sparse.
+	if opts.preallocate && !f.sparse(opts) {
+		if err := disk.Preallocate(file, fileSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hash the data as it is written
+	writeHash := sha256.New()
+	w := io.MultiWriter(opts.faults.Writer(opts.rateLimit.WriterContext(ctx, file)), writeHash)
+
+	// Copy the file's contents in chunks, starting with the magic number for its extension. Each
+	// chunk is copied through io.CopyN's small buffer rather than generated whole.
+	const chunkSize = 10 * size.MB
+	r := f.reader()
+	remaining := fileSize
+
+	// Zero fill needs no writes after the header: extending the file leaves a hole that reads back
+	// as zeros. The zeros are hashed separately for the manifest, reusing runs already hashed.
+	var sum []byte
+	if f.sparse(opts) {
+		if err := opts.pause.WaitContext(ctx); err != nil {
+			return nil, fmt.Errorf("layer creation cancelled: %w", err)
+		}
+		header := f.header[:min(int64(len(f.header)), fileSize)]
+		if _, err := file.Write(header); err != nil {
+			return nil, fmt.Errorf("failed to write data to file: %w", err)
+		}
+		if err := file.Truncate(fileSize); err != nil {
+			return nil, fmt.Errorf("failed to extend file: %w", err)
+		}
+		if opts.progress != nil && len(header) > 0 {
+			opts.progress(int64(len(header)))
+		}
+		if sum, err = hashZeroRun(ctx, header, fileSize, opts); err != nil {
+			return nil, err
+		}
+		remaining = 0
+	}
+
+	for remaining > 0 {
+		// Block here while writes are paused, and stop if the layer is cancelled
+		if err := opts.pause.WaitContext(ctx); err != nil {
+			return nil, fmt.Errorf("layer creation cancelled: %w", err)
+		}
+
+		writeSize := remaining
+		if writeSize > chunkSize {
+			writeSize = chunkSize
+		}
+
+		// Write the next chunk of data to the file
+		if _, err := io.CopyN(w, r, writeSize); err != nil {
+			return nil, fmt.Errorf("failed to write data to file: %w", err)
+		}
+
+		remaining -= writeSize
+		if opts.progress != nil {
+			opts.progress(writeSize)
+		}
+	}
+	if sum == nil {
+		sum = writeHash.Sum(nil)
+	}
+	stats := manifest.NewLayerStats()
+	stats.AddFile(fileName, fileSize, sum)
+	if !opts.verifyWrites {
+		return stats, nil
+	}
+
+	// Close the file before re-reading it
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close file: %w", err)
+	}
+	beforeVerify(filePath)
+	if err := verify.File(filePath, fileSize, sum); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// verifySizeTolerance is the fraction of its requested size a layer may differ by under --verify-sizes
+const verifySizeTolerance = 0.01
+
+// layerSizeTolerance returns the fraction of its requested size a layer may differ by under
+// --verify-sizes, widened to any shortfall --size-tolerance allows mock filesystem layers
+func (cfg *buildConfig) layerSizeTolerance() float64 {
+	if cfg.hasLayerMode(contentModeMockFS) && cfg.sizeTolerance/100 > verifySizeTolerance {
+		return cfg.sizeTolerance / 100
+	}
+	return verifySizeTolerance
+}
+
+// verifyLayerSizes sums the bytes of each layer's files on disk and compares them with the
+// requested sizes, writing each layer's discrepancy to out and failing if any is beyond tolerance
+func verifyLayerSizes(out io.Writer, buildDir string, sizes []int64, tolerance float64) error {
+	fmt.Fprintln(out, "Verifying layer sizes...")
+	var mismatched []string
+	for i, layerDir := range layerDirs(buildDir, len(sizes)) {
+		actual, err := verify.DirSize(layerDir)
+		if err != nil {
+			return err
+		}
+		diff := actual - sizes[i]
+		var percent float64
+		if sizes[i] > 0 {
+			percent = float64(diff) / float64(sizes[i]) * 100
+		}
+		fmt.Fprintf(out, "  Layer %d: requested %s, found %s (%+d bytes, %+.2f%%)\n", i+1, size.Format(sizes[i]), size.Format(actual), diff, percent)
+		if !verify.WithinTolerance(actual, sizes[i], tolerance) {
+			mismatched = append(mismatched, fmt.Sprintf("layer %d is %d bytes instead of %d", i+1, actual, sizes[i]))
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("%s (tolerance %g%%)", strings.Join(mismatched, ", "), tolerance*100)
+	}
+	return nil
+}
+
+// optionalID returns a pointer to a uid or gid flag value, or nil if it is unset (negative)
+func optionalID(id int) *int {
+	if id < 0 {
+		return nil
+	}
+	return &id
+}
+
+// isPrivileged reports whether the process can change file ownership
+var isPrivileged = func() bool { return os.Geteuid() == 0 }
+
+// applyOwnership records the requested uid and gid (-1 = unchanged) in the manifest entries and,
+// when running as root, chowns every generated file and directory to match. Otherwise a warning
+// is written to out.
+func applyOwnership(out io.Writer, buildDir string, layers []manifest.Layer, uid int, gid int) error {
+	for i := range layers {
+		layers[i].UID, layers[i].GID = optionalID(uid), optionalID(gid)
+	}
+
+	if !isPrivileged() {
+		fmt.Fprintln(out, "⚠️  Warning: Not running as root, skipping chown of generated files (image tarballs written with --output still carry the requested ownership)")
+		return nil
+	}
+	for _, layer := range layers {
+		layerDir := filepath.Join(buildDir, fmt.Sprintf("layer%d", layer.Number))
+		err := filepath.WalkDir(layerDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to chown %s: %w", layerDir, err)
+		}
+	}
+	return nil
+}
+
+// setFixedTimes sets the access and modification times of everything below root to t. Symlinks
+// get the times themselves, since os.Chtimes would follow them to their targets.
+func setFixedTimes(root string, t time.Time) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return setSymlinkTimes(path, t)
+		}
+		return os.Chtimes(path, t, t)
+	})
+}
+
+// writeLayerManifest writes the layer manifest to the build directory and, if requested, to manifestFile
+func writeLayerManifest(buildDir string, layers []manifest.Layer, manifestFile string) error {
+	if err := manifest.Write(filepath.Join(buildDir, manifest.FileName), layers); err != nil {
+		return err
+	}
+	if manifestFile != "" {
+		return manifest.Write(manifestFile, layers)
+	}
+	return nil
+}
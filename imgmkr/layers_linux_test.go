@@ -0,0 +1,76 @@
+package imgmkr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestCreateLayerFilePreallocate(t *testing.T) {
+	const fileSize = 12*size.MB + 5
+	layerDir := t.TempDir()
+	opts := layerFileOptions{preallocate: true, verifyWrites: true, magicHeaders: true, seed: 9}
+	stats, err := createLayerFile(context.Background(), layerDir, fileSize, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error creating preallocated layer file: %v", err)
+	}
+
+	// Preallocating changes only how the file is laid out, not what it holds
+	f := newLayerFile(fileSize, opts)
+	info, err := os.Stat(filepath.Join(layerDir, f.name))
+	if err != nil {
+		t.Fatalf("Failed to stat layer file: %v", err)
+	}
+	if info.Size() != fileSize {
+		t.Errorf("Expected %d bytes, got %d", fileSize, info.Size())
+	}
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks; blocks*512 < fileSize {
+		t.Errorf("Expected the whole file to be allocated, got %d blocks", blocks)
+	}
+	expected, err := f.stats()
+	if err != nil {
+		t.Fatalf("Failed to hash layer file: %v", err)
+	}
+	if stats.Digest() != expected.Digest() {
+		t.Errorf("Expected digest %s, got %s", expected.Digest(), stats.Digest())
+	}
+	onDisk, err := manifest.StatDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to stat layer: %v", err)
+	}
+	if onDisk.Digest() != expected.Digest() {
+		t.Errorf("Expected the file on disk to have digest %s, got %s", expected.Digest(), onDisk.Digest())
+	}
+}
+
+func TestSetFixedTimesSymlinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Symlink("file", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	fixed := time.Unix(1700000000, 0)
+	if err := setFixedTimes(root, fixed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The symlink itself gets the fixed time, not just its target
+	for _, name := range []string{"file", "link"} {
+		info, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", name, err)
+		}
+		if !info.ModTime().Equal(fixed) {
+			t.Errorf("Expected %s to have mtime %v, got %v", name, fixed, info.ModTime())
+		}
+	}
+}
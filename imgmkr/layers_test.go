@@ -0,0 +1,637 @@
+package imgmkr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/fault"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/pause"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestCreateLayerFileVerifyWrites(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Verified writes succeed when nothing tampers with the file
+	if _, err := createLayerFile(context.Background(), filepath.Join(tempDir, "intact"), 4096, layerFileOptions{verifyWrites: true}); err != nil {
+		t.Fatalf("Unexpected error creating verified layer file: %v", err)
+	}
+
+	// Corrupt the file between write and verify
+	origBeforeVerify := beforeVerify
+	defer func() { beforeVerify = origBeforeVerify }()
+	var corrupted string
+	beforeVerify = func(filePath string) {
+		corrupted = filePath
+		file, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", filePath, err)
+		}
+		defer file.Close()
+		if _, err := file.WriteAt([]byte{0}, 100); err != nil {
+			t.Fatalf("Failed to corrupt %s: %v", filePath, err)
+		}
+	}
+
+	_, err := createLayerFile(context.Background(), filepath.Join(tempDir, "corrupt"), 4096, layerFileOptions{verifyWrites: true})
+	if err == nil {
+		t.Fatal("Expected verification to detect the corrupted file")
+	}
+	if !strings.Contains(err.Error(), corrupted) || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected checksum mismatch identifying %s, got: %v", corrupted, err)
+	}
+}
+
+func TestCreateLayersConcurrentlyManifest(t *testing.T) {
+	for _, useMockFS := range []bool{false, true} {
+		cfg := &buildConfig{maxConcurrent: 2, mockFS: useMockFS, maxDepth: 3}
+
+		buildDir := t.TempDir()
+		sizes := []int64{4 * size.KB, 64 * size.KB}
+		layers, err := createLayersConcurrently(context.Background(), buildDir, sizes, cfg, nil, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating layers (mock-fs %v): %v", useMockFS, err)
+		}
+		if len(layers) != len(sizes) {
+			t.Fatalf("Expected %d manifest entries, got %d", len(sizes), len(layers))
+		}
+
+		// The manifest must describe what is actually on disk
+		for i, layer := range layers {
+			onDisk, err := manifest.StatDir(filepath.Join(buildDir, fmt.Sprintf("layer%d", i+1)))
+			if err != nil {
+				t.Fatalf("Failed to stat layer %d: %v", i+1, err)
+			}
+			if layer.Number != i+1 || layer.RequestedSize != sizes[i] || layer.ContentMode != cfg.contentMode() {
+				t.Errorf("Layer %d: unexpected manifest entry %+v", i+1, layer)
+			}
+			if layer.ActualSize != onDisk.Bytes() || layer.FileCount != onDisk.FileCount() || layer.Digest != onDisk.Digest() {
+				t.Errorf("Layer %d: manifest %+v does not match disk (%d bytes, %d files, %s)",
+					i+1, layer, onDisk.Bytes(), onDisk.FileCount(), onDisk.Digest())
+			}
+		}
+	}
+}
+
+func TestCreateMixedLayers(t *testing.T) {
+	// --mock-fs applies to the layers that don't pick their own mode
+	cfg, _, err := parseBuildFlags([]string{"--layer-sizes", "64KB:file,512KB,32KB:mockfs", "--mock-fs", "--target-files", "20", "--max-concurrent", "3", "--quiet", "mixed:v1"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error parsing layer sizes: %v", err)
+	}
+	if !reflect.DeepEqual(sizes, []int64{64 * size.KB, 512 * size.KB, 32 * size.KB}) {
+		t.Fatalf("Unexpected layer sizes %v", sizes)
+	}
+
+	buildDir := t.TempDir()
+	layers, err := createLayersConcurrently(context.Background(), buildDir, sizes, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating layers: %v", err)
+	}
+	expected := []string{contentModeSingleFile, contentModeMockFS, contentModeMockFS}
+	for i, layer := range layers {
+		if layer.ContentMode != expected[i] {
+			t.Errorf("Layer %d: expected content mode %s, got %s", i+1, expected[i], layer.ContentMode)
+		}
+	}
+
+	// The single-file layer holds one file, and the mock filesystem layers a tree of many
+	entries, err := os.ReadDir(filepath.Join(buildDir, "layer1"))
+	if err != nil || len(entries) != 1 || !entries[0].Type().IsRegular() {
+		t.Errorf("Expected layer1 to hold a single file, got %v (err: %v)", entries, err)
+	}
+	for _, layerNum := range []int{2, 3} {
+		layerDir := filepath.Join(buildDir, fmt.Sprintf("layer%d", layerNum))
+		var files, dirs int
+		err := filepath.WalkDir(layerDir, func(path string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case path == layerDir:
+			case d.IsDir():
+				dirs++
+			default:
+				files++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to walk layer %d: %v", layerNum, err)
+		}
+		if files < 2 || dirs == 0 {
+			t.Errorf("Expected layer %d to be a tree of files, got %d files in %d directories", layerNum, files, dirs)
+		}
+		if layers[layerNum-1].FileCount != files {
+			t.Errorf("Layer %d: expected the manifest to count %d files, got %d", layerNum, files, layers[layerNum-1].FileCount)
+		}
+	}
+}
+
+func TestCreateLayerFileMagicHeaders(t *testing.T) {
+	layerDir := t.TempDir()
+	stats, err := createLayerFile(context.Background(), layerDir, 4096, layerFileOptions{magicHeaders: true})
+	if err != nil {
+		t.Fatalf("Unexpected error creating layer file: %v", err)
+	}
+
+	entries, err := os.ReadDir(layerDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected exactly one layer file, got %d (err: %v)", len(entries), err)
+	}
+	data, err := os.ReadFile(filepath.Join(layerDir, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("Failed to read layer file: %v", err)
+	}
+
+	expected := content.MagicHeader(filepath.Ext(entries[0].Name()), 4096)
+	if len(expected) == 0 {
+		t.Fatalf("Layer file %s has no recognized extension", entries[0].Name())
+	}
+	if !bytes.HasPrefix(data, expected) {
+		t.Errorf("Expected %s to start with %q, got %q", entries[0].Name(), expected, data[:len(expected)])
+	}
+	if int64(len(data)) != 4096 || stats.Bytes() != 4096 {
+		t.Errorf("Expected 4096 bytes, got %d on disk and %d recorded", len(data), stats.Bytes())
+	}
+}
+
+func TestCreateLayerFileProgress(t *testing.T) {
+	// Larger than one chunk, so progress is reported more than once
+	fileSize := int64(25*size.MB + 123)
+	var reported int64
+	var calls int
+	_, err := createLayerFile(context.Background(), t.TempDir(), fileSize, layerFileOptions{
+		magicHeaders: true,
+		progress: func(n int64) {
+			reported += n
+			calls++
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating layer file: %v", err)
+	}
+	if reported != fileSize {
+		t.Errorf("Expected %d bytes reported, got %d", fileSize, reported)
+	}
+	if calls < 2 {
+		t.Errorf("Expected progress between chunks, got %d reports", calls)
+	}
+}
+
+// BenchmarkCreateLayerFile writes a layer spanning several chunks; with -benchmem the memory
+// allocated per layer stays small, since chunks are copied through io.CopyN's buffer
+func BenchmarkCreateLayerFile(b *testing.B) {
+	const fileSize = 32 * size.MB
+	layerDir := b.TempDir()
+	opts := layerFileOptions{fill: fillRandom, seed: 1}
+	b.SetBytes(fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := createLayerFile(context.Background(), layerDir, fileSize, opts); err != nil {
+			b.Fatalf("Unexpected error creating layer file: %v", err)
+		}
+	}
+}
+
+func TestFaultInjectionStopsLayers(t *testing.T) {
+	faults, err := fault.New(1, 0, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buildDir := t.TempDir()
+	cfg := &buildConfig{maxConcurrent: 1, faults: faults}
+	_, err = createLayersConcurrently(context.Background(), buildDir, []int64{4 * size.KB, 4 * size.KB, 4 * size.KB}, cfg, nil, nil)
+	if !errors.Is(err, fault.ErrInjected) {
+		t.Fatalf("Expected an injected write failure, got %v", err)
+	}
+
+	// Layers not yet started when the first one failed are skipped
+	entries, err := os.ReadDir(buildDir)
+	if err != nil {
+		t.Fatalf("Failed to read build directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "layer1" {
+		t.Errorf("Expected only layer1 to be started, got %v", entries)
+	}
+}
+
+func TestFaultInjectionCleanup(t *testing.T) {
+	// Half the writes fail across concurrent mock filesystem layers
+	tmpdir := t.TempDir()
+	err := RunBuild([]string{"--layer-sizes", "256KB,256KB,256KB,256KB", "--mock-fs", "--max-concurrent", "4",
+		"--fault-inject", "fail=0.5,delay=1ms", "--deterministic", "--tmpdir-prefix", tmpdir, "faulty:v1"})
+	if !errors.Is(err, fault.ErrInjected) {
+		t.Fatalf("Expected an injected write failure, got %v", err)
+	}
+
+	// Nothing is left behind in the temp directory
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatalf("Failed to read temp directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected the build directory to be cleaned up, found %v", entries)
+	}
+}
+
+func TestCreateLayerFileDict(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "64KB", "--content", "dict:16", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.dictSize != 16 {
+		t.Fatalf("Expected a 16-byte dictionary, got %d", cfg.dictSize)
+	}
+
+	layerDir := t.TempDir()
+	if _, err := createLayerFile(context.Background(), layerDir, 64*size.KB, layerFileOptions{dictSize: cfg.dictSize, seed: 1}); err != nil {
+		t.Fatalf("Unexpected error creating layer file: %v", err)
+	}
+	entries, err := os.ReadDir(layerDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected exactly one layer file, got %d (err: %v)", len(entries), err)
+	}
+	data, err := os.ReadFile(filepath.Join(layerDir, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("Failed to read layer file: %v", err)
+	}
+
+	// The file is the dictionary over and over
+	if int64(len(data)) != 64*size.KB || !bytes.Equal(data, bytes.Repeat(data[:16], len(data)/16)) {
+		t.Error("Expected the file to repeat a 16-byte dictionary")
+	}
+	if bytes.Equal(data[:16], bytes.Repeat([]byte("x"), 16)) {
+		t.Error("Expected a random dictionary, not the default fill")
+	}
+}
+
+func TestCreateLayerFileFill(t *testing.T) {
+	const fileSize = 4 * size.MB
+	gzipRatio := func(fill string, compressible float64) float64 {
+		layerDir := t.TempDir()
+		if _, err := createLayerFile(context.Background(), layerDir, fileSize, layerFileOptions{fill: fill, compressible: compressible, seed: 1}); err != nil {
+			t.Fatalf("Unexpected error creating %s layer file: %v", fill, err)
+		}
+		data, err := os.ReadFile(filepath.Join(layerDir, "4.00 MiB-file"))
+		if err != nil || len(data) != fileSize {
+			t.Fatalf("Expected a %d-byte %s file, got %d bytes (err: %v)", fileSize, fill, len(data), err)
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		return float64(buf.Len()) / fileSize
+	}
+
+	// Random data barely compresses, so the pushed layer is close to the requested size
+	if ratio := gzipRatio(fillRandom, 0); ratio < 0.9 {
+		t.Errorf("Expected random fill to gzip to at least 90%% of its size, got %.1f%%", ratio*100)
+	}
+
+	// Precompressed data is already gzipped, so compressing it again saves nothing
+	if ratio := gzipRatio(fillPrecompressed, 0); ratio < 0.99 {
+		t.Errorf("Expected precompressed fill to gzip to at least 99%% of its size, got %.1f%%", ratio*100)
+	}
+	for _, fill := range []string{fillZero, fillText} {
+		if ratio := gzipRatio(fill, 0); ratio > 0.01 {
+			t.Errorf("Expected %s fill to compress almost completely, got %.1f%%", fill, ratio*100)
+		}
+	}
+
+	// A compressible ratio shrinks the compressed layer
+	if half, most := gzipRatio(fillRandom, 0.5), gzipRatio(fillRandom, 0.9); half > 0.55 || most >= half {
+		t.Errorf("Expected compressible ratios 0.5 and 0.9 to gzip to about 50%% and 10%%, got %.1f%% and %.1f%%", half*100, most*100)
+	}
+
+	// Random fill is seeded like the rest of the layer
+	data := make([][]byte, 2)
+	for i := range data {
+		f := newLayerFile(64*size.KB, layerFileOptions{fill: fillRandom, seed: 7})
+		var err error
+		if data[i], err = io.ReadAll(f.reader()); err != nil {
+			t.Fatalf("Failed to read layer file: %v", err)
+		}
+	}
+	if !bytes.Equal(data[0], data[1]) {
+		t.Error("Expected the same seed to give the same random fill")
+	}
+}
+
+func TestCreateLayerFileSparse(t *testing.T) {
+	const fileSize = 256 * size.MB
+	layerDir := t.TempDir()
+	opts := layerFileOptions{fill: fillZero, magicHeaders: true, seed: 3}
+	start := time.Now()
+	stats, err := createLayerFile(context.Background(), layerDir, fileSize, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error creating zero layer file: %v", err)
+	}
+	// No data is written past the header, so only hashing the zeros takes any time
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected a sparse file to be created near-instantly, took %s", elapsed)
+	}
+
+	f := newLayerFile(fileSize, opts)
+	info, err := os.Stat(filepath.Join(layerDir, f.name))
+	if err != nil {
+		t.Fatalf("Failed to stat layer file: %v", err)
+	}
+	if info.Size() != fileSize {
+		t.Errorf("Expected the file to report %d bytes, got %d", fileSize, info.Size())
+	}
+
+	// The file reads back as its header followed by zeros, as the manifest records
+	expected, err := f.stats()
+	if err != nil {
+		t.Fatalf("Failed to hash layer file: %v", err)
+	}
+	if stats.Digest() != expected.Digest() {
+		t.Errorf("Expected digest %s, got %s", expected.Digest(), stats.Digest())
+	}
+	onDisk, err := manifest.StatDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to stat layer: %v", err)
+	}
+	if onDisk.Digest() != expected.Digest() {
+		t.Errorf("Expected the file on disk to have digest %s, got %s", expected.Digest(), onDisk.Digest())
+	}
+}
+
+func TestHashZeroRun(t *testing.T) {
+	// Later runs after the same header resume from the zeros already hashed, shorter or longer
+	header := []byte("zero-run-test")
+	runs := newZeroRuns()
+	for _, zeros := range []int64{3*zeroChunkSize + 5, 2*zeroChunkSize + 1, 4 * zeroChunkSize} {
+		fileSize := int64(len(header)) + zeros
+		var progress []int64
+		sum, err := hashZeroRun(context.Background(), header, fileSize, layerFileOptions{zeroRuns: runs, progress: func(n int64) { progress = append(progress, n) }})
+		if err != nil {
+			t.Fatalf("Unexpected error hashing %d bytes: %v", fileSize, err)
+		}
+		want := sha256.New()
+		want.Write(header)
+		io.CopyN(want, content.NewByteReader(0), zeros)
+		if !bytes.Equal(sum, want.Sum(nil)) {
+			t.Errorf("For %d bytes, expected sum %x, got %x", fileSize, want.Sum(nil), sum)
+		}
+		var total int64
+		for _, n := range progress {
+			total += n
+		}
+		if total != zeros {
+			t.Errorf("For %d bytes, expected %d bytes of progress, got %d", fileSize, zeros, total)
+		}
+		if zeros == 2*zeroChunkSize+1 && progress[0] != 2*zeroChunkSize {
+			t.Errorf("Expected the first two runs to be resumed, got progress %v", progress)
+		}
+	}
+}
+
+func TestCreateLayerFilePause(t *testing.T) {
+	gate := pause.New()
+	gate.Pause()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := createLayerFile(context.Background(), t.TempDir(), 4096, layerFileOptions{pause: gate})
+		done <- err
+	}()
+	waitForPause(t, gate, done)
+
+	// Hashing a sparse file's zeros also stalls, when paused partway through
+	gate = pause.New()
+	var once sync.Once
+	paused := make(chan struct{})
+	pauseOnce := func(int64) {
+		once.Do(func() {
+			gate.Pause()
+			close(paused)
+		})
+	}
+	go func() {
+		_, err := createLayerFile(context.Background(), t.TempDir(), 64*size.MB+7, layerFileOptions{fill: fillZero, pause: gate, progress: pauseOnce})
+		done <- err
+	}()
+	<-paused
+	waitForPause(t, gate, done)
+}
+
+// waitForPause checks that the layer file being created stalls while gate is paused, and that
+// done receives its result once gate is resumed
+func waitForPause(t *testing.T, gate *pause.Gate, done chan error) {
+	t.Helper()
+
+	// Writes stall while paused
+	select {
+	case <-done:
+		t.Fatal("Layer file was written while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// And complete once resumed
+	gate.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error creating layer file: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Layer file was not written after resuming")
+	}
+}
+
+func TestCreateLayerFileCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel after the first chunk of a layer far too big to finish quickly
+	var written int64
+	start := time.Now()
+	_, err := createLayerFile(ctx, t.TempDir(), 64*size.GB, layerFileOptions{
+		fill: fillZero,
+		progress: func(n int64) {
+			written += n
+			cancel()
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancellation to return promptly, took %v", elapsed)
+	}
+	if written >= 64*size.GB {
+		t.Error("Expected the layer to stop before it was fully written")
+	}
+}
+
+func TestVerifyLayerSizes(t *testing.T) {
+	for _, useMockFS := range []bool{false, true} {
+		cfg := &buildConfig{maxConcurrent: 2, mockFS: useMockFS, maxDepth: 3}
+		buildDir := t.TempDir()
+		sizes := []int64{64 * size.KB, 1 * size.MB}
+		if _, err := createLayersConcurrently(context.Background(), buildDir, sizes, cfg, nil, nil); err != nil {
+			t.Fatalf("Unexpected error creating layers (mock-fs %v): %v", useMockFS, err)
+		}
+
+		var out bytes.Buffer
+		if err := verifyLayerSizes(&out, buildDir, sizes, cfg.layerSizeTolerance()); err != nil {
+			t.Errorf("Expected the layers to match their requested sizes (mock-fs %v): %v", useMockFS, err)
+		}
+		if !strings.Contains(out.String(), "Layer 2: requested 1.00 MiB") {
+			t.Errorf("Expected a report for each layer, got %q", out.String())
+		}
+
+		// A layer beyond the tolerance is reported by number
+		extra := filepath.Join(buildDir, "layer2", "extra")
+		if err := os.WriteFile(extra, make([]byte, 20*size.KB), 0644); err != nil {
+			t.Fatalf("Failed to write extra file: %v", err)
+		}
+		err := verifyLayerSizes(io.Discard, buildDir, sizes, cfg.layerSizeTolerance())
+		if err == nil || !strings.Contains(err.Error(), "layer 2") || strings.Contains(err.Error(), "layer 1") {
+			t.Errorf("Expected only layer 2 to be reported (mock-fs %v), got %v", useMockFS, err)
+		}
+	}
+
+	// Mock filesystem layers may fall short by as much as --size-tolerance allows
+	cfg := &buildConfig{mockFS: true, sizeTolerance: 5}
+	if tolerance := cfg.layerSizeTolerance(); tolerance != 0.05 {
+		t.Errorf("Expected --size-tolerance to widen the tolerance to 0.05, got %g", tolerance)
+	}
+}
+
+func TestSeedSingleFileLayers(t *testing.T) {
+	sizes := []int64{64 * size.KB, 128 * size.KB, 64 * size.KB}
+	// contents creates the layers and returns each layer's file contents
+	contents := func(cfg *buildConfig) [][]byte {
+		buildDir := t.TempDir()
+		if _, err := createLayersConcurrently(context.Background(), buildDir, sizes, cfg, nil, nil); err != nil {
+			t.Fatalf("Unexpected error creating layers: %v", err)
+		}
+		result := make([][]byte, len(sizes))
+		for i, layerDir := range layerDirs(buildDir, len(sizes)) {
+			entries, err := os.ReadDir(layerDir)
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("Expected one file in layer %d, got %v (err: %v)", i+1, entries, err)
+			}
+			data, err := os.ReadFile(filepath.Join(layerDir, entries[0].Name()))
+			if err != nil {
+				t.Fatalf("Failed to read layer %d: %v", i+1, err)
+			}
+			result[i] = append([]byte(entries[0].Name()+"\n"), data...)
+		}
+		return result
+	}
+
+	for _, fill := range []string{fillRandom, fillPrecompressed} {
+		// Runs with the same seed match layer for layer, however many workers generate them
+		first := contents(&buildConfig{seed: 42, fill: fill, magicHeaders: true, maxConcurrent: 1})
+		second := contents(&buildConfig{seed: 42, fill: fill, magicHeaders: true, maxConcurrent: 3})
+		for i := range sizes {
+			if !bytes.Equal(first[i], second[i]) {
+				t.Errorf("Fill %s: expected layer %d to be identical with the same seed", fill, i+1)
+			}
+		}
+		// Each layer has its own seed, so same-sized layers differ
+		if bytes.Equal(first[0], first[2]) {
+			t.Errorf("Fill %s: expected layers 1 and 3 to differ", fill)
+		}
+		other := contents(&buildConfig{seed: 43, fill: fill, magicHeaders: true, maxConcurrent: 1})
+		if bytes.Equal(first[0], other[0]) {
+			t.Errorf("Fill %s: expected a different seed to give different content", fill)
+		}
+	}
+}
+
+func TestIdenticalLayers(t *testing.T) {
+	sizes := []int64{64 * size.KB, 32 * size.KB, 64 * size.KB, 64 * size.KB}
+	digests := func(cfg *buildConfig) []string {
+		buildDir := t.TempDir()
+		layers, err := createLayersConcurrently(context.Background(), buildDir, sizes, cfg, nil, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating layers: %v", err)
+		}
+		result := make([]string, len(layers))
+		for i, layerDir := range layerDirs(buildDir, len(layers)) {
+			stats, err := manifest.StatDir(layerDir)
+			if err != nil {
+				t.Fatalf("Failed to stat layer %d: %v", i+1, err)
+			}
+			if stats.Digest() != layers[i].Digest {
+				t.Errorf("Layer %d: manifest digest %s does not match disk %s", i+1, layers[i].Digest, stats.Digest())
+			}
+			result[i] = stats.Digest()
+		}
+		return result
+	}
+
+	for _, args := range [][]string{
+		{"--identical-layers", "test:v1"},
+		{"--identical-layers", "--magic-headers", "test:v1"},
+		{"--identical-layers", "--fill", "text", "test:v1"},
+		{"--identical-layers", "--mock-fs", "--mock-links", "0.2", "test:v1"},
+	} {
+		cfg, _, err := parseBuildArgs(append([]string{"--layer-sizes", "64KB"}, args...))
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %v: %v", args, err)
+		}
+		if cfg.seed == 0 {
+			t.Fatalf("Expected --identical-layers to pick a seed for %v", args)
+		}
+
+		// Layers of the same size hash to the same digest, files and names included
+		d := digests(cfg)
+		if d[0] != d[2] || d[0] != d[3] || d[0] == d[1] {
+			t.Errorf("Expected layers 1, 3, and 4 to be identical and layer 2 to differ with %v, got %v", args, d)
+		}
+
+		// Without the flag, random content differs between layers of the same size
+		if cfg.fill != fillText {
+			cfg.identicalLayers = false
+			if d := digests(cfg); d[0] == d[2] {
+				t.Errorf("Expected distinct layers without --identical-layers for %v, got %v", args, d)
+			}
+		}
+	}
+}
+
+func TestApplyOwnershipUnprivileged(t *testing.T) {
+	origIsPrivileged := isPrivileged
+	defer func() { isPrivileged = origIsPrivileged }()
+	isPrivileged = func() bool { return false }
+
+	buildDir := t.TempDir()
+	layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{4 * size.KB}, &buildConfig{maxConcurrent: 1}, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+
+	// Ownership is recorded in the manifest even when chown is skipped
+	if err := applyOwnership(io.Discard, buildDir, layers, 1000, -1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if layers[0].UID == nil || *layers[0].UID != 1000 || layers[0].GID != nil {
+		t.Errorf("Expected the manifest to record uid 1000 and no gid, got %+v", layers[0])
+	}
+}
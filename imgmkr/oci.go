@@ -0,0 +1,531 @@
+package imgmkr
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// tarOptions controls how layer directories are written as tar streams
+type tarOptions struct {
+	deterministic bool // Zero ownership and timestamps and normalize permissions
+	keepModes     bool // Keep permissions when deterministic, as they were set explicitly
+	uid           *int // Owner to record for every entry (nil = from the file, or 0 if deterministic)
+	gid           *int // Group to record for every entry (nil = from the file, or 0 if deterministic)
+}
+
+// writeLayerTar writes the contents of layerDir to w as an uncompressed tar stream, with entry
+// names relative to layerDir. Entries are written in lexical order, and a file seen before under
+// another name is written as a hardlink to that name. If opts.deterministic is set, ownership
+// and timestamps are zeroed and permissions normalized so the stream depends only on the files'
+// names and contents. The requested uid and gid are set on every entry either way.
+func writeLayerTar(w io.Writer, layerDir string, opts tarOptions) error {
+	tw := tar.NewWriter(w)
+	var links manifest.Hardlinks
+	err := filepath.WalkDir(layerDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(layerDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		if info.Mode().IsRegular() {
+			if first, ok := links.Seen(header.Name, info); ok {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first, 0
+			}
+		}
+		if opts.deterministic {
+			mode := header.Mode
+			normalizeHeader(header)
+			if opts.keepModes {
+				header.Mode = mode
+			}
+		}
+		if opts.uid != nil {
+			header.Uid, header.Uname = *opts.uid, ""
+		}
+		if opts.gid != nil {
+			header.Gid, header.Gname = *opts.gid, ""
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive layer directory %s: %w", layerDir, err)
+	}
+	return tw.Close()
+}
+
+// writeFileLayerTar writes a tar stream holding only f, generated as it is written, with the given
+// modification time. Ownership and permissions follow the same rules as writeLayerTar. The file's
+// contents are hashed as they are written, and onSum (if not nil) is called with the SHA-256 once
+// the whole file has been written.
+func writeFileLayerTar(w io.Writer, f layerFile, modTime time.Time, opts tarOptions, onSum func(sum []byte)) error {
+	tw := tar.NewWriter(w)
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     f.name,
+		Size:     f.size,
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+	if opts.deterministic {
+		normalizeHeader(header)
+	}
+	if opts.uid != nil {
+		header.Uid = *opts.uid
+	}
+	if opts.gid != nil {
+		header.Gid = *opts.gid
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, hash), f.reader()); err != nil {
+		return fmt.Errorf("failed to stream %s: %w", f.name, err)
+	}
+	if onSum != nil {
+		onSum(hash.Sum(nil))
+	}
+	return tw.Close()
+}
+
+// normalizeHeader clears the parts of a tar header that vary between runs and machines
+func normalizeHeader(header *tar.Header) {
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+	header.ModTime = time.Unix(0, 0)
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		header.Mode = 0755
+	case tar.TypeSymlink:
+		header.Mode = 0777
+	default:
+		header.Mode = 0644
+	}
+}
+
+// layerFromDir creates an image layer from the contents of a layer directory
+func layerFromDir(layerDir string, opts tarOptions) (v1.Layer, error) {
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeLayerTar(pw, layerDir, opts))
+		}()
+		return pr, nil
+	})
+}
+
+// layerFromFile creates an image layer holding only f, generating its contents each time the
+// layer is read rather than from a file on disk. onSum is called with the file's SHA-256 each time
+// the whole file is read (may be nil).
+func layerFromFile(f layerFile, modTime time.Time, opts tarOptions, onSum func(sum []byte)) (v1.Layer, error) {
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeFileLayerTar(pw, f, modTime, opts, onSum))
+		}()
+		return pr, nil
+	})
+}
+
+// readBaseTarball loads an image tarball (as written by `docker save` or imgmkr) and checks it is well-formed
+func readBaseTarball(path string) (v1.Image, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to read base image tarball: %w", err)
+	}
+	img, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base image tarball %s: %w", path, err)
+	}
+	if err := validate.Image(img, validate.Fast); err != nil {
+		return nil, fmt.Errorf("base image tarball %s is not a well-formed image: %w", path, err)
+	}
+	return img, nil
+}
+
+// scratchBase returns an empty Linux image for the current architecture, the equivalent of
+// FROM scratch, for building an image from the generated layers alone
+func scratchBase() (v1.Image, error) {
+	img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{
+		OS:           "linux",
+		Architecture: runtime.GOARCH,
+		RootFS:       v1.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create empty base image: %w", err)
+	}
+	return img, nil
+}
+
+// layerHistory returns an image config history entry for each generated layer, recording how it
+// was made. Layers whose tar would have no entries (empty[i]) are marked as empty layers; a nil
+// empty marks none.
+func layerHistory(layers []manifest.Layer, empty []bool, created time.Time) []v1.History {
+	history := make([]v1.History, len(layers))
+	for i, layer := range layers {
+		history[i] = v1.History{
+			Created:    v1.Time{Time: created},
+			CreatedBy:  fmt.Sprintf("imgmkr ADD layer%d / # %s %s, %d files", layer.Number, size.Format(layer.RequestedSize), layer.ContentMode, layer.FileCount),
+			Comment:    "synthetic layer generated by imgmkr",
+			EmptyLayer: empty != nil && empty[i],
+		}
+	}
+	return history
+}
+
+// emptyLayerDirs reports for each layer directory whether it has no entries, so its layer tar
+// would be empty. Directories holding only empty files, empty subdirectories, or whiteouts are
+// not empty.
+func emptyLayerDirs(layerDirs []string) ([]bool, error) {
+	empty := make([]bool, len(layerDirs))
+	for i, dir := range layerDirs {
+		f, err := os.Open(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer directory %s: %w", dir, err)
+		}
+		_, err = f.Readdirnames(1)
+		f.Close()
+		switch {
+		case err == io.EOF:
+			empty[i] = true
+		case err != nil:
+			return nil, fmt.Errorf("failed to read layer directory %s: %w", dir, err)
+		}
+	}
+	return empty, nil
+}
+
+// appendOptions controls how appendToTarball builds the derived image
+type appendOptions struct {
+	tarOptions
+	history       []v1.History             // Config history entry for each layer; layers marked empty are left out (may be nil)
+	maxConcurrent int                      // Maximum number of layer blobs to produce at once (0 = 1)
+	labels        map[string]string        // Labels to add to the image config (may be nil)
+	env           []keyValue               // Environment variables to set in the image config, in order (may be nil)
+	entrypoint    []string                 // Entrypoint to set in the image config (nil = inherited)
+	cmd           []string                 // Default command to set in the image config (nil = inherited, unless entrypoint is set)
+	annotations   func() map[string]string // Returns the annotations to add to the image manifest, once the layers are created (may be nil)
+}
+
+// layersFromDirs creates an image layer from each layer directory, tarring, compressing, and
+// digesting up to maxWorkers layers at once. Directories for which skip is true get a nil layer.
+// Layers are returned in the same order as layerDirs.
+func layersFromDirs(layerDirs []string, skip []bool, opts tarOptions, maxWorkers int) ([]v1.Layer, error) {
+	return createLayers(len(layerDirs), skip, maxWorkers, func(i int) (v1.Layer, error) {
+		layer, err := layerFromDir(layerDirs[i], opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create layer from %s: %w", layerDirs[i], err)
+		}
+		return layer, nil
+	})
+}
+
+// layersFromFiles creates a streamed image layer from each single-file layer, up to maxWorkers at
+// once. Files for which skip is true get a nil layer. Layers are returned in the same order as files.
+// Creating a layer reads it to digest it, so onSum (if not nil) has been called with the SHA-256 of
+// every file not skipped by the time they are returned.
+func layersFromFiles(files []layerFile, skip []bool, modTime time.Time, opts tarOptions, maxWorkers int, onSum func(i int, sum []byte)) ([]v1.Layer, error) {
+	return createLayers(len(files), skip, maxWorkers, func(i int) (v1.Layer, error) {
+		var fileSum func([]byte)
+		if onSum != nil {
+			fileSum = func(sum []byte) { onSum(i, sum) }
+		}
+		layer, err := layerFromFile(files[i], modTime, opts, fileSum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create layer %d: %w", i+1, err)
+		}
+		return layer, nil
+	})
+}
+
+// createLayers calls newLayer for each of count layers, up to maxWorkers at once, skipping
+// those for which skip is true, and returns the layers in order
+func createLayers(count int, skip []bool, maxWorkers int, newLayer func(i int) (v1.Layer, error)) ([]v1.Layer, error) {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+
+	layers := make([]v1.Layer, count)
+	errs := make([]error, count)
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < maxWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				layers[i], errs[i] = newLayer(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		if skip == nil || !skip[i] {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+// appendToTarball appends one layer per layer directory to the image in basePath, or to an empty
+// image if basePath is empty, and writes the derived image, tagged repoTag, to outPath. It returns
+// the digest of the image's manifest.
+func appendToTarball(basePath string, outPath string, repoTag string, layerDirs []string, opts appendOptions) (string, error) {
+	return appendLayers(basePath, outPath, repoTag, opts, func(empty []bool) ([]v1.Layer, error) {
+		return layersFromDirs(layerDirs, empty, opts.tarOptions, opts.maxConcurrent)
+	})
+}
+
+// streamToTarball appends one streamed layer per single-file layer to the image in basePath (or
+// an empty image, as for appendToTarball) and writes the derived image, tagged repoTag, to outPath. Layer contents are generated as the
+// layers are digested and written, so nothing but the output tarball touches the disk, and onSum
+// is called with the SHA-256 of file i each time it is generated (see layersFromFiles). It returns
+// the digest of the image's manifest.
+func streamToTarball(basePath string, outPath string, repoTag string, files []layerFile, modTime time.Time, opts appendOptions, onSum func(i int, sum []byte)) (string, error) {
+	return appendLayers(basePath, outPath, repoTag, opts, func(empty []bool) ([]v1.Layer, error) {
+		return layersFromFiles(files, empty, modTime, opts.tarOptions, opts.maxConcurrent, onSum)
+	})
+}
+
+// configureImage returns img with the labels, environment, entrypoint, and command in opts set in
+// its config, as the equivalent Dockerfile instructions would set them
+func configureImage(img v1.Image, opts appendOptions) (v1.Image, error) {
+	if len(opts.labels) == 0 && len(opts.env) == 0 && opts.entrypoint == nil && opts.cmd == nil {
+		return img, nil
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	config := *cfg.Config.DeepCopy()
+	if len(opts.labels) > 0 && config.Labels == nil {
+		config.Labels = make(map[string]string, len(opts.labels))
+	}
+	for key, value := range opts.labels {
+		config.Labels[key] = value
+	}
+	for _, env := range opts.env {
+		config.Env = setEnv(config.Env, env)
+	}
+	// As with ENTRYPOINT, a new entrypoint drops the command inherited from the base image
+	if opts.entrypoint != nil {
+		config.Entrypoint = opts.entrypoint
+		config.Cmd = nil
+	}
+	if opts.cmd != nil {
+		config.Cmd = opts.cmd
+	}
+	img, err = mutate.Config(img, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure image: %w", err)
+	}
+	return img, nil
+}
+
+// setEnv returns env, a list of KEY=value entries, with kv replacing any entry for the same key
+func setEnv(env []string, kv keyValue) []string {
+	for i, entry := range env {
+		if key, _, _ := strings.Cut(entry, "="); key == kv.key {
+			env[i] = kv.String()
+			return env
+		}
+	}
+	return append(env, kv.String())
+}
+
+// appendLayers appends the layers made by newLayers to the image in basePath (or an empty image
+// if basePath is empty) and writes the derived image, tagged repoTag, to outPath. newLayers is told which layers are history-only
+// empty layers and must return a nil layer for them. It returns the digest of the image's manifest.
+func appendLayers(basePath string, outPath string, repoTag string, opts appendOptions, newLayers func(empty []bool) ([]v1.Layer, error)) (string, error) {
+	tag, err := name.NewTag(repoTag)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", repoTag, err)
+	}
+
+	var base v1.Image
+	if basePath != "" {
+		base, err = readBaseTarball(basePath)
+	} else {
+		base, err = scratchBase()
+	}
+	if err != nil {
+		return "", err
+	}
+	img, err := deriveImage(base, opts, newLayers)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tarball.WriteToFile(outPath, tag, img); err != nil {
+		return "", fmt.Errorf("failed to write image tarball: %w", err)
+	}
+	return imageDigest(img)
+}
+
+// imageDigest returns the digest of img's manifest
+func imageDigest(img v1.Image) (string, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return "", fmt.Errorf("failed to compute image digest: %w", err)
+	}
+	return digest.String(), nil
+}
+
+// deriveImage appends the layers returned by newLayers to base, with the history, config, and
+// annotations in opts
+func deriveImage(base v1.Image, opts appendOptions, newLayers func(empty []bool) ([]v1.Layer, error)) (v1.Image, error) {
+	// Empty layers are recorded in history only
+	var empty []bool
+	if opts.history != nil {
+		empty = make([]bool, len(opts.history))
+		for i, entry := range opts.history {
+			empty[i] = entry.EmptyLayer
+		}
+	}
+	layers, err := newLayers(empty)
+	if err != nil {
+		return nil, err
+	}
+
+	adds := make([]mutate.Addendum, len(layers))
+	for i := range adds {
+		adds[i].Layer = layers[i]
+		if opts.history != nil {
+			adds[i].History = opts.history[i]
+		}
+	}
+
+	img, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to append layers: %w", err)
+	}
+	if img, err = configureImage(img, opts); err != nil {
+		return nil, err
+	}
+	if opts.annotations != nil {
+		if annotations := opts.annotations(); len(annotations) > 0 {
+			img = mutate.Annotations(img, annotations).(v1.Image)
+		}
+	}
+	return img, nil
+}
+
+// pushBackoff retries transient registry errors during a direct push, up to five attempts
+// waiting 1s, 2s, 4s, and 8s in between
+var pushBackoff = remote.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: 5}
+
+// pushToRegistry appends one layer per layer directory to an empty image and pushes it to
+// repoTag without a container daemon, authenticating with the credentials docker login stores.
+// The push stops once ctx is done. It returns the digest of the pushed manifest.
+func pushToRegistry(ctx context.Context, repoTag string, layerDirs []string, opts appendOptions) (string, error) {
+	tag, err := name.NewTag(repoTag)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", repoTag, err)
+	}
+	base, err := scratchBase()
+	if err != nil {
+		return "", err
+	}
+	img, err := deriveImage(base, opts, func(empty []bool) ([]v1.Layer, error) {
+		return layersFromDirs(layerDirs, empty, opts.tarOptions, opts.maxConcurrent)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = remote.Write(tag, img,
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithRetryBackoff(pushBackoff),
+		remote.WithJobs(max(opts.maxConcurrent, 1)))
+	var transportErr *transport.Error
+	switch {
+	case errors.As(err, &transportErr) && (transportErr.StatusCode == http.StatusUnauthorized || transportErr.StatusCode == http.StatusForbidden):
+		return "", fmt.Errorf("registry %s refused the credentials for %s (log in with docker login): %w", tag.RegistryStr(), repoTag, err)
+	case err != nil:
+		return "", fmt.Errorf("failed to push image to %s: %w", tag.RegistryStr(), err)
+	}
+	return imageDigest(img)
+}
+
+// layerAnnotationPrefix starts the manifest annotation keys describing each generated layer
+const layerAnnotationPrefix = "dev.imgmkr.layer."
+
+// layerAnnotations returns manifest annotations recording each generated layer's requested size
+// and content digest, keyed by layer number, e.g. dev.imgmkr.layer.1.size
+func layerAnnotations(layers []manifest.Layer) map[string]string {
+	annotations := make(map[string]string, 2*len(layers))
+	for _, layer := range layers {
+		key := fmt.Sprintf("%s%d.", layerAnnotationPrefix, layer.Number)
+		annotations[key+"size"] = strconv.FormatInt(layer.RequestedSize, 10)
+		annotations[key+"digest"] = layer.Digest
+	}
+	return annotations
+}
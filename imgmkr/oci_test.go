@@ -0,0 +1,752 @@
+package imgmkr
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// writeBaseTarball writes a random image with the given number of layers to a tarball
+func writeBaseTarball(t *testing.T, numLayers int64) string {
+	img, err := random.Image(1024, numLayers)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "base.tar")
+	if err := tarball.WriteToFile(path, name.MustParseReference("base:v1"), img); err != nil {
+		t.Fatalf("Failed to write base tarball: %v", err)
+	}
+	return path
+}
+
+func TestWriteLayerTar(t *testing.T) {
+	layerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(layerDir, "dir1"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(layerDir, "dir1", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeLayerTar(&buf, layerDir, tarOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 2 || names[0] != "dir1/" || names[1] != "dir1/file" {
+		t.Errorf("Expected entries [dir1/ dir1/file], got %v", names)
+	}
+}
+
+func TestWriteLayerTarLinks(t *testing.T) {
+	layerDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(layerDir, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Link(filepath.Join(layerDir, "a"), filepath.Join(layerDir, "b")); err != nil {
+		t.Skipf("Hardlinks not supported: %v", err)
+	}
+	if err := os.Symlink("a", filepath.Join(layerDir, "c")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeLayerTar(&buf, layerDir, tarOptions{deterministic: true}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The second name of the file is a hardlink to the first, without the data again
+	expected := []tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Size: 5},
+		{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"},
+		{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a"},
+	}
+	tr := tar.NewReader(&buf)
+	for _, want := range expected {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		if header.Name != want.Name || header.Typeflag != want.Typeflag || header.Linkname != want.Linkname || header.Size != want.Size {
+			t.Errorf("Expected entry %s (type %c, link %q, %d bytes), got %s (type %c, link %q, %d bytes)",
+				want.Name, want.Typeflag, want.Linkname, want.Size, header.Name, header.Typeflag, header.Linkname, header.Size)
+		}
+	}
+}
+
+func TestWriteLayerTarKeepModes(t *testing.T) {
+	layerDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(layerDir, "secret"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(layerDir, "secret"), 0600); err != nil {
+		t.Fatalf("Failed to set mode: %v", err)
+	}
+
+	// Deterministic output normalizes permissions unless they were set on purpose
+	for _, test := range []struct {
+		keepModes bool
+		mode      int64
+	}{
+		{false, 0644},
+		{true, 0600},
+	} {
+		var buf bytes.Buffer
+		if err := writeLayerTar(&buf, layerDir, tarOptions{deterministic: true, keepModes: test.keepModes}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		header, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		if header.Mode != test.mode {
+			t.Errorf("keepModes %v: expected mode %o, got %o", test.keepModes, test.mode, header.Mode)
+		}
+	}
+}
+
+func TestWriteLayerTarOwnership(t *testing.T) {
+	layerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(layerDir, "dir1"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(layerDir, "dir1", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	uid, gid := 1234, 5678
+	var buf bytes.Buffer
+	if err := writeLayerTar(&buf, layerDir, tarOptions{deterministic: true, uid: &uid, gid: &gid}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		if header.Uid != uid || header.Gid != gid {
+			t.Errorf("Entry %s: expected owner %d:%d, got %d:%d", header.Name, uid, gid, header.Uid, header.Gid)
+		}
+	}
+}
+
+func TestAppendToTarball(t *testing.T) {
+	basePath := writeBaseTarball(t, 2)
+
+	layerDir := t.TempDir()
+	if _, err := createLayerFile(context.Background(), layerDir, 4096, layerFileOptions{}); err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+
+	outPath := filepath.Join(t.TempDir(), "derived.tar")
+	if _, err := appendToTarball(basePath, outPath, "derived:v1", []string{layerDir}, appendOptions{}); err != nil {
+		t.Fatalf("Unexpected error appending to tarball: %v", err)
+	}
+
+	derived, err := tarball.ImageFromPath(outPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to read derived tarball: %v", err)
+	}
+	layers, err := derived.Layers()
+	if err != nil {
+		t.Fatalf("Failed to read derived layers: %v", err)
+	}
+	if len(layers) != 3 {
+		t.Errorf("Expected 3 layers after appending one to a 2-layer base, got %d", len(layers))
+	}
+}
+
+func TestWriteImageTarball(t *testing.T) {
+	// Without a base tarball the layers are written onto an empty image
+	var layerDirs []string
+	var wantDiffIDs []v1.Hash
+	for _, layerSize := range []int64{4096, 8192} {
+		layerDir := t.TempDir()
+		if _, err := createLayerFile(context.Background(), layerDir, layerSize, layerFileOptions{}); err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		layer, err := layerFromDir(layerDir, tarOptions{})
+		if err != nil {
+			t.Fatalf("Failed to create layer tarball: %v", err)
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			t.Fatalf("Failed to compute diff ID: %v", err)
+		}
+		layerDirs = append(layerDirs, layerDir)
+		wantDiffIDs = append(wantDiffIDs, diffID)
+	}
+
+	outPath := filepath.Join(t.TempDir(), "image.tar")
+	digest, err := appendToTarball("", outPath, "scratch-image:v1", layerDirs, appendOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error writing tarball: %v", err)
+	}
+
+	img, err := tarball.ImageFromPath(outPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to read image tarball: %v", err)
+	}
+	if err := validate.Image(img); err != nil {
+		t.Fatalf("Image is not valid: %v", err)
+	}
+	if want, err := img.Digest(); err != nil || digest != want.String() {
+		t.Errorf("Expected the written image's digest %s, got %s", want, digest)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if len(m.Layers) != 2 {
+		t.Fatalf("Expected 2 layers in the manifest, got %d", len(m.Layers))
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if cfg.OS != "linux" || cfg.Architecture == "" {
+		t.Errorf("Expected a linux config with an architecture, got %s/%s", cfg.OS, cfg.Architecture)
+	}
+	if len(cfg.RootFS.DiffIDs) != 2 {
+		t.Fatalf("Expected 2 diff IDs in the config, got %d", len(cfg.RootFS.DiffIDs))
+	}
+	for i, want := range wantDiffIDs {
+		if got := cfg.RootFS.DiffIDs[i]; got != want {
+			t.Errorf("Layer %d: expected diff ID %s, got %s", i+1, want, got)
+		}
+	}
+}
+
+func TestBuildImageTarball(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "image.tar")
+	tmpdir := t.TempDir()
+	err := RunBuild([]string{"--layer-sizes", "4KB,8KB", "--output", outPath, "--tmpdir-prefix", tmpdir, "tarball:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error building image tarball: %v", err)
+	}
+
+	tag := name.MustParseReference("tarball:v1").(name.Tag)
+	img, err := tarball.ImageFromPath(outPath, &tag)
+	if err != nil {
+		t.Fatalf("Failed to read image tarball: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Failed to read layers: %v", err)
+	}
+	if len(layers) != 2 {
+		t.Errorf("Expected 2 layers, got %d", len(layers))
+	}
+
+	entries, err := os.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatalf("Failed to read tmpdir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected the build directory to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestBuildImageTarballSquash(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "image.tar")
+	err := RunBuild([]string{"--layer-sizes", "4KB,4KB,8KB", "--squash", "--output", outPath, "--tmpdir-prefix", t.TempDir(), "squash:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error building squashed image tarball: %v", err)
+	}
+
+	tag := name.MustParseReference("squash:v1").(name.Tag)
+	img, err := tarball.ImageFromPath(outPath, &tag)
+	if err != nil {
+		t.Fatalf("Failed to read image tarball: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Failed to read layers: %v", err)
+	}
+	if len(layers) != 1 {
+		t.Fatalf("Expected 1 layer, got %d", len(layers))
+	}
+
+	// Each generated layer's files are kept under its own directory, so none are lost
+	rc, err := layers[0].Uncompressed()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	defer rc.Close()
+	sizes := make(map[string]int64)
+	var total int64
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read layer tar: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			sizes[strings.SplitN(strings.TrimPrefix(hdr.Name, "/"), "/", 2)[0]] += hdr.Size
+			total += hdr.Size
+		}
+	}
+	if total != 16*size.KB {
+		t.Errorf("Expected %d bytes of files, got %d", 16*size.KB, total)
+	}
+	expected := map[string]int64{"layer1": 4 * size.KB, "layer2": 4 * size.KB, "layer3": 8 * size.KB}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected file sizes by directory %v, got %v", expected, sizes)
+	}
+}
+
+func TestPushToRegistry(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	sizes := []int64{4096, 8192}
+	var layerDirs []string
+	for _, layerSize := range sizes {
+		layerDir := t.TempDir()
+		if _, err := createLayerFile(context.Background(), layerDir, layerSize, layerFileOptions{}); err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		layerDirs = append(layerDirs, layerDir)
+	}
+
+	repoTag := host + "/pushed:v1"
+	digest, err := pushToRegistry(context.Background(), repoTag, layerDirs, appendOptions{maxConcurrent: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error pushing: %v", err)
+	}
+
+	ref, err := name.ParseReference(repoTag)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", repoTag, err)
+	}
+	img, err := remote.Image(ref)
+	if err != nil {
+		t.Fatalf("Failed to pull pushed image: %v", err)
+	}
+	if want, err := img.Digest(); err != nil || digest != want.String() {
+		t.Errorf("Expected the pushed image's digest %s, got %s", want, digest)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if len(m.Layers) != len(sizes) {
+		t.Fatalf("Expected %d layers in the pushed manifest, got %d", len(sizes), len(m.Layers))
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Failed to read layers: %v", err)
+	}
+	for i, layer := range layers {
+		// Random content doesn't compress, so each layer holds at least its file
+		if m.Layers[i].Size < sizes[i] {
+			t.Errorf("Layer %d: expected a compressed size of at least %d, got %d", i+1, sizes[i], m.Layers[i].Size)
+		}
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			t.Fatalf("Failed to read layer %d: %v", i+1, err)
+		}
+		tr := tar.NewReader(rc)
+		var total int64
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read layer %d tar: %v", i+1, err)
+			}
+			total += header.Size
+		}
+		rc.Close()
+		if total != sizes[i] {
+			t.Errorf("Layer %d: expected %d bytes of files, got %d", i+1, sizes[i], total)
+		}
+	}
+}
+
+func TestPushToRegistryUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	layerDir := t.TempDir()
+	if _, err := createLayerFile(context.Background(), layerDir, 4096, layerFileOptions{}); err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	_, err := pushToRegistry(context.Background(), host+"/private:v1", []string{layerDir}, appendOptions{})
+	if err == nil || !strings.Contains(err.Error(), "docker login") {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+}
+
+func TestAppendToTarballHistory(t *testing.T) {
+	basePath := writeBaseTarball(t, 2)
+	base, err := readBaseTarball(basePath)
+	if err != nil {
+		t.Fatalf("Failed to read base tarball: %v", err)
+	}
+	baseConfig, err := base.ConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to read base config: %v", err)
+	}
+
+	// One layer with content, one holding only an empty file, and one without any entries
+	buildDir := t.TempDir()
+	layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{4096, 0}, &buildConfig{maxConcurrent: 2}, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+	layers = append(layers, manifest.Layer{Number: 3, ContentMode: layers[0].ContentMode})
+	layerDirs := []string{filepath.Join(buildDir, "layer1"), filepath.Join(buildDir, "layer2"), filepath.Join(buildDir, "layer3")}
+	if err := os.Mkdir(layerDirs[2], 0755); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := emptyLayerDirs(layerDirs)
+	if err != nil {
+		t.Fatalf("Unexpected error checking layer directories: %v", err)
+	}
+	history := layerHistory(layers, empty, time.Now())
+
+	outPath := filepath.Join(t.TempDir(), "derived.tar")
+	if _, err := appendToTarball(basePath, outPath, "derived:v1", layerDirs, appendOptions{history: history}); err != nil {
+		t.Fatalf("Unexpected error appending to tarball: %v", err)
+	}
+
+	derived, err := tarball.ImageFromPath(outPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to read derived tarball: %v", err)
+	}
+	config, err := derived.ConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to read derived config: %v", err)
+	}
+	added := config.History[len(baseConfig.History):]
+	if len(added) != len(layers) {
+		t.Fatalf("Expected %d history entries for %d layers, got %d", len(layers), len(layers), len(added))
+	}
+	for i, entry := range added {
+		if !strings.Contains(entry.CreatedBy, layers[i].ContentMode) || entry.Created.IsZero() || entry.Comment == "" {
+			t.Errorf("History entry %d is missing fields: %+v", i, entry)
+		}
+	}
+	if added[0].EmptyLayer || added[1].EmptyLayer || !added[2].EmptyLayer {
+		t.Errorf("Expected only the layer without entries to be marked empty, got %v, %v, and %v", added[0].EmptyLayer, added[1].EmptyLayer, added[2].EmptyLayer)
+	}
+
+	// Empty layers are recorded in history only
+	derivedLayers, err := derived.Layers()
+	if err != nil {
+		t.Fatalf("Failed to read derived layers: %v", err)
+	}
+	if len(derivedLayers) != len(config.RootFS.DiffIDs) || len(derivedLayers) != 4 {
+		t.Errorf("Expected 4 layers matching the diff IDs, got %d layers and %d diff IDs", len(derivedLayers), len(config.RootFS.DiffIDs))
+	}
+}
+
+func TestDeriveImageAnnotations(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	buildDir := t.TempDir()
+	layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{4096, 8192}, &buildConfig{maxConcurrent: 2}, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+	layerDirs := []string{filepath.Join(buildDir, "layer1"), filepath.Join(buildDir, "layer2")}
+
+	cfg := &buildConfig{maxConcurrent: 2, manifestAnnotations: true}
+	opts, err := cfg.appendOptions(layers, layerDirs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	img, err := deriveImage(base, opts, func(empty []bool) ([]v1.Layer, error) {
+		return layersFromDirs(layerDirs, empty, opts.tarOptions, opts.maxConcurrent)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error deriving image: %v", err)
+	}
+	// Check the manifest as it would be pushed
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+
+	for _, layer := range layers {
+		key := fmt.Sprintf("dev.imgmkr.layer.%d.", layer.Number)
+		if got := m.Annotations[key+"size"]; got != fmt.Sprint(layer.RequestedSize) {
+			t.Errorf("Expected %ssize %d, got %q", key, layer.RequestedSize, got)
+		}
+		if got := m.Annotations[key+"digest"]; got == "" || got != layer.Digest {
+			t.Errorf("Expected %sdigest %s, got %q", key, layer.Digest, got)
+		}
+	}
+	if len(m.Annotations) != 2*len(layers) {
+		t.Errorf("Expected %d annotations, got %v", 2*len(layers), m.Annotations)
+	}
+	// Annotations are only added when asked for
+	cfg.manifestAnnotations = false
+	if opts, _ := cfg.appendOptions(layers, layerDirs); opts.annotations != nil {
+		t.Errorf("Expected no annotations, got %v", opts.annotations())
+	}
+}
+
+func TestDeriveImageConfig(t *testing.T) {
+	base, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	base, err = mutate.Config(base, v1.Config{Env: []string{"PATH=/bin", "GREETING=old"}, Cmd: []string{"old"}})
+	if err != nil {
+		t.Fatalf("Failed to configure base image: %v", err)
+	}
+	noLayers := func(empty []bool) ([]v1.Layer, error) { return nil, nil }
+
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1KB", "--label", "purpose=test", "--env", "GREETING=hello world", "--env", "EXTRA=1", "--entrypoint", "/bin/sh -c", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts, err := cfg.appendOptions(nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	img, err := deriveImage(base, opts, noLayers)
+	if err != nil {
+		t.Fatalf("Unexpected error deriving image: %v", err)
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if expected := []string{"PATH=/bin", "GREETING=hello world", "EXTRA=1"}; !reflect.DeepEqual(config.Config.Env, expected) {
+		t.Errorf("Expected env %q, got %q", expected, config.Config.Env)
+	}
+	if expected := []string{"/bin/sh", "-c"}; !reflect.DeepEqual(config.Config.Entrypoint, expected) {
+		t.Errorf("Expected entrypoint %q, got %q", expected, config.Config.Entrypoint)
+	}
+	// A new entrypoint drops the base image's command
+	if config.Config.Cmd != nil {
+		t.Errorf("Expected no command, got %q", config.Config.Cmd)
+	}
+	if got := config.Config.Labels["purpose"]; got != "test" {
+		t.Errorf("Expected label purpose=test, got %q", got)
+	}
+
+	// The base image's command is kept unless replaced
+	img, err = deriveImage(base, appendOptions{}, noLayers)
+	if err != nil {
+		t.Fatalf("Unexpected error deriving image: %v", err)
+	}
+	if config, err = img.ConfigFile(); err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if expected := []string{"old"}; !reflect.DeepEqual(config.Config.Cmd, expected) {
+		t.Errorf("Expected command %q, got %q", expected, config.Config.Cmd)
+	}
+	img, err = deriveImage(base, appendOptions{cmd: []string{"echo", "new"}}, noLayers)
+	if err != nil {
+		t.Fatalf("Unexpected error deriving image: %v", err)
+	}
+	if config, err = img.ConfigFile(); err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if expected := []string{"echo", "new"}; !reflect.DeepEqual(config.Config.Cmd, expected) {
+		t.Errorf("Expected command %q, got %q", expected, config.Config.Cmd)
+	}
+}
+
+func TestAppendToTarballConcurrent(t *testing.T) {
+	basePath := writeBaseTarball(t, 1)
+	buildDir := t.TempDir()
+	cfg := &buildConfig{maxConcurrent: 4, mockFS: true, maxDepth: 2}
+	layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{16 * 1024, 32 * 1024, 8 * 1024, 64 * 1024}, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+	layerDirs := make([]string, len(layers))
+	for i := range layerDirs {
+		layerDirs[i] = filepath.Join(buildDir, fmt.Sprintf("layer%d", i+1))
+	}
+
+	// imageDigest builds the image with the given concurrency and returns its digest
+	imageDigest := func(maxConcurrent int) string {
+		outPath := filepath.Join(t.TempDir(), "derived.tar")
+		opts := appendOptions{tarOptions: tarOptions{deterministic: true}, maxConcurrent: maxConcurrent}
+		if _, err := appendToTarball(basePath, outPath, "derived:v1", layerDirs, opts); err != nil {
+			t.Fatalf("Unexpected error appending to tarball: %v", err)
+		}
+		img, err := tarball.ImageFromPath(outPath, nil)
+		if err != nil {
+			t.Fatalf("Failed to read derived tarball: %v", err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatalf("Failed to compute image digest: %v", err)
+		}
+		return digest.String()
+	}
+
+	if serial, concurrent := imageDigest(1), imageDigest(4); serial != concurrent {
+		t.Errorf("Expected identical images built serially and concurrently, got %s and %s", serial, concurrent)
+	}
+}
+
+func TestReadBaseTarballInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bogus.tar")
+	if err := os.WriteFile(path, []byte("not a tarball"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := readBaseTarball(path); err == nil {
+		t.Error("Expected an error for a malformed base tarball")
+	}
+	if _, err := readBaseTarball(filepath.Join(t.TempDir(), "missing.tar")); err == nil {
+		t.Error("Expected an error for a missing base tarball")
+	}
+}
+
+func TestStreamBuild(t *testing.T) {
+	basePath := writeBaseTarball(t, 2)
+	outDir := t.TempDir()
+	outPath := filepath.Join(outDir, "streamed.tar")
+	manifestPath := filepath.Join(outDir, "layers.json")
+
+	// Anything written to a build directory would land in TMPDIR
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	err := RunBuild([]string{"--layer-sizes", "4KB,1MB", "--magic-headers", "--deterministic", "--stream-layers",
+		"--manifest-file", manifestPath, "--append-to-tar", basePath, "--output", outPath, "streamed:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error streaming layers: %v", err)
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read TMPDIR: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no build directory to be written, found %d entries in TMPDIR", len(entries))
+	}
+
+	derived, err := tarball.ImageFromPath(outPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to read derived tarball: %v", err)
+	}
+	if err := validate.Image(derived); err != nil {
+		t.Fatalf("Derived image is not valid: %v", err)
+	}
+	layers, err := derived.Layers()
+	if err != nil {
+		t.Fatalf("Failed to read derived layers: %v", err)
+	}
+	if len(layers) != 4 {
+		t.Fatalf("Expected 4 layers after streaming two onto a 2-layer base, got %d", len(layers))
+	}
+
+	// Streamed layers match the same layers written to disk, and the manifest matches both
+	recorded, err := manifest.Read(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to read layer manifest: %v", err)
+	}
+	for i, layerSize := range []int64{4 * size.KB, 1 * size.MB} {
+		layerDir := t.TempDir()
+		stats, err := createLayerFile(context.Background(), layerDir, layerSize, layerFileOptions{magicHeaders: true, seed: seedFromTag("streamed:v1") + int64(i+1)})
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		if recorded[i].Digest != stats.Digest() {
+			t.Errorf("Layer %d: manifest digest %s does not match the layer on disk %s", i+1, recorded[i].Digest, stats.Digest())
+		}
+
+		onDisk, err := layerFromDir(layerDir, tarOptions{deterministic: true})
+		if err != nil {
+			t.Fatalf("Failed to create layer tarball: %v", err)
+		}
+		want, _ := onDisk.DiffID()
+		got, err := layers[2+i].DiffID()
+		if err != nil {
+			t.Fatalf("Failed to read streamed diff ID: %v", err)
+		}
+		if got != want {
+			t.Errorf("Layer %d: streamed diff ID %s does not match the layer written to disk %s", i+1, got, want)
+		}
+	}
+}
+
+func TestLayersFromFilesSums(t *testing.T) {
+	// Every file's sum is known once its layer is created, without hashing it separately
+	files := []layerFile{
+		newLayerFile(4*size.KB, layerFileOptions{fill: fillRandom, seed: 1}),
+		newLayerFile(64*size.KB, layerFileOptions{fill: fillText, seed: 2}),
+	}
+	var mu sync.Mutex
+	sums := make([][]byte, len(files))
+	_, err := layersFromFiles(files, nil, time.Now(), tarOptions{}, 2, func(i int, sum []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		sums[i] = sum
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating layers: %v", err)
+	}
+	for i, f := range files {
+		want := sha256.New()
+		io.Copy(want, f.reader())
+		if !bytes.Equal(sums[i], want.Sum(nil)) {
+			t.Errorf("File %d: expected sum %x, got %x", i+1, want.Sum(nil), sums[i])
+		}
+	}
+}
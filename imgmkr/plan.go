@@ -0,0 +1,89 @@
+package imgmkr
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jlbutler/imgmkr/mockfs"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// RunPlan implements the plan command: show what a build would generate without writing anything
+func RunPlan(args []string) error {
+	cfg := &buildConfig{}
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: imgmkr plan (--layer-sizes [sizes] | --random-layers N) [flags]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	addLayerFlags(fs, cfg)
+	fs.Parse(args)
+	if cfg.listProfiles {
+		writeProfiles(os.Stdout)
+		return nil
+	}
+
+	if err := cfg.checkLayerSizeSource(); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) { cfg.maxDepthSet = cfg.maxDepthSet || f.Name == "max-depth" })
+	if err := cfg.applyProfile(); err != nil {
+		return err
+	}
+	if err := cfg.parseLayerModes(); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("plan takes no arguments")
+	}
+	if cfg.hasLayerMode(contentModeMockFS) {
+		if err := cfg.mockfsOptions().Validate(); err != nil {
+			return fmt.Errorf("invalid mock filesystem options: %w", err)
+		}
+	}
+
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		return err
+	}
+	if cfg.hasLayerMode(contentModeMockFS) {
+		if err := cfg.checkLayerSizes(sizes); err != nil {
+			return err
+		}
+	}
+
+	writePlan(os.Stdout, cfg, sizes)
+	return nil
+}
+
+// writePlan writes a description of the layers that would be generated for sizes to w.
+// Mock filesystem plans are randomized, so the file breakdown is a sample of one build.
+func writePlan(w io.Writer, cfg *buildConfig, sizes []int64) {
+	var total int64
+	for i, layerSize := range sizes {
+		total += layerSize
+		mode := cfg.layerMode(i + 1)
+		label := mode
+		if mode == contentModeMockFS && cfg.profile != "" {
+			label += ", " + cfg.profile + " profile"
+		}
+		fmt.Fprintf(w, "layer%d: %s (%s)\n", i+1, size.Format(layerSize), label)
+		if mode != contentModeMockFS {
+			continue
+		}
+		if cfg.flatFiles > 0 {
+			fileSizes := mockfs.FlatFileSizes(layerSize, cfg.flatFiles)
+			fmt.Fprintf(w, "  %d files of %s to %s in the layer root\n",
+				len(fileSizes), size.Format(fileSizes[len(fileSizes)-1]), size.Format(fileSizes[0]))
+			continue
+		}
+
+		plan := mockfs.PlanLayer(layerSize, cfg.mockfsOptions())
+		fmt.Fprintf(w, "  %d files totaling %s: %d very large, %d large, %d medium, %d small\n",
+			plan.Files(), size.Format(plan.TotalSize()),
+			len(plan.VeryLargeFiles), len(plan.LargeFiles), len(plan.MediumFiles), len(plan.SmallFiles))
+	}
+	fmt.Fprintf(w, "%d layers, %s total\n", len(sizes), size.Format(total))
+}
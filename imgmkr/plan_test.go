@@ -0,0 +1,34 @@
+package imgmkr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestWritePlan(t *testing.T) {
+	sizes := []int64{size.MB, 50 * size.MB}
+
+	var buf bytes.Buffer
+	writePlan(&buf, &buildConfig{}, sizes)
+	for _, want := range []string{"layer1: 1.00 MiB (single-file)", "layer2: 50.00 MiB (single-file)", "2 layers, 51.00 MiB total"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected plan to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	writePlan(&buf, &buildConfig{mockFS: true, targetFiles: 8}, sizes)
+	if !strings.Contains(buf.String(), "layer1: 1.00 MiB (mock-fs)") || strings.Count(buf.String(), "files totaling") != 2 {
+		t.Errorf("Expected a file breakdown for each mock-fs layer, got:\n%s", buf.String())
+	}
+
+	// Layers that pick their own mode are planned as that mode
+	buf.Reset()
+	writePlan(&buf, &buildConfig{layerModes: []string{contentModeSingleFile, contentModeMockFS}, targetFiles: 8}, sizes)
+	if !strings.Contains(buf.String(), "layer1: 1.00 MiB (single-file)") || !strings.Contains(buf.String(), "layer2: 50.00 MiB (mock-fs)") || strings.Count(buf.String(), "files totaling") != 1 {
+		t.Errorf("Expected only layer2 to be planned as a mock filesystem, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,102 @@
+package imgmkr
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/disk"
+	"github.com/jlbutler/imgmkr/memory"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// Memory held by each concurrent layer writer: its write chunk, and gzip buffers when tarballs are written
+const (
+	writerMemory     = 10 * size.MB
+	compressorMemory = 1 * size.MB
+)
+
+// memoryRequirements returns the buffer memory the build would use without a budget
+func (cfg *buildConfig) memoryRequirements() memory.Requirements {
+	req := memory.Requirements{Workers: cfg.maxConcurrent, PerWorker: writerMemory + int64(cfg.dictSize)}
+	if cfg.writesTarball() || cfg.pushMode == pushModeDirect {
+		req.PerWorker += compressorMemory
+	}
+	randomFill := cfg.fillMode() == fillRandom || cfg.fillMode() == fillPrecompressed
+	if cfg.dictSize == 0 && ((cfg.hasLayerMode(contentModeMockFS) && !cfg.trueRandom) || (cfg.hasLayerMode(contentModeSingleFile) && randomFill)) {
+		req.Cache, req.MinCache = content.CacheSize, content.MinCacheSize
+	}
+	if cfg.fillMode() == fillPrecompressed {
+		req.PerWorker += compressorMemory
+	}
+	return req
+}
+
+// applyMemoryBudget lowers concurrency and, if that is not enough, the build's random cache size
+// so the build's buffers fit in --max-memory
+func (cfg *buildConfig) applyMemoryBudget() error {
+	if cfg.maxMemory == 0 {
+		return nil
+	}
+	limit := cfg.maxMemory
+
+	out := cfg.statusOut()
+	req := cfg.memoryRequirements()
+	plan, err := memory.Fit(limit, req)
+	if err != nil {
+		return err
+	}
+	if plan.Workers < cfg.maxConcurrent {
+		fmt.Fprintf(out, "Limiting to %d concurrent layers to fit --max-memory %s\n", plan.Workers, size.Format(limit))
+		cfg.maxConcurrent = plan.Workers
+	}
+	if plan.Cache < req.Cache {
+		// The cached data depends on the cache size, so a smaller cache would change the layers
+		if cfg.deterministic {
+			return fmt.Errorf("--max-memory %s is too small for --deterministic, which needs %s", size.Format(limit), size.Format(req.PerWorker+req.Cache))
+		}
+		fmt.Fprintf(out, "Shrinking the random data cache to %s to fit --max-memory %s\n", size.Format(plan.Cache), size.Format(limit))
+		cfg.cacheSize = plan.Cache
+	}
+	return nil
+}
+
+// randomCache returns a new random data cache of the size the memory budget allows
+func (cfg *buildConfig) randomCache() *content.Cache {
+	if cfg.cacheSize == 0 {
+		return content.NewCache(content.CacheSize)
+	}
+	return content.NewCache(int(cfg.cacheSize))
+}
+
+// availableSpace returns the free bytes on the filesystem holding a directory (a variable for testing)
+var availableSpace = disk.Available
+
+// checkDiskSpace fails the build if the layers can't fit on the filesystem the build directory is
+// created on, and warns if there may not be room for a builder to copy them into its image store
+// as well. Free space that can't be queried is not checked; a missing --tmpdir-prefix directory
+// is reported when the build directory is created.
+func (cfg *buildConfig) checkDiskSpace(sizes []int64) error {
+	dir := cfg.tmpdirPrefix
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	free, err := availableSpace(dir)
+	if err != nil {
+		return nil
+	}
+
+	var need int64
+	for _, layerSize := range sizes {
+		need += layerSize
+	}
+	if err := disk.Check(need, free); err != nil {
+		return fmt.Errorf("%w in %s", err, dir)
+	}
+	builder := !cfg.writesTarball() && cfg.output != outputNone && cfg.pushMode != pushModeDirect
+	if builder && 2*need > free {
+		fmt.Fprintf(cfg.statusOut(), "⚠️  Warning: %s of layers leaves little room in %s (%s free) for the builder to copy them into its image store if it is on the same filesystem\n",
+			size.Format(need), dir, size.Format(free))
+	}
+	return nil
+}
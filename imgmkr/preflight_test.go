@@ -0,0 +1,103 @@
+package imgmkr
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/disk"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestDiskSpacePreflight(t *testing.T) {
+	origAvailable := availableSpace
+	defer func() { availableSpace = origAvailable }()
+	availableSpace = func(string) (int64, error) { return 1 * size.MB, nil }
+
+	// The build fails before the build directory is created
+	tmpdir := t.TempDir()
+	err := RunBuild([]string{"--layer-sizes", "1MB,1MB", "--dry-run", "--tmpdir-prefix", tmpdir, "full:v1"})
+	if err == nil || !strings.Contains(err.Error(), "need 2.00 MiB, have 1.00 MiB free") {
+		t.Errorf("Expected a not enough disk space error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Errorf("Expected nothing written, found %d entries", len(entries))
+	}
+
+	// Layers that fit are built; free space that can't be queried isn't checked
+	for _, available := range []func(string) (int64, error){
+		func(string) (int64, error) { return 4 * size.MB, nil },
+		func(string) (int64, error) { return 0, disk.ErrUnsupported },
+	} {
+		availableSpace = available
+		cfg := &buildConfig{tmpdirPrefix: tmpdir, output: outputNone, quiet: true}
+		if err := cfg.checkDiskSpace([]int64{1 * size.MB, 1 * size.MB}); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func TestApplyMemoryBudget(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected int
+		hasError bool
+	}{
+		// No budget leaves concurrency alone
+		{[]string{"--layer-sizes", "1GB", "--max-concurrent", "8", "test:v1"}, 8, false},
+		// Each writer holds a 10MB chunk
+		{[]string{"--layer-sizes", "1GB", "--fill", "text", "--max-concurrent", "8", "--max-memory", "35MB", "test:v1"}, 3, false},
+		// Random single-file layers also hold the 64MB random cache
+		{[]string{"--layer-sizes", "1GB", "--max-concurrent", "8", "--max-memory", "100MB", "test:v1"}, 3, false},
+		// Mock filesystems also hold the 64MB random cache
+		{[]string{"--layer-sizes", "1GB", "--mock-fs", "--max-concurrent", "8", "--max-memory", "100MB", "test:v1"}, 3, false},
+		// Fresh random data needs no cache
+		{[]string{"--layer-sizes", "1GB", "--mock-fs", "--true-random", "--max-concurrent", "8", "--max-memory", "100MB", "test:v1"}, 8, false},
+		// Shrinking the cache would change deterministic layers
+		{[]string{"--layer-sizes", "1GB", "--mock-fs", "--deterministic", "--max-memory", "40MB", "test:v1"}, 0, true},
+		{[]string{"--layer-sizes", "1GB", "--max-memory", "1MB", "test:v1"}, 0, true},
+	}
+
+	for _, test := range tests {
+		cfg, _, err := parseBuildArgs(test.args)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %v: %v", test.args, err)
+		}
+		err = cfg.applyMemoryBudget()
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected an error for %v", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", test.args, err)
+		}
+		if cfg.maxConcurrent != test.expected {
+			t.Errorf("For %v, expected %d concurrent layers, got %d", test.args, test.expected, cfg.maxConcurrent)
+		}
+	}
+}
+
+func TestApplyMemoryBudgetCache(t *testing.T) {
+	// Shrinking the cache only affects the build it was shrunk for
+	small, _, err := parseBuildArgs([]string{"--layer-sizes", "1GB", "--max-memory", "40MB", "--quiet", "test:v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := small.applyMemoryBudget(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := small.randomCache().Size(); got != 30*size.MB {
+		t.Errorf("Expected a 30MB cache, got %d bytes", got)
+	}
+
+	next, _, err := parseBuildArgs([]string{"--layer-sizes", "1GB", "test:v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := next.randomCache().Size(); got != content.CacheSize {
+		t.Errorf("Expected the default cache for the next build, got %d bytes", got)
+	}
+}
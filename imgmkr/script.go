@@ -0,0 +1,132 @@
+package imgmkr
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/manifest"
+)
+
+// shellQuote quotes s for use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printfEscape renders data as a printf format string of octal escapes
+func printfEscape(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		fmt.Fprintf(&b, `\%03o`, c)
+	}
+	return b.String()
+}
+
+// writeScript writes a standalone shell script to w that recreates the generated layers in buildDir
+// and builds them into repoTag with docker (or $BUILDER). Single-file layers filled with zeros or
+// text (per fill) are reproduced exactly; randomly filled single files and mock filesystem files
+// keep their paths, sizes, and magic headers but get fresh random data. Symlinks and hardlinks are
+// recreated as links.
+func writeScript(w io.Writer, buildDir string, repoTag string, layers []manifest.Layer, fill string, dockerfile dockerfileOptions) error {
+	fmt.Fprintf(w, "#!/bin/sh\n")
+	fmt.Fprintf(w, "# Recreates the image %s as generated by imgmkr.\n", repoTag)
+	fmt.Fprintf(w, "# Random files are refilled with random data of the same size, so their digests differ.\n")
+	fmt.Fprintf(w, "set -eu\n\n")
+	fmt.Fprintf(w, "BUILDER=\"${BUILDER:-docker}\"\n")
+	fmt.Fprintf(w, "BUILD_DIR=\"$(mktemp -d)\"\n")
+	fmt.Fprintf(w, "trap 'rm -rf \"$BUILD_DIR\"' EXIT\n")
+	fmt.Fprintf(w, "cd \"$BUILD_DIR\"\n")
+
+	for _, layer := range layers {
+		layerName := fmt.Sprintf("layer%d", layer.Number)
+		fmt.Fprintf(w, "\n# %s: %d bytes, %d files (%s)\n", layerName, layer.ActualSize, layer.FileCount, layer.ContentMode)
+
+		layerDir := filepath.Join(buildDir, layerName)
+		var links manifest.Hardlinks
+		err := filepath.WalkDir(layerDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(buildDir, path)
+			if err != nil {
+				return err
+			}
+			target := shellQuote(filepath.ToSlash(relPath))
+			if d.IsDir() {
+				fmt.Fprintf(w, "mkdir -p %s\n", target)
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			// Links are recreated as links: the walk is in lexical order, so a hardlink's first
+			// name has already been written when a later name is seen
+			if info.Mode()&fs.ModeSymlink != 0 {
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "ln -s %s %s\n", shellQuote(filepath.ToSlash(link)), target)
+				return nil
+			}
+			if first, ok := links.Seen(filepath.ToSlash(relPath), info); ok {
+				fmt.Fprintf(w, "ln %s %s\n", shellQuote(first), target)
+				return nil
+			}
+			fileSize := info.Size()
+			header := content.MagicHeader(filepath.Ext(path), fileSize)
+			remaining := fileSize - int64(len(header))
+
+			// Single-file layers are filled as fill says, mock filesystem files with random data
+			data := fmt.Sprintf("head -c %d /dev/urandom", remaining)
+			if layer.ContentMode == contentModeSingleFile {
+				switch fill {
+				case fillZero:
+					data = fmt.Sprintf("head -c %d /dev/zero", remaining)
+				case fillText:
+					data = fmt.Sprintf("head -c %d /dev/zero | tr '\\000' 'x'", remaining)
+				}
+			}
+
+			switch {
+			case fileSize == 0:
+				fmt.Fprintf(w, ": > %s\n", target)
+			case len(header) > 0 && remaining > 0:
+				fmt.Fprintf(w, "{ printf '%s'; %s; } > %s\n", printfEscape(header), data, target)
+			case len(header) > 0:
+				fmt.Fprintf(w, "printf '%s' > %s\n", printfEscape(header), target)
+			default:
+				fmt.Fprintf(w, "%s > %s\n", data, target)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read layer directory %s: %w", layerDir, err)
+		}
+	}
+
+	fmt.Fprintf(w, "\ncat > Dockerfile <<'EOF'\n%sEOF\n\n", renderDockerfile(len(layers), dockerfile))
+	fmt.Fprintf(w, "\"$BUILDER\" build -t %s .\n", shellQuote(repoTag))
+	return nil
+}
+
+// emitScript writes the build script for the generated layers to path
+func emitScript(path string, buildDir string, repoTag string, layers []manifest.Layer, fill string, dockerfile dockerfileOptions) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create build script: %w", err)
+	}
+	defer file.Close()
+
+	if err := writeScript(file, buildDir, repoTag, layers, fill, dockerfile); err != nil {
+		return err
+	}
+	return file.Close()
+}
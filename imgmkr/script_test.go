@@ -0,0 +1,198 @@
+package imgmkr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestWriteScript(t *testing.T) {
+	buildDir := t.TempDir()
+	sizes := []int64{4 * size.KB, 12 * size.KB}
+	layers, err := createLayersConcurrently(context.Background(), buildDir, sizes, &buildConfig{maxConcurrent: 2, fill: fillText}, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeScript(&buf, buildDir, "test:v1", layers, fillText, dockerfileOptions{}); err != nil {
+		t.Fatalf("Unexpected error writing script: %v", err)
+	}
+	script := buf.String()
+
+	for _, want := range []string{
+		"mkdir -p 'layer1'",
+		"head -c 4096 /dev/zero | tr '\\000' 'x' > 'layer1/4.00 KiB-file'",
+		"mkdir -p 'layer2'",
+		"head -c 12288 /dev/zero | tr '\\000' 'x' > 'layer2/12.00 KiB-file'",
+		"COPY layer2 /",
+		`"$BUILDER" build -t 'test:v1' .`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected script to contain %q, got:\n%s", want, script)
+		}
+	}
+
+	// Random fills can't be reproduced, so the script generates fresh random data
+	buf.Reset()
+	if err := writeScript(&buf, buildDir, "test:v1", layers, fillRandom, dockerfileOptions{}); err != nil {
+		t.Fatalf("Unexpected error writing script: %v", err)
+	}
+	if want := "head -c 4096 /dev/urandom > 'layer1/4.00 KiB-file'"; !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected script to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestWriteScriptReproducesSingleFileLayers(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+
+	for _, fill := range []string{fillText, fillZero} {
+		t.Run(fill, func(t *testing.T) {
+			buildDir := t.TempDir()
+			cfg := &buildConfig{maxConcurrent: 2, magicHeaders: true, fill: fill}
+			layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{4 * size.KB, 3}, cfg, nil, nil)
+			if err != nil {
+				t.Fatalf("Failed to create layers: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := writeScript(&buf, buildDir, "test:v1", layers, fill, dockerfileOptions{}); err != nil {
+				t.Fatalf("Unexpected error writing script: %v", err)
+			}
+
+			// Run the script with a fake builder that copies out the build context
+			tempDir := t.TempDir()
+			copyDir := filepath.Join(tempDir, "context")
+			builder := filepath.Join(tempDir, "builder")
+			if err := os.WriteFile(builder, []byte("#!/bin/sh\ncp -R . \"$OUT\"\n"), 0755); err != nil {
+				t.Fatalf("Failed to write fake builder: %v", err)
+			}
+			cmd := exec.Command(sh, "-c", buf.String())
+			cmd.Env = append(cmd.Environ(), "BUILDER="+builder, "OUT="+copyDir)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("Script failed: %v\n%s", err, out)
+			}
+
+			for _, layer := range layers {
+				stats, err := manifest.StatDir(filepath.Join(copyDir, fmt.Sprintf("layer%d", layer.Number)))
+				if err != nil {
+					t.Fatalf("Failed to stat recreated layer %d: %v", layer.Number, err)
+				}
+				if stats.Digest() != layer.Digest {
+					t.Errorf("Layer %d: expected the script to reproduce digest %s, got %s", layer.Number, layer.Digest, stats.Digest())
+				}
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if quoted := shellQuote("it's"); quoted != `'it'\''s'` {
+		t.Errorf("Unexpected quoting: %s", quoted)
+	}
+}
+
+func TestEmitScriptDockerfile(t *testing.T) {
+	scriptPath := filepath.Join(t.TempDir(), "build.sh")
+	err := RunBuild([]string{"--layer-sizes", "4KB", "--quiet", "--output", "none", "--tmpdir-prefix", t.TempDir(),
+		"--emit-script", scriptPath, "--label", "team=qa", "--env", "FOO=bar", "--cmd", "sh -c true", "script:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(scriptPath)
+	if err != nil {
+		t.Fatalf("Failed to read build script: %v", err)
+	}
+	script := string(data)
+
+	// The script's Dockerfile sets the same labels, environment, and command as the build's
+	for _, want := range []string{
+		`LABEL team="qa"`,
+		`ENV FOO="bar"`,
+		`CMD ["sh","-c","true"]`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected script to contain %q, got:\n%s", want, script)
+		}
+	}
+}
+
+func TestWriteScriptLinks(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not available")
+	}
+
+	// A mock filesystem layer with a file, a symlink to it, and a hardlink to it
+	buildDir := t.TempDir()
+	layerDir := filepath.Join(buildDir, "layer1", "dir")
+	if err := os.MkdirAll(layerDir, 0755); err != nil {
+		t.Fatalf("Failed to create layer directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(layerDir, "a.bin"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Link(filepath.Join(layerDir, "a.bin"), filepath.Join(layerDir, "b.bin")); err != nil {
+		t.Skipf("hardlinks not supported: %v", err)
+	}
+	if err := os.Symlink("a.bin", filepath.Join(layerDir, "c.bin")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	layers := []manifest.Layer{{Number: 1, ContentMode: contentModeMockFS}}
+
+	var buf bytes.Buffer
+	if err := writeScript(&buf, buildDir, "test:v1", layers, fillRandom, dockerfileOptions{}); err != nil {
+		t.Fatalf("Unexpected error writing script: %v", err)
+	}
+	script := buf.String()
+	for _, want := range []string{
+		"ln 'layer1/dir/a.bin' 'layer1/dir/b.bin'",
+		"ln -s 'a.bin' 'layer1/dir/c.bin'",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected script to contain %q, got:\n%s", want, script)
+		}
+	}
+
+	// Run the script with a fake builder that copies out the build context, keeping links
+	tempDir := t.TempDir()
+	copyDir := filepath.Join(tempDir, "context")
+	builder := filepath.Join(tempDir, "builder")
+	if err := os.WriteFile(builder, []byte("#!/bin/sh\nmkdir \"$OUT\" && tar cf - . | (cd \"$OUT\" && tar xf -)\n"), 0755); err != nil {
+		t.Fatalf("Failed to write fake builder: %v", err)
+	}
+	cmd := exec.Command(sh, "-c", script)
+	cmd.Env = append(cmd.Environ(), "BUILDER="+builder, "OUT="+copyDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Script failed: %v\n%s", err, out)
+	}
+
+	recreated := filepath.Join(copyDir, "layer1", "dir")
+	if link, err := os.Readlink(filepath.Join(recreated, "c.bin")); err != nil || link != "a.bin" {
+		t.Errorf("Expected c.bin to be a symlink to a.bin, got %q (err: %v)", link, err)
+	}
+	first, err := os.Stat(filepath.Join(recreated, "a.bin"))
+	if err != nil {
+		t.Fatalf("Failed to stat a.bin: %v", err)
+	}
+	second, err := os.Stat(filepath.Join(recreated, "b.bin"))
+	if err != nil {
+		t.Fatalf("Failed to stat b.bin: %v", err)
+	}
+	if !os.SameFile(first, second) || first.Size() != 4 {
+		t.Errorf("Expected b.bin to be a hardlink to the 4-byte a.bin, got sizes %d and %d", first.Size(), second.Size())
+	}
+}
@@ -0,0 +1,269 @@
+package imgmkr
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// base returns the base sizes are read in: size.Binary unless --size-base says otherwise
+func (cfg *buildConfig) base() int64 {
+	if cfg.sizeBase == 0 {
+		return size.Binary
+	}
+	return cfg.sizeBase
+}
+
+// checkLayerSizeSource checks that exactly one of --layer-sizes, --layer-sizes-file, and
+// --random-layers was given, unless a Config gave the sizes
+func (cfg *buildConfig) checkLayerSizeSource() error {
+	if cfg.sizeList != nil && cfg.layerSizes == "" && cfg.layerSizesFile == "" && cfg.randomLayers == 0 {
+		return nil
+	}
+	switch {
+	case cfg.layerSizes != "" && cfg.layerSizesFile != "":
+		return fmt.Errorf("--layer-sizes and --layer-sizes-file cannot be combined")
+	case (cfg.layerSizes != "" || cfg.layerSizesFile != "") && cfg.randomLayers != 0:
+		return fmt.Errorf("--layer-sizes and --layer-sizes-file cannot be combined with --random-layers")
+	case cfg.randomLayers < 0:
+		return fmt.Errorf("--random-layers must be greater than zero")
+	case cfg.layerSizes == "" && cfg.layerSizesFile == "" && cfg.randomLayers == 0:
+		return fmt.Errorf("--layer-sizes, --layer-sizes-file, or --random-layers is required")
+	case cfg.layerSizeRange != "" && cfg.randomLayers == 0:
+		return fmt.Errorf("--layer-size-range requires --random-layers (or --num-layers)")
+	}
+	return nil
+}
+
+// parseLayerSizes returns the size of each layer to generate, either parsed from --layer-sizes or
+// --layer-sizes-file or drawn at random for --random-layers
+func (cfg *buildConfig) parseLayerSizes() ([]int64, error) {
+	if cfg.randomLayers == 0 {
+		var sizes []int64
+		var err error
+		if cfg.sizeList != nil && cfg.layerSizes == "" && cfg.layerSizesFile == "" {
+			sizes = cfg.sizeList
+		} else if cfg.layerSizesFile != "" {
+			sizes, err = readLayerSizesFile(cfg.layerSizesFile, cfg.base())
+		} else {
+			var list string
+			if list, _, err = splitLayerModes(cfg.layerSizes, cfg.base()); err == nil {
+				sizes, err = size.ParseListWithBase(list, cfg.base())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing layer sizes: %w", err)
+		}
+		if cfg.noZeroLayers {
+			for i, layerSize := range sizes {
+				if layerSize == 0 {
+					return nil, fmt.Errorf("layer %d has size 0 (--no-zero-layers)", i+1)
+				}
+			}
+		}
+		return sizes, nil
+	}
+
+	if cfg.layerSizeRange != "" {
+		minSize, maxSize, err := size.ParseRangeWithBase(cfg.layerSizeRange, cfg.base())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing --layer-size-range: %w", err)
+		}
+		if cfg.noZeroLayers && minSize == 0 {
+			return nil, fmt.Errorf("--layer-size-range must start above 0 with --no-zero-layers")
+		}
+		return randomLayerSizes(cfg.randomLayers, minSize, maxSize, cfg.seed), nil
+	}
+
+	minSize, err := size.ParseWithBase(cfg.randomMin, cfg.base())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing --random-min: %w", err)
+	}
+	maxSize, err := size.ParseWithBase(cfg.randomMax, cfg.base())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing --random-max: %w", err)
+	}
+	if cfg.noZeroLayers && minSize == 0 {
+		return nil, fmt.Errorf("--random-min must be greater than 0 with --no-zero-layers")
+	}
+	if minSize > maxSize {
+		return nil, fmt.Errorf("--random-min (%s) must not be greater than --random-max (%s)", size.Format(minSize), size.Format(maxSize))
+	}
+	return randomLayerSizes(cfg.randomLayers, minSize, maxSize, cfg.seed), nil
+}
+
+// readLayerSizesFile reads the layer sizes listed in path, one per line, in base
+func readLayerSizesFile(path string, base int64) ([]int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("layer sizes file %s does not exist", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sizes, err := size.ReadListWithBase(file, base)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sizes, nil
+}
+
+// randomLayerSizes returns n sizes drawn uniformly from [minSize, maxSize]. The same non-zero
+// seed always gives the same sizes; a zero seed gives different sizes each run.
+func randomLayerSizes(n int, minSize, maxSize int64, seed int64) []int64 {
+	rng := content.NewRand(seed)
+	sizes := make([]int64, n)
+	for i := range sizes {
+		sizes[i] = minSize + rng.Int63n(maxSize-minSize+1)
+	}
+	return sizes
+}
+
+// seedFromTag derives a non-zero content seed from the image's repository:tag
+func seedFromTag(repoTag string) int64 {
+	sum := sha256.Sum256([]byte(repoTag))
+	seed := int64(binary.BigEndian.Uint64(sum[:8]) >> 1)
+	if seed == 0 {
+		seed = 1
+	}
+	return seed
+}
+
+// layerSeed returns the content seed for a layer, or 0 if content is not seeded. Each layer gets
+// its own seed rather than a share of one random source, since concurrent workers would draw from
+// a shared source in a different order every run.
+func (cfg *buildConfig) layerSeed(layerNum int) int64 {
+	if cfg.seed == 0 {
+		return 0
+	}
+	return cfg.seed + int64(layerNum)
+}
+
+// contentLayer returns the layer whose seed generates layer layerNum's content: with
+// --identical-layers the first layer of the same size, and otherwise the layer itself
+func (cfg *buildConfig) contentLayer(sizes []int64, layerNum int) int {
+	if cfg.identicalLayers {
+		for i, layerSize := range sizes[:layerNum-1] {
+			if layerSize == sizes[layerNum-1] {
+				return i + 1
+			}
+		}
+	}
+	return layerNum
+}
+
+// checkLayerSizes checks that each mock filesystem layer's size can be generated with the mock
+// filesystem options
+func (cfg *buildConfig) checkLayerSizes(sizes []int64) error {
+	opts := cfg.mockfsOptions()
+	for i, layerSize := range sizes {
+		if cfg.layerMode(i+1) != contentModeMockFS {
+			continue
+		}
+		if err := opts.CheckLayerSize(layerSize); err != nil {
+			return fmt.Errorf("invalid size for layer %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkTotalSize fails the build if the layer sizes add up to more than --max-total-size
+func (cfg *buildConfig) checkTotalSize(sizes []int64) error {
+	if cfg.maxTotalSize == 0 {
+		return nil
+	}
+	var total int64
+	for _, layerSize := range sizes {
+		if layerSize > math.MaxInt64-total {
+			total = math.MaxInt64
+			break
+		}
+		total += layerSize
+	}
+	if total > cfg.maxTotalSize {
+		return fmt.Errorf("layers total %s, more than --max-total-size %s", size.Format(total), size.Format(cfg.maxTotalSize))
+	}
+	return nil
+}
+
+// layerModeSuffixes maps the suffixes a --layer-sizes entry may end with to the content mode of
+// its layers
+var layerModeSuffixes = map[string]string{
+	"file":   contentModeSingleFile,
+	"mockfs": contentModeMockFS,
+}
+
+// splitLayerModes splits the content mode suffixes off a --layer-sizes list such as
+// "1GB:file,500MB x 2:mockfs", returning the list without them and the content mode of each layer
+// the list gives ("" for layers without a suffix). The modes are nil if no entry has a suffix.
+// Sizes are read in base.
+func splitLayerModes(list string, base int64) (string, []string, error) {
+	if !strings.Contains(list, ":") {
+		return list, nil, nil
+	}
+	entries := strings.Split(list, ",")
+	var modes []string
+	for i, entry := range entries {
+		sizeStr, suffix, hasSuffix := strings.Cut(entry, ":")
+		mode := ""
+		if hasSuffix {
+			var ok bool
+			if mode, ok = layerModeSuffixes[strings.TrimSpace(suffix)]; !ok {
+				return "", nil, fmt.Errorf("unknown layer mode %q in %q: must be file or mockfs", suffix, entry)
+			}
+		}
+		sizes, err := size.ParseListWithBase(sizeStr, base)
+		if err != nil {
+			return "", nil, err
+		}
+		for range sizes {
+			modes = append(modes, mode)
+		}
+		entries[i] = sizeStr
+	}
+	return strings.Join(entries, ","), modes, nil
+}
+
+// parseLayerModes sets the content mode of each layer that picks its own in --layer-sizes
+func (cfg *buildConfig) parseLayerModes() error {
+	if cfg.layerSizes == "" {
+		return nil
+	}
+	_, modes, err := splitLayerModes(cfg.layerSizes, cfg.base())
+	if err != nil {
+		return fmt.Errorf("invalid --layer-sizes: %w", err)
+	}
+	cfg.layerModes = modes
+	return nil
+}
+
+// layerMode returns the content mode of layer layerNum: its own from --layer-sizes, or the build's
+func (cfg *buildConfig) layerMode(layerNum int) string {
+	if layerNum <= len(cfg.layerModes) && cfg.layerModes[layerNum-1] != "" {
+		return cfg.layerModes[layerNum-1]
+	}
+	return cfg.contentMode()
+}
+
+// hasLayerMode reports whether any layer has content mode mode
+func (cfg *buildConfig) hasLayerMode(mode string) bool {
+	if cfg.layerModes == nil {
+		return cfg.contentMode() == mode
+	}
+	for i := range cfg.layerModes {
+		if cfg.layerMode(i+1) == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package imgmkr
+
+import (
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestSplitLayerModes(t *testing.T) {
+	list, modes, err := splitLayerModes("1GB:file, 500MB x 2:mockfs,1MB", size.Binary)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if list != "1GB, 500MB x 2,1MB" {
+		t.Errorf("Expected the list without modes, got %q", list)
+	}
+	expected := []string{contentModeSingleFile, contentModeMockFS, contentModeMockFS, ""}
+	if !reflect.DeepEqual(modes, expected) {
+		t.Errorf("Expected modes %q, got %q", expected, modes)
+	}
+
+	// Lists without modes are left alone
+	if list, modes, err := splitLayerModes("1MB,2MB x 3", size.Binary); list != "1MB,2MB x 3" || modes != nil || err != nil {
+		t.Errorf("Expected the list unchanged with no modes, got %q, %q (err: %v)", list, modes, err)
+	}
+
+	for _, list := range []string{"1MB:tree", "1MB:", "1XB:file"} {
+		if _, _, err := splitLayerModes(list, size.Binary); err == nil {
+			t.Errorf("%q: expected an error", list)
+		}
+	}
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	// A run over the cap fails before anything is written, however big the layers are
+	tmpdir := t.TempDir()
+	start := time.Now()
+	err := RunBuild([]string{"--layer-sizes", "512GB,512GB,512GB", "--max-total-size", "1TB", "--dry-run", "--tmpdir-prefix", tmpdir, "huge:v1"})
+	if err == nil || !strings.Contains(err.Error(), "layers total 1.50 TiB, more than --max-total-size 1.00 TiB") {
+		t.Errorf("Expected a --max-total-size error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the run to fail fast, took %s", elapsed)
+	}
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Errorf("Expected nothing written, found %d entries", len(entries))
+	}
+
+	// A run under the cap proceeds
+	stdout := captureStdout(t, func() {
+		err = RunBuild([]string{"--layer-sizes", "4KB,4KB", "--max-total-size", "8KB", "--dry-run", "--quiet", "--tmpdir-prefix", tmpdir, "small:v1"})
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error under the cap: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(strings.TrimSpace(stdout), "layer2")); err != nil {
+		t.Errorf("Expected the layers to be written under the cap: %v", err)
+	}
+
+	// Sizes that overflow when added up are still over the cap
+	cfg := &buildConfig{maxTotalSize: size.PB}
+	if err := cfg.checkTotalSize([]int64{math.MaxInt64, 1}); err == nil {
+		t.Error("Expected an error for sizes adding up past the largest int64")
+	}
+}
+
+func TestNoZeroLayers(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes", "1MB,0,2MB", "--no-zero-layers", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = cfg.parseLayerSizes()
+	if err == nil || !strings.Contains(err.Error(), "layer 2") {
+		t.Errorf("Expected an error naming layer 2, got %v", err)
+	}
+
+	// Zero sizes are allowed by default
+	cfg.noZeroLayers = false
+	if sizes, err := cfg.parseLayerSizes(); err != nil || len(sizes) != 3 {
+		t.Errorf("Expected 3 sizes without --no-zero-layers, got %v (err: %v)", sizes, err)
+	}
+
+	// Random sizes must not be able to draw 0
+	cfg, _, err = parseBuildArgs([]string{"--random-layers", "3", "--random-min", "0", "--no-zero-layers", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := cfg.parseLayerSizes(); err == nil {
+		t.Error("Expected an error for --random-min 0 with --no-zero-layers")
+	}
+}
+
+func TestRandomLayerSizes(t *testing.T) {
+	cfg, _, err := parseBuildArgs([]string{"--random-layers", "20", "--random-min", "1MB", "--random-max", "1GB", "--deterministic", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error generating layer sizes: %v", err)
+	}
+	if len(sizes) != 20 {
+		t.Fatalf("Expected 20 layers, got %d", len(sizes))
+	}
+	for i, layerSize := range sizes {
+		if layerSize < 1*size.MB || layerSize > 1*size.GB {
+			t.Errorf("Layer %d size %d is outside 1MB-1GB", i+1, layerSize)
+		}
+	}
+
+	// The same seed gives the same sizes
+	again, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error generating layer sizes: %v", err)
+	}
+	for i := range sizes {
+		if again[i] != sizes[i] {
+			t.Fatalf("Expected identical sizes for the same seed, got %v and %v", sizes, again)
+		}
+	}
+
+	// A single-value range is allowed
+	if fixed := randomLayerSizes(3, 4096, 4096, 1); fixed[0] != 4096 || fixed[2] != 4096 {
+		t.Errorf("Expected every size to be 4096, got %v", fixed)
+	}
+
+	invalid := [][]string{
+		{"--random-layers", "3", "--layer-sizes", "1MB", "test:v1"},
+		{"--random-layers", "-1", "test:v1"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+	cfg = &buildConfig{randomLayers: 3, randomMin: "1GB", randomMax: "1MB"}
+	if _, err := cfg.parseLayerSizes(); err == nil {
+		t.Error("Expected an error for --random-min greater than --random-max")
+	}
+}
+
+func TestLayerSizesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sizes.txt")
+	if err := os.WriteFile(path, []byte("# two layers\n1MB\n\n4KB\n"), 0644); err != nil {
+		t.Fatalf("Failed to write sizes file: %v", err)
+	}
+	cfg, _, err := parseBuildArgs([]string{"--layer-sizes-file", path, "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error reading layer sizes: %v", err)
+	}
+	if len(sizes) != 2 || sizes[0] != 1*size.MB || sizes[1] != 4*size.KB {
+		t.Errorf("Expected sizes 1MB and 4KB, got %v", sizes)
+	}
+
+	// A missing file is reported clearly
+	cfg = &buildConfig{layerSizesFile: filepath.Join(t.TempDir(), "missing.txt")}
+	if _, err := cfg.parseLayerSizes(); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected a missing file error, got %v", err)
+	}
+
+	invalid := [][]string{
+		{"--layer-sizes-file", path, "--layer-sizes", "1MB", "test:v1"},
+		{"--layer-sizes-file", path, "--random-layers", "3", "test:v1"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestLayerSizeRange(t *testing.T) {
+	args := []string{"--num-layers", "10", "--layer-size-range", "1MB-5MB", "--seed", "42", "test:v1"}
+	cfg, _, err := parseBuildArgs(args)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error generating layer sizes: %v", err)
+	}
+	if len(sizes) != 10 {
+		t.Fatalf("Expected 10 layers, got %d", len(sizes))
+	}
+	for i, layerSize := range sizes {
+		if layerSize < 1*size.MB || layerSize > 5*size.MB {
+			t.Errorf("Layer %d size %d is outside 1MB-5MB", i+1, layerSize)
+		}
+	}
+
+	// The same --seed gives the same sizes in a separate run, and seeds the content too
+	again, _, err := parseBuildArgs(args)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	againSizes, err := again.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error generating layer sizes: %v", err)
+	}
+	for i := range sizes {
+		if againSizes[i] != sizes[i] {
+			t.Fatalf("Expected identical sizes for --seed 42, got %v and %v", sizes, againSizes)
+		}
+	}
+	if cfg.layerSeed(1) != 43 {
+		t.Errorf("Expected layer 1 to be seeded from --seed, got %d", cfg.layerSeed(1))
+	}
+
+	// --seed wins over the tag's seed with --deterministic
+	cfg, _, err = parseBuildArgs([]string{"--num-layers", "2", "--seed", "42", "--deterministic", "test:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.seed != 42 {
+		t.Errorf("Expected seed 42, got %d", cfg.seed)
+	}
+
+	invalid := [][]string{
+		{"--layer-size-range", "1MB-5MB", "test:v1"},
+		{"--layer-sizes", "1MB", "--layer-size-range", "1MB-5MB", "test:v1"},
+	}
+	for _, args := range invalid {
+		if _, _, err := parseBuildFlags(args, flag.ContinueOnError); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+	for _, spec := range []string{"5MB-1MB", "1MB", "0-1MB"} {
+		cfg = &buildConfig{randomLayers: 3, layerSizeRange: spec, noZeroLayers: true}
+		if _, err := cfg.parseLayerSizes(); err == nil {
+			t.Errorf("Expected an error for --layer-size-range %s", spec)
+		}
+	}
+}
+
+func TestSizeBase(t *testing.T) {
+	// --size-base applies to every size, including those given before it
+	args := []string{"--max-memory", "1GB", "--write-rate", "10MB/s", "--content", "dict:4KB", "--max-total-size", "1TB",
+		"--layer-sizes", "1MB,2KB x 2", "--size-base", "decimal", "test:v1"}
+	cfg, _, err := parseBuildFlags(args, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.maxMemory != 1000000000 || cfg.writeRate != 10000000 || cfg.dictSize != 4000 || cfg.maxTotalSize != 1000000000000 {
+		t.Errorf("Expected decimal sizes, got --max-memory %d, --write-rate %d, --content %d, --max-total-size %d", cfg.maxMemory, cfg.writeRate, cfg.dictSize, cfg.maxTotalSize)
+	}
+	sizes, err := cfg.parseLayerSizes()
+	if err != nil {
+		t.Fatalf("Unexpected error parsing layer sizes: %v", err)
+	}
+	if !reflect.DeepEqual(sizes, []int64{1000000, 2000, 2000}) {
+		t.Errorf("Expected decimal layer sizes, got %v", sizes)
+	}
+
+	// Sizes files, ranges, and IEC units
+	path := filepath.Join(t.TempDir(), "sizes.txt")
+	if err := os.WriteFile(path, []byte("1MB\n1MiB\n"), 0644); err != nil {
+		t.Fatalf("Failed to write sizes file: %v", err)
+	}
+	cfg, _, err = parseBuildFlags([]string{"--size-base", "decimal", "--layer-sizes-file", path, "test:v1"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sizes, err := cfg.parseLayerSizes(); err != nil || !reflect.DeepEqual(sizes, []int64{1000000, 1 * size.MB}) {
+		t.Errorf("Expected 1000000 and 1MiB, got %v (err: %v)", sizes, err)
+	}
+	cfg, _, err = parseBuildFlags([]string{"--size-base", "decimal", "--num-layers", "5", "--layer-size-range", "1MB-1MB", "test:v1"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sizes, err := cfg.parseLayerSizes(); err != nil || sizes[0] != 1000000 {
+		t.Errorf("Expected 1000000-byte layers, got %v (err: %v)", sizes, err)
+	}
+
+	// Sizes stay binary by default
+	cfg, _, err = parseBuildFlags([]string{"--max-memory", "1GB", "--layer-sizes", "1MB", "test:v1"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sizes, err := cfg.parseLayerSizes(); err != nil || cfg.maxMemory != 1*size.GB || sizes[0] != 1*size.MB {
+		t.Errorf("Expected binary sizes, got --max-memory %d and %v (err: %v)", cfg.maxMemory, sizes, err)
+	}
+
+	if _, _, err := parseBuildFlags([]string{"--size-base", "si", "--layer-sizes", "1MB", "test:v1"}, flag.ContinueOnError); err == nil {
+		t.Errorf("Expected an error for an unknown --size-base")
+	}
+}
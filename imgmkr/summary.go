@@ -0,0 +1,57 @@
+package imgmkr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// buildSummary describes a successful build, for CI dashboards to read instead of the log
+type buildSummary struct {
+	RepoTag    string  `json:"repo_tag"`
+	Layers     int     `json:"layers"`
+	LayerSizes []int64 `json:"layer_sizes"`       // Requested size of each layer in bytes
+	TotalSize  int64   `json:"total_size"`        // Requested size of all layers in bytes
+	DurationMS int64   `json:"duration_ms"`       // Wall-clock time from the start of the build
+	Builder    string  `json:"builder,omitempty"` // finch or docker, if one built the image
+	Digest     string  `json:"digest,omitempty"`  // Manifest digest, or the builder's image ID, if known
+	MockFS     bool    `json:"mock_fs"`           // Whether any layer is a mock filesystem
+}
+
+// newBuildSummary summarizes a build of repoTag with the given requested layer sizes, built
+// with builder ("" for none) into the image with digest ("" if unknown) in duration
+func newBuildSummary(cfg *buildConfig, repoTag string, sizes []int64, builder string, digest string, duration time.Duration) buildSummary {
+	summary := buildSummary{
+		RepoTag:    repoTag,
+		Layers:     len(sizes),
+		LayerSizes: sizes,
+		DurationMS: duration.Milliseconds(),
+		Builder:    builder,
+		Digest:     digest,
+		MockFS:     cfg.hasLayerMode(contentModeMockFS),
+	}
+	for _, layerSize := range sizes {
+		summary.TotalSize += layerSize
+	}
+	return summary
+}
+
+// writeBuildSummary writes summary as indented JSON to path, or to stdout if path is "-"
+func writeBuildSummary(stdout io.Writer, path string, summary buildSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode build summary: %w", err)
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = stdout.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write build summary: %w", err)
+	}
+	return nil
+}
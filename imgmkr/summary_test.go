@@ -0,0 +1,95 @@
+package imgmkr
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildSummary(t *testing.T) {
+	cfg := &buildConfig{mockFS: true}
+	digest := "sha256:" + strings.Repeat("a", 64)
+	summary := newBuildSummary(cfg, "test:v1", []int64{1024, 2048, 4096}, "finch", digest, 1500*time.Millisecond)
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := writeBuildSummary(io.Discard, path, summary); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read summary: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Summary is not valid JSON: %v", err)
+	}
+	expected := map[string]interface{}{
+		"repo_tag":    "test:v1",
+		"layers":      float64(3),
+		"total_size":  float64(7168),
+		"duration_ms": float64(1500),
+		"builder":     "finch",
+		"digest":      digest,
+		"mock_fs":     true,
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, fields[key])
+		}
+	}
+	if sizes, ok := fields["layer_sizes"].([]interface{}); !ok || len(sizes) != 3 || sizes[1] != float64(2048) {
+		t.Errorf("Expected the requested layer sizes, got %v", fields["layer_sizes"])
+	}
+
+	// Builds that write the image themselves use no builder
+	summary = newBuildSummary(&buildConfig{}, "test:v1", []int64{1024}, "", "", time.Second)
+	data, _ = json.Marshal(summary)
+	fields = nil
+	json.Unmarshal(data, &fields)
+	if _, ok := fields["builder"]; ok || fields["digest"] != nil || fields["mock_fs"] != false {
+		t.Errorf("Expected no builder, digest, or mock-fs, got %s", data)
+	}
+}
+
+func TestSummaryJSONFlag(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "image.tar")
+	summaryPath := filepath.Join(t.TempDir(), "summary.json")
+	err := RunBuild([]string{"--layer-sizes", "1KB,2KB", "--output", outPath, "--summary-json", summaryPath, "--quiet", "summary:v1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(summaryPath)
+	if err != nil {
+		t.Fatalf("Expected a summary to be written: %v", err)
+	}
+	var summary buildSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Summary is not valid JSON: %v", err)
+	}
+	if summary.RepoTag != "summary:v1" || summary.Layers != 2 || summary.TotalSize != 3072 || summary.Builder != "" || summary.MockFS {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	// A mock filesystem layer chosen per layer counts as --mock-fs
+	err = RunBuild([]string{"--layer-sizes", "1MB:mockfs,1KB", "--output", outPath, "--summary-json", summaryPath, "--quiet", "summary:v2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err = os.ReadFile(summaryPath)
+	if err != nil {
+		t.Fatalf("Expected a summary to be written: %v", err)
+	}
+	summary = buildSummary{}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Summary is not valid JSON: %v", err)
+	}
+	if !summary.MockFS || summary.Layers != 2 {
+		t.Errorf("Expected a two-layer mock-fs summary, got %+v", summary)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package imgmkr
+
+import "time"
+
+// setSymlinkTimes does nothing on platforms that can't set a symlink's own times
+func setSymlinkTimes(path string, t time.Time) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package imgmkr
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSymlinkTimes sets the access and modification times of the symlink at path itself to t,
+// rather than those of its target
+func setSymlinkTimes(path string, t time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(t.UnixNano()), unix.NsecToTimespec(t.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
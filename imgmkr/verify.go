@@ -0,0 +1,68 @@
+package imgmkr
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jlbutler/imgmkr/manifest"
+)
+
+// RunVerify implements the verify command: check a build directory against its layer manifest
+func RunVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	manifestPath := fs.String("manifest", "", "Path of the layer manifest to check against (default: layers.json in the build directory)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: imgmkr verify [--manifest path] build-dir\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("build directory argument is required")
+	}
+	return verifyBuildDir(os.Stdout, fs.Arg(0), *manifestPath)
+}
+
+// verifyBuildDir re-reads each layer directory in buildDir and compares its file count, size,
+// and digest against the layer manifest, reporting each layer to w
+func verifyBuildDir(w io.Writer, buildDir string, manifestPath string) error {
+	if manifestPath == "" {
+		manifestPath = filepath.Join(buildDir, manifest.FileName)
+	}
+	layers, err := manifest.Read(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, layer := range layers {
+		layerDir := filepath.Join(buildDir, fmt.Sprintf("layer%d", layer.Number))
+		stats, err := manifest.StatDir(layerDir)
+		if err != nil {
+			fmt.Fprintf(w, "layer%d: FAILED (%v)\n", layer.Number, err)
+			failed++
+			continue
+		}
+
+		switch {
+		case stats.FileCount() != layer.FileCount:
+			fmt.Fprintf(w, "layer%d: FAILED (%d files, manifest has %d)\n", layer.Number, stats.FileCount(), layer.FileCount)
+		case stats.Bytes() != layer.ActualSize:
+			fmt.Fprintf(w, "layer%d: FAILED (%d bytes, manifest has %d)\n", layer.Number, stats.Bytes(), layer.ActualSize)
+		case stats.Digest() != layer.Digest:
+			fmt.Fprintf(w, "layer%d: FAILED (digest %s, manifest has %s)\n", layer.Number, stats.Digest(), layer.Digest)
+		default:
+			fmt.Fprintf(w, "layer%d: OK\n", layer.Number)
+			continue
+		}
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d layers failed verification", failed, len(layers))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package imgmkr
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestVerifyBuildDir(t *testing.T) {
+	buildDir := t.TempDir()
+	cfg := &buildConfig{maxConcurrent: 2}
+	layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{4 * size.KB, 8 * size.KB}, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+	if err := writeLayerManifest(buildDir, layers, ""); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := verifyBuildDir(&buf, buildDir, ""); err != nil {
+		t.Fatalf("Expected an intact build directory to verify, got: %v\n%s", err, buf.String())
+	}
+
+	// Modify a file in the second layer
+	entries, err := os.ReadDir(filepath.Join(buildDir, "layer2"))
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("Failed to list layer2: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "layer2", entries[0].Name()), []byte("changed"), 0644); err != nil {
+		t.Fatalf("Failed to modify layer2: %v", err)
+	}
+
+	buf.Reset()
+	if err := verifyBuildDir(&buf, buildDir, filepath.Join(buildDir, manifest.FileName)); err == nil {
+		t.Fatal("Expected verification to fail after modifying a layer")
+	}
+	if !strings.Contains(buf.String(), "layer1: OK") || !strings.Contains(buf.String(), "layer2: FAILED") {
+		t.Errorf("Expected only layer2 to fail, got:\n%s", buf.String())
+	}
+}
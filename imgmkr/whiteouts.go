@@ -0,0 +1,151 @@
+package imgmkr
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/whiteout"
+)
+
+// addWhiteouts creates the whiteout marker for each spec in its layer, after checking that the
+// deleted path exists in an earlier layer, and updates the affected manifest entries to match
+func addWhiteouts(buildDir string, layers []manifest.Layer, specs []whiteout.Spec) error {
+	layerDirs := make([]string, len(layers))
+	for i := range layerDirs {
+		layerDirs[i] = filepath.Join(buildDir, fmt.Sprintf("layer%d", i+1))
+	}
+
+	updated := make(map[int]bool)
+	for _, spec := range specs {
+		if !whiteout.ExistsIn(layerDirs[:spec.Layer-1], spec.Path) {
+			return fmt.Errorf("cannot delete %s in layer %d: it does not exist in an earlier layer", spec.Path, spec.Layer)
+		}
+		if _, err := whiteout.Create(layerDirs[spec.Layer-1], spec.Path); err != nil {
+			return err
+		}
+		updated[spec.Layer] = true
+	}
+
+	// Whiteout markers are layer files, so the manifest must include them
+	for layerNum := range updated {
+		if err := restatLayer(layerDirs[layerNum-1], &layers[layerNum-1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMockWhiteouts has each layer after the first delete a random fraction of the files the
+// layer below it created, with whiteout markers, and make the same fraction of its directories
+// opaque. Layer n's entries are drawn with a random source seeded by seed(n), and those that
+// collide with its own files are skipped. The affected manifest entries are updated to match.
+func addMockWhiteouts(buildDir string, layers []manifest.Layer, fraction float64, seed func(int) int64) error {
+	dirs := layerDirs(buildDir, len(layers))
+	for layerNum := 2; layerNum <= len(layers); layerNum++ {
+		lowerDir, layerDir := dirs[layerNum-2], dirs[layerNum-1]
+		files, subdirs, err := layerEntries(lowerDir)
+		if err != nil {
+			return err
+		}
+
+		rng := content.NewRand(seed(layerNum))
+		deletes := pickFraction(rng, files, fraction)
+		opaques := pickFraction(rng, subdirs, fraction)
+
+		created := false
+		for _, p := range deletes {
+			// A layer can't both delete and create the same path
+			if whiteout.ExistsIn([]string{layerDir}, p) || !canHoldMarker(layerDir, path.Dir(p)) {
+				continue
+			}
+			if _, err := whiteout.Create(layerDir, p); err != nil {
+				return err
+			}
+			created = true
+		}
+		for _, p := range opaques {
+			if !canHoldMarker(layerDir, p) {
+				continue
+			}
+			if _, err := whiteout.CreateOpaque(layerDir, p); err != nil {
+				return err
+			}
+			created = true
+		}
+		if created {
+			if err := restatLayer(layerDir, &layers[layerNum-1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// canHoldMarker reports whether a marker can be created in dir, relative to layerDir, without
+// replacing a file in the layer
+func canHoldMarker(layerDir string, dir string) bool {
+	info, err := os.Stat(filepath.Join(layerDir, filepath.FromSlash(dir)))
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	return info.IsDir()
+}
+
+// layerEntries returns the slash-separated paths of the files (other than whiteout markers) and
+// the subdirectories in layerDir, in walk order
+func layerEntries(layerDir string) (files []string, dirs []string, err error) {
+	err = filepath.WalkDir(layerDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == layerDir {
+			return err
+		}
+		relPath, err := filepath.Rel(layerDir, p)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, relPath)
+		case !whiteout.IsMarker(relPath):
+			files = append(files, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read layer directory %s: %w", layerDir, err)
+	}
+	return files, dirs, nil
+}
+
+// pickFraction returns a random fraction of paths, rounded to the nearest path, in their original order
+func pickFraction(rng *rand.Rand, paths []string, fraction float64) []string {
+	n := int(math.Round(fraction * float64(len(paths))))
+	picked := rng.Perm(len(paths))[:n]
+	sort.Ints(picked)
+	result := make([]string, n)
+	for i, index := range picked {
+		result[i] = paths[index]
+	}
+	return result
+}
+
+// restatLayer updates a layer's manifest entry to match what is on disk in layerDir
+func restatLayer(layerDir string, layer *manifest.Layer) error {
+	stats, err := manifest.StatDir(layerDir)
+	if err != nil {
+		return err
+	}
+	layer.ActualSize = stats.Bytes()
+	layer.FileCount = stats.FileCount()
+	layer.Digest = stats.Digest()
+	return nil
+}
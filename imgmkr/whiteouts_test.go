@@ -0,0 +1,98 @@
+package imgmkr
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
+	"github.com/jlbutler/imgmkr/whiteout"
+)
+
+func TestAddWhiteouts(t *testing.T) {
+	buildDir := t.TempDir()
+	cfg := &buildConfig{maxConcurrent: 2}
+	layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{4 * size.KB, 4 * size.KB}, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+
+	// Paths must exist in an earlier layer
+	missing := []whiteout.Spec{{Layer: 2, Path: "missing"}}
+	if err := addWhiteouts(buildDir, layers, missing); err == nil {
+		t.Error("Expected an error deleting a path not in an earlier layer")
+	}
+
+	target := size.Format(4*size.KB) + "-file"
+	if err := addWhiteouts(buildDir, layers, []whiteout.Spec{{Layer: 2, Path: target}}); err != nil {
+		t.Fatalf("Unexpected error adding whiteout: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(buildDir, "layer2", ".wh."+target)); err != nil {
+		t.Errorf("Expected whiteout .wh.%s in layer2: %v", target, err)
+	}
+	if layers[1].FileCount != 2 {
+		t.Errorf("Expected the layer2 manifest entry to include the whiteout, got %+v", layers[1])
+	}
+}
+
+func TestAddMockWhiteouts(t *testing.T) {
+	buildDir := t.TempDir()
+	cfg := &buildConfig{maxConcurrent: 2, mockFS: true, maxDepth: 3, targetFiles: 40, seed: 5}
+	layers, err := createLayersConcurrently(context.Background(), buildDir, []int64{256 * size.KB, 256 * size.KB, 256 * size.KB}, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create layers: %v", err)
+	}
+	if err := addMockWhiteouts(buildDir, layers, 0.25, cfg.layerSeed); err != nil {
+		t.Fatalf("Unexpected error adding whiteouts: %v", err)
+	}
+
+	// Every marker must delete something the layer below created
+	dirs := layerDirs(buildDir, len(layers))
+	for layerNum := 2; layerNum <= len(dirs); layerNum++ {
+		var deletes, opaques int
+		err := filepath.WalkDir(dirs[layerNum-1], func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !strings.HasPrefix(d.Name(), whiteout.Prefix) {
+				return err
+			}
+			relPath, _ := filepath.Rel(dirs[layerNum-1], p)
+			dir, name := filepath.Split(relPath)
+			if name == whiteout.Opaque {
+				opaques++
+				if info, err := os.Stat(filepath.Join(dirs[layerNum-2], dir)); err != nil || !info.IsDir() {
+					t.Errorf("Layer %d: opaque marker %s has no directory in layer %d", layerNum, relPath, layerNum-1)
+				}
+				return nil
+			}
+			deletes++
+			target := filepath.Join(dir, strings.TrimPrefix(name, whiteout.Prefix))
+			if _, err := os.Lstat(filepath.Join(dirs[layerNum-2], target)); err != nil {
+				t.Errorf("Layer %d: whiteout %s deletes %s, which is not in layer %d", layerNum, relPath, target, layerNum-1)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to walk layer %d: %v", layerNum, err)
+		}
+		if deletes == 0 || opaques == 0 {
+			t.Errorf("Layer %d: expected whiteouts and opaque markers, got %d and %d", layerNum, deletes, opaques)
+		}
+
+		// The manifest counts the markers
+		stats, err := manifest.StatDir(dirs[layerNum-1])
+		if err != nil {
+			t.Fatalf("Failed to stat layer %d: %v", layerNum, err)
+		}
+		if layers[layerNum-1].FileCount != stats.FileCount() || layers[layerNum-1].Digest != stats.Digest() {
+			t.Errorf("Layer %d: manifest entry %+v does not include the markers", layerNum, layers[layerNum-1])
+		}
+	}
+
+	// The first layer has nothing below it to delete
+	if _, err := os.Stat(filepath.Join(dirs[0], whiteout.Opaque)); err == nil {
+		t.Error("Expected no markers in the first layer")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		args     []string
+		command  string
+		remained int
+	}{
+		{[]string{"build", "--layer-sizes", "1MB", "test:v1"}, "build", 3},
+		{[]string{"plan", "--layer-sizes", "1MB"}, "plan", 2},
+		{[]string{"probe"}, "probe", 0},
+		{[]string{"verify", "/tmp/build"}, "verify", 1},
+		// Flags without a subcommand run build for backward compatibility
+		{[]string{"--layer-sizes", "1MB", "test:v1"}, "build", 3},
+		// --probe predates the probe subcommand and still runs it
+		{[]string{"--probe"}, "probe", 0},
+		{[]string{"-probe"}, "probe", 0},
+	}
+
+	for _, test := range tests {
+		cmd, args, err := route(test.args)
+		if err != nil {
+			t.Errorf("route(%v): unexpected error: %v", test.args, err)
+			continue
+		}
+		if cmd.name != test.command || len(args) != test.remained {
+			t.Errorf("route(%v): expected %s with %d args, got %s with %v", test.args, test.command, test.remained, cmd.name, args)
+		}
+	}
+
+	for _, args := range [][]string{nil, {"help"}, {"-h"}, {"--help"}} {
+		if _, _, err := route(args); err != errUsage {
+			t.Errorf("route(%v): expected usage, got %v", args, err)
+		}
+	}
+
+	if _, _, err := route([]string{"bogus"}); err == nil || err == errUsage {
+		t.Errorf("Expected an unknown command error, got %v", err)
+	}
+}
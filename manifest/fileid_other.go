@@ -0,0 +1,10 @@
+//go:build !unix
+
+package manifest
+
+import "io/fs"
+
+// linkedFileID is not supported on this platform: no file is recognized as a hardlink
+func linkedFileID(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
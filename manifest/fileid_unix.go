@@ -0,0 +1,17 @@
+//go:build unix
+
+package manifest
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// linkedFileID returns the identity of the file behind info, if it has more than one link
+func linkedFileID(info fs.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
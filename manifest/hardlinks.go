@@ -0,0 +1,32 @@
+package manifest
+
+import "io/fs"
+
+// Hardlinks recognizes regular files seen earlier in a walk under another name
+type Hardlinks struct {
+	seen map[fileID]string
+}
+
+// fileID identifies a file across all of its names
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// Seen reports the name a file was first seen under, if the file behind info was seen before,
+// and otherwise records it under name. Only files with more than one link are tracked; hardlinks
+// are not recognized on platforms without inode numbers.
+func (h *Hardlinks) Seen(name string, info fs.FileInfo) (string, bool) {
+	id, ok := linkedFileID(info)
+	if !ok {
+		return "", false
+	}
+	if first, ok := h.seen[id]; ok {
+		return first, true
+	}
+	if h.seen == nil {
+		h.seen = make(map[fileID]string)
+	}
+	h.seen[id] = name
+	return "", false
+}
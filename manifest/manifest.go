@@ -0,0 +1,172 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileName is the name of the layer manifest written to the build directory
+const FileName = "layers.json"
+
+// Layer describes a generated layer
+type Layer struct {
+	Number         int    `json:"number"`
+	RequestedSize  int64  `json:"requested_size"`
+	ActualSize     int64  `json:"actual_size"`
+	FileCount      int    `json:"file_count"`
+	ContentMode    string `json:"content_mode"`
+	Digest         string `json:"digest"`
+	UniqueContents int    `json:"unique_contents,omitempty"` // Number of distinct file contents, when limited
+	UID            *int   `json:"uid,omitempty"`             // Owner requested for the layer's files, if any
+	GID            *int   `json:"gid,omitempty"`             // Group requested for the layer's files, if any
+}
+
+// LayerStats accumulates the files written to a layer
+type LayerStats struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	bytes int64
+}
+
+// NewLayerStats creates an empty set of layer statistics
+func NewLayerStats() *LayerStats {
+	return &LayerStats{files: make(map[string][]byte)}
+}
+
+// AddFile records a written file by its path relative to the layer directory
+func (s *LayerStats) AddFile(relPath string, fileSize int64, sum []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[relPath] = sum
+	s.bytes += fileSize
+}
+
+// AddHardlink records a hardlink, by its path relative to the layer directory, to a file with
+// the given SHA-256 already recorded. It counts as a file, but its data is not counted again.
+func (s *LayerStats) AddHardlink(relPath string, sum []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[relPath] = sum
+}
+
+// FileCount returns the number of files recorded
+func (s *LayerStats) FileCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// Bytes returns the total size of the files recorded
+func (s *LayerStats) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// UniqueContents returns the number of distinct file contents recorded
+func (s *LayerStats) UniqueContents() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sums := make(map[string]bool, len(s.files))
+	for _, sum := range s.files {
+		sums[string(sum)] = true
+	}
+	return len(sums)
+}
+
+// Digest returns a sha256 digest over the sorted per-file digests, so it is independent of write order
+func (s *LayerStats) Digest() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Hash one "<sha256>  <path>" line per file, as sha256sum would print them
+	hash := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(hash, "%x  %s\n", s.files[path], path)
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil))
+}
+
+// Write marshals the layers to path as indented JSON
+func Write(path string, layers []Layer) error {
+	data, err := json.MarshalIndent(layers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal layer manifest: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write layer manifest: %w", err)
+	}
+	return nil
+}
+
+// Read loads a layer manifest written by Write
+func Read(path string) ([]Layer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layer manifest: %w", err)
+	}
+	var layers []Layer
+	if err := json.Unmarshal(data, &layers); err != nil {
+		return nil, fmt.Errorf("failed to parse layer manifest %s: %w", path, err)
+	}
+	return layers, nil
+}
+
+// StatDir walks an existing layer directory and hashes every regular file in it. Hardlinks to
+// a file already hashed are recorded as AddHardlink does.
+func StatDir(layerDir string) (*LayerStats, error) {
+	stats := NewLayerStats()
+	var links Hardlinks
+	err := filepath.WalkDir(layerDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		relPath, err := filepath.Rel(layerDir, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if first, ok := links.Seen(relPath, info); ok {
+			stats.AddHardlink(relPath, stats.files[first])
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		n, err := io.Copy(hash, file)
+		if err != nil {
+			return err
+		}
+
+		stats.AddFile(relPath, n, hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layer directory %s: %w", layerDir, err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,93 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayerStatsDigestOrderIndependent(t *testing.T) {
+	sumA := sha256.Sum256([]byte("a"))
+	sumB := sha256.Sum256([]byte("b"))
+
+	first := NewLayerStats()
+	first.AddFile("dir1/a", 1, sumA[:])
+	first.AddFile("b", 1, sumB[:])
+
+	second := NewLayerStats()
+	second.AddFile("b", 1, sumB[:])
+	second.AddFile("dir1/a", 1, sumA[:])
+
+	if first.Digest() != second.Digest() {
+		t.Errorf("Expected digests to match regardless of order: %s != %s", first.Digest(), second.Digest())
+	}
+	if first.FileCount() != 2 || first.Bytes() != 2 {
+		t.Errorf("Expected 2 files and 2 bytes, got %d files and %d bytes", first.FileCount(), first.Bytes())
+	}
+
+	second.AddFile("c", 1, sumA[:])
+	if first.Digest() == second.Digest() {
+		t.Error("Expected digests to differ after adding a file")
+	}
+}
+
+func TestStatDir(t *testing.T) {
+	layerDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(layerDir, "dir1"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	files := map[string]string{"a": "hello", "dir1/b": "world!"}
+	expected := NewLayerStats()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(layerDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		sum := sha256.Sum256([]byte(content))
+		expected.AddFile(name, int64(len(content)), sum[:])
+	}
+
+	stats, err := StatDir(layerDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats.FileCount() != 2 || stats.Bytes() != 11 {
+		t.Errorf("Expected 2 files and 11 bytes, got %d files and %d bytes", stats.FileCount(), stats.Bytes())
+	}
+	if stats.Digest() != expected.Digest() {
+		t.Errorf("Expected digest %s, got %s", expected.Digest(), stats.Digest())
+	}
+}
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	layers := []Layer{
+		{Number: 1, RequestedSize: 1024, ActualSize: 1024, FileCount: 1, ContentMode: "single-file", Digest: "sha256:abc"},
+		{Number: 2, RequestedSize: 2048, ActualSize: 2048, FileCount: 5, ContentMode: "mock-fs", Digest: "sha256:def"},
+	}
+	if err := Write(path, layers); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var decoded []Layer
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal manifest: %v", err)
+	}
+	if len(decoded) != 2 || decoded[1] != layers[1] {
+		t.Errorf("Expected %+v, got %+v", layers, decoded)
+	}
+
+	// Read round-trips what Write produced
+	read, err := Read(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading manifest: %v", err)
+	}
+	if len(read) != 2 || read[0] != layers[0] || read[1] != layers[1] {
+		t.Errorf("Expected %+v, got %+v", layers, read)
+	}
+}
@@ -0,0 +1,58 @@
+// Package memory fits imgmkr's buffer allocations into a memory budget
+package memory
+
+import (
+	"fmt"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// Requirements describes the memory a build would use if it were not limited
+type Requirements struct {
+	Workers   int   // Requested number of concurrent layer writers
+	PerWorker int64 // Memory each writer holds (write chunk plus compression buffers)
+	Cache     int64 // Preferred size of the shared random cache (0 if unused)
+	MinCache  int64 // Smallest usable shared random cache
+}
+
+// Plan is the concurrency and cache size that fit a budget
+type Plan struct {
+	Workers int
+	Cache   int64
+}
+
+// Usage returns the memory the plan's buffers use
+func (p Plan) Usage(req Requirements) int64 {
+	return int64(p.Workers)*req.PerWorker + p.Cache
+}
+
+// Fit returns the largest plan for req that stays within limit bytes. Concurrency is reduced
+// first, down to a single writer, and only then is the shared cache shrunk, down to MinCache.
+// A limit of 0 means no limit. Fit returns an error if even one writer with the smallest
+// cache does not fit.
+func Fit(limit int64, req Requirements) (Plan, error) {
+	plan := Plan{Workers: req.Workers, Cache: req.Cache}
+	if limit <= 0 || plan.Usage(req) <= limit {
+		return plan, nil
+	}
+
+	// Drop writers until the rest fit alongside the full cache
+	if req.PerWorker > 0 {
+		plan.Workers = int((limit - req.Cache) / req.PerWorker)
+	}
+	if plan.Workers >= 1 {
+		return plan, nil
+	}
+
+	// A single writer still doesn't fit, so shrink the cache
+	plan.Workers = 1
+	if req.Cache > 0 {
+		plan.Cache = limit - req.PerWorker
+		if plan.Cache >= req.MinCache {
+			return plan, nil
+		}
+		plan.Cache = req.MinCache
+	}
+	return Plan{}, fmt.Errorf("memory budget of %s is too small: a single layer writer needs at least %s",
+		size.Format(limit), size.Format(plan.Usage(req)))
+}
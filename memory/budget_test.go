@@ -0,0 +1,58 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestFit(t *testing.T) {
+	req := Requirements{Workers: 8, PerWorker: 10 * size.MB, Cache: 64 * size.MB, MinCache: 1 * size.MB}
+
+	tests := []struct {
+		limit    int64
+		expected Plan
+		hasError bool
+	}{
+		// Unlimited, or enough room for everything
+		{0, Plan{Workers: 8, Cache: 64 * size.MB}, false},
+		{1 * size.GB, Plan{Workers: 8, Cache: 64 * size.MB}, false},
+
+		// Concurrency is reduced before the cache
+		{144 * size.MB, Plan{Workers: 8, Cache: 64 * size.MB}, false},
+		{100 * size.MB, Plan{Workers: 3, Cache: 64 * size.MB}, false},
+		{74 * size.MB, Plan{Workers: 1, Cache: 64 * size.MB}, false},
+
+		// Then the cache shrinks
+		{40 * size.MB, Plan{Workers: 1, Cache: 30 * size.MB}, false},
+		{11 * size.MB, Plan{Workers: 1, Cache: 1 * size.MB}, false},
+
+		// Too small for a single writer
+		{10 * size.MB, Plan{}, true},
+	}
+
+	for _, test := range tests {
+		plan, err := Fit(test.limit, req)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected error for limit %s, got %+v", size.Format(test.limit), plan)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for limit %s: %v", size.Format(test.limit), err)
+		}
+		if plan != test.expected {
+			t.Errorf("For limit %s, expected %+v, got %+v", size.Format(test.limit), test.expected, plan)
+		}
+		if test.limit > 0 && plan.Usage(req) > test.limit {
+			t.Errorf("For limit %s, plan %+v uses %s", size.Format(test.limit), plan, size.Format(plan.Usage(req)))
+		}
+	}
+
+	// Without a cache, only concurrency is reduced
+	plan, err := Fit(25*size.MB, Requirements{Workers: 5, PerWorker: 10 * size.MB})
+	if err != nil || plan != (Plan{Workers: 2}) {
+		t.Errorf("Expected 2 writers and no cache, got %+v (err: %v)", plan, err)
+	}
+}
@@ -0,0 +1,82 @@
+package mockfs
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// FileProfile is a named preset that names files like a kind of image, picking each file's
+// extension by its size without changing the sizes themselves
+type FileProfile struct {
+	Name        string
+	Description string
+	Buckets     []SizeBucket // Extensions by file size; only Max and Extensions are used
+}
+
+// fileProfiles lists the available file profiles, in the order they are shown. Extensions
+// repeated in a bucket are picked more often.
+var fileProfiles = []*FileProfile{
+	{
+		Name:        "generic",
+		Description: "Config files and logs, shared libraries, and large binaries and archives",
+		Buckets: []SizeBucket{
+			{Max: 16 * size.KB, Extensions: []string{".conf", ".conf", ".txt", ".txt", ".json", ".log", ".yaml", ".sh"}},
+			{Max: size.MB, Extensions: []string{".so", ".so", ".txt", ".log", ".json", ".bin"}},
+			{Max: math.MaxInt64, Extensions: []string{".bin", ".bin", ".tar", ".tar", ".so", ".gz"}},
+		},
+	},
+	{
+		Name:        "python",
+		Description: "Python packages: modules and bytecode, extension modules, and wheels",
+		Buckets: []SizeBucket{
+			{Max: 16 * size.KB, Extensions: []string{".py", ".py", ".py", ".pyc", ".pyc", ".txt", ".cfg", ".toml"}},
+			{Max: size.MB, Extensions: []string{".py", ".pyc", ".so", ".so", ".json"}},
+			{Max: math.MaxInt64, Extensions: []string{".so", ".so", ".whl", ".bin", ".tar"}},
+		},
+	},
+	{
+		Name:        "java",
+		Description: "Java application: classes and properties, and large jars",
+		Buckets: []SizeBucket{
+			{Max: 16 * size.KB, Extensions: []string{".class", ".class", ".class", ".properties", ".xml", ".conf", ".txt"}},
+			{Max: size.MB, Extensions: []string{".class", ".jar", ".jar", ".xml", ".so"}},
+			{Max: math.MaxInt64, Extensions: []string{".jar", ".jar", ".jar", ".war", ".so", ".bin"}},
+		},
+	},
+	{
+		Name:        "node",
+		Description: "Node.js application: JavaScript sources and source maps, and native addons",
+		Buckets: []SizeBucket{
+			{Max: 16 * size.KB, Extensions: []string{".js", ".js", ".js", ".json", ".md", ".ts", ".map"}},
+			{Max: size.MB, Extensions: []string{".js", ".js", ".map", ".json", ".node"}},
+			{Max: math.MaxInt64, Extensions: []string{".node", ".wasm", ".tar", ".bin"}},
+		},
+	},
+}
+
+// FileProfiles returns the available file profiles
+func FileProfiles() []*FileProfile {
+	return fileProfiles
+}
+
+// LookupFileProfile returns the file profile with the given name
+func LookupFileProfile(name string) (*FileProfile, error) {
+	for _, p := range fileProfiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	names := make([]string, len(fileProfiles))
+	for i, p := range fileProfiles {
+		names[i] = p.Name
+	}
+	return nil, fmt.Errorf("unknown file profile %q (available: %v)", name, names)
+}
+
+// extension returns a random extension for a file of the given size
+func (p *FileProfile) extension(rng *rand.Rand, fileSize int64) string {
+	return bucketExtension(p.Buckets, rng, fileSize)
+}
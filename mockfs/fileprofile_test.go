@@ -0,0 +1,99 @@
+package mockfs
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestFileProfileExtensions(t *testing.T) {
+	// A size in each bucket of every profile, smallest bucket first
+	sizes := []int64{2 * size.KB, 256 * size.KB, 64 * size.MB}
+	expected := map[string][][]string{
+		"generic": {{".conf", ".txt"}, {".so"}, {".bin", ".tar"}},
+		"python":  {{".py", ".pyc"}, {".so"}, {".so", ".whl"}},
+		"java":    {{".class", ".properties"}, {".class", ".jar"}, {".jar", ".war"}},
+		"node":    {{".js", ".json"}, {".js", ".map"}, {".node", ".wasm"}},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, p := range FileProfiles() {
+		want, ok := expected[p.Name]
+		if !ok {
+			t.Errorf("No expectations for file profile %s", p.Name)
+			continue
+		}
+		for i, fileSize := range sizes {
+			seen := make(map[string]bool)
+			for n := 0; n < 200; n++ {
+				ext := p.extension(rng, fileSize)
+				if !slices.Contains(p.Buckets[i].Extensions, ext) {
+					t.Errorf("%s: extension %q for a %s file is not from its size bucket", p.Name, ext, size.Format(fileSize))
+				}
+				seen[ext] = true
+			}
+			for _, ext := range want[i] {
+				if !seen[ext] {
+					t.Errorf("%s: expected %s files to be named %s, got %v", p.Name, size.Format(fileSize), ext, seen)
+				}
+			}
+		}
+	}
+
+	if _, err := LookupFileProfile("ruby"); err == nil {
+		t.Error("Expected an error for an unknown file profile")
+	}
+	if err := (Options{FileProfile: "ruby"}).Validate(); err == nil {
+		t.Error("Expected options with an unknown file profile to be invalid")
+	}
+}
+
+func TestCreateWithFileProfile(t *testing.T) {
+	profile, err := LookupFileProfile("java")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, opts := range []Options{
+		{MaxDepth: 2, TargetFiles: 50, FileProfile: "java", Seed: 1},
+		{FlatFiles: 20, FileProfile: "java", Seed: 1},
+		{MaxDepth: 2, FileProfile: "java", Profile: "os-base", Seed: 1}, // Overrides the profile's extensions
+	} {
+		layerDir := t.TempDir()
+		if _, err := Create(context.Background(), layerDir, 4*size.MB, opts); err != nil {
+			t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+		}
+
+		var files int
+		err := filepath.WalkDir(layerDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files++
+			for _, b := range profile.Buckets {
+				if info.Size() <= b.Max {
+					if !slices.Contains(b.Extensions, filepath.Ext(path)) {
+						t.Errorf("Expected %s (%s) to have an extension from %v", d.Name(), size.Format(info.Size()), b.Extensions)
+					}
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to walk layer: %v", err)
+		}
+		if files == 0 {
+			t.Error("Expected files in the layer")
+		}
+	}
+}
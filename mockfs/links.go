@@ -0,0 +1,59 @@
+package mockfs
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// writtenFile is a regular file written to the layer, which links may point to
+type writtenFile struct {
+	path string
+	sum  []byte
+}
+
+// addLinks adds opts.Links links for every regular file written to the layer, each a symlink or
+// hardlink, with even odds, to a random one of those files. A link goes in the directory of
+// another random file, so links stay inside the layer and are only made once their targets
+// exist. Symlinks hold a relative target and are not recorded in the layer statistics; hardlinks
+// are recorded as files whose data is not counted again.
+func (b *layerBuilder) addLinks() error {
+	files := b.written
+	numLinks := int(math.Round(b.opts.Links * float64(len(files))))
+	for i := 0; i < numLinks; i++ {
+		target := files[b.rng.Intn(len(files))]
+		dir := filepath.Dir(files[b.rng.Intn(len(files))].path)
+		symlink := b.rng.Intn(2) == 0
+
+		kind := "hardlink"
+		if symlink {
+			kind = "symlink"
+		}
+		linkPath := filepath.Join(dir, safeName(fmt.Sprintf("%s%d-%s", kind, i+1, filepath.Base(target.path))))
+		if err := checkPathLen(linkPath); err != nil {
+			return err
+		}
+
+		if !symlink {
+			if err := os.Link(target.path, linkPath); err != nil {
+				return fmt.Errorf("failed to create hardlink: %w", explainPathErr(err, linkPath))
+			}
+			relPath, err := filepath.Rel(b.layerDir, linkPath)
+			if err != nil {
+				return err
+			}
+			b.stats.AddHardlink(filepath.ToSlash(relPath), target.sum)
+			continue
+		}
+
+		linkTarget, err := filepath.Rel(dir, target.path)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(linkTarget, linkPath); err != nil {
+			return fmt.Errorf("failed to create symlink: %w", explainPathErr(err, linkPath))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package mockfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestCreateLinks(t *testing.T) {
+	for _, opts := range []Options{
+		{MaxDepth: 3, TargetFiles: 40, Links: 0.5, Seed: 1},
+		{FlatFiles: 20, Links: 0.5, Seed: 1},
+	} {
+		layerDir := t.TempDir()
+		stats, err := Create(context.Background(), layerDir, 2*size.MB, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+		}
+
+		var regular []os.FileInfo
+		var symlinks, hardlinks int
+		err = filepath.WalkDir(layerDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				symlinks++
+				// Symlinks are relative and resolve to a file inside the layer
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				resolved, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					t.Errorf("Symlink %s is dangling: %v", path, err)
+					return nil
+				}
+				root, _ := filepath.EvalSymlinks(layerDir)
+				if filepath.IsAbs(target) || !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+					t.Errorf("Expected symlink %s -> %s to stay within the layer", path, target)
+				}
+				return nil
+			}
+			for _, other := range regular {
+				if os.SameFile(info, other) {
+					hardlinks++
+					break
+				}
+			}
+			regular = append(regular, info)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to walk layer: %v", err)
+		}
+		if symlinks == 0 || hardlinks == 0 {
+			t.Errorf("Expected both symlinks and hardlinks, got %d symlinks and %d hardlinks", symlinks, hardlinks)
+		}
+
+		// Links add no bytes: hardlinks count as files, symlinks not at all
+		if stats.Bytes() != 2*size.MB {
+			t.Errorf("Expected links to leave the layer at %d bytes, got %d", 2*size.MB, stats.Bytes())
+		}
+		if stats.FileCount() != len(regular) {
+			t.Errorf("Expected %d files including hardlinks, got %d", len(regular), stats.FileCount())
+		}
+
+		// Reading the layer back agrees with the statistics recorded while writing it
+		read, err := manifest.StatDir(layerDir)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if read.Bytes() != stats.Bytes() || read.FileCount() != stats.FileCount() || read.Digest() != stats.Digest() {
+			t.Errorf("Expected StatDir to match the written layer: %d bytes, %d files, %s; got %d bytes, %d files, %s",
+				stats.Bytes(), stats.FileCount(), stats.Digest(), read.Bytes(), read.FileCount(), read.Digest())
+		}
+	}
+
+	if err := (Options{Links: 1.5}).Validate(); err == nil {
+		t.Error("Expected an error for a links fraction above 1")
+	}
+}
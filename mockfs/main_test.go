@@ -0,0 +1,12 @@
+package mockfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Every layer created in tests must add up to exactly its requested size
+	strictSizes = true
+	os.Exit(m.Run())
+}
@@ -1,43 +1,384 @@
 package mockfs
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/fault"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/pause"
 	"github.com/jlbutler/imgmkr/size"
+	"github.com/jlbutler/imgmkr/throttle"
+	"github.com/jlbutler/imgmkr/verify"
 )
 
-// Create creates a mock filesystem structure with multiple files and directories
-func Create(layerDir string, layerSize int64, maxDepth int, targetFiles int) error {
+// Options controls the shape and behavior of a mock filesystem
+type Options struct {
+	MaxDepth       int               // Maximum directory depth
+	TargetFiles    int               // Target number of files (0 = calculated from layer size)
+	ExactFileCount bool              // Plan exactly the target number of files instead of about that many
+	MinSubdirs     int               // Minimum subdirectories created per level (0 = default of 2)
+	MaxSubdirs     int               // Maximum subdirectories created per level (0 = default of 4)
+	VerifyWrites   bool              // Re-read each file after writing and compare checksums
+	MagicHeaders   bool              // Give files an extension and start them with that format's magic number
+	Pause          *pause.Gate       // Gate checked between chunks so writes can be paused (may be nil)
+	Progress       func(int64)       // Called with the number of bytes written after each chunk (may be nil)
+	RateLimit      *throttle.Limiter // Shared limiter capping write throughput (may be nil)
+	Faults         *fault.Injector   // Fault injector wrapping file writes (may be nil)
+	PruneEmpty     bool              // Remove directories that end up containing no files
+	TrueRandom     bool              // Generate fresh random data for every file instead of reusing the random buffer
+	Cache          *content.Cache    // Random buffer reused for file data (nil = one of content.CacheSize)
+	Seed           int64             // Seed for the layout and content, so the same seed gives the same layer (0 = random)
+	FlatFiles      int               // Create exactly this many files directly in the layer root instead of a tree (0 = tree)
+	SizeTolerance  float64           // Percentage the layer may fall short of its size to avoid a corrective file (0 = exact)
+	UniqueContents int               // Limit the layer to this many distinct file contents, copying them to the other files (0 = all distinct)
+	Profile        string            // Name of a profile shaping file sizes, extensions, and directory names (empty = default shape)
+	FileProfile    string            // Name of a file profile picking file extensions by size, over the profile's (empty = none)
+	Links          float64           // Links to add per regular file, each a symlink or hardlink to another file (0 = none)
+	FileMode       os.FileMode       // Permissions set on every file, overriding the umask (0 = as created)
+	DirMode        os.FileMode       // Permissions set on every subdirectory, overriding the umask (0 = as created)
+	SpecialModes   float64           // Fraction of files made executable or setuid executable, instead of FileMode (0 = none)
+	StrictSize     bool              // Fail unless the planned and written file sizes add up to exactly the layer size
+	TrickyNames    float64           // Fraction of files given Unicode, whitespace, or shell-unfriendly names (0 = none)
+	DictSize       int               // Fill each file by repeating a random dictionary of this many bytes (0 = random data)
+	Compressible   float64           // Fraction (0 to 1) of random data written as compressible zero bytes instead
+}
+
+// Default subdirectory fanout per level
+const (
+	DefaultMinSubdirs = 2
+	DefaultMaxSubdirs = 4
+)
+
+// Validate checks that the options are consistent
+func (o Options) Validate() error {
+	minSubdirs, maxSubdirs := o.subdirRange()
+	if minSubdirs < 1 || maxSubdirs < 1 {
+		return fmt.Errorf("subdirectory counts must be at least 1 (min %d, max %d)", minSubdirs, maxSubdirs)
+	}
+	if minSubdirs > maxSubdirs {
+		return fmt.Errorf("minimum subdirectories (%d) cannot exceed maximum subdirectories (%d)", minSubdirs, maxSubdirs)
+	}
+	if o.FlatFiles < 0 {
+		return fmt.Errorf("flat file count cannot be negative (%d)", o.FlatFiles)
+	}
+	if o.UniqueContents < 0 {
+		return fmt.Errorf("unique contents count cannot be negative (%d)", o.UniqueContents)
+	}
+	if o.UniqueContents > 0 && o.FlatFiles > 0 {
+		return fmt.Errorf("unique contents cannot be combined with flat files")
+	}
+	if o.UniqueContents > 0 && o.MagicHeaders {
+		// Copies are named independently of their source, so they would carry another format's magic number
+		return fmt.Errorf("unique contents cannot be combined with magic headers")
+	}
+	if o.SizeTolerance < 0 || o.SizeTolerance >= 100 {
+		return fmt.Errorf("size tolerance must be at least 0%% and below 100%% (got %g%%)", o.SizeTolerance)
+	}
+	if o.TrickyNames < 0 || o.TrickyNames > 1 {
+		return fmt.Errorf("tricky names fraction must be between 0 and 1 (got %g)", o.TrickyNames)
+	}
+	if o.DictSize < 0 {
+		return fmt.Errorf("dictionary size cannot be negative (%d)", o.DictSize)
+	}
+	if o.DictSize > 0 && o.TrueRandom {
+		return fmt.Errorf("dictionary content cannot be combined with true random data")
+	}
+	if o.FileMode&^modeBits != 0 || o.DirMode&^modeBits != 0 {
+		return fmt.Errorf("file and directory modes may only set permission, setuid, setgid, and sticky bits (got %v and %v)", o.FileMode, o.DirMode)
+	}
+	if o.SpecialModes < 0 || o.SpecialModes > 1 {
+		return fmt.Errorf("special modes fraction must be between 0 and 1 (got %g)", o.SpecialModes)
+	}
+	if o.Links < 0 || o.Links > 1 {
+		return fmt.Errorf("links fraction must be between 0 and 1 (got %g)", o.Links)
+	}
+	if o.Compressible < 0 || o.Compressible > 1 {
+		return fmt.Errorf("compressible fraction must be between 0 and 1 (got %g)", o.Compressible)
+	}
+	if o.Compressible > 0 && o.DictSize > 0 {
+		return fmt.Errorf("a compressible fraction cannot be combined with dictionary content")
+	}
+	if o.ExactFileCount && o.SizeTolerance > 0 {
+		return fmt.Errorf("an exact file count cannot be combined with a size tolerance, which only avoids adding a file")
+	}
+	if o.StrictSize && (o.SizeTolerance > 0 || o.UniqueContents > 0) {
+		return fmt.Errorf("strict sizes cannot be combined with a size tolerance or unique contents, which change the layer size")
+	}
+	if o.Profile != "" {
+		if _, err := LookupProfile(o.Profile); err != nil {
+			return err
+		}
+		if o.FlatFiles > 0 {
+			return fmt.Errorf("profiles cannot be combined with flat files")
+		}
+	}
+	if o.FileProfile != "" {
+		if _, err := LookupFileProfile(o.FileProfile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strictSizes turns on the exact size check for every layer without a size tolerance or unique
+// contents, whether or not StrictSize is set (tests set it to catch drift)
+var strictSizes = false
+
+// strict reports whether the layer's file sizes must add up to exactly the layer size
+func (o Options) strict() bool {
+	return o.StrictSize || (strictSizes && o.SizeTolerance == 0 && o.UniqueContents == 0)
+}
+
+// checkSize returns an error if a strict layer's files, as planned or as written, don't add up to layerSize
+func (o Options) checkSize(what string, got int64, layerSize int64) error {
+	if o.strict() && got != layerSize {
+		return fmt.Errorf("%s files total %d bytes, not the requested layer size of %d bytes", what, got, layerSize)
+	}
+	return nil
+}
+
+// profile returns the profile named in the options, or nil if none is set
+func (o Options) profile() *Profile {
+	if o.Profile == "" {
+		return nil
+	}
+	p, _ := LookupProfile(o.Profile)
+	return p
+}
+
+// fileProfile returns the selected file profile, or nil for none
+func (o Options) fileProfile() *FileProfile {
+	if o.FileProfile == "" {
+		return nil
+	}
+	p, _ := LookupFileProfile(o.FileProfile)
+	return p
+}
+
+// CheckLayerSize checks that a layer of the given size can be generated with these options
+func (o Options) CheckLayerSize(layerSize int64) error {
+	if int64(o.FlatFiles) > layerSize {
+		return fmt.Errorf("cannot split %d bytes into %d flat files of at least 1 byte each", layerSize, o.FlatFiles)
+	}
+	if o.ExactFileCount && o.FlatFiles == 0 && int64(o.targetFiles(layerSize)) > layerSize {
+		return fmt.Errorf("cannot split %d bytes into exactly %d files of at least 1 byte each", layerSize, o.targetFiles(layerSize))
+	}
+	return nil
+}
+
+// subdirRange returns the subdirectory fanout bounds, applying defaults for unset values
+func (o Options) subdirRange() (int, int) {
+	minSubdirs, maxSubdirs := o.MinSubdirs, o.MaxSubdirs
+	if minSubdirs == 0 {
+		minSubdirs = DefaultMinSubdirs
+		if maxSubdirs > 0 && maxSubdirs < minSubdirs {
+			minSubdirs = maxSubdirs
+		}
+	}
+	if maxSubdirs == 0 {
+		maxSubdirs = DefaultMaxSubdirs
+		if minSubdirs > maxSubdirs {
+			maxSubdirs = minSubdirs
+		}
+	}
+	return minSubdirs, maxSubdirs
+}
+
+// beforeVerify is called between writing a file and verifying it (used by tests to simulate corruption)
+var beforeVerify = func(filePath string) {}
+
+// layerBuilder holds the state shared while populating a single layer
+type layerBuilder struct {
+	ctx         context.Context // Cancels the layer's writes
+	layerDir    string
+	opts        Options
+	stats       *manifest.LayerStats
+	rng         *rand.Rand
+	blobs       map[int64]blob // First file written with each size, when contents are shared
+	profile     *Profile       // Profile naming files and directories (may be nil)
+	fileProfile *FileProfile   // File profile picking file extensions, over the profile's (may be nil)
+	written     []writtenFile  // Regular files written so far, for links to point to
+	dirs        []string       // Subdirectories created, in order, for setting their modes
+}
+
+// filler returns the Filler for the next file's data, drawing from the layer's random source
+func (b *layerBuilder) filler(fileSize int64) *content.Filler {
+	if b.opts.DictSize > 0 {
+		return content.NewDictFiller(content.NewDict(b.rng, int(min(int64(b.opts.DictSize), fileSize))))
+	}
+	return content.NewFiller(b.rng, b.opts.Cache, b.opts.TrueRandom).WithCompressibleRatio(b.opts.Compressible)
+}
+
+// blob is a file whose content is copied to other files of the same size
+type blob struct {
+	path string
+	sum  []byte
+}
+
+// Create creates a mock filesystem structure with multiple files and directories. Cancelling ctx
+// stops the writes between chunks and returns an error wrapping ctx.Err().
+func Create(ctx context.Context, layerDir string, layerSize int64, opts Options) (*manifest.LayerStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, cancelled(err)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := opts.CheckLayerSize(layerSize); err != nil {
+		return nil, err
+	}
+
 	// Create the layer directory if it doesn't exist
 	if err := os.MkdirAll(layerDir, 0755); err != nil {
-		return fmt.Errorf("failed to create layer directory: %w", err)
+		return nil, fmt.Errorf("failed to create layer directory: %w", err)
 	}
 
-	// Calculate target files if not specified (roughly 1 file per 10MB, min 5, max 1000)
-	if targetFiles == 0 {
-		targetFiles = int(layerSize / (10 * size.MB))
-		if targetFiles < 5 {
-			targetFiles = 5
+	rng := content.NewRand(opts.Seed)
+	b := &layerBuilder{ctx: ctx, layerDir: layerDir, opts: opts, stats: manifest.NewLayerStats(), rng: rng, profile: opts.profile(), fileProfile: opts.fileProfile()}
+
+	// Put every file in the layer root instead of distributing them through a tree
+	if opts.FlatFiles > 0 {
+		if err := b.createFlatFiles(layerSize); err != nil {
+			return nil, err
 		}
-		if targetFiles > 1000 {
-			targetFiles = 1000
+		if err := b.addLinks(); err != nil {
+			return nil, err
 		}
+		return b.stats, opts.checkSize("written", b.stats.Bytes(), layerSize)
 	}
 
-	// Create realistic file size distribution
-	filePlan := CreatePlan(layerSize, targetFiles)
+	// Create realistic file size distribution, with one size per shared content
+	filePlan := opts.plan(rng, layerSize)
+	if opts.UniqueContents > 0 {
+		filePlan = dedupSizes(filePlan, opts.UniqueContents)
+		b.blobs = make(map[int64]blob)
+	}
+	if err := opts.checkSize("planned", filePlan.TotalSize(), layerSize); err != nil {
+		return nil, err
+	}
 
 	// Create directory structure and files based on the plan
-	return createFilesFromPlan(layerDir, filePlan, maxDepth, 0)
+	if err := b.createFilesFromPlan(layerDir, filePlan, 0); err != nil {
+		return nil, err
+	}
+	if err := b.addLinks(); err != nil {
+		return nil, err
+	}
+
+	// Remove empty directories so layer contents don't depend on how builders treat them
+	if opts.PruneEmpty {
+		if err := PruneEmptyDirs(layerDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.setDirModes(); err != nil {
+		return nil, err
+	}
+	return b.stats, opts.checkSize("written", b.stats.Bytes(), layerSize)
+}
+
+// PruneEmptyDirs removes every directory below root that contains no files, directly or in
+// its subdirectories. The root directory itself is kept.
+func PruneEmptyDirs(root string) error {
+	_, err := pruneDir(root, true)
+	return err
+}
+
+// pruneDir removes dir if, after pruning its subdirectories, it is empty and not the root.
+// It reports whether dir was removed.
+func pruneDir(dir string, isRoot bool) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	remaining := len(entries)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		removed, err := pruneDir(filepath.Join(dir, entry.Name()), false)
+		if err != nil {
+			return false, err
+		}
+		if removed {
+			remaining--
+		}
+	}
+
+	if remaining > 0 || isRoot {
+		return false, nil
+	}
+	if err := os.Remove(dir); err != nil {
+		return false, fmt.Errorf("failed to remove empty directory: %w", err)
+	}
+	return true, nil
+}
+
+// targetFiles returns the number of files to plan for a layer, calculating it if not specified
+func (o Options) targetFiles(layerSize int64) int {
+	if o.TargetFiles != 0 {
+		return o.TargetFiles
+	}
+	if p := o.profile(); p != nil {
+		return p.targetFiles(layerSize)
+	}
+	return DefaultTargetFiles(layerSize)
+}
+
+// DefaultTargetFiles returns the number of files used for a layer when no target is given
+// (roughly 1 file per 10MB, min 5, max 1000)
+func DefaultTargetFiles(layerSize int64) int {
+	targetFiles := int(layerSize / (10 * size.MB))
+	if targetFiles < 5 {
+		targetFiles = 5
+	}
+	if targetFiles > 1000 {
+		targetFiles = 1000
+	}
+	return targetFiles
+}
+
+// FlatFileSizes splits layerSize into n file sizes that differ by at most one byte
+func FlatFileSizes(layerSize int64, n int) []int64 {
+	sizes := make([]int64, n)
+	for i := range sizes {
+		sizes[i] = layerSize / int64(n)
+		if int64(i) < layerSize%int64(n) {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// createFlatFiles creates opts.FlatFiles files directly in the layer directory, together totaling layerSize
+func (b *layerBuilder) createFlatFiles(layerSize int64) error {
+	for i, fileSize := range FlatFileSizes(layerSize, b.opts.FlatFiles) {
+		// Number the files, as many share the same size
+		fileName := b.fileName(fmt.Sprintf("%s-file%d", size.Format(fileSize), i+1)) + b.extension(fileSize)
+		filePath := filepath.Join(b.layerDir, safeName(fileName))
+
+		sum, err := createSingleFile(b.ctx, filePath, fileSize, b.fileMode(), b.opts, b.filler(fileSize))
+		if err != nil {
+			return err
+		}
+		b.addFile(filePath, fileSize, sum)
+	}
+	return nil
 }
 
 // createFilesFromPlan creates files based on the file size plan
-func createFilesFromPlan(dir string, plan Plan, maxDepth int, currentDepth int) error {
+func (b *layerBuilder) createFilesFromPlan(dir string, plan Plan, currentDepth int) error {
 	// Calculate total files to distribute
-	totalFiles := len(plan.VeryLargeFiles) + len(plan.LargeFiles) + len(plan.MediumFiles) + len(plan.SmallFiles)
+	totalFiles := plan.Files()
 	if totalFiles == 0 {
 		return nil
 	}
@@ -51,7 +392,7 @@ func createFilesFromPlan(dir string, plan Plan, maxDepth int, currentDepth int)
 
 	// Shuffle to distribute different sizes across directories
 	for i := range allFiles {
-		j := rand.Intn(i + 1)
+		j := b.rng.Intn(i + 1)
 		allFiles[i], allFiles[j] = allFiles[j], allFiles[i]
 	}
 
@@ -60,38 +401,51 @@ func createFilesFromPlan(dir string, plan Plan, maxDepth int, currentDepth int)
 	if filesAtThisLevel < 1 {
 		filesAtThisLevel = totalFiles
 	}
-	if currentDepth >= maxDepth {
+	if currentDepth >= b.opts.MaxDepth {
 		filesAtThisLevel = totalFiles // All files at this level if max depth reached
 	}
 
-	// Create files at this level
+	// Create files at this level, numbering files whose sizes format the same so none is overwritten
+	names := make(map[string]int)
 	for i := 0; i < filesAtThisLevel && i < len(allFiles); i++ {
 		fileSize := allFiles[i]
 		fileName := fmt.Sprintf("%s-file", size.Format(fileSize))
-		filePath := filepath.Join(dir, fileName)
+		if names[fileName]++; names[fileName] > 1 {
+			fileName += fmt.Sprintf("%d", names[fileName])
+		}
+		fileName = b.fileName(fileName) + b.extension(fileSize)
+		filePath := filepath.Join(dir, safeName(fileName))
 
-		err := createSingleFile(filePath, fileSize)
+		sum, err := b.createFile(filePath, fileSize)
 		if err != nil {
 			return err
 		}
+		b.addFile(filePath, fileSize, sum)
 	}
 
 	// Create subdirectories with remaining files
 	remainingFiles := allFiles[filesAtThisLevel:]
-	if len(remainingFiles) > 0 && currentDepth < maxDepth {
-		// Create 2-4 subdirectories
-		numSubdirs := 2 + rand.Intn(3) // 2-4 subdirectories
+	if len(remainingFiles) > 0 && currentDepth < b.opts.MaxDepth {
+		// Create between MinSubdirs and MaxSubdirs subdirectories
+		minSubdirs, maxSubdirs := b.opts.subdirRange()
+		numSubdirs := minSubdirs + b.rng.Intn(maxSubdirs-minSubdirs+1)
 		if numSubdirs > len(remainingFiles) {
 			numSubdirs = len(remainingFiles)
 		}
 
 		filesPerSubdir := len(remainingFiles) / numSubdirs
 		for i := 0; i < numSubdirs; i++ {
-			subdirName := fmt.Sprintf("dir%d", i+1)
-			subdirPath := filepath.Join(dir, subdirName)
+			subdirName := b.profile.dirName(i)
+			subdirPath := filepath.Join(dir, safeName(subdirName))
 
+			if err := checkPathLen(subdirPath); err != nil {
+				return err
+			}
 			if err := os.MkdirAll(subdirPath, 0755); err != nil {
-				return fmt.Errorf("failed to create subdirectory: %w", err)
+				return fmt.Errorf("failed to create subdirectory: %w", explainPathErr(err, subdirPath))
+			}
+			if b.opts.DirMode != 0 {
+				b.dirs = append(b.dirs, subdirPath)
 			}
 
 			// Calculate files for this subdirectory
@@ -104,23 +458,8 @@ func createFilesFromPlan(dir string, plan Plan, maxDepth int, currentDepth int)
 			if startIdx < len(remainingFiles) {
 				subdirFiles := remainingFiles[startIdx:endIdx]
 
-				// Create a plan for this subdirectory
-				subdirPlan := Plan{}
-				for _, fileSize := range subdirFiles {
-					// Categorize files back into size buckets for recursive call
-					switch {
-					case fileSize >= 512*size.MB:
-						subdirPlan.VeryLargeFiles = append(subdirPlan.VeryLargeFiles, fileSize)
-					case fileSize >= 10*size.MB:
-						subdirPlan.LargeFiles = append(subdirPlan.LargeFiles, fileSize)
-					case fileSize >= 100*size.KB:
-						subdirPlan.MediumFiles = append(subdirPlan.MediumFiles, fileSize)
-					default:
-						subdirPlan.SmallFiles = append(subdirPlan.SmallFiles, fileSize)
-					}
-				}
-
-				err := createFilesFromPlan(subdirPath, subdirPlan, maxDepth, currentDepth+1)
+				// Categorize files back into size buckets for the recursive call
+				err := b.createFilesFromPlan(subdirPath, planFromSizes(subdirFiles), currentDepth+1)
 				if err != nil {
 					return err
 				}
@@ -131,38 +470,152 @@ func createFilesFromPlan(dir string, plan Plan, maxDepth int, currentDepth int)
 	return nil
 }
 
-// createSingleFile creates a single file of the specified size
-func createSingleFile(filePath string, fileSize int64) error {
+// createFile creates a file of the given size in the tree. When contents are shared, files
+// after the first of each size are copies of it.
+func (b *layerBuilder) createFile(filePath string, fileSize int64) ([]byte, error) {
+	if b.blobs != nil {
+		if src, ok := b.blobs[fileSize]; ok {
+			return src.sum, copyFile(b.ctx, src.path, filePath, fileSize, src.sum, b.fileMode(), b.opts)
+		}
+	}
+
+	sum, err := createSingleFile(b.ctx, filePath, fileSize, b.fileMode(), b.opts, b.filler(fileSize))
+	if err != nil {
+		return nil, err
+	}
+	if b.blobs != nil {
+		b.blobs[fileSize] = blob{path: filePath, sum: sum}
+	}
+	return sum, nil
+}
+
+// copyFile copies srcPath, of the given size and SHA-256, to filePath, optionally verifying the copy,
+// and sets its mode (0 = as created)
+func copyFile(ctx context.Context, srcPath string, filePath string, fileSize int64, sum []byte, mode os.FileMode, opts Options) error {
+	if err := checkPathLen(filePath); err != nil {
+		return err
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", srcPath, err)
+	}
+	defer src.Close()
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", explainPathErr(err, filePath))
+	}
+	defer file.Close()
+
+	// Copy the data in chunks, as createSingleFile writes it
+	const chunkSize = 10 * size.MB
+	w := opts.Faults.Writer(opts.RateLimit.WriterContext(ctx, file))
+	for remaining := fileSize; remaining > 0; {
+		// Block here while writes are paused, and stop if the layer is cancelled
+		if err := opts.Pause.WaitContext(ctx); err != nil {
+			return cancelled(err)
+		}
+
+		n, err := io.CopyN(w, src, min(remaining, chunkSize))
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", srcPath, filePath, err)
+		}
+		remaining -= n
+		if opts.Progress != nil {
+			opts.Progress(n)
+		}
+	}
+	if opts.VerifyWrites {
+		// Close the file before re-reading it
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to close file: %w", err)
+		}
+		beforeVerify(filePath)
+		if err := verify.File(filePath, fileSize, sum); err != nil {
+			return err
+		}
+	}
+	// Set the mode last, as it may not allow reading the file back
+	return setMode(filePath, mode)
+}
+
+// cancelled wraps the error from a done context for a layer whose writes it stopped
+func cancelled(err error) error {
+	return fmt.Errorf("layer creation cancelled: %w", err)
+}
+
+// addFile records a written file in the layer statistics
+func (b *layerBuilder) addFile(filePath string, fileSize int64, sum []byte) {
+	relPath, err := filepath.Rel(b.layerDir, filePath)
+	if err != nil {
+		relPath = filePath
+	}
+	b.stats.AddFile(filepath.ToSlash(relPath), fileSize, sum)
+	if b.opts.Links > 0 {
+		b.written = append(b.written, writtenFile{path: filePath, sum: sum})
+	}
+}
+
+// createSingleFile creates a single file of the specified size filled by filler, optionally verifying
+// it after writing, and sets its mode (0 = as created). It returns the SHA-256 of the data written.
+func createSingleFile(ctx context.Context, filePath string, fileSize int64, mode os.FileMode, opts Options, filler *content.Filler) ([]byte, error) {
+	// Fail before creating the file rather than deep in the tree with a bare ENAMETOOLONG
+	if err := checkPathLen(filePath); err != nil {
+		return nil, err
+	}
 	file, err := os.Create(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, fmt.Errorf("failed to create file: %w", explainPathErr(err, filePath))
 	}
 	defer file.Close()
 
-	// Fill the file with data in chunks
+	// Hash the data as it is written
+	writeHash := sha256.New()
+	w := io.MultiWriter(opts.Faults.Writer(opts.RateLimit.WriterContext(ctx, file)), writeHash)
+
+	// Start the file with the magic number for its extension, then fill it
+	var header []byte
+	if opts.MagicHeaders {
+		header = content.MagicHeader(filepath.Ext(filePath), fileSize)
+	}
+	r := content.NewReader(header, filler, fileSize)
+
+	// Copy the data in chunks through io.CopyN's small buffer
 	const chunkSize = 10 * size.MB
 	remaining := fileSize
 
 	for remaining > 0 {
+		// Block here while writes are paused, and stop if the layer is cancelled
+		if err := opts.Pause.WaitContext(ctx); err != nil {
+			return nil, cancelled(err)
+		}
+
 		writeSize := remaining
 		if writeSize > chunkSize {
 			writeSize = chunkSize
 		}
 
-		// Create a buffer with data
-		data := make([]byte, writeSize)
-		for i := range data {
-			data[i] = byte(rand.Intn(256))
-		}
-
-		// Write the data to the file
-		_, err = file.Write(data)
-		if err != nil {
-			return fmt.Errorf("failed to write data to file: %w", err)
+		// Write the next chunk of data to the file
+		if _, err := io.CopyN(w, r, writeSize); err != nil {
+			return nil, fmt.Errorf("failed to write data to file: %w", err)
 		}
 
 		remaining -= writeSize
+		if opts.Progress != nil {
+			opts.Progress(writeSize)
+		}
 	}
 
-	return nil
+	sum := writeHash.Sum(nil)
+	if opts.VerifyWrites {
+		// Close the file before re-reading it
+		if err := file.Close(); err != nil {
+			return nil, fmt.Errorf("failed to close file: %w", err)
+		}
+		beforeVerify(filePath)
+		if err := verify.File(filePath, fileSize, sum); err != nil {
+			return sum, err
+		}
+	}
+	// Set the mode last, as it may not allow reading the file back
+	return sum, setMode(filePath, mode)
 }
@@ -1,9 +1,19 @@
 package mockfs
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/manifest"
+	"github.com/jlbutler/imgmkr/size"
 )
 
 func TestCreate(t *testing.T) {
@@ -16,7 +26,7 @@ func TestCreate(t *testing.T) {
 
 	// Test creating a mock filesystem
 	layerDir := filepath.Join(tempDir, "test-layer")
-	err = Create(layerDir, 10*1024, 2, 5) // 10KB, depth 2, 5 files
+	_, err = Create(context.Background(), layerDir, 10*1024, Options{MaxDepth: 2, TargetFiles: 5}) // 10KB, depth 2, 5 files
 	if err != nil {
 		t.Errorf("Unexpected error creating mock filesystem: %v", err)
 	}
@@ -35,3 +45,448 @@ func TestCreate(t *testing.T) {
 		t.Errorf("No files were created in mock filesystem")
 	}
 }
+
+func TestCreateVerifyWrites(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Verified writes succeed when nothing tampers with the files
+	_, err := Create(context.Background(), filepath.Join(tempDir, "intact"), 64*1024, Options{MaxDepth: 2, TargetFiles: 5, VerifyWrites: true})
+	if err != nil {
+		t.Fatalf("Unexpected error creating verified mock filesystem: %v", err)
+	}
+
+	// Corrupt the first file between write and verify
+	origBeforeVerify := beforeVerify
+	defer func() { beforeVerify = origBeforeVerify }()
+	var corrupted string
+	beforeVerify = func(filePath string) {
+		if corrupted == "" {
+			corrupted = filePath
+			if err := os.Truncate(filePath, 1); err != nil {
+				t.Fatalf("Failed to corrupt %s: %v", filePath, err)
+			}
+		}
+	}
+
+	_, err = Create(context.Background(), filepath.Join(tempDir, "corrupt"), 64*1024, Options{MaxDepth: 2, TargetFiles: 5, VerifyWrites: true})
+	if err == nil {
+		t.Fatal("Expected verification to detect the corrupted file")
+	}
+	if !strings.Contains(err.Error(), corrupted) {
+		t.Errorf("Expected error to identify %s, got: %v", corrupted, err)
+	}
+}
+
+func TestCreateSubdirFanout(t *testing.T) {
+	tests := []struct {
+		name       string
+		minSubdirs int
+		maxSubdirs int
+	}{
+		{"chain", 1, 1},
+		{"range", 2, 3},
+		{"wide", 5, 5},
+	}
+
+	for _, test := range tests {
+		layerDir := filepath.Join(t.TempDir(), test.name)
+		opts := Options{MaxDepth: 3, TargetFiles: 200, MinSubdirs: test.minSubdirs, MaxSubdirs: test.maxSubdirs}
+		if _, err := Create(context.Background(), layerDir, 2*size.MB, opts); err != nil {
+			t.Fatalf("%s: unexpected error creating mock filesystem: %v", test.name, err)
+		}
+
+		// Every directory that has subdirectories must stay within the requested fanout,
+		// unless fewer files remained to distribute than the minimum
+		err := filepath.WalkDir(layerDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return err
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			subdirs, distributed := 0, 0
+			for _, entry := range entries {
+				if entry.IsDir() {
+					subdirs++
+					distributed += countFiles(t, filepath.Join(path, entry.Name()))
+				}
+			}
+			if subdirs == 0 {
+				return nil
+			}
+			minExpected := test.minSubdirs
+			if distributed < minExpected {
+				minExpected = distributed
+			}
+			if subdirs < minExpected || subdirs > test.maxSubdirs {
+				t.Errorf("%s: directory %s has %d subdirectories, expected %d-%d", test.name, path, subdirs, minExpected, test.maxSubdirs)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to walk mock filesystem: %v", test.name, err)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		hasError bool
+	}{
+		{Options{}, false},
+		{Options{MinSubdirs: 1, MaxSubdirs: 1}, false},
+		{Options{MinSubdirs: 20, MaxSubdirs: 20}, false},
+		{Options{MaxSubdirs: 1}, false},
+		{Options{MinSubdirs: 4, MaxSubdirs: 2}, true},
+		{Options{MinSubdirs: -1, MaxSubdirs: 2}, true},
+		{Options{FlatFiles: -1}, true},
+		{Options{SizeTolerance: 1.5}, false},
+		{Options{SizeTolerance: -1}, true},
+		{Options{SizeTolerance: 100}, true},
+		{Options{StrictSize: true}, false},
+		{Options{StrictSize: true, SizeTolerance: 1}, true},
+		{Options{StrictSize: true, UniqueContents: 10}, true},
+		{Options{MagicHeaders: true, UniqueContents: 10}, true},
+		{Options{TrickyNames: 0.25}, false},
+		{Options{TrickyNames: -0.1}, true},
+		{Options{TrickyNames: 1.5}, true},
+		{Options{DictSize: 4096}, false},
+		{Options{DictSize: -1}, true},
+		{Options{DictSize: 4096, TrueRandom: true}, true},
+		{Options{Compressible: 0.5}, false},
+		{Options{Compressible: 1}, false},
+		{Options{Compressible: 1.5}, true},
+		{Options{Compressible: -0.5}, true},
+		{Options{Compressible: 0.5, DictSize: 4096}, true},
+		{Options{ExactFileCount: true, TargetFiles: 100}, false},
+		{Options{ExactFileCount: true, SizeTolerance: 1}, true},
+	}
+
+	for _, test := range tests {
+		err := test.opts.Validate()
+		if test.hasError && err == nil {
+			t.Errorf("Expected error for %+v, but got none", test.opts)
+		}
+		if !test.hasError && err != nil {
+			t.Errorf("Unexpected error for %+v: %v", test.opts, err)
+		}
+	}
+}
+
+// countFiles returns the number of regular files under dir
+func countFiles(t *testing.T, dir string) int {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %s: %v", dir, err)
+	}
+	return count
+}
+
+func TestCreateMagicHeaders(t *testing.T) {
+	layerDir := filepath.Join(t.TempDir(), "magic")
+	stats, err := Create(context.Background(), layerDir, 256*1024, Options{MaxDepth: 2, TargetFiles: 10, MagicHeaders: true})
+	if err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+
+	var total int64
+	err = filepath.WalkDir(layerDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		total += int64(len(data))
+
+		expected := content.MagicHeader(filepath.Ext(path), int64(len(data)))
+		if len(expected) == 0 {
+			t.Errorf("File %s has no recognized extension", path)
+		} else if !bytes.HasPrefix(data, expected) {
+			t.Errorf("Expected %s to start with %q", path, expected)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk mock filesystem: %v", err)
+	}
+	if total != 256*1024 || stats.Bytes() != total {
+		t.Errorf("Expected %d bytes, got %d on disk and %d recorded", 256*1024, total, stats.Bytes())
+	}
+}
+
+func TestPruneEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"keep/nested", "empty/deeper/deepest", "alsoempty"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "keep", "nested", "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := PruneEmptyDirs(root); err != nil {
+		t.Fatalf("Unexpected error pruning: %v", err)
+	}
+
+	for _, dir := range []string{"empty", "alsoempty"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+			t.Errorf("Expected empty directory %s to be removed", dir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "keep", "nested", "file")); err != nil {
+		t.Errorf("Expected directory with files to be kept: %v", err)
+	}
+
+	// The root is kept even when it ends up empty
+	emptyRoot := t.TempDir()
+	if err := PruneEmptyDirs(emptyRoot); err != nil {
+		t.Fatalf("Unexpected error pruning: %v", err)
+	}
+	if _, err := os.Stat(emptyRoot); err != nil {
+		t.Errorf("Expected root directory to be kept: %v", err)
+	}
+}
+
+func TestCreateSeeded(t *testing.T) {
+	opts := Options{MaxDepth: 3, TargetFiles: 20, MagicHeaders: true, Seed: 42}
+	first, err := Create(context.Background(), t.TempDir(), 512*size.KB, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+	second, err := Create(context.Background(), t.TempDir(), 512*size.KB, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+	if first.Digest() != second.Digest() {
+		t.Errorf("Expected the same seed to produce identical layers, got %s and %s", first.Digest(), second.Digest())
+	}
+
+	opts.Seed = 43
+	third, err := Create(context.Background(), t.TempDir(), 512*size.KB, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+	if third.Digest() == first.Digest() {
+		t.Error("Expected a different seed to produce a different layer")
+	}
+}
+
+func TestCreateFlatFiles(t *testing.T) {
+	layerDir := t.TempDir()
+	stats, err := Create(context.Background(), layerDir, 10*size.KB+7, Options{MaxDepth: 3, FlatFiles: 100})
+	if err != nil {
+		t.Fatalf("Unexpected error creating flat layer: %v", err)
+	}
+
+	entries, err := os.ReadDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to read layer directory: %v", err)
+	}
+	if len(entries) != 100 {
+		t.Errorf("Expected exactly 100 files in the layer root, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("Expected no subdirectories, found %s", entry.Name())
+		}
+	}
+	if stats.FileCount() != 100 || stats.Bytes() != 10*size.KB+7 {
+		t.Errorf("Expected 100 files totaling %d bytes, got %d files and %d bytes", 10*size.KB+7, stats.FileCount(), stats.Bytes())
+	}
+
+	// Every file needs at least one byte
+	if _, err := Create(context.Background(), t.TempDir(), 50, Options{FlatFiles: 51}); err == nil {
+		t.Error("Expected an error for more flat files than bytes")
+	}
+}
+
+func TestCreateExactFileCount(t *testing.T) {
+	for _, opts := range []Options{
+		{MaxDepth: 3, TargetFiles: 137, ExactFileCount: true},
+		{MaxDepth: 3, TargetFiles: 3, ExactFileCount: true},
+		{MaxDepth: 3, TargetFiles: 40, ExactFileCount: true, Profile: "node-app"},
+	} {
+		layerDir := t.TempDir()
+		stats, err := Create(context.Background(), layerDir, 2*size.MB+3, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", opts, err)
+		}
+		if got := countFiles(t, layerDir); got != opts.TargetFiles || stats.FileCount() != opts.TargetFiles {
+			t.Errorf("Expected exactly %d files, got %d on disk and %d in the stats", opts.TargetFiles, got, stats.FileCount())
+		}
+		if stats.Bytes() != 2*size.MB+3 {
+			t.Errorf("Expected the files to total %d bytes, got %d", 2*size.MB+3, stats.Bytes())
+		}
+	}
+
+	// Every file needs at least one byte
+	if _, err := Create(context.Background(), t.TempDir(), 50, Options{TargetFiles: 51, ExactFileCount: true}); err == nil {
+		t.Error("Expected an error for more files than bytes")
+	}
+}
+
+func TestCreateDictContent(t *testing.T) {
+	layerDir := t.TempDir()
+	if _, err := Create(context.Background(), layerDir, 16*size.KB, Options{FlatFiles: 4, DictSize: 32, Seed: 1}); err != nil {
+		t.Fatalf("Unexpected error creating layer: %v", err)
+	}
+
+	entries, err := os.ReadDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to read layer directory: %v", err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(layerDir, entry.Name()))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", entry.Name(), err)
+		}
+		if !bytes.Equal(data, bytes.Repeat(data[:32], len(data)/32)) {
+			t.Errorf("Expected %s to repeat a 32-byte dictionary", entry.Name())
+		}
+	}
+}
+
+func TestCreateCompressibleContent(t *testing.T) {
+	layerDir := t.TempDir()
+	if _, err := Create(context.Background(), layerDir, 64*size.KB, Options{FlatFiles: 2, Compressible: 0.75, Seed: 1}); err != nil {
+		t.Fatalf("Unexpected error creating layer: %v", err)
+	}
+
+	entries, err := os.ReadDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to read layer directory: %v", err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(layerDir, entry.Name()))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", entry.Name(), err)
+		}
+
+		// Each block starts with its compressible zero bytes
+		zeros := int(0.75 * content.MixBlockSize)
+		if !bytes.Equal(data[:zeros], make([]byte, zeros)) || bytes.Equal(data[zeros:content.MixBlockSize], make([]byte, content.MixBlockSize-zeros)) {
+			t.Errorf("Expected %s to start with %d zero bytes followed by random data", entry.Name(), zeros)
+		}
+	}
+}
+
+func TestCreateUniqueContents(t *testing.T) {
+	layerDir := t.TempDir()
+	stats, err := Create(context.Background(), layerDir, 2*size.MB, Options{MaxDepth: 2, TargetFiles: 200, UniqueContents: 10})
+	if err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+	if files := countFiles(t, layerDir); files != stats.FileCount() || files < 100 {
+		t.Errorf("Expected every planned file on disk, got %d on disk and %d recorded", files, stats.FileCount())
+	}
+
+	// Re-read the files from disk so shared contents are really shared
+	onDisk, err := manifest.StatDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to stat layer: %v", err)
+	}
+	if onDisk.UniqueContents() != 10 || stats.UniqueContents() != 10 {
+		t.Errorf("Expected 10 distinct contents, got %d on disk and %d recorded", onDisk.UniqueContents(), stats.UniqueContents())
+	}
+	if onDisk.Digest() != stats.Digest() {
+		t.Error("Expected the recorded digest to match the files on disk")
+	}
+}
+
+func TestCopyFileChunks(t *testing.T) {
+	const fileSize = 2*10*size.MB + 5
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src")
+	if err := os.WriteFile(srcPath, bytes.Repeat([]byte("x"), fileSize), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	// Copies report progress a chunk at a time, like generated files
+	var progress []int64
+	opts := Options{Progress: func(n int64) { progress = append(progress, n) }}
+	if err := copyFile(context.Background(), srcPath, filepath.Join(dir, "copy"), fileSize, nil, 0, opts); err != nil {
+		t.Fatalf("Unexpected error copying file: %v", err)
+	}
+	if expected := []int64{10 * size.MB, 10 * size.MB, 5}; !reflect.DeepEqual(progress, expected) {
+		t.Errorf("Expected progress %v, got %v", expected, progress)
+	}
+
+	// And stop between chunks once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	opts.Progress = func(int64) { cancel() }
+	err := copyFile(ctx, srcPath, filepath.Join(dir, "cancelled"), fileSize, nil, 0, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestLayerSizesExact(t *testing.T) {
+	// Planned files must add up to the layer size across sizes and file counts, including
+	// sizes at the edges of the size buckets
+	layerSizes := []int64{1, 100, 1023, 1024, 1025, 100 * size.KB, 100*size.KB + 1, 10*size.MB + 7, 1 * size.GB, 3*size.GB + 12345}
+	targets := []int{1, 2, 3, 5, 11, 100, 1000, 5000}
+	for _, layerSize := range layerSizes {
+		for _, targetFiles := range targets {
+			for seed := int64(1); seed <= 10; seed++ {
+				plan := PlanLayer(layerSize, Options{TargetFiles: targetFiles, Seed: seed})
+				if plan.TotalSize() != layerSize {
+					t.Errorf("%d bytes, %d files, seed %d: planned files total %d bytes", layerSize, targetFiles, seed, plan.TotalSize())
+				}
+			}
+		}
+	}
+
+	// And so must the files written, checked by the strict size invariant
+	for _, layerSize := range []int64{1, 1025, 100*size.KB + 1, 3*size.MB + 7} {
+		for _, targetFiles := range []int{1, 7, 50} {
+			opts := Options{MaxDepth: 2, TargetFiles: targetFiles, StrictSize: true}
+			stats, err := Create(context.Background(), t.TempDir(), layerSize, opts)
+			if err != nil {
+				t.Errorf("%d bytes, %d files: %v", layerSize, targetFiles, err)
+				continue
+			}
+			if stats.Bytes() != layerSize {
+				t.Errorf("%d bytes, %d files: wrote %d bytes", layerSize, targetFiles, stats.Bytes())
+			}
+		}
+	}
+}
+
+func TestCreateCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel after the first chunk; the remaining files are never written
+	start := time.Now()
+	_, err := Create(ctx, t.TempDir(), 64*size.GB, Options{
+		MaxDepth:    2,
+		TargetFiles: 10,
+		Progress:    func(int64) { cancel() },
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancellation to return promptly, took %v", elapsed)
+	}
+
+	// A context that is already done stops creation before anything is written
+	layerDir := filepath.Join(t.TempDir(), "layer")
+	if _, err := Create(ctx, layerDir, size.MB, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(layerDir); !os.IsNotExist(err) {
+		t.Errorf("Expected no layer directory after cancelling, got %v", err)
+	}
+}
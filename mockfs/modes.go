@@ -0,0 +1,67 @@
+package mockfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// modeBits are the FileMode bits a file or directory mode may set
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// specialModes are the modes given to the fraction of files picked by Options.SpecialModes
+var specialModes = []os.FileMode{0755, 0755 | os.ModeSetuid}
+
+// ParseMode parses an octal Unix mode such as 0644 or 4755 into a FileMode, mapping the setuid,
+// setgid, and sticky bits to their FileMode equivalents
+func ParseMode(s string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("invalid mode %q: must be octal, from 0 to 7777", s)
+	}
+	mode := os.FileMode(bits) & os.ModePerm
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// fileMode returns the mode for the next file: a special mode for opts.SpecialModes of files,
+// and opts.FileMode for the rest (0 = leave the mode os.Create gave it)
+func (b *layerBuilder) fileMode() os.FileMode {
+	if b.opts.SpecialModes > 0 && b.rng.Float64() < b.opts.SpecialModes {
+		return specialModes[b.rng.Intn(len(specialModes))]
+	}
+	return b.opts.FileMode
+}
+
+// setMode sets the permissions of path to mode, overriding the umask, unless mode is 0
+func setMode(path string, mode os.FileMode) error {
+	if mode == 0 {
+		return nil
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", path, err)
+	}
+	return nil
+}
+
+// setDirModes sets every subdirectory created in the layer to opts.DirMode, deepest first so a
+// mode without write or search permission can't lock out the rest. Directories pruned since
+// they were created are skipped.
+func (b *layerBuilder) setDirModes() error {
+	for i := len(b.dirs) - 1; i >= 0; i-- {
+		err := setMode(b.dirs[i], b.opts.DirMode)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package mockfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		s    string
+		mode os.FileMode
+	}{
+		{"0644", 0644},
+		{"600", 0600},
+		{"4755", 0755 | os.ModeSetuid},
+		{"2750", 0750 | os.ModeSetgid},
+		{"1777", 0777 | os.ModeSticky},
+	}
+	for _, test := range tests {
+		if mode, err := ParseMode(test.s); err != nil || mode != test.mode {
+			t.Errorf("ParseMode(%q) = %v, %v; want %v", test.s, mode, err, test.mode)
+		}
+	}
+	for _, s := range []string{"", "0888", "10000", "rwx"} {
+		if _, err := ParseMode(s); err == nil {
+			t.Errorf("Expected an error for mode %q", s)
+		}
+	}
+}
+
+func TestCreateModes(t *testing.T) {
+	layerDir := t.TempDir()
+	opts := Options{MaxDepth: 3, TargetFiles: 30, FileMode: 0600, DirMode: 0750 | os.ModeSetgid, Seed: 1}
+	if _, err := Create(context.Background(), layerDir, 256*size.KB, opts); err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+
+	// Every file and subdirectory has exactly the requested mode, whatever the umask
+	var files, dirs int
+	err := filepath.WalkDir(layerDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || path == layerDir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		want := opts.FileMode
+		if d.IsDir() {
+			want = os.ModeDir | opts.DirMode
+			dirs++
+		} else {
+			files++
+		}
+		if info.Mode() != want {
+			t.Errorf("Expected %s to have mode %v, got %v", path, want, info.Mode())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk layer: %v", err)
+	}
+	if files == 0 || dirs == 0 {
+		t.Fatalf("Expected files and directories, got %d files and %d directories", files, dirs)
+	}
+}
+
+func TestCreateSpecialModes(t *testing.T) {
+	layerDir := t.TempDir()
+	opts := Options{FlatFiles: 40, FileMode: 0644, SpecialModes: 0.5, Seed: 1}
+	if _, err := Create(context.Background(), layerDir, 40*size.KB, opts); err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+
+	counts := make(map[os.FileMode]int)
+	entries, err := os.ReadDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", entry.Name(), err)
+		}
+		counts[info.Mode()]++
+	}
+	for _, mode := range []os.FileMode{0644, 0755, 0755 | os.ModeSetuid} {
+		if counts[mode] == 0 {
+			t.Errorf("Expected some files with mode %v, got %v", mode, counts)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("Expected only the file mode and the special modes, got %v", counts)
+	}
+}
@@ -0,0 +1,93 @@
+package mockfs
+
+import (
+	"math/rand"
+	"runtime"
+	"strings"
+
+	"github.com/jlbutler/imgmkr/content"
+)
+
+// trickyPrefixes start a name with characters that are legal but easily mistaken for options,
+// comments, or shell syntax
+var trickyPrefixes = []string{"", "-", "--", " ", "#", "~", "@", "+", "=", "'", "[", "{", "!", "$", "%", "&", ","}
+
+// trickySuffixes follow the usual name with Unicode, whitespace, and shell metacharacters. Each
+// starts with a space and contains no dot, so the name's extension is unchanged. Some are only
+// legal on Unix-like systems and are skipped elsewhere.
+var trickySuffixes = []string{
+	" café",
+	" naïve nai\u0308ve", // Precomposed and combining accents
+	" 日本語",
+	" Ελληνικά",
+	" עברית", // Right-to-left
+	" 😀",
+	" zero\u200bwidth", // Zero-width space
+	"  double  space",
+	" (copy)",
+	" [1]",
+	" 'quoted'",
+	" $HOME",
+	" `tick`",
+	" semi;colon",
+	" amp&ersand",
+	" 100%",
+	" back\\slash",
+	" col:on",
+	" ast*risk",
+	" que?tion",
+	" <angle>",
+	" pi|pe",
+	" \"double\"",
+	" new\nline",
+	" tab\tbed",
+}
+
+// trickyName returns name with a random tricky prefix and suffix, or name unchanged if the
+// result would not be a legal name on this OS
+func trickyName(rng *rand.Rand, name string) string {
+	tricky := trickyPrefixes[rng.Intn(len(trickyPrefixes))] + name + trickySuffixes[rng.Intn(len(trickySuffixes))]
+	if !legalName(tricky, runtime.GOOS) {
+		return name
+	}
+	return tricky
+}
+
+// legalName reports whether name can be created as a file name on goos
+func legalName(name string, goos string) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return false
+	}
+	if goos != "windows" {
+		return true
+	}
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+			return false
+		}
+	}
+	// Windows drops trailing dots and spaces, so the name would not round-trip
+	return !strings.HasSuffix(name, " ") && !strings.HasSuffix(name, ".")
+}
+
+// extension returns the extension for a file of the given size, from the file profile, the
+// profile, or a random format with a magic number, in that order ("" for none)
+func (b *layerBuilder) extension(fileSize int64) string {
+	switch {
+	case b.fileProfile != nil:
+		return b.fileProfile.extension(b.rng, fileSize)
+	case b.profile != nil:
+		return b.profile.extension(b.rng, fileSize)
+	case b.opts.MagicHeaders:
+		return content.RandomMagicExtension(b.rng)
+	}
+	return ""
+}
+
+// fileName returns name, made tricky for the configured fraction of files
+func (b *layerBuilder) fileName(name string) string {
+	if b.opts.TrickyNames > 0 && b.rng.Float64() < b.opts.TrickyNames {
+		return trickyName(b.rng, name)
+	}
+	return name
+}
@@ -0,0 +1,102 @@
+package mockfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestLegalName(t *testing.T) {
+	tests := []struct {
+		name    string
+		unix    bool
+		windows bool
+	}{
+		{"-1.00 KB-file café", true, true},
+		{"1.00 KB-file 日本語", true, true},
+		{"1.00 KB-file col:on", true, false},
+		{"1.00 KB-file new\nline", true, false},
+		{"1.00 KB-file ", true, false},
+		{"a/b", false, false},
+		{"", false, false},
+		{"..", false, false},
+	}
+	for _, test := range tests {
+		if got := legalName(test.name, "linux"); got != test.unix {
+			t.Errorf("legalName(%q, linux) = %v, want %v", test.name, got, test.unix)
+		}
+		if got := legalName(test.name, "windows"); got != test.windows {
+			t.Errorf("legalName(%q, windows) = %v, want %v", test.name, got, test.windows)
+		}
+	}
+
+	// Every name in the corpus is legal on Unix
+	for _, prefix := range trickyPrefixes {
+		for _, suffix := range trickySuffixes {
+			if name := prefix + "1.00 KB-file" + suffix; !legalName(name, "linux") {
+				t.Errorf("Expected %q to be legal on Unix", name)
+			}
+		}
+	}
+}
+
+func TestTrickyNames(t *testing.T) {
+	plain := regexp.MustCompile(`^[0-9.]+ [A-Za-z]+-file[0-9]*$`)
+	for _, opts := range []Options{
+		{MaxDepth: 2, TargetFiles: 60, TrickyNames: 1, Seed: 1},
+		{FlatFiles: 30, TrickyNames: 1, Seed: 1},
+	} {
+		layerDir := t.TempDir()
+		stats, err := Create(context.Background(), layerDir, 256*1024, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+		}
+
+		var files, tricky int
+		err = filepath.WalkDir(layerDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			files++
+			if !plain.MatchString(d.Name()) {
+				tricky++
+			}
+
+			// The name as listed round-trips through Lstat
+			info, err := os.Lstat(filepath.Join(filepath.Dir(path), d.Name()))
+			if err != nil {
+				t.Errorf("Failed to Lstat %q: %v", d.Name(), err)
+				return nil
+			}
+			if info.Name() != d.Name() {
+				t.Errorf("Expected Lstat to return %q, got %q", d.Name(), info.Name())
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to walk mock filesystem: %v", err)
+		}
+		if files != stats.FileCount() {
+			t.Errorf("Expected %d files, found %d", stats.FileCount(), files)
+		}
+
+		// Names that would be illegal here fall back to plain names, but most are tricky
+		if tricky < files/2 {
+			t.Errorf("Expected most of %d files to have tricky names, got %d", files, tricky)
+		}
+	}
+
+	// Without the option, every name is plain
+	layerDir := t.TempDir()
+	if _, err := Create(context.Background(), layerDir, 64*1024, Options{MaxDepth: 1, TargetFiles: 10, Seed: 1}); err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+	entries, _ := os.ReadDir(layerDir)
+	for _, entry := range entries {
+		if !entry.IsDir() && !plain.MatchString(entry.Name()) {
+			t.Errorf("Expected a plain name, got %q", entry.Name())
+		}
+	}
+}
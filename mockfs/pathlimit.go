@@ -0,0 +1,56 @@
+package mockfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unicode/utf8"
+)
+
+// maxNameLen is the longest file or directory name most filesystems accept, in bytes
+const maxNameLen = 255
+
+// maxPathLen is the longest path the OS accepts, in bytes (a variable so tests can lower it)
+var maxPathLen = func() int {
+	switch runtime.GOOS {
+	case "windows":
+		return 260
+	case "darwin":
+		return 1024
+	default:
+		return 4096
+	}
+}()
+
+// safeName shortens name to fit maxNameLen, replacing its tail with a hash of the full name
+// so distinct long names stay distinct. Names that already fit are returned unchanged.
+func safeName(name string) string {
+	if len(name) <= maxNameLen {
+		return name
+	}
+	suffix := fmt.Sprintf("-%x", sha256.Sum256([]byte(name)))[:17]
+	// Cut at a character boundary so multi-byte names stay valid UTF-8
+	cut := maxNameLen - len(suffix)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + suffix
+}
+
+// checkPathLen returns an error if path is too long for the OS to create
+func checkPathLen(path string) error {
+	if len(path) > maxPathLen {
+		return fmt.Errorf("path %s is %d bytes, exceeding the %d-byte limit (use a shorter --tmpdir-prefix or a lower --max-depth)", path, len(path), maxPathLen)
+	}
+	return nil
+}
+
+// explainPathErr adds advice to errors caused by a path or name being too long
+func explainPathErr(err error, path string) error {
+	if errors.Is(err, syscall.ENAMETOOLONG) {
+		return fmt.Errorf("path %s is too long for this filesystem (use a shorter --tmpdir-prefix or a lower --max-depth): %w", path, err)
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package mockfs
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSafeName(t *testing.T) {
+	if name := safeName("1.00 KB-file"); name != "1.00 KB-file" {
+		t.Errorf("Expected short names to be unchanged, got %s", name)
+	}
+
+	long1 := strings.Repeat("a", 300) + "1"
+	long2 := strings.Repeat("a", 300) + "2"
+	safe1, safe2 := safeName(long1), safeName(long2)
+	if len(safe1) > maxNameLen || len(safe2) > maxNameLen {
+		t.Errorf("Expected names of at most %d bytes, got %d and %d", maxNameLen, len(safe1), len(safe2))
+	}
+	if safe1 == safe2 {
+		t.Error("Expected distinct long names to stay distinct")
+	}
+
+	// Multi-byte names are not cut mid-character
+	if safe := safeName(strings.Repeat("日", 100)); len(safe) > maxNameLen || !utf8.ValidString(safe) {
+		t.Errorf("Expected valid UTF-8 of at most %d bytes, got %d bytes %q", maxNameLen, len(safe), safe)
+	}
+}
+
+func TestCreatePathTooLong(t *testing.T) {
+	layerDir := t.TempDir()
+
+	// A deep tree that fits creates cleanly
+	if _, err := Create(context.Background(), layerDir+"/fits", 100*1024, Options{MaxDepth: 6, TargetFiles: 50, MinSubdirs: 1, MaxSubdirs: 1}); err != nil {
+		t.Fatalf("Unexpected error creating deep tree: %v", err)
+	}
+
+	// One that doesn't fails with an error naming the path and the limit
+	origMaxPathLen := maxPathLen
+	defer func() { maxPathLen = origMaxPathLen }()
+	maxPathLen = len(layerDir) + 30
+
+	_, err := Create(context.Background(), layerDir+"/deep", 100*1024, Options{MaxDepth: 6, TargetFiles: 50, MinSubdirs: 1, MaxSubdirs: 1})
+	if err == nil {
+		t.Fatal("Expected an error for paths over the limit")
+	}
+	if !strings.Contains(err.Error(), layerDir) || !strings.Contains(err.Error(), "byte limit") {
+		t.Errorf("Expected an error naming the path and limit, got: %v", err)
+	}
+}
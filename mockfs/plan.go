@@ -3,6 +3,7 @@ package mockfs
 import (
 	"math/rand"
 
+	"github.com/jlbutler/imgmkr/content"
 	"github.com/jlbutler/imgmkr/size"
 )
 
@@ -14,15 +15,152 @@ type Plan struct {
 	SmallFiles     []int64 // 1KB - 100KB
 }
 
+// Files returns the number of files in the plan
+func (p Plan) Files() int {
+	return len(p.VeryLargeFiles) + len(p.LargeFiles) + len(p.MediumFiles) + len(p.SmallFiles)
+}
+
+// TotalSize returns the sum of all planned file sizes
+func (p Plan) TotalSize() int64 {
+	var total int64
+	for _, bucket := range [][]int64{p.VeryLargeFiles, p.LargeFiles, p.MediumFiles, p.SmallFiles} {
+		for _, fileSize := range bucket {
+			total += fileSize
+		}
+	}
+	return total
+}
+
+// dedupSizes folds the plan's file sizes into at most n distinct sizes, so files can share content.
+// Sizes are sorted and split into n groups of similar sizes, and each file takes its group's
+// average size, which keeps the total within a few bytes per group of the original.
+func dedupSizes(p Plan, n int) Plan {
+	sizes := make([]int64, 0, p.Files())
+	for _, bucket := range [][]int64{p.VeryLargeFiles, p.LargeFiles, p.MediumFiles, p.SmallFiles} {
+		sizes = append(sizes, bucket...)
+	}
+	if n <= 0 || n >= len(sizes) {
+		return p
+	}
+	size.Sort(sizes, false)
+
+	var prev int64
+	for g := 0; g < n; g++ {
+		start, end := g*len(sizes)/n, (g+1)*len(sizes)/n
+		var sum int64
+		for _, fileSize := range sizes[start:end] {
+			sum += fileSize
+		}
+
+		// Groups must end up with distinct sizes to stay distinct contents
+		avg := sum / int64(end-start)
+		if avg <= prev {
+			avg = prev + 1
+		}
+		for i := start; i < end; i++ {
+			sizes[i] = avg
+		}
+		prev = avg
+	}
+
+	return planFromSizes(sizes)
+}
+
+// planFromSizes sorts file sizes into the plan's size buckets
+func planFromSizes(sizes []int64) Plan {
+	plan := Plan{}
+	for _, fileSize := range sizes {
+		switch {
+		case fileSize >= 512*size.MB:
+			plan.VeryLargeFiles = append(plan.VeryLargeFiles, fileSize)
+		case fileSize >= 10*size.MB:
+			plan.LargeFiles = append(plan.LargeFiles, fileSize)
+		case fileSize >= 100*size.KB:
+			plan.MediumFiles = append(plan.MediumFiles, fileSize)
+		default:
+			plan.SmallFiles = append(plan.SmallFiles, fileSize)
+		}
+	}
+	return plan
+}
+
 // CreatePlan creates a realistic distribution of file sizes
 func CreatePlan(totalSize int64, targetFiles int) Plan {
+	return createPlan(content.NewRand(0), totalSize, targetFiles, 0)
+}
+
+// CreateExactPlan creates a realistic distribution of file sizes like CreatePlan, with exactly
+// files files (which must not exceed totalSize, so each can hold at least 1 byte)
+func CreateExactPlan(totalSize int64, files int) Plan {
+	return exactFileCount(CreatePlan(totalSize, files), files)
+}
+
+// PlanLayer creates the file size distribution Create would use for a layer with the given options
+func PlanLayer(layerSize int64, opts Options) Plan {
+	return dedupSizes(opts.plan(content.NewRand(opts.Seed), layerSize), opts.UniqueContents)
+}
+
+// plan creates the file size distribution for a layer, following the profile if one is set
+func (o Options) plan(rng *rand.Rand, layerSize int64) Plan {
+	var plan Plan
+	if p := o.profile(); p != nil {
+		plan = p.plan(rng, layerSize, o.targetFiles(layerSize))
+	} else {
+		plan = createPlan(rng, layerSize, o.targetFiles(layerSize), o.SizeTolerance)
+	}
+	if o.ExactFileCount {
+		plan = exactFileCount(plan, o.targetFiles(layerSize))
+	}
+	return plan
+}
+
+// exactFileCount reshapes the plan into exactly n files with the same total, keeping its shape:
+// files beyond the n largest are folded into the smallest of those, and while there are too few
+// files the largest are split in half. Plans that can't hold n files of at least 1 byte are
+// returned as they are.
+func exactFileCount(p Plan, n int) Plan {
+	if n < 1 || p.TotalSize() < int64(n) {
+		return p
+	}
+	sizes := make([]int64, 0, max(p.Files(), n))
+	for _, bucket := range [][]int64{p.VeryLargeFiles, p.LargeFiles, p.MediumFiles, p.SmallFiles} {
+		sizes = append(sizes, bucket...)
+	}
+	if len(sizes) == n {
+		return p
+	}
+	size.Sort(sizes, true)
+
+	if len(sizes) > n {
+		for i, fileSize := range sizes[n:] {
+			sizes[n-1-i%n] += fileSize
+		}
+		return planFromSizes(sizes[:n])
+	}
+
+	// Each pass splits the largest files, so the count at least doubles until it reaches n
+	for len(sizes) < n {
+		for i, count := 0, len(sizes); i < count && len(sizes) < n && sizes[i] > 1; i++ {
+			half := sizes[i] / 2
+			sizes[i] -= half
+			sizes = append(sizes, half)
+		}
+		size.Sort(sizes, true)
+	}
+	return planFromSizes(sizes)
+}
+
+// createPlan creates a realistic distribution of file sizes, drawing sizes from rng. If the
+// distributed sizes come within tolerance percent of totalSize, the remainder is left out
+// instead of being topped up; a tolerance of 0 always tops up to exactly totalSize.
+func createPlan(rng *rand.Rand, totalSize int64, targetFiles int, tolerance float64) Plan {
 	plan := Plan{}
 	remainingSize := totalSize
 	remainingFiles := targetFiles
 
 	// For large layers (>= 1GB), include some very large files
 	if totalSize >= size.GB && remainingFiles > 10 {
-		numVeryLarge := 1 + rand.Intn(3) // 1-3 very large files
+		numVeryLarge := 1 + rng.Intn(3) // 1-3 very large files
 		if numVeryLarge > remainingFiles/4 {
 			numVeryLarge = remainingFiles / 4 // Don't use more than 25% of files for very large
 		}
@@ -32,7 +170,10 @@ func CreatePlan(totalSize int64, targetFiles int) Plan {
 
 		for i := 0; i < numVeryLarge && remainingSize > minVeryLargeSize && remainingFiles > 0; i++ {
 			// Random size between 512MB and maxVeryLargeSize
-			fileSize := rand.Int63n(maxVeryLargeSize-minVeryLargeSize) + minVeryLargeSize
+			fileSize := minVeryLargeSize
+			if maxVeryLargeSize > minVeryLargeSize {
+				fileSize += rng.Int63n(maxVeryLargeSize - minVeryLargeSize)
+			}
 			if fileSize > remainingSize/2 { // Don't use more than half remaining size
 				fileSize = remainingSize / 2
 			}
@@ -58,11 +199,11 @@ func CreatePlan(totalSize int64, targetFiles int) Plan {
 			if remainingSize/int64(remainingFiles) < maxSize {
 				maxSize = remainingSize / int64(remainingFiles) * 2 // Allow up to 2x average
 			}
-			if maxSize < 10*size.MB {
+			if maxSize <= 10*size.MB {
 				break
 			}
 
-			fileSize := rand.Int63n(maxSize-10*size.MB) + 10*size.MB
+			fileSize := rng.Int63n(maxSize-10*size.MB) + 10*size.MB
 			plan.LargeFiles = append(plan.LargeFiles, fileSize)
 			remainingSize -= fileSize
 			remainingFiles--
@@ -81,11 +222,11 @@ func CreatePlan(totalSize int64, targetFiles int) Plan {
 			if remainingSize/int64(remainingFiles) < maxSize {
 				maxSize = remainingSize / int64(remainingFiles) * 2
 			}
-			if maxSize < 100*size.KB {
+			if maxSize <= 100*size.KB {
 				break
 			}
 
-			fileSize := rand.Int63n(maxSize-100*size.KB) + 100*size.KB
+			fileSize := rng.Int63n(maxSize-100*size.KB) + 100*size.KB
 			plan.MediumFiles = append(plan.MediumFiles, fileSize)
 			remainingSize -= fileSize
 			remainingFiles--
@@ -107,7 +248,7 @@ func CreatePlan(totalSize int64, targetFiles int) Plan {
 			fileSize = remainingSize // Use all remaining size
 			remainingFiles = 1       // This will be the last file
 		} else {
-			fileSize = rand.Int63n(maxSize-1024) + 1024
+			fileSize = rng.Int63n(maxSize-1024) + 1024
 		}
 
 		plan.SmallFiles = append(plan.SmallFiles, fileSize)
@@ -115,20 +256,24 @@ func CreatePlan(totalSize int64, targetFiles int) Plan {
 		remainingFiles--
 	}
 
+	// Close enough: leave the remainder out rather than adding a corrective file
+	if remainingSize > 0 && float64(remainingSize) <= float64(totalSize)*tolerance/100 {
+		return plan
+	}
+
 	// If there's remaining size, distribute it among existing files or create a new medium file
 	if remainingSize > 0 {
-		if remainingSize >= 100*size.KB {
+		lastSmallIdx := len(plan.SmallFiles) - 1
+		switch {
+		case remainingSize >= 100*size.KB:
 			// Create a new medium file with the remaining size
 			plan.MediumFiles = append(plan.MediumFiles, remainingSize)
-		} else if len(plan.SmallFiles) > 0 {
+		case lastSmallIdx >= 0 && plan.SmallFiles[lastSmallIdx]+remainingSize < 100*size.KB:
 			// Add to the last small file only if it keeps it in the small range
-			lastSmallIdx := len(plan.SmallFiles) - 1
-			if plan.SmallFiles[lastSmallIdx]+remainingSize < 100*size.KB {
-				plan.SmallFiles[lastSmallIdx] += remainingSize
-			} else {
-				// Create a new small file with remaining size
-				plan.SmallFiles = append(plan.SmallFiles, remainingSize)
-			}
+			plan.SmallFiles[lastSmallIdx] += remainingSize
+		default:
+			// Create a new small file with remaining size
+			plan.SmallFiles = append(plan.SmallFiles, remainingSize)
 		}
 	}
 
@@ -1,6 +1,7 @@
 package mockfs
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/jlbutler/imgmkr/size"
@@ -50,3 +51,120 @@ func TestCreatePlan(t *testing.T) {
 		}
 	}
 }
+
+func TestPlanTotals(t *testing.T) {
+	plan := Plan{
+		LargeFiles:  []int64{20 * size.MB},
+		MediumFiles: []int64{200 * size.KB, 300 * size.KB},
+		SmallFiles:  []int64{2 * size.KB},
+	}
+	if plan.Files() != 4 {
+		t.Errorf("Expected 4 files, got %d", plan.Files())
+	}
+	expected := int64(20*size.MB + 500*size.KB + 2*size.KB)
+	if plan.TotalSize() != expected {
+		t.Errorf("Expected total size %d, got %d", expected, plan.TotalSize())
+	}
+}
+
+func TestCreatePlanTolerance(t *testing.T) {
+	const totalSize, targetFiles, tolerance = size.MB, 100, 10.0
+
+	skipped := 0
+	for seed := int64(1); seed <= 50; seed++ {
+		// Exact mode always tops up to the requested size
+		exact := createPlan(rand.New(rand.NewSource(seed)), totalSize, targetFiles, 0)
+		if exact.TotalSize() != totalSize {
+			t.Fatalf("Seed %d: expected exact plan to total %d, got %d", seed, totalSize, exact.TotalSize())
+		}
+
+		plan := createPlan(rand.New(rand.NewSource(seed)), totalSize, targetFiles, tolerance)
+		if plan.TotalSize() == totalSize {
+			continue
+		}
+
+		// Short plans must be within tolerance, without a corrective file
+		skipped++
+		if float64(totalSize-plan.TotalSize()) > totalSize*tolerance/100 {
+			t.Errorf("Seed %d: plan total %d is outside %g%% of %d", seed, plan.TotalSize(), tolerance, totalSize)
+		}
+		if plan.Files() > targetFiles {
+			t.Errorf("Seed %d: expected no corrective file within tolerance, got %d files for a target of %d", seed, plan.Files(), targetFiles)
+		}
+	}
+	if skipped == 0 {
+		t.Error("Expected some plans to finish within tolerance without topping up")
+	}
+}
+
+func TestPlanSumsToTotal(t *testing.T) {
+	check := func(name string, plan Plan, totalSize int64, targetFiles int) {
+		t.Helper()
+		if plan.TotalSize() != totalSize {
+			t.Errorf("%s: plan for %d bytes in %d files totals %d", name, totalSize, targetFiles, plan.TotalSize())
+		}
+		for _, bucket := range [][]int64{plan.VeryLargeFiles, plan.LargeFiles, plan.MediumFiles, plan.SmallFiles} {
+			for _, fileSize := range bucket {
+				if fileSize < 1 {
+					t.Errorf("%s: plan for %d bytes in %d files has a %d byte file", name, totalSize, targetFiles, fileSize)
+					return
+				}
+			}
+		}
+	}
+
+	// Totals from a few bytes to several GB, with file counts from none to far more than fit
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		totalSize := 1 + rng.Int63n(int64(1)<<uint(1+rng.Intn(34)))
+		targetFiles := rng.Intn(2000)
+
+		check("CreatePlan", CreatePlan(totalSize, targetFiles), totalSize, targetFiles)
+		check("createPlan", createPlan(rand.New(rand.NewSource(int64(i))), totalSize, targetFiles, 0), totalSize, targetFiles)
+		if targetFiles == 0 {
+			continue
+		}
+		for _, p := range Profiles() {
+			check(p.Name, p.plan(rand.New(rand.NewSource(int64(i))), totalSize, targetFiles), totalSize, targetFiles)
+		}
+	}
+}
+
+func TestCreateExactPlan(t *testing.T) {
+	tests := []struct {
+		totalSize int64
+		files     int
+	}{
+		{10 * size.MB, 1},
+		{10 * size.MB, 20},
+		{10 * size.MB, 500},           // Far more than the default plan makes
+		{2 * size.GB, 3},              // Fewer than the very large and large files planned
+		{2 * size.GB, 10000},          // Past the caps on large and medium files
+		{5000, 5000},                  // One byte each
+		{size.MB + 17, 999},           // Sizes that don't divide evenly
+		{100 * size.KB, 250},          // Fewer bytes than the small file minimum allows
+		{512 * size.MB, 50},           // No very large files
+		{3 * size.GB, 1000},           // Very large files to split
+		{7 * size.KB, 2},              // Tiny layer
+		{64 * size.MB, 64},            // One per MB
+		{123456789, 4321},             // Odd total and count
+		{size.GB + 1, 1},              // Everything in one file
+		{10 * size.KB, 10 * 1024 / 2}, // Two bytes each
+	}
+	for _, test := range tests {
+		plan := CreateExactPlan(test.totalSize, test.files)
+		if plan.Files() != test.files {
+			t.Errorf("Expected exactly %d files for %d bytes, got %d", test.files, test.totalSize, plan.Files())
+		}
+		if plan.TotalSize() != test.totalSize {
+			t.Errorf("Expected %d files to total %d bytes, got %d", test.files, test.totalSize, plan.TotalSize())
+		}
+		for _, bucket := range [][]int64{plan.VeryLargeFiles, plan.LargeFiles, plan.MediumFiles, plan.SmallFiles} {
+			for _, fileSize := range bucket {
+				if fileSize < 1 {
+					t.Fatalf("Expected every file to hold at least 1 byte, got %d for %d files of %d bytes", fileSize, test.files, test.totalSize)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package mockfs
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// Profile is a named preset that shapes a mock filesystem like a common kind of image
+type Profile struct {
+	Name        string
+	Description string
+	Buckets     []SizeBucket // File size distribution
+	MinFiles    int          // Fewest files planned for a layer
+	MaxFiles    int          // Most files planned for a layer
+	MaxDepth    int          // Directory depth used unless --max-depth is given
+	DirNames    []string     // Names for the subdirectories at each level, before falling back to dirN
+}
+
+// SizeBucket is a range of file sizes in a profile's distribution
+type SizeBucket struct {
+	Min        int64    // Smallest file size
+	Max        int64    // Largest file size
+	Share      float64  // Fraction of files drawn from this bucket
+	Extensions []string // Extensions for files in this bucket, picked at random ("" = none)
+}
+
+// profiles lists the available profiles, in the order they are shown
+var profiles = []*Profile{
+	{
+		Name:        "node-app",
+		Description: "Node.js application: thousands of small JavaScript files in a deep node_modules tree",
+		Buckets: []SizeBucket{
+			{Min: 200, Max: 8 * size.KB, Share: 0.85, Extensions: []string{".js", ".js", ".js", ".json", ".md", ".ts", ".map"}},
+			{Min: 8 * size.KB, Max: 200 * size.KB, Share: 0.13, Extensions: []string{".js", ".js", ".map", ".json"}},
+			{Min: 200 * size.KB, Max: 2 * size.MB, Share: 0.02, Extensions: []string{".js", ".node", ".wasm"}},
+		},
+		MinFiles: 50,
+		MaxFiles: 50000,
+		MaxDepth: 6,
+		DirNames: []string{"node_modules", "lib", "dist", "src", "test", "bin"},
+	},
+	{
+		Name:        "ml-model",
+		Description: "Machine learning model: a few huge weight files alongside small config files",
+		Buckets: []SizeBucket{
+			{Min: 512, Max: 64 * size.KB, Share: 0.5, Extensions: []string{".json", ".txt", ".yaml"}},
+			{Min: 256 * size.MB, Max: 4 * size.GB, Share: 0.5, Extensions: []string{".safetensors", ".bin", ".onnx"}},
+		},
+		MinFiles: 3,
+		MaxFiles: 8,
+		MaxDepth: 1,
+		DirNames: []string{"model", "tokenizer"},
+	},
+	{
+		Name:        "os-base",
+		Description: "Operating system base: a root filesystem of config files, headers, binaries, and shared libraries",
+		Buckets: []SizeBucket{
+			{Min: 100, Max: 4 * size.KB, Share: 0.6, Extensions: []string{"", ".conf", ".h", ".txt", ".sh"}},
+			{Min: 4 * size.KB, Max: 100 * size.KB, Share: 0.3, Extensions: []string{"", ".h", ".py", ".mo"}},
+			{Min: 100 * size.KB, Max: 2 * size.MB, Share: 0.09, Extensions: []string{"", ".so"}},
+			{Min: 2 * size.MB, Max: 20 * size.MB, Share: 0.01, Extensions: []string{".so", ".a"}},
+		},
+		MinFiles: 50,
+		MaxFiles: 20000,
+		MaxDepth: 4,
+		DirNames: []string{"usr", "lib", "etc", "bin", "sbin", "var", "opt", "share"},
+	},
+}
+
+// Profiles returns the available profiles
+func Profiles() []*Profile {
+	return profiles
+}
+
+// LookupProfile returns the profile with the given name
+func LookupProfile(name string) (*Profile, error) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	names := make([]string, len(profiles))
+	for i, p := range profiles {
+		names[i] = p.Name
+	}
+	return nil, fmt.Errorf("unknown profile %q (available: %v)", name, names)
+}
+
+// meanFileSize returns the expected size of a file drawn from the profile's distribution
+func (p *Profile) meanFileSize() float64 {
+	var mean float64
+	for _, b := range p.Buckets {
+		mean += b.Share * logUniformMean(b.Min, b.Max)
+	}
+	return mean
+}
+
+// logUniformMean returns the mean of sizes drawn log-uniformly from [lo, hi]
+func logUniformMean(lo, hi int64) float64 {
+	if lo == hi {
+		return float64(lo)
+	}
+	return float64(hi-lo) / math.Log(float64(hi)/float64(lo))
+}
+
+// targetFiles returns the number of files for a layer, so that files of the profile's average
+// size add up to layerSize, within the profile's limits
+func (p *Profile) targetFiles(layerSize int64) int {
+	files := int(float64(layerSize) / p.meanFileSize())
+	if files < p.MinFiles {
+		files = p.MinFiles
+	}
+	if files > p.MaxFiles {
+		files = p.MaxFiles
+	}
+	return files
+}
+
+// plan draws targetFiles sizes from the profile's distribution and scales them to add up to
+// exactly totalSize. Scaling keeps the shape of the distribution when the file count had to be
+// clamped; otherwise it is close to 1.
+func (p *Profile) plan(rng *rand.Rand, totalSize int64, targetFiles int) Plan {
+	if int64(targetFiles) > totalSize {
+		targetFiles = int(totalSize)
+	}
+	if targetFiles < 1 {
+		return Plan{}
+	}
+
+	drawn := make([]float64, targetFiles)
+	var sum float64
+	for i := range drawn {
+		b := p.pickBucket(rng)
+		drawn[i] = math.Exp(math.Log(float64(b.Min)) + rng.Float64()*math.Log(float64(b.Max)/float64(b.Min)))
+		sum += drawn[i]
+	}
+
+	scale := float64(totalSize) / sum
+	sizes := make([]int64, targetFiles)
+	var planned int64
+	for i, d := range drawn {
+		sizes[i] = int64(d * scale)
+		if sizes[i] < 1 {
+			sizes[i] = 1
+		}
+		planned += sizes[i]
+	}
+
+	// Settle rounding on the largest file, which it changes the least. Raising tiny files to 1
+	// byte can overshoot by more than the largest file holds, so any excess is taken from the
+	// largest files in turn, down to 1 byte each (targetFiles <= totalSize leaves enough).
+	size.Sort(sizes, true)
+	excess := planned - totalSize
+	if excess < 0 {
+		sizes[0] -= excess
+	}
+	for i := 0; excess > 0; i++ {
+		take := min(excess, sizes[i]-1)
+		sizes[i] -= take
+		excess -= take
+	}
+	return planFromSizes(sizes)
+}
+
+// pickBucket returns a bucket chosen at random in proportion to the buckets' shares
+func (p *Profile) pickBucket(rng *rand.Rand) SizeBucket {
+	var total float64
+	for _, b := range p.Buckets {
+		total += b.Share
+	}
+	r := rng.Float64() * total
+	for _, b := range p.Buckets {
+		if r < b.Share {
+			return b
+		}
+		r -= b.Share
+	}
+	return p.Buckets[len(p.Buckets)-1]
+}
+
+// extension returns a random extension for a file of the given size
+func (p *Profile) extension(rng *rand.Rand, fileSize int64) string {
+	return bucketExtension(p.Buckets, rng, fileSize)
+}
+
+// bucketExtension returns a random extension for a file of the given size, from the first of
+// buckets large enough to hold it (the last if none is)
+func bucketExtension(buckets []SizeBucket, rng *rand.Rand, fileSize int64) string {
+	b := buckets[len(buckets)-1]
+	for _, candidate := range buckets {
+		if fileSize <= candidate.Max {
+			b = candidate
+			break
+		}
+	}
+	if len(b.Extensions) == 0 {
+		return ""
+	}
+	return b.Extensions[rng.Intn(len(b.Extensions))]
+}
+
+// dirName returns the name of the i'th subdirectory at a level
+func (p *Profile) dirName(i int) string {
+	if p != nil && i < len(p.DirNames) {
+		return p.DirNames[i]
+	}
+	return fmt.Sprintf("dir%d", i+1)
+}
@@ -0,0 +1,150 @@
+package mockfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jlbutler/imgmkr/content"
+	"github.com/jlbutler/imgmkr/size"
+)
+
+// planSizes returns the file sizes of a profile's plan for a layer, largest first
+func planSizes(t *testing.T, profile string, layerSize int64) []int64 {
+	plan := PlanLayer(layerSize, Options{Profile: profile, Seed: 7})
+	if plan.TotalSize() != layerSize {
+		t.Errorf("%s: expected the plan to total %d bytes, got %d", profile, layerSize, plan.TotalSize())
+	}
+	var sizes []int64
+	for _, bucket := range [][]int64{plan.VeryLargeFiles, plan.LargeFiles, plan.MediumFiles, plan.SmallFiles} {
+		sizes = append(sizes, bucket...)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] > sizes[j] })
+	return sizes
+}
+
+func TestProfileShapes(t *testing.T) {
+	// node-app: thousands of files, most of them a few KB
+	sizes := planSizes(t, "node-app", 200*size.MB)
+	if len(sizes) < 5000 {
+		t.Errorf("node-app: expected thousands of files, got %d", len(sizes))
+	}
+	if median := sizes[len(sizes)/2]; median > 16*size.KB {
+		t.Errorf("node-app: expected a median file size under 16KB, got %s", size.Format(median))
+	}
+
+	// ml-model: a handful of files, with almost all bytes in the weights
+	sizes = planSizes(t, "ml-model", 4*size.GB)
+	if len(sizes) < 3 || len(sizes) > 8 {
+		t.Errorf("ml-model: expected 3-8 files, got %d", len(sizes))
+	}
+	if sizes[0] < 4*size.GB/3 {
+		t.Errorf("ml-model: expected the largest file to hold at least a third of the layer, got %s", size.Format(sizes[0]))
+	}
+	if smallest := sizes[len(sizes)-1]; smallest > 1*size.MB {
+		t.Errorf("ml-model: expected small config files alongside the weights, smallest is %s", size.Format(smallest))
+	}
+
+	// os-base: mostly small files, with a long tail of libraries
+	sizes = planSizes(t, "os-base", 500*size.MB)
+	var small int
+	for _, fileSize := range sizes {
+		if fileSize <= 8*size.KB {
+			small++
+		}
+	}
+	if small*2 < len(sizes) {
+		t.Errorf("os-base: expected most files to be under 8KB, got %d of %d", small, len(sizes))
+	}
+	if sizes[0] < 1*size.MB {
+		t.Errorf("os-base: expected some files of at least 1MB, largest is %s", size.Format(sizes[0]))
+	}
+}
+
+func TestCreateProfile(t *testing.T) {
+	osBase, err := LookupProfile("os-base")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up profile: %v", err)
+	}
+	layerDir := t.TempDir()
+	stats, err := Create(context.Background(), layerDir, 2*size.MB, Options{Profile: "os-base", MaxDepth: 2, MagicHeaders: true, Seed: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error creating mock filesystem: %v", err)
+	}
+	if stats.Bytes() != 2*size.MB {
+		t.Errorf("Expected %d bytes, got %d", 2*size.MB, stats.Bytes())
+	}
+
+	// Directories take the profile's names
+	entries, err := os.ReadDir(layerDir)
+	if err != nil {
+		t.Fatalf("Failed to read layer directory: %v", err)
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	if len(dirs) == 0 {
+		t.Error("Expected subdirectories in the layer root")
+	}
+	for _, dir := range dirs {
+		if !strings.Contains(strings.Join(osBase.DirNames, " "), dir) {
+			t.Errorf("Expected os-base directory names, got %v", dirs)
+		}
+	}
+
+	// Files take the profile's extensions, with magic headers where the format has one
+	allowed := map[string]bool{}
+	for _, bucket := range osBase.Buckets {
+		for _, ext := range bucket.Extensions {
+			allowed[ext] = true
+		}
+	}
+	err = filepath.WalkDir(layerDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// Names are "<size>-file", numbered if the size repeats, then the extension
+		name := filepath.Base(path)
+		ext := strings.TrimLeft(name[strings.LastIndex(name, "-file")+len("-file"):], "0123456789")
+		if !allowed[ext] {
+			t.Errorf("File %s has an extension outside the os-base profile", path)
+		}
+		if header := content.MagicHeader(ext, 1024); len(header) > 0 {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(string(data), string(content.MagicHeader(ext, int64(len(data))))) {
+				t.Errorf("Expected %s to start with its magic header", path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk mock filesystem: %v", err)
+	}
+}
+
+func TestLookupProfile(t *testing.T) {
+	for _, p := range Profiles() {
+		found, err := LookupProfile(p.Name)
+		if err != nil || found != p {
+			t.Errorf("Expected to find profile %s, got %v (err: %v)", p.Name, found, err)
+		}
+	}
+	if _, err := LookupProfile("missing"); err == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+	if err := (Options{Profile: "missing"}).Validate(); err == nil {
+		t.Error("Expected options naming an unknown profile to be invalid")
+	}
+	if err := (Options{Profile: "node-app", FlatFiles: 10}).Validate(); err == nil {
+		t.Error("Expected a profile with flat files to be invalid")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -23,8 +24,8 @@ func TestSizeModule(t *testing.T) {
 
 	// Test formatting
 	formatted := size.Format(1024 * 1024)
-	if formatted != "1.00 MB" {
-		t.Errorf("Expected '1.00 MB', got %s", formatted)
+	if formatted != "1.00 MiB" {
+		t.Errorf("Expected '1.00 MiB', got %s", formatted)
 	}
 
 	// Test list parsing
@@ -77,7 +78,7 @@ func TestMockfsModule(t *testing.T) {
 
 	// Test creating a mock filesystem
 	layerDir := filepath.Join(tempDir, "test-layer")
-	err = mockfs.Create(layerDir, 10*1024, 2, 5) // 10KB, depth 2, 5 files
+	_, err = mockfs.Create(context.Background(), layerDir, 10*1024, mockfs.Options{MaxDepth: 2, TargetFiles: 5}) // 10KB, depth 2, 5 files
 	if err != nil {
 		t.Errorf("Unexpected error creating mock filesystem: %v", err)
 	}
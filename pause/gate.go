@@ -0,0 +1,78 @@
+package pause
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// Gate lets writers be paused and resumed between chunks
+type Gate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	out    io.Writer // Where pause and resume messages are written
+}
+
+// New creates a new gate in the running state
+func New() *Gate {
+	g := &Gate{out: os.Stdout}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// SetOutput sets where pause and resume messages are written (os.Stdout by default). It must be
+// called before SetupSignalHandling.
+func (g *Gate) SetOutput(w io.Writer) {
+	g.out = w
+}
+
+// Pause causes subsequent calls to Wait to block until Resume is called
+func (g *Gate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+}
+
+// Resume releases any writers blocked in Wait
+func (g *Gate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+	g.cond.Broadcast()
+}
+
+// Paused reports whether the gate is currently paused
+func (g *Gate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// Wait blocks while the gate is paused. A nil gate never blocks.
+func (g *Gate) Wait() {
+	g.WaitContext(context.Background())
+}
+
+// WaitContext blocks while the gate is paused, unless ctx is done first. It returns ctx.Err(),
+// so writers can check for cancellation between chunks with a single call. A nil gate never blocks.
+func (g *Gate) WaitContext(ctx context.Context) error {
+	if g == nil {
+		return ctx.Err()
+	}
+	// Wake the wait below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.cond.Broadcast()
+	})
+	defer stop()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused && ctx.Err() == nil {
+		g.cond.Wait()
+	}
+	return ctx.Err()
+}
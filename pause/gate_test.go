@@ -0,0 +1,73 @@
+package pause
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGateWaitBlocksWhilePaused(t *testing.T) {
+	g := New()
+	g.Pause()
+	if !g.Paused() {
+		t.Fatal("Expected gate to be paused")
+	}
+
+	released := make(chan struct{})
+	go func() {
+		g.Wait()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+		t.Fatal("Wait returned while the gate was paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.Resume()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after Resume")
+	}
+}
+
+func TestGateWaitRunning(t *testing.T) {
+	// Neither a running gate nor a nil gate should block
+	New().Wait()
+	var g *Gate
+	g.Wait()
+}
+
+func TestGateWaitContextCancel(t *testing.T) {
+	g := New()
+	g.Pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	released := make(chan error, 1)
+	go func() {
+		released <- g.WaitContext(ctx)
+	}()
+
+	// Cancelling releases a waiter even though the gate is still paused
+	cancel()
+	select {
+	case err := <-released:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitContext did not return after cancel")
+	}
+	if !g.Paused() {
+		t.Error("Expected gate to stay paused")
+	}
+
+	// A nil gate reports cancellation too
+	var nilGate *Gate
+	if err := nilGate.WaitContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from a nil gate, got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package pause
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SetupSignalHandling pauses the gate on SIGUSR1 and resumes it on SIGUSR2. It returns a function
+// that stops handling the signals.
+func (g *Gate) SetupSignalHandling() (stop func()) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGUSR1:
+				if !g.Paused() {
+					g.Pause()
+					fmt.Fprintf(g.out, "\n⏸️  Paused layer creation (send SIGUSR2 to resume)\n")
+				}
+			case syscall.SIGUSR2:
+				if g.Paused() {
+					g.Resume()
+					fmt.Fprintf(g.out, "\n▶️  Resumed layer creation\n")
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(sigChan)
+	}
+}
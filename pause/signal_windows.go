@@ -0,0 +1,8 @@
+//go:build windows
+
+package pause
+
+// SetupSignalHandling is a no-op on Windows, which has no SIGUSR1/SIGUSR2
+func (g *Gate) SetupSignalHandling() (stop func()) {
+	return func() {}
+}
@@ -1,14 +1,46 @@
 package progress
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/term"
+
 	"github.com/jlbutler/imgmkr/size"
 )
 
+// renderInterval limits how often intra-layer progress redraws the multi-line display
+const renderInterval = 100 * time.Millisecond
+
+// singleLineInterval limits how often intra-layer progress appends a status line, which is usually
+// going to a log
+const singleLineInterval = time.Second
+
+// Format selects how a Tracker reports progress
+type Format string
+
+// Progress formats
+const (
+	FormatBar  Format = "bar"  // Redrawn progress bar for people watching (the default)
+	FormatJSON Format = "json" // One JSON object per line, for CI logs and other programs
+)
+
+// ParseFormat parses a progress format name
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(s); format {
+	case FormatBar, FormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown progress format %q: must be %s or %s", s, FormatBar, FormatJSON)
+}
+
 // Tracker tracks progress across concurrent operations
 type Tracker struct {
 	totalLayers     int
@@ -16,6 +48,21 @@ type Tracker struct {
 	totalSize       int64
 	completedSize   int64
 	startTime       time.Time
+
+	out           io.Writer
+	format        Format
+	multiLine     bool                // Draw one line per in-flight layer (requires a terminal)
+	mu            sync.Mutex          // Guards the fields below and serializes rendering
+	inFlight      map[int]*LayerState // Layers currently being written, by layer number
+	renderedLines int                 // Lines drawn by the last multi-line render
+	lastRender    time.Time
+}
+
+// LayerState is a snapshot of an in-flight layer's progress
+type LayerState struct {
+	Layer   int
+	Written int64
+	Total   int64
 }
 
 // New creates a new progress tracker
@@ -24,46 +71,334 @@ func New(totalLayers int, totalSize int64) *Tracker {
 		totalLayers: totalLayers,
 		totalSize:   totalSize,
 		startTime:   time.Now(),
+		out:         os.Stdout,
+		format:      FormatBar,
+		multiLine:   term.IsTerminal(int(os.Stdout.Fd())),
+		inFlight:    make(map[int]*LayerState),
+	}
+}
+
+// SetFormat sets how progress is reported. It must be called before any progress is recorded.
+func (pt *Tracker) SetFormat(format Format) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.format = format
+	if format == FormatJSON {
+		pt.multiLine = false
+	}
+}
+
+// DisableBar writes a status line per update instead of redrawing the multi-line display, as is
+// done automatically when the output is not a terminal
+func (pt *Tracker) DisableBar() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.multiLine = false
+}
+
+// SetOutput sets where progress is written (os.Stdout by default). The multi-line display is only
+// drawn when w is a terminal.
+func (pt *Tracker) SetOutput(w io.Writer) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.out = w
+	f, ok := w.(*os.File)
+	pt.multiLine = ok && pt.format != FormatJSON && term.IsTerminal(int(f.Fd()))
+}
+
+// SetStartTime sets when the work being tracked started, for the elapsed time, throughput, and
+// ETA (when the tracker was created by default)
+func (pt *Tracker) SetStartTime(t time.Time) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.startTime = t
+}
+
+// Start marks a layer as in-flight
+func (pt *Tracker) Start(layerNum int, layerSize int64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.inFlight[layerNum] = &LayerState{Layer: layerNum, Total: layerSize}
+	if pt.multiLine {
+		pt.renderMultiLine()
+	}
+}
+
+// Advance records n more bytes written for an in-flight layer. A layer never counts more than
+// its total, so bytes reported beyond it are not counted twice when the layer completes.
+func (pt *Tracker) Advance(layerNum int, n int64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	state, ok := pt.inFlight[layerNum]
+	if !ok {
+		return
+	}
+	state.Written += n
+	if state.Written > state.Total {
+		state.Written = state.Total
+	}
+	switch {
+	case pt.format == FormatJSON:
+		// Only completed layers are reported
+	case pt.multiLine && time.Since(pt.lastRender) >= renderInterval:
+		pt.renderMultiLine()
+	case !pt.multiLine && time.Since(pt.lastRender) >= singleLineInterval:
+		pt.renderSingleLine(fmt.Sprintf("Layer %d: %.1f%%", layerNum, percent(state.Written, state.Total)))
+	}
+}
+
+// doneBytes returns the bytes written so far: all of each completed layer and the written part
+// of each in-flight layer. Callers must hold pt.mu.
+func (pt *Tracker) doneBytes() int64 {
+	done := atomic.LoadInt64(&pt.completedSize)
+	for _, state := range pt.inFlight {
+		done += state.Written
+	}
+	return done
+}
+
+// DoneBytes returns the bytes written so far across completed and in-flight layers
+func (pt *Tracker) DoneBytes() int64 {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.doneBytes()
+}
+
+// InFlight returns a snapshot of the in-flight layers, ordered by layer number
+func (pt *Tracker) InFlight() []LayerState {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	states := make([]LayerState, 0, len(pt.inFlight))
+	for _, state := range pt.inFlight {
+		states = append(states, *state)
 	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Layer < states[j].Layer })
+	return states
 }
 
-// Update updates the progress and displays current status
+// Update updates the progress and displays current status. It is safe to call from concurrent
+// workers: the display is rendered under pt.mu, so lines from different layers never interleave.
 func (pt *Tracker) Update(layerNum int, layerSize int64, duration time.Duration) {
 	atomic.AddInt64(&pt.completedLayers, 1)
 	atomic.AddInt64(&pt.completedSize, layerSize)
 
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	delete(pt.inFlight, layerNum)
+	if pt.format == FormatJSON {
+		pt.writeLayerEvent(layerNum, duration)
+		return
+	}
+	if pt.multiLine {
+		pt.renderMultiLine()
+		return
+	}
+	pt.renderSingleLine(fmt.Sprintf("Layer %d: %s", layerNum, duration.Round(time.Millisecond)))
+}
+
+// renderSingleLine appends a newline-terminated status line with a progress bar, ending with
+// status. Lines are never overwritten, so they read cleanly in a log or pipe. Byte progress
+// includes the written part of in-flight layers, so the bar moves within a large layer.
+// Callers must hold pt.mu.
+func (pt *Tracker) renderSingleLine(status string) {
 	completed := atomic.LoadInt64(&pt.completedLayers)
-	completedSize := atomic.LoadInt64(&pt.completedSize)
+	doneSize := pt.doneBytes()
 
 	// Calculate progress percentage
 	progressPercent := float64(completed) / float64(pt.totalLayers) * 100
-	sizeProgressPercent := float64(completedSize) / float64(pt.totalSize) * 100
+	sizeProgressPercent := percent(doneSize, pt.totalSize)
+
+	// Display progress
+	fmt.Fprintf(pt.out, "[%s] %d/%d layers (%.1f%%) | %s/%s (%.1f%%) | %s | ETA: %s\n",
+		renderBar(30, sizeProgressPercent),
+		completed, pt.totalLayers, progressPercent,
+		size.Format(doneSize), size.Format(pt.totalSize), sizeProgressPercent,
+		status, pt.eta(doneSize).Round(time.Second))
+	pt.lastRender = time.Now()
+}
 
-	// Calculate ETA
+// eta estimates the time left from the rate doneSize bytes were written at
+func (pt *Tracker) eta(doneSize int64) time.Duration {
+	if doneSize <= 0 {
+		return 0
+	}
 	elapsed := time.Since(pt.startTime)
-	var eta time.Duration
-	if completed > 0 {
-		avgTimePerLayer := elapsed / time.Duration(completed)
-		remainingLayers := int64(pt.totalLayers) - completed
-		eta = avgTimePerLayer * time.Duration(remainingLayers)
+	return time.Duration(float64(elapsed) * float64(pt.totalSize-doneSize) / float64(doneSize))
+}
+
+// layerEvent is the JSON line written for each completed layer in FormatJSON
+type layerEvent struct {
+	Event           string  `json:"event"` // Always "layer"
+	Layer           int     `json:"layer"`
+	CompletedLayers int64   `json:"completed_layers"`
+	TotalLayers     int     `json:"total_layers"`
+	CompletedBytes  int64   `json:"completed_bytes"` // Includes the written part of in-flight layers
+	TotalBytes      int64   `json:"total_bytes"`
+	LayerDurationMs int64   `json:"layer_duration_ms"`
+	ETASeconds      float64 `json:"eta_seconds"`
+}
+
+// summaryEvent is the JSON line written by Finish in FormatJSON
+type summaryEvent struct {
+	Event           string `json:"event"` // Always "summary"
+	CompletedLayers int64  `json:"completed_layers"`
+	TotalLayers     int    `json:"total_layers"`
+	CompletedBytes  int64  `json:"completed_bytes"`
+	TotalBytes      int64  `json:"total_bytes"`
+	DurationMs      int64  `json:"duration_ms"`
+	BytesPerSecond  int64  `json:"bytes_per_second"`
+}
+
+// writeLayerEvent writes the JSON line for a completed layer. Callers must hold pt.mu.
+func (pt *Tracker) writeLayerEvent(layerNum int, duration time.Duration) {
+	doneSize := pt.doneBytes()
+	pt.writeJSON(layerEvent{
+		Event:           "layer",
+		Layer:           layerNum,
+		CompletedLayers: atomic.LoadInt64(&pt.completedLayers),
+		TotalLayers:     pt.totalLayers,
+		CompletedBytes:  doneSize,
+		TotalBytes:      pt.totalSize,
+		LayerDurationMs: duration.Milliseconds(),
+		ETASeconds:      pt.eta(doneSize).Seconds(),
+	})
+}
+
+// writeJSON writes event to the output as a single line. Like the bar, output errors are ignored.
+func (pt *Tracker) writeJSON(event any) {
+	json.NewEncoder(pt.out).Encode(event)
+}
+
+// renderMultiLine redraws the aggregate line and one line per in-flight layer. Callers must hold pt.mu.
+func (pt *Tracker) renderMultiLine() {
+	var b strings.Builder
+
+	// Move back to the top of the previous render
+	if pt.renderedLines > 1 {
+		fmt.Fprintf(&b, "\x1b[%dA", pt.renderedLines-1)
 	}
+	b.WriteString("\r")
 
-	// Create progress bar
-	barWidth := 30
-	filledWidth := int(float64(barWidth) * progressPercent / 100)
-	bar := strings.Repeat("█", filledWidth) + strings.Repeat("░", barWidth-filledWidth)
+	// Aggregate line counts bytes from completed and in-flight layers
+	completed := atomic.LoadInt64(&pt.completedLayers)
+	doneSize := atomic.LoadInt64(&pt.completedSize)
+	layerNums := make([]int, 0, len(pt.inFlight))
+	for layerNum, state := range pt.inFlight {
+		doneSize += state.Written
+		layerNums = append(layerNums, layerNum)
+	}
+	sort.Ints(layerNums)
 
-	// Display progress
-	fmt.Printf("\r[%s] %d/%d layers (%.1f%%) | %s/%s (%.1f%%) | Layer %d: %s | ETA: %s",
-		bar,
-		completed, pt.totalLayers, progressPercent,
-		size.Format(completedSize), size.Format(pt.totalSize), sizeProgressPercent,
-		layerNum, duration.Round(time.Millisecond),
-		eta.Round(time.Second))
+	sizePercent := percent(doneSize, pt.totalSize)
+	fmt.Fprintf(&b, "\x1b[2K[%s] %d/%d layers | %s/%s (%.1f%%) | ETA: %s",
+		renderBar(30, sizePercent),
+		completed, pt.totalLayers,
+		size.Format(doneSize), size.Format(pt.totalSize), sizePercent,
+		pt.eta(doneSize).Round(time.Second))
+
+	// One line per in-flight layer
+	for _, layerNum := range layerNums {
+		state := pt.inFlight[layerNum]
+		layerPercent := percent(state.Written, state.Total)
+		fmt.Fprintf(&b, "\n\x1b[2K  Layer %d: [%s] %s/%s (%.1f%%)",
+			layerNum, renderBar(20, layerPercent),
+			size.Format(state.Written), size.Format(state.Total), layerPercent)
+	}
+
+	// Clear lines left over from a previous, taller render
+	lines := 1 + len(layerNums)
+	for i := lines; i < pt.renderedLines; i++ {
+		b.WriteString("\n\x1b[2K")
+	}
+	if pt.renderedLines > lines {
+		fmt.Fprintf(&b, "\x1b[%dA", pt.renderedLines-lines)
+	}
+
+	fmt.Fprint(pt.out, b.String())
+	pt.renderedLines = lines
+	pt.lastRender = time.Now()
+}
+
+// renderBar returns a progress bar of the given width filled to percent
+func renderBar(width int, percent float64) string {
+	filledWidth := int(float64(width) * percent / 100)
+	if filledWidth > width {
+		filledWidth = width
+	}
+	return strings.Repeat("█", filledWidth) + strings.Repeat("░", width-filledWidth)
+}
+
+// percent returns done as a percentage of total
+func percent(done, total int64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return float64(done) / float64(total) * 100
+}
+
+// RenderSummary returns a one-line static summary of the completed layers, their total size,
+// the elapsed time, and the average throughput, for logs where the animated bar is not useful
+func (pt *Tracker) RenderSummary() string {
+	return pt.renderSummary(time.Since(pt.startTime))
+}
+
+// renderSummary renders the summary line as if elapsed time had passed since the tracker started
+func (pt *Tracker) renderSummary(elapsed time.Duration) string {
+	completed := atomic.LoadInt64(&pt.completedLayers)
+	completedSize := atomic.LoadInt64(&pt.completedSize)
+	throughput := pt.throughput(elapsed)
+	return fmt.Sprintf("[%s] %d/%d layers, %s in %s (%s/s)",
+		renderBar(30, percent(completed, int64(pt.totalLayers))),
+		completed, pt.totalLayers,
+		size.Format(completedSize), elapsed.Round(time.Second),
+		size.Format(throughput))
+}
+
+// throughput returns the average bytes per second of the completed layers over elapsed
+func (pt *Tracker) throughput(elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(atomic.LoadInt64(&pt.completedSize)) / elapsed.Seconds())
 }
 
-// Finish completes the progress display
+// Stop ends the progress display after a failure, without a summary. The multi-line display is
+// redrawn without its in-flight layers and the cursor left below it, so errors print cleanly.
+func (pt *Tracker) Stop() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if !pt.multiLine || pt.renderedLines == 0 {
+		return
+	}
+	pt.inFlight = make(map[int]*LayerState)
+	pt.renderMultiLine()
+	fmt.Fprintln(pt.out)
+	pt.renderedLines = 0
+}
+
+// Finish completes the progress display. When status lines are written instead of the redrawn
+// display, the static summary is printed first. In FormatJSON a final summary object is written
+// instead.
 func (pt *Tracker) Finish() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
 	elapsed := time.Since(pt.startTime)
-	fmt.Printf("\n✅ All layers completed in %s\n", elapsed.Round(time.Millisecond))
+	if pt.format == FormatJSON {
+		pt.writeJSON(summaryEvent{
+			Event:           "summary",
+			CompletedLayers: atomic.LoadInt64(&pt.completedLayers),
+			TotalLayers:     pt.totalLayers,
+			CompletedBytes:  atomic.LoadInt64(&pt.completedSize),
+			TotalBytes:      pt.totalSize,
+			DurationMs:      elapsed.Milliseconds(),
+			BytesPerSecond:  pt.throughput(elapsed),
+		})
+		return
+	}
+	if pt.multiLine {
+		fmt.Fprintln(pt.out)
+	} else {
+		fmt.Fprintln(pt.out, pt.renderSummary(elapsed))
+	}
+	fmt.Fprintf(pt.out, "✅ All layers completed in %s\n", elapsed.Round(time.Millisecond))
 }
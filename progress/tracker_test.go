@@ -1,6 +1,12 @@
 package progress
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -52,3 +58,303 @@ func TestUpdate(t *testing.T) {
 	// Test Finish (just make sure it doesn't crash)
 	tracker.Finish()
 }
+
+func TestInFlightLayerState(t *testing.T) {
+	tracker := New(3, 6*1024*1024)
+	tracker.out = io.Discard
+
+	tracker.Start(1, 2*1024*1024)
+	tracker.Start(2, 4*1024*1024)
+	tracker.Advance(1, 1024*1024)
+	tracker.Advance(2, 512*1024)
+	tracker.Advance(2, 512*1024)
+	tracker.Advance(9, 1024) // Unknown layers are ignored
+
+	states := tracker.InFlight()
+	expected := []LayerState{
+		{Layer: 1, Written: 1024 * 1024, Total: 2 * 1024 * 1024},
+		{Layer: 2, Written: 1024 * 1024, Total: 4 * 1024 * 1024},
+	}
+	if len(states) != len(expected) {
+		t.Fatalf("Expected %d in-flight layers, got %d", len(expected), len(states))
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Errorf("Expected in-flight state %+v, got %+v", expected[i], states[i])
+		}
+	}
+
+	// Completed layers are no longer in flight
+	tracker.Update(1, 2*1024*1024, time.Millisecond*100)
+	states = tracker.InFlight()
+	if len(states) != 1 || states[0].Layer != 2 {
+		t.Errorf("Expected only layer 2 in flight, got %+v", states)
+	}
+}
+
+func TestPartialProgress(t *testing.T) {
+	var buf bytes.Buffer
+	tracker := New(2, 6*1024*1024)
+	tracker.out = &buf
+	tracker.multiLine = false
+
+	tracker.Start(1, 4*1024*1024)
+	tracker.Start(2, 2*1024*1024)
+	for i := 0; i < 4; i++ {
+		tracker.Advance(1, 1024*1024)
+	}
+	tracker.Advance(1, 1024) // Bytes beyond the layer's total are not counted
+	tracker.Advance(2, 1024*1024)
+	if done := tracker.DoneBytes(); done != 5*1024*1024 {
+		t.Errorf("Expected %d bytes done while in flight, got %d", 5*1024*1024, done)
+	}
+	if !strings.Contains(buf.String(), "Layer 1: ") {
+		t.Errorf("Expected partial progress in the single-line output, got %q", buf.String())
+	}
+
+	// Completing a layer moves its bytes from in flight to completed without counting them twice
+	tracker.Update(1, 4*1024*1024, time.Millisecond*100)
+	if done := tracker.DoneBytes(); done != 5*1024*1024 {
+		t.Errorf("Expected %d bytes done after layer 1, got %d", 5*1024*1024, done)
+	}
+	tracker.Advance(2, 1024*1024)
+	tracker.Update(2, 2*1024*1024, time.Millisecond*100)
+	if done := tracker.DoneBytes(); done != 6*1024*1024 {
+		t.Errorf("Expected %d bytes done after both layers, got %d", 6*1024*1024, done)
+	}
+}
+
+func TestMultiLineRender(t *testing.T) {
+	var buf bytes.Buffer
+	tracker := New(2, 4*1024*1024)
+	tracker.out = &buf
+	tracker.multiLine = true
+
+	tracker.Start(1, 2*1024*1024)
+	tracker.Start(2, 2*1024*1024)
+	tracker.Advance(1, 1024*1024)
+	tracker.Update(1, 2*1024*1024, time.Millisecond*100)
+	tracker.Update(2, 2*1024*1024, time.Millisecond*100)
+	tracker.Finish()
+
+	output := buf.String()
+	for _, want := range []string{"Layer 1: [", "Layer 2: [", "2/2 layers", "\x1b[2K"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected multi-line output to contain %q", want)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	var buf bytes.Buffer
+	tracker := New(2, 4*1024*1024)
+	tracker.out = &buf
+	tracker.multiLine = true
+
+	tracker.Start(1, 2*1024*1024)
+	tracker.Start(2, 2*1024*1024)
+	tracker.Advance(1, 1024*1024)
+	tracker.Advance(2, 1024*1024)
+	buf.Reset()
+	tracker.Stop()
+
+	// The in-flight lines are cleared, the cursor is moved back up to the aggregate line, and a
+	// newline leaves it below the display
+	output := buf.String()
+	if strings.Contains(output, "Layer 1: [") || !strings.Contains(output, "0/2 layers") || !strings.HasSuffix(output, "\x1b[2A\n") {
+		t.Errorf("Unexpected output stopping the display: %q", output)
+	}
+	if strings.Contains(output, "completed") {
+		t.Errorf("Expected no summary after stopping, got %q", output)
+	}
+
+	// Stopping again, or without a display, writes nothing
+	buf.Reset()
+	tracker.Stop()
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing written stopping twice, got %q", buf.String())
+	}
+}
+
+func TestRenderSummary(t *testing.T) {
+	tracker := New(12, 4*1024*1024*1024)
+	tracker.out = io.Discard
+	tracker.multiLine = false
+	for i := 1; i <= 12; i++ {
+		tracker.Update(i, 4*1024*1024*1024/12, time.Second)
+	}
+
+	summary := tracker.renderSummary(64 * time.Second)
+	for _, want := range []string{"12/12 layers", "4.00 GiB", "in 1m4s", "64.00 MiB/s", strings.Repeat("█", 30)} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("Expected summary to contain %q, got %q", want, summary)
+		}
+	}
+	if strings.ContainsAny(summary, "\r\n") {
+		t.Errorf("Expected a single static line, got %q", summary)
+	}
+
+	// Finish prints the summary when the output is not a terminal
+	var buf bytes.Buffer
+	tracker.out = &buf
+	tracker.Finish()
+	if !strings.Contains(buf.String(), "12/12 layers, 4.00 GiB in") {
+		t.Errorf("Expected Finish to print the summary, got %q", buf.String())
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	tracker := New(2, 6*1024*1024)
+	tracker.out = &buf
+	tracker.multiLine = true
+	tracker.SetFormat(FormatJSON)
+
+	tracker.Start(1, 2*1024*1024)
+	tracker.Start(2, 4*1024*1024)
+	tracker.Advance(1, 2*1024*1024)
+	tracker.Advance(2, 1024*1024)
+	tracker.Update(1, 2*1024*1024, 150*time.Millisecond)
+	tracker.Advance(2, 3*1024*1024)
+	tracker.Update(2, 4*1024*1024, 250*time.Millisecond)
+	tracker.Finish()
+
+	if strings.ContainsAny(buf.String(), "\r\x1b") {
+		t.Errorf("Expected no bar output in JSON mode, got %q", buf.String())
+	}
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("Expected 2 layer lines and a summary, got %d lines", len(lines))
+	}
+
+	// JSON numbers unmarshal as float64
+	first := lines[0]
+	expected := map[string]float64{
+		"layer":             1,
+		"completed_layers":  1,
+		"total_layers":      2,
+		"completed_bytes":   3 * 1024 * 1024, // Includes the part of layer 2 written so far
+		"total_bytes":       6 * 1024 * 1024,
+		"layer_duration_ms": 150,
+	}
+	if first["event"] != "layer" {
+		t.Errorf("Expected a layer event, got %v", first["event"])
+	}
+	for key, want := range expected {
+		if got, ok := first[key].(float64); !ok || got != want {
+			t.Errorf("Expected %s %v, got %v", key, want, first[key])
+		}
+	}
+	if _, ok := first["eta_seconds"].(float64); !ok {
+		t.Errorf("Expected eta_seconds, got %v", first["eta_seconds"])
+	}
+
+	summary := lines[2]
+	if summary["event"] != "summary" || summary["completed_layers"] != float64(2) || summary["completed_bytes"] != float64(6*1024*1024) {
+		t.Errorf("Unexpected summary %v", summary)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, s := range []string{"bar", "json"} {
+		if format, err := ParseFormat(s); err != nil || string(format) != s {
+			t.Errorf("ParseFormat(%q) = %q, %v", s, format, err)
+		}
+	}
+	if _, err := ParseFormat("plain"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+// nonTerminal is an output writer that is not an *os.File, so it is never a terminal
+type nonTerminal struct {
+	bytes.Buffer
+}
+
+func TestNonTerminalOutput(t *testing.T) {
+	out := &nonTerminal{}
+	tracker := New(2, 4*1024*1024)
+	tracker.SetOutput(out)
+
+	tracker.Start(1, 2*1024*1024)
+	tracker.Start(2, 2*1024*1024)
+	tracker.Advance(1, 1024*1024)
+	tracker.Update(1, 2*1024*1024, time.Millisecond*100)
+	tracker.Update(2, 2*1024*1024, time.Millisecond*100)
+	tracker.Finish()
+
+	output := out.String()
+	if strings.ContainsAny(output, "\r\x1b") {
+		t.Errorf("Expected no carriage returns or escape codes, got %q", output)
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected a line per update plus the summary and completion lines, got %q", output)
+	}
+	if !strings.Contains(lines[0], "Layer 1: 50.0%") || !strings.Contains(lines[2], "2/2 layers") {
+		t.Errorf("Unexpected status lines %q", lines)
+	}
+}
+
+func TestDisableBar(t *testing.T) {
+	var buf bytes.Buffer
+	tracker := New(1, 1024)
+	tracker.out = &buf
+	tracker.multiLine = true
+	tracker.DisableBar()
+
+	tracker.Start(1, 1024)
+	tracker.Update(1, 1024, time.Millisecond)
+	tracker.Finish()
+	if strings.ContainsAny(buf.String(), "\r\x1b") {
+		t.Errorf("Expected plain status lines with the bar disabled, got %q", buf.String())
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	const layers = 200
+	out := &nonTerminal{}
+	tracker := New(layers, layers*1024)
+	tracker.SetOutput(out)
+
+	// Run with -race: every worker renders through the same tracker
+	var wg sync.WaitGroup
+	for i := 1; i <= layers; i++ {
+		wg.Add(1)
+		go func(layerNum int) {
+			defer wg.Done()
+			tracker.Start(layerNum, 1024)
+			tracker.Advance(layerNum, 512)
+			tracker.Update(layerNum, 1024, time.Millisecond)
+		}(i)
+	}
+	wg.Wait()
+	tracker.Finish()
+
+	if done := tracker.DoneBytes(); done != layers*1024 {
+		t.Errorf("Expected %d bytes done, got %d", layers*1024, done)
+	}
+
+	// Every line is whole: a status line, the summary, or the completion line
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) < layers+2 {
+		t.Fatalf("Expected at least %d lines, got %d", layers+2, len(lines))
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if !strings.HasPrefix(line, "[") || strings.Count(line, "[") != 1 {
+			t.Errorf("Expected a single coherent status line, got %q", line)
+		}
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "✅ All layers completed") {
+		t.Errorf("Expected the completion line last, got %q", lines[len(lines)-1])
+	}
+}
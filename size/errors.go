@@ -0,0 +1,78 @@
+package size
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by Parse and the other parsers, wrapped in a *ParseError naming the input.
+// Check for them with errors.Is.
+var (
+	ErrEmptySize         = errors.New("empty size string")
+	ErrInvalidNumber     = errors.New("invalid number")
+	ErrUnknownUnit       = errors.New("unknown unit")
+	ErrTooLarge          = errors.New("size is too large")
+	ErrInvalidExpression = errors.New("invalid size expression")
+)
+
+// ErrorKind says why a size failed to parse
+type ErrorKind int
+
+const (
+	KindEmpty             ErrorKind = iota // The size is empty or only whitespace
+	KindInvalidNumber                      // The number before the unit is malformed
+	KindUnknownUnit                        // The number is followed by a suffix that isn't a unit
+	KindTooLarge                           // The size overflows an int64
+	KindInvalidExpression                  // A size expression is malformed or negative
+)
+
+// sentinel returns the error matching k with errors.Is
+func (k ErrorKind) sentinel() error {
+	switch k {
+	case KindEmpty:
+		return ErrEmptySize
+	case KindInvalidNumber:
+		return ErrInvalidNumber
+	case KindUnknownUnit:
+		return ErrUnknownUnit
+	case KindTooLarge:
+		return ErrTooLarge
+	default:
+		return ErrInvalidExpression
+	}
+}
+
+// String returns a short description of k
+func (k ErrorKind) String() string {
+	return k.sentinel().Error()
+}
+
+// ParseError reports a size that could not be parsed. It unwraps to the Err sentinel for its
+// Kind, so errors.Is(err, ErrUnknownUnit) works however deeply the error is wrapped.
+type ParseError struct {
+	Input  string    // The offending size, literal, or expression
+	Kind   ErrorKind // Why it failed to parse
+	Detail string    // More about the failure, e.g. the unknown unit (may be empty)
+}
+
+func (e *ParseError) Error() string {
+	switch e.Kind {
+	case KindEmpty:
+		return "empty size string"
+	case KindInvalidNumber:
+		return fmt.Sprintf("invalid size format: %s", e.Input)
+	case KindUnknownUnit:
+		return fmt.Sprintf("invalid size format: %s (unknown unit %q)", e.Input, e.Detail)
+	case KindTooLarge:
+		return fmt.Sprintf("size %s is too large", e.Input)
+	}
+	if e.Detail != "" {
+		return fmt.Sprintf("invalid size expression %q: %s", e.Input, e.Detail)
+	}
+	return fmt.Sprintf("invalid size expression %q", e.Input)
+}
+
+// Unwrap returns the sentinel error for e's Kind
+func (e *ParseError) Unwrap() error {
+	return e.Kind.sentinel()
+}
@@ -0,0 +1,233 @@
+package size
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// value is an intermediate result while evaluating a size expression. Bare numbers without
+// a unit are scalars, so "4*256MB" multiplies a size by a count rather than two sizes.
+type value struct {
+	bytes  int64
+	scalar float64 // Exact value of a scalar, which may be fractional (e.g. "1.5*1GB")
+	unit   bool    // Whether the value is a size with a unit rather than a bare number
+}
+
+// ParseExpr evaluates a size expression such as "512MB+512MB", "1GB-100MB", or "4*(256MB+1KB)"
+// into bytes. Expressions combine size literals (as accepted by Parse) with +, -, *, and
+// parentheses, with * binding tighter than + and -. At least one side of a * must be a bare
+// number, and the result must not be negative or overflow.
+func ParseExpr(expr string) (int64, error) {
+	return parseExpr(expr, Binary)
+}
+
+// parseExpr evaluates a size expression, reading SI-style suffixes as powers of base
+func parseExpr(expr string, base int64) (int64, error) {
+	if strings.TrimSpace(expr) == "" {
+		return 0, &ParseError{Input: expr, Kind: KindEmpty}
+	}
+
+	p := &exprParser{tokens: tokenize(expr), base: base}
+	if len(p.tokens) == 1 {
+		// A bare literal keeps the literal parser's error messages
+		return parseLiteral(p.tokens[0], base)
+	}
+
+	v, err := p.parseSum()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		// Keep the kind of a bad literal, and of an overflow
+		var literalErr *ParseError
+		switch {
+		case errors.As(err, &literalErr):
+			return 0, fmt.Errorf("invalid size expression %q: %w", expr, err)
+		case errors.Is(err, ErrTooLarge):
+			return 0, &ParseError{Input: expr, Kind: KindTooLarge}
+		}
+		return 0, &ParseError{Input: expr, Kind: KindInvalidExpression, Detail: err.Error()}
+	}
+	if v.bytes < 0 {
+		return 0, &ParseError{Input: expr, Kind: KindInvalidExpression, Detail: "size is negative"}
+	}
+	return v.bytes, nil
+}
+
+// tokenize splits expr into operators, parentheses, and size literals, dropping whitespace.
+// A number followed by whitespace and a unit, as in "512 KB", is kept as one literal, as is a
+// number followed by any other word, so "512 XB" is reported as an unknown unit.
+func tokenize(expr string) []string {
+	var tokens []string
+	literal := -1
+	for i, r := range expr {
+		isOp := strings.ContainsRune("+-*()", r)
+		isSpace := r == ' ' || r == '\t'
+		if (isOp || isSpace) && literal >= 0 {
+			tokens = append(tokens, expr[literal:i])
+			literal = -1
+		}
+		switch {
+		case isOp:
+			tokens = append(tokens, string(r))
+		case !isSpace && literal < 0:
+			literal = i
+		}
+	}
+	if literal >= 0 {
+		tokens = append(tokens, expr[literal:])
+	}
+
+	// Only whitespace separates two literals, so rejoin a number and the unit (or word) after it
+	merged := tokens[:0]
+	for i := 0; i < len(tokens); i++ {
+		if i+1 < len(tokens) && isWord(tokens[i+1]) {
+			if _, err := strconv.ParseFloat(tokens[i], 64); err == nil {
+				merged = append(merged, tokens[i]+tokens[i+1])
+				i++
+				continue
+			}
+		}
+		merged = append(merged, tokens[i])
+	}
+	return merged
+}
+
+// isWord reports whether token is made only of letters, like the unit suffixes "KB" or "mib"
+func isWord(token string) bool {
+	for _, r := range token {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return token != ""
+}
+
+// exprParser is a recursive descent parser over the tokens of a size expression
+type exprParser struct {
+	tokens []string
+	pos    int
+	base   int64 // Base for SI-style suffixes
+}
+
+// next returns the next token without consuming it, or "" at the end of the expression
+func (p *exprParser) next() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// parseSum parses terms separated by + and -
+func (p *exprParser) parseSum() (value, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return value{}, err
+	}
+	for op := p.next(); op == "+" || op == "-"; op = p.next() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return value{}, err
+		}
+		if left, err = add(left, right, op == "-"); err != nil {
+			return value{}, err
+		}
+	}
+	return left, nil
+}
+
+// parseProduct parses factors separated by *
+func (p *exprParser) parseProduct() (value, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return value{}, err
+	}
+	for p.next() == "*" {
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return value{}, err
+		}
+		if left, err = multiply(left, right); err != nil {
+			return value{}, err
+		}
+	}
+	return left, nil
+}
+
+// parseFactor parses a size literal or a parenthesized expression
+func (p *exprParser) parseFactor() (value, error) {
+	token := p.next()
+	switch token {
+	case "":
+		return value{}, fmt.Errorf("expected a size at end of expression")
+	case "(":
+		p.pos++
+		v, err := p.parseSum()
+		if err != nil {
+			return value{}, err
+		}
+		if p.next() != ")" {
+			return value{}, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return v, nil
+	case "+", "-", "*", ")":
+		return value{}, fmt.Errorf("expected a size, got %q", token)
+	}
+
+	p.pos++
+	bytes, err := parseLiteral(token, p.base)
+	if err != nil {
+		return value{}, err
+	}
+	if n, err := strconv.ParseFloat(token, 64); err == nil {
+		return value{bytes: bytes, scalar: n}, nil
+	}
+	return value{bytes: bytes, unit: true}, nil
+}
+
+// errOverflow is returned when evaluating an expression overflows an int64
+var errOverflow = fmt.Errorf("size overflows: %w", ErrTooLarge)
+
+// add returns a+b, or a-b when subtract is set
+func add(a, b value, subtract bool) (value, error) {
+	if subtract {
+		if b.bytes == math.MinInt64 {
+			return value{}, errOverflow
+		}
+		b.bytes, b.scalar = -b.bytes, -b.scalar
+	}
+	sum := a.bytes + b.bytes
+	if (b.bytes > 0 && sum < a.bytes) || (b.bytes < 0 && sum > a.bytes) {
+		return value{}, errOverflow
+	}
+	return value{bytes: sum, scalar: a.scalar + b.scalar, unit: a.unit || b.unit}, nil
+}
+
+// multiply returns a*b, where at least one of a and b must be a bare number
+func multiply(a, b value) (value, error) {
+	if a.unit && b.unit {
+		return value{}, fmt.Errorf("cannot multiply two sizes")
+	}
+	if a.unit {
+		a, b = b, a
+	}
+
+	// a is now a scalar; b may be a size or another scalar
+	var product float64
+	if b.unit {
+		product = a.scalar * float64(b.bytes)
+	} else {
+		product = a.scalar * b.scalar
+	}
+	if product >= math.MaxInt64 || product <= math.MinInt64 {
+		return value{}, errOverflow
+	}
+	return value{bytes: int64(product), scalar: product, unit: b.unit}, nil
+}
@@ -0,0 +1,66 @@
+package size
+
+import (
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		hasError bool
+	}{
+		// Bare literals
+		{"512MB", 512 * MB, false},
+		{"8150", 8150, false},
+
+		// Arithmetic
+		{"512MB+512MB", 1 * GB, false},
+		{"1GB-100MB", 1*GB - 100*MB, false},
+		{"4*256MB", 1 * GB, false},
+		{"256MB*4", 1 * GB, false},
+		{"1.5*1GB", int64(1.5 * GB), false},
+		{" 1GB + 1KB ", 1*GB + 1*KB, false},
+
+		// Precedence and parentheses
+		{"1GB+2*1MB", 1*GB + 2*MB, false},
+		{"2*1MB+1GB", 1*GB + 2*MB, false},
+		{"(1GB+1MB)*2", 2*GB + 2*MB, false},
+		{"2*(1+1)*1KB", 4 * KB, false},
+		{"1GB-100MB-100MB", 1*GB - 200*MB, false},
+		{"1GB-(100MB-100MB)", 1 * GB, false},
+
+		// Errors
+		{"1GB+", 0, true},
+		{"+1GB", 0, true},
+		{"1GB++1MB", 0, true},
+		{"(1GB", 0, true},
+		{"1GB)", 0, true},
+		{"()", 0, true},
+		{"1MB*1MB", 0, true},
+		{"100MB-1GB", 0, true},
+		{"1GB 1MB", 0, true},
+		{"1GB+invalid", 0, true},
+		{"9000000000GB", 0, true},
+		{"8000000000GB+1000000000GB", 0, true},
+		{"9000000000*9000000000", 0, true},
+		{"nan", 0, true},
+	}
+
+	for _, test := range tests {
+		result, err := ParseExpr(test.input)
+
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected error for input %q, but got %d", test.input, result)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Unexpected error for input %q: %v", test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("For input %q, expected %d, got %d", test.input, test.expected, result)
+			}
+		}
+	}
+}
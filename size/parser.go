@@ -1,9 +1,13 @@
 package size
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 // Constants for size units
@@ -11,98 +15,345 @@ const (
 	KB = 1024
 	MB = 1024 * KB
 	GB = 1024 * MB
+	TB = 1024 * GB
+	PB = 1024 * TB
 )
 
-// Parse parses a string like "512KB", "1.5MB", "2.75GB", "8150", "8B" into bytes
+// Bases for the KB, MB, GB, TB, and PB suffixes. The IEC suffixes KiB, MiB, GiB, TiB, and PiB
+// are always powers of 1024.
+const (
+	Binary  = 1024 // KB is 1024 bytes, as imgmkr has always read it (the default)
+	Decimal = 1000 // KB is 1000 bytes, as in SI and most registry tooling
+)
+
+// units lists the accepted size suffixes as powers of the base, or of 1024 for IEC suffixes.
+// Longer suffixes come first so that "KB" is not matched as "B".
+var units = []struct {
+	suffix string
+	power  int
+	iec    bool
+}{
+	{"BYTES", 0, false},
+	{"BYTE", 0, false},
+	{"KIB", 1, true},
+	{"MIB", 2, true},
+	{"GIB", 3, true},
+	{"TIB", 4, true},
+	{"PIB", 5, true},
+	{"KB", 1, false},
+	{"MB", 2, false},
+	{"GB", 3, false},
+	{"TB", 4, false},
+	{"PB", 5, false},
+	{"B", 0, false},
+	{"K", 1, false},
+	{"M", 2, false},
+	{"G", 3, false},
+	{"T", 4, false},
+	{"P", 5, false},
+}
+
+// Parse parses a string like "512KB", "1.5MB", "2.75GB", "2TB", "4MiB", "8150", "8B" into bytes,
+// reading KB and the other SI-style suffixes as powers of 1024. Sizes may also be written as
+// expressions such as "1GB-100MB" (see ParseExpr).
 func Parse(sizeStr string) (int64, error) {
+	return ParseExpr(sizeStr)
+}
+
+// ParseWithBase parses a size like Parse, reading KB, MB, GB, TB, and PB as powers of base,
+// which must be Binary or Decimal. IEC suffixes such as MiB are powers of 1024 with either base.
+func ParseWithBase(sizeStr string, base int64) (int64, error) {
+	if err := checkBase(base); err != nil {
+		return 0, err
+	}
+	return parseExpr(sizeStr, base)
+}
+
+// checkBase checks that base is Binary or Decimal
+func checkBase(base int64) error {
+	if base != Binary && base != Decimal {
+		return fmt.Errorf("invalid size base %d: must be %d or %d", base, Binary, Decimal)
+	}
+	return nil
+}
+
+// ParseBase parses the name of a size base, "binary" or "decimal", as for --size-base
+func ParseBase(name string) (int64, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "binary":
+		return Binary, nil
+	case "decimal":
+		return Decimal, nil
+	}
+	return 0, fmt.Errorf("unknown size base %q: must be binary or decimal", name)
+}
+
+// BaseName returns the name ParseBase reads as base
+func BaseName(base int64) string {
+	if base == Decimal {
+		return "decimal"
+	}
+	return "binary"
+}
+
+// parseLiteral parses a single size literal like "512KB" or "8150" into bytes, reading SI-style
+// suffixes as powers of base
+func parseLiteral(sizeStr string, base int64) (int64, error) {
 	sizeStr = strings.TrimSpace(sizeStr)
 	if sizeStr == "" {
-		return 0, fmt.Errorf("empty size string")
+		return 0, &ParseError{Input: sizeStr, Kind: KindEmpty}
 	}
 
-	// Convert to uppercase for easier matching
+	// Find the unit suffix (case-insensitive); no suffix means bytes
 	upperStr := strings.ToUpper(sizeStr)
-
-	// Check for size suffixes (case-insensitive, with variations)
 	var multiplier float64 = 1
-	var numStr string
-
-	// Bytes: B, b, bytes (or no suffix)
-	if strings.HasSuffix(upperStr, "B") && !strings.HasSuffix(upperStr, "KB") && !strings.HasSuffix(upperStr, "MB") && !strings.HasSuffix(upperStr, "GB") {
-		multiplier = 1
-		numStr = sizeStr[:len(sizeStr)-1]
-	} else if strings.HasSuffix(upperStr, "BYTES") {
-		multiplier = 1
-		numStr = sizeStr[:len(sizeStr)-5]
-	} else if strings.HasSuffix(upperStr, "BYTE") {
-		multiplier = 1
-		numStr = sizeStr[:len(sizeStr)-4]
-		// Kilobytes: KB, K, kb, k
-	} else if strings.HasSuffix(upperStr, "KB") {
-		multiplier = float64(KB)
-		numStr = sizeStr[:len(sizeStr)-2]
-	} else if strings.HasSuffix(upperStr, "K") {
-		multiplier = float64(KB)
-		numStr = sizeStr[:len(sizeStr)-1]
-		// Megabytes: MB, M, mb, m
-	} else if strings.HasSuffix(upperStr, "MB") {
-		multiplier = float64(MB)
-		numStr = sizeStr[:len(sizeStr)-2]
-	} else if strings.HasSuffix(upperStr, "M") {
-		multiplier = float64(MB)
-		numStr = sizeStr[:len(sizeStr)-1]
-		// Gigabytes: GB, G, gb, g
-	} else if strings.HasSuffix(upperStr, "GB") {
-		multiplier = float64(GB)
-		numStr = sizeStr[:len(sizeStr)-2]
-	} else if strings.HasSuffix(upperStr, "G") {
-		multiplier = float64(GB)
-		numStr = sizeStr[:len(sizeStr)-1]
-	} else {
-		// No suffix - assume bytes
-		numStr = sizeStr
+	numStr := sizeStr
+	for _, unit := range units {
+		if strings.HasSuffix(upperStr, unit.suffix) {
+			unitBase := base
+			if unit.iec {
+				unitBase = Binary
+			}
+			multiplier = math.Pow(float64(unitBase), float64(unit.power))
+			numStr = sizeStr[:len(sizeStr)-len(unit.suffix)]
+			break
+		}
 	}
 
 	// Parse the numeric part as float64 to handle decimal values
 	size, err := strconv.ParseFloat(numStr, 64)
-	if err != nil {
-		return 0, fmt.Errorf("invalid size format: %s", sizeStr)
+	if err != nil || math.IsNaN(size) {
+		if unit := unknownUnit(sizeStr); unit != "" {
+			return 0, &ParseError{Input: sizeStr, Kind: KindUnknownUnit, Detail: unit}
+		}
+		return 0, &ParseError{Input: sizeStr, Kind: KindInvalidNumber}
 	}
 
 	// Convert to int64 after multiplication
+	if size*multiplier >= math.MaxInt64 {
+		return 0, &ParseError{Input: sizeStr, Kind: KindTooLarge}
+	}
 	return int64(size * multiplier), nil
 }
 
-// ParseList parses a comma-separated list of sizes
+// unknownUnit returns the suffix of a size literal like "1.5XB" when it is a valid number followed
+// by letters that aren't a unit, or "" otherwise
+func unknownUnit(sizeStr string) string {
+	numStr := strings.TrimRightFunc(sizeStr, unicode.IsLetter)
+	if numStr == "" || numStr == sizeStr {
+		return ""
+	}
+	if _, err := strconv.ParseFloat(strings.TrimSpace(numStr), 64); err != nil {
+		return ""
+	}
+	return sizeStr[len(numStr):]
+}
+
+// maxRepeat is the largest repetition count ParseList accepts for one entry
+const maxRepeat = 10000
+
+// ParseList parses a comma-separated list of sizes. An entry may repeat a size, as in
+// "512MB x 20" or "512MB*20", which expands to twenty entries of 512MB.
 func ParseList(sizesStr string) ([]int64, error) {
+	return ParseListWithBase(sizesStr, Binary)
+}
+
+// ParseListWithBase parses a list of sizes like ParseList, reading each size as ParseWithBase does
+func ParseListWithBase(sizesStr string, base int64) ([]int64, error) {
+	if err := checkBase(base); err != nil {
+		return nil, err
+	}
 	if sizesStr == "" {
 		return nil, fmt.Errorf("layer sizes cannot be empty")
 	}
 
-	sizeStrs := strings.Split(sizesStr, ",")
-	sizes := make([]int64, len(sizeStrs))
-
-	for i, sizeStr := range sizeStrs {
-		size, err := Parse(sizeStr)
+	var sizes []int64
+	for _, entry := range strings.Split(sizesStr, ",") {
+		sizeStr, count, err := parseRepeat(entry, base)
+		if err != nil {
+			return nil, err
+		}
+		size, err := parseExpr(sizeStr, base)
 		if err != nil {
 			return nil, err
 		}
-		sizes[i] = size
+		for i := 0; i < count; i++ {
+			sizes = append(sizes, size)
+		}
 	}
 
 	return sizes, nil
 }
 
-// Format formats a size in bytes to a human-readable string
-func Format(size int64) string {
-	switch {
-	case size >= GB:
-		return fmt.Sprintf("%.2f GB", float64(size)/float64(GB))
-	case size >= MB:
-		return fmt.Sprintf("%.2f MB", float64(size)/float64(MB))
-	case size >= KB:
-		return fmt.Sprintf("%.2f KB", float64(size)/float64(KB))
-	default:
+// ReadList reads sizes from r, one per line, as for --layer-sizes-file. Blank lines and lines
+// starting with # are skipped, and a line may repeat a size as in ParseList (e.g. "512MB x 20").
+// Errors name the offending line.
+func ReadList(r io.Reader) ([]int64, error) {
+	return ReadListWithBase(r, Binary)
+}
+
+// ReadListWithBase reads sizes like ReadList, reading each size as ParseWithBase does
+func ReadListWithBase(r io.Reader, base int64) ([]int64, error) {
+	if err := checkBase(base); err != nil {
+		return nil, err
+	}
+	var sizes []int64
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sizeStr, count, err := parseRepeat(line, base)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		size, err := parseExpr(sizeStr, base)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		for i := 0; i < count; i++ {
+			sizes = append(sizes, size)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no sizes found")
+	}
+	return sizes, nil
+}
+
+// parseRepeat splits a list entry into its size and repetition count. Repetition is written
+// "<size> x <count>" for any size, or "<size>*<count>" when the size is a single literal with a
+// unit, so expressions such as "(1GB+1MB)*2", "4*256MB", and "256MB*1.5" still multiply. An x
+// only repeats when it follows a valid size and precedes a whole number, so entries such as
+// "5XB" and "0x10" are left to fail as sizes. Sizes are read in base.
+func parseRepeat(entry string, base int64) (string, int, error) {
+	var sizeStr, countStr string
+	if i := strings.LastIndexAny(entry, "xX"); i >= 0 && isRepeatedSize(entry[:i], entry[i+1:], base) {
+		sizeStr, countStr = entry[:i], entry[i+1:]
+	} else if i := strings.LastIndex(entry, "*"); i >= 0 && isRepeatedLiteral(entry[:i], entry[i+1:]) {
+		sizeStr, countStr = entry[:i], entry[i+1:]
+	} else {
+		return entry, 1, nil
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid repetition count in %q: must be a whole number", strings.TrimSpace(entry))
+	}
+	if count <= 0 || count > maxRepeat {
+		return "", 0, fmt.Errorf("invalid repetition count in %q: must be between 1 and %d", strings.TrimSpace(entry), maxRepeat)
+	}
+	return sizeStr, count, nil
+}
+
+// isRepeatedSize reports whether "<sizeStr>x<countStr>" repeats a size: sizeStr parses as a size
+// and countStr is an integer. A 0 written right before the x reads as a hex prefix, not a size.
+func isRepeatedSize(sizeStr, countStr string, base int64) bool {
+	if _, err := strconv.Atoi(strings.TrimSpace(countStr)); err != nil {
+		return false
+	}
+	if strings.TrimLeft(sizeStr, " \t") == "0" {
+		return false
+	}
+	_, err := parseExpr(sizeStr, base)
+	return err == nil
+}
+
+// isRepeatedLiteral reports whether "<sizeStr>*<countStr>" repeats a size rather than
+// multiplying it: sizeStr is a single literal with a unit and countStr is an integer
+func isRepeatedLiteral(sizeStr, countStr string) bool {
+	tokens := tokenize(sizeStr)
+	if len(tokens) != 1 {
+		return false
+	}
+	if _, err := strconv.ParseFloat(tokens[0], 64); err == nil {
+		return false
+	}
+	_, err := strconv.ParseInt(strings.TrimSpace(countStr), 10, 64)
+	return err == nil
+}
+
+// ParseRange parses a size range like "1MB-5MB" into its inclusive bounds. Each bound is
+// parsed by Parse, so a bound may be an expression, but not one using "-".
+func ParseRange(rangeStr string) (min, max int64, err error) {
+	return ParseRangeWithBase(rangeStr, Binary)
+}
+
+// ParseRangeWithBase parses a size range like ParseRange, reading each bound as ParseWithBase does
+func ParseRangeWithBase(rangeStr string, base int64) (min, max int64, err error) {
+	if err := checkBase(base); err != nil {
+		return 0, 0, err
+	}
+	if strings.Count(rangeStr, "-") != 1 {
+		return 0, 0, fmt.Errorf("invalid size range %q: expected <min>-<max>, e.g. 1MB-5MB", rangeStr)
+	}
+	minStr, maxStr, _ := strings.Cut(rangeStr, "-")
+	if min, err = parseExpr(minStr, base); err != nil {
+		return 0, 0, fmt.Errorf("invalid size range %q: %w", rangeStr, err)
+	}
+	if max, err = parseExpr(maxStr, base); err != nil {
+		return 0, 0, fmt.Errorf("invalid size range %q: %w", rangeStr, err)
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("invalid size range %q: minimum %s is greater than maximum %s", rangeStr, Format(min), Format(max))
+	}
+	return min, max, nil
+}
+
+// ParseRate parses a throughput like "50MB/s" into bytes per second. The "/s" suffix is optional.
+func ParseRate(rateStr string) (int64, error) {
+	return ParseRateWithBase(rateStr, Binary)
+}
+
+// ParseRateWithBase parses a throughput like ParseRate, reading the size as ParseWithBase does
+func ParseRateWithBase(rateStr string, base int64) (int64, error) {
+	if err := checkBase(base); err != nil {
+		return 0, err
+	}
+	rateStr = strings.TrimSpace(rateStr)
+	upperStr := strings.ToUpper(rateStr)
+	for _, suffix := range []string{"/SEC", "/S"} {
+		if strings.HasSuffix(upperStr, suffix) {
+			rateStr = rateStr[:len(rateStr)-len(suffix)]
+			break
+		}
+	}
+
+	bytesPerSecond, err := parseExpr(rateStr, base)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate: %w", err)
+	}
+	if bytesPerSecond <= 0 {
+		return 0, fmt.Errorf("rate must be greater than zero")
+	}
+	return bytesPerSecond, nil
+}
+
+// FormatWithBase formats a size in bytes like Format, in units that are powers of base: KB, MB,
+// and so on for Decimal, or the unambiguous KiB, MiB, and so on for Binary
+func FormatWithBase(size int64, base int64) string {
+	suffixes := []string{"KB", "MB", "GB", "TB", "PB"}
+	if base != Decimal {
+		base = Binary
+		suffixes = []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	}
+	if size < base {
 		return fmt.Sprintf("%d bytes", size)
 	}
+	value, i := float64(size)/float64(base), 0
+	for ; value >= float64(base) && i < len(suffixes)-1; i++ {
+		value /= float64(base)
+	}
+	return fmt.Sprintf("%.2f %s", value, suffixes[i])
+}
+
+// Format formats a size in bytes to a human-readable string, in powers of 1024 labeled with the
+// IEC units KiB, MiB, and so on, which Parse reads the same way whatever its base
+func Format(size int64) string {
+	return FormatWithBase(size, Binary)
 }
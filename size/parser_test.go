@@ -1,6 +1,9 @@
 package size
 
 import (
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -41,6 +44,43 @@ func TestParse(t *testing.T) {
 		{"2.75GB", int64(2.75 * GB), false},
 		{"1.5G", int64(1.5 * GB), false},
 
+		// Terabytes and petabytes
+		{"2TB", 2 * TB, false},
+		{"2tb", 2 * TB, false},
+		{"2T", 2 * TB, false},
+		{"1.5t", int64(1.5 * TB), false},
+		{"1PB", 1 * PB, false},
+		{"1pb", 1 * PB, false},
+		{"1P", 1 * PB, false},
+		{"0.5p", PB / 2, false},
+		{"8191PB", 8191 * PB, false},
+		{"10000PB", 0, true},
+		{"8192PB", 0, true},
+
+		// IEC binary units
+		{"512KiB", 512 * KB, false},
+		{"1MiB", 1 * MB, false},
+		{"1mib", 1 * MB, false},
+		{"1.5GiB", int64(1.5 * GB), false},
+		{"2TiB", 2 * TB, false},
+		{"1PiB", 1 * PB, false},
+		{"1MB+1MiB", 2 * MB, false},
+		{"1Mi", 0, true},
+
+		// Whitespace between the number and unit
+		{"512 KB", 512 * KB, false},
+		{" 512 kb ", 512 * KB, false},
+		{"1.5 GB", int64(1.5 * GB), false},
+		{"1.5\tGiB", int64(1.5 * GB), false},
+		{"8  bytes", 8, false},
+		{"1 GB - 100 MB", 1*GB - 100*MB, false},
+		{"2 * 512 MB", 1 * GB, false},
+		{"5 1 2KB", 0, true},
+		{"512 K B", 0, true},
+		{"512 XB", 0, true},
+		{"KB 512", 0, true},
+		{"1GB MB", 0, true},
+
 		// Edge cases and errors
 		{"1024", 1024, false},
 		{"0", 0, false},
@@ -69,6 +109,77 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  error
+		kind  ErrorKind
+	}{
+		{"", ErrEmptySize, KindEmpty},
+		{"   ", ErrEmptySize, KindEmpty},
+		{"invalid", ErrInvalidNumber, KindInvalidNumber},
+		{"MB", ErrInvalidNumber, KindInvalidNumber},
+		{"1.2.3MB", ErrInvalidNumber, KindInvalidNumber},
+		{"1.5XB", ErrUnknownUnit, KindUnknownUnit},
+		{"512 XB", ErrUnknownUnit, KindUnknownUnit},
+		{"10 parsecs", ErrUnknownUnit, KindUnknownUnit},
+		{"9000000PB", ErrTooLarge, KindTooLarge},
+		{"8000PB+8000PB", ErrTooLarge, KindTooLarge},
+		{"1MB+1XB", ErrUnknownUnit, KindUnknownUnit},
+		{"1MB-2MB", ErrInvalidExpression, KindInvalidExpression},
+		{"(1MB", ErrInvalidExpression, KindInvalidExpression},
+		{"1MB*1MB", ErrInvalidExpression, KindInvalidExpression},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.input)
+		if !errors.Is(err, test.want) {
+			t.Errorf("For input %q, expected an error matching %v, got %v", test.input, test.want, err)
+			continue
+		}
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("For input %q, expected a *ParseError, got %T", test.input, err)
+			continue
+		}
+		if parseErr.Kind != test.kind {
+			t.Errorf("For input %q, expected kind %v, got %v", test.input, test.kind, parseErr.Kind)
+		}
+	}
+
+	// The offending input and unit are kept, and the kind survives wrapping
+	_, err := Parse("1.5XB")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Input != "1.5XB" || parseErr.Detail != "XB" {
+		t.Errorf("Expected the input and unknown unit to be recorded, got %+v", parseErr)
+	}
+	if err.Error() != `invalid size format: 1.5XB (unknown unit "XB")` {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+	if _, err := ReadList(strings.NewReader("1MB\n2QB\n")); !errors.Is(err, ErrUnknownUnit) {
+		t.Errorf("Expected ReadList to wrap the parse error, got %v", err)
+	}
+	// An x in a unit or hex-like number isn't a repetition, so the size error comes through
+	for _, test := range []struct {
+		input string
+		want  error
+	}{
+		{"5XB", ErrUnknownUnit},
+		{"1MB,5XB", ErrUnknownUnit},
+		{"0x10", ErrInvalidNumber},
+	} {
+		if _, err := ParseList(test.input); !errors.Is(err, test.want) {
+			t.Errorf("Expected ParseList(%q) to return %v, got %v", test.input, test.want, err)
+		}
+	}
+	if _, err := ReadList(strings.NewReader("1MB\n5XB\n")); !errors.Is(err, ErrUnknownUnit) {
+		t.Errorf("Expected ReadList to return the unknown unit error for 5XB, got %v", err)
+	}
+	if _, _, err := ParseRange("1MB-"); !errors.Is(err, ErrEmptySize) {
+		t.Errorf("Expected ParseRange to wrap the parse error, got %v", err)
+	}
+}
+
 func TestParseList(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -77,6 +188,39 @@ func TestParseList(t *testing.T) {
 	}{
 		{"512KB,1MB,2GB", []int64{512 * KB, 1 * MB, 2 * GB}, false},
 		{"1MB", []int64{1 * MB}, false},
+		{"512MB+512MB,4*256MB", []int64{1 * GB, 1 * GB}, false},
+
+		// Repetition
+		{"512MB x 3", []int64{512 * MB, 512 * MB, 512 * MB}, false},
+		{"512MBx2", []int64{512 * MB, 512 * MB}, false},
+		{"0 x 2", []int64{0, 0}, false},
+		{"1KB X 2", []int64{1 * KB, 1 * KB}, false},
+		{"512MB*3", []int64{512 * MB, 512 * MB, 512 * MB}, false},
+		{"512 MB * 2", []int64{512 * MB, 512 * MB}, false},
+		{"1GB,512MB x 2,2MB", []int64{1 * GB, 512 * MB, 512 * MB, 2 * MB}, false},
+		{"1KB*2,2KB,3KB x 1", []int64{1 * KB, 1 * KB, 2 * KB, 3 * KB}, false},
+		{"(1GB+1MB) x 2", []int64{1*GB + 1*MB, 1*GB + 1*MB}, false},
+		{"8150 x 2", []int64{8150, 8150}, false},
+
+		// Products are still expressions
+		{"(1GB+1MB)*2", []int64{2*GB + 2*MB}, false},
+		{"2*512MB", []int64{1 * GB}, false},
+		{"1GB*1.5", []int64{int64(1.5 * GB)}, false},
+		{"8150*2", []int64{16300}, false},
+
+		// Malformed repetition
+		{"512MB x abc", nil, true},
+		{"512MB x 0", nil, true},
+		{"512MB x -1", nil, true},
+		{"512MB*0", nil, true},
+		{"512MB x", nil, true},
+		{"x 20", nil, true},
+		{"512MB x 1.5", nil, true},
+		{"512MB x 2 x 2", nil, true},
+		{"1MB x 100000", nil, true},
+		{"5XB", nil, true},
+		{"0x10", nil, true},
+		{"512MB*abc", nil, true},
 		{"", nil, true},
 		{"1MB,invalid", nil, true},
 	}
@@ -105,18 +249,277 @@ func TestParseList(t *testing.T) {
 	}
 }
 
+func TestReadList(t *testing.T) {
+	input := `# Layer sizes for the pull test
+512KB
+
+1MB   
+  # An indented comment
+2GB x 2
+8150
+`
+	sizes, err := ReadList(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []int64{512 * KB, 1 * MB, 2 * GB, 2 * GB, 8150}
+	if len(sizes) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, sizes)
+	}
+	for i := range expected {
+		if sizes[i] != expected[i] {
+			t.Errorf("Size %d: expected %d, got %d", i+1, expected[i], sizes[i])
+		}
+	}
+
+	// Errors name the line
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"1MB\n\n# comment\n2XB\n", "line 4"},
+		{"1MB\n512MB x abc\n", "line 2"},
+		{"", "no sizes"},
+		{"# only comments\n\n", "no sizes"},
+	}
+	for _, test := range tests {
+		_, err := ReadList(strings.NewReader(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("For %q, expected an error mentioning %q, got %v", test.input, test.want, err)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		hasError bool
+	}{
+		{"50MB/s", 50 * MB, false},
+		{"50mb/s", 50 * MB, false},
+		{"512KB/sec", 512 * KB, false},
+		{"1GB", 1 * GB, false},
+		{"1.5M/s", int64(1.5 * MB), false},
+		{"0MB/s", 0, true},
+		{"/s", 0, true},
+		{"fast", 0, true},
+	}
+
+	for _, test := range tests {
+		result, err := ParseRate(test.input)
+
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected error for input %q, but got none", test.input)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Unexpected error for input %q: %v", test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("For input %q, expected %d, got %d", test.input, test.expected, result)
+			}
+		}
+	}
+}
+
+func TestParseWithBase(t *testing.T) {
+	tests := []struct {
+		input    string
+		base     int64
+		expected int64
+		hasError bool
+	}{
+		{"1MB", Binary, 1024 * 1024, false},
+		{"1MiB", Binary, 1024 * 1024, false},
+		{"1MB", Decimal, 1000 * 1000, false},
+		{"1MiB", Decimal, 1024 * 1024, false},
+		{"512KB", Decimal, 512000, false},
+		{"512k", Decimal, 512000, false},
+		{"1.5GB", Decimal, 1500000000, false},
+		{"2TB", Decimal, 2000000000000, false},
+		{"1PB", Decimal, 1000000000000000, false},
+		{"8150", Decimal, 8150, false},
+		{"1GB-1GiB", Binary, 0, false},
+		{"1GiB-1GB", Decimal, 73741824, false},
+		{"2*1MB", Decimal, 2000000, false},
+		{"1MB", 1024 * 1024, 0, true},
+		{"1MB", 0, 0, true},
+		{"1XB", Decimal, 0, true},
+	}
+
+	for _, test := range tests {
+		result, err := ParseWithBase(test.input, test.base)
+
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected error for input %q base %d, but got none", test.input, test.base)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Unexpected error for input %q base %d: %v", test.input, test.base, err)
+			}
+			if result != test.expected {
+				t.Errorf("For input %q base %d, expected %d, got %d", test.input, test.base, test.expected, result)
+			}
+		}
+	}
+
+	// Parse keeps reading KB and friends as powers of 1024
+	for _, input := range []string{"1MB", "1MiB", "3GB-1KB"} {
+		want, _ := ParseWithBase(input, Binary)
+		if got, _ := Parse(input); got != want {
+			t.Errorf("Parse(%q) = %d, want %d", input, got, want)
+		}
+	}
+}
+
+func TestListsWithBase(t *testing.T) {
+	sizes, err := ParseListWithBase("1MB,1MiB,2KB x 2", Decimal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []int64{1000000, 1048576, 2000, 2000}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected %v, got %v", expected, sizes)
+	}
+
+	sizes, err = ReadListWithBase(strings.NewReader("# sizes\n1GB\n500MB x 2\n"), Decimal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []int64{1000000000, 500000000, 500000000}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected %v, got %v", expected, sizes)
+	}
+
+	min, max, err := ParseRangeWithBase("1MB-5MB", Decimal)
+	if err != nil || min != 1000000 || max != 5000000 {
+		t.Errorf("Expected 1000000-5000000, got %d-%d (err: %v)", min, max, err)
+	}
+
+	rate, err := ParseRateWithBase("50MB/s", Decimal)
+	if err != nil || rate != 50000000 {
+		t.Errorf("Expected 50000000, got %d (err: %v)", rate, err)
+	}
+
+	// Only the binary and decimal bases are accepted
+	if _, err := ParseListWithBase("1MB", 0); err == nil {
+		t.Errorf("Expected an error for base 0")
+	}
+	if _, err := ReadListWithBase(strings.NewReader("1MB"), 10); err == nil {
+		t.Errorf("Expected an error for base 10")
+	}
+	if _, _, err := ParseRangeWithBase("1MB-2MB", 0); err == nil {
+		t.Errorf("Expected an error for base 0")
+	}
+	if _, err := ParseRateWithBase("1MB/s", 0); err == nil {
+		t.Errorf("Expected an error for base 0")
+	}
+}
+
+func TestParseBase(t *testing.T) {
+	for name, expected := range map[string]int64{"binary": Binary, "decimal": Decimal, "Decimal": Decimal} {
+		base, err := ParseBase(name)
+		if err != nil || base != expected {
+			t.Errorf("ParseBase(%q) = %d, %v; expected %d", name, base, err, expected)
+		}
+		if BaseName(base) != strings.ToLower(name) {
+			t.Errorf("Expected BaseName(%d) to be %q, got %q", base, strings.ToLower(name), BaseName(base))
+		}
+	}
+	if _, err := ParseBase("si"); err == nil {
+		t.Errorf("Expected an error for an unknown base")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		input    string
+		min, max int64
+		hasError bool
+	}{
+		{"1MB-5MB", 1 * MB, 5 * MB, false},
+		{"512KB-1GB", 512 * KB, 1 * GB, false},
+		{" 1 MB - 5 MB ", 1 * MB, 5 * MB, false},
+		{"0-8150", 0, 8150, false},
+		{"4KB-4KB", 4 * KB, 4 * KB, false},
+		{"2*1MB-1GB+1MB", 2 * MB, 1*GB + 1*MB, false},
+
+		// Inverted ranges
+		{"5MB-1MB", 0, 0, true},
+		{"1GB-1023MB", 0, 0, true},
+
+		// Missing or extra dashes and malformed bounds
+		{"1MB", 0, 0, true},
+		{"1MB 5MB", 0, 0, true},
+		{"1MB-2MB-5MB", 0, 0, true},
+		{"-5MB", 0, 0, true},
+		{"1MB-", 0, 0, true},
+		{"-", 0, 0, true},
+		{"", 0, 0, true},
+		{"1XB-5MB", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		min, max, err := ParseRange(test.input)
+
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected error for input %q, but got none", test.input)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Unexpected error for input %q: %v", test.input, err)
+			}
+			if min != test.min || max != test.max {
+				t.Errorf("For input %q, expected %d-%d, got %d-%d", test.input, test.min, test.max, min, max)
+			}
+		}
+	}
+}
+
+func TestFormatWithBase(t *testing.T) {
+	tests := []struct {
+		input    int64
+		base     int64
+		expected string
+	}{
+		{512, Binary, "512 bytes"},
+		{1000, Binary, "1000 bytes"},
+		{1000, Decimal, "1.00 KB"},
+		{1024, Binary, "1.00 KiB"},
+		{1024, Decimal, "1.02 KB"},
+		{1024 * 1024, Binary, "1.00 MiB"},
+		{1000 * 1000, Decimal, "1.00 MB"},
+		{1024 * 1024, Decimal, "1.05 MB"},
+		{int64(2.75 * GB), Binary, "2.75 GiB"},
+		{2000000000000, Decimal, "2.00 TB"},
+		{int64(1.5 * PB), Binary, "1.50 PiB"},
+		{5000 * 1000000000000000, Decimal, "5000.00 PB"},
+	}
+
+	for _, test := range tests {
+		result := FormatWithBase(test.input, test.base)
+		if result != test.expected {
+			t.Errorf("For input %d base %d, expected %q, got %q", test.input, test.base, test.expected, result)
+		}
+	}
+}
+
 func TestFormat(t *testing.T) {
 	tests := []struct {
 		input    int64
 		expected string
 	}{
 		{512, "512 bytes"},
-		{1024, "1.00 KB"},
-		{1536, "1.50 KB"},
-		{1024 * 1024, "1.00 MB"},
-		{1024 * 1024 * 1024, "1.00 GB"},
-		{int64(1.5 * MB), "1.50 MB"},
-		{int64(2.75 * GB), "2.75 GB"},
+		{1024, "1.00 KiB"},
+		{1536, "1.50 KiB"},
+		{1024 * 1024, "1.00 MiB"},
+		{1024 * 1024 * 1024, "1.00 GiB"},
+		{int64(1.5 * MB), "1.50 MiB"},
+		{int64(2.75 * GB), "2.75 GiB"},
+		{2 * TB, "2.00 TiB"},
+		{int64(1.5 * PB), "1.50 PiB"},
 	}
 
 	for _, test := range tests {
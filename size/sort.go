@@ -0,0 +1,40 @@
+package size
+
+import "sort"
+
+// Compare returns -1 if a is smaller than b, +1 if it is larger, and 0 if they are equal
+func Compare(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Sort sorts sizes in place, smallest first, or largest first if descending is set
+func Sort(sizes []int64, descending bool) {
+	sort.SliceStable(sizes, func(i, j int) bool { return less(sizes[i], sizes[j], descending) })
+}
+
+// SortIndices returns the indices of sizes ordered by size, smallest first, or largest first if
+// descending is set, leaving sizes unchanged. Equal sizes keep their original order, so layers
+// can be processed in size order while keeping their original numbering.
+func SortIndices(sizes []int64, descending bool) []int {
+	indices := make([]int, len(sizes))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool { return less(sizes[indices[i]], sizes[indices[j]], descending) })
+	return indices
+}
+
+// less orders a before b, reversing the order if descending is set
+func less(a, b int64, descending bool) bool {
+	if descending {
+		return Compare(a, b) > 0
+	}
+	return Compare(a, b) < 0
+}
@@ -0,0 +1,55 @@
+package size
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b     int64
+		expected int
+	}{
+		{1, 2, -1},
+		{2, 1, 1},
+		{KB, KB, 0},
+		{-1, 0, -1},
+	}
+	for _, test := range tests {
+		if got := Compare(test.a, test.b); got != test.expected {
+			t.Errorf("Compare(%d, %d) = %d, want %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	sizes := []int64{MB, KB, GB, 0, MB}
+	Sort(sizes, false)
+	if expected := []int64{0, KB, MB, MB, GB}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected ascending %v, got %v", expected, sizes)
+	}
+
+	Sort(sizes, true)
+	if expected := []int64{GB, MB, MB, KB, 0}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected descending %v, got %v", expected, sizes)
+	}
+}
+
+func TestSortIndices(t *testing.T) {
+	sizes := []int64{MB, KB, GB, KB, MB}
+	original := append([]int64(nil), sizes...)
+
+	// Equal sizes keep their original order in both directions
+	if got, expected := SortIndices(sizes, false), []int{1, 3, 0, 4, 2}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected ascending indices %v, got %v", expected, got)
+	}
+	if got, expected := SortIndices(sizes, true), []int{2, 0, 4, 1, 3}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected descending indices %v, got %v", expected, got)
+	}
+	if !reflect.DeepEqual(sizes, original) {
+		t.Errorf("Expected sizes to be unchanged, got %v", sizes)
+	}
+	if got := SortIndices(nil, false); len(got) != 0 {
+		t.Errorf("Expected no indices for no sizes, got %v", got)
+	}
+}
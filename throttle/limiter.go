@@ -0,0 +1,74 @@
+package throttle
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// maxBurst caps the number of bytes released at once, keeping throughput smooth
+const maxBurst = 1024 * 1024
+
+// Limiter caps the aggregate throughput of every writer it wraps
+type Limiter struct {
+	limiter *rate.Limiter
+	burst   int
+}
+
+// NewLimiter creates a limiter allowing bytesPerSecond across all wrapped writers
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	// Allow roughly 100ms worth of data per token acquisition
+	burst := bytesPerSecond / 10
+	if burst > maxBurst {
+		burst = maxBurst
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst)),
+		burst:   int(burst),
+	}
+}
+
+// Writer wraps w so that writes wait for the limiter. A nil limiter returns w unchanged.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	return l.WriterContext(context.Background(), w)
+}
+
+// WriterContext wraps w like Writer, but a write waiting for the limiter fails with ctx.Err()
+// once ctx is done. A nil limiter returns w unchanged.
+func (l *Limiter) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{ctx: ctx, w: w, l: l}
+}
+
+// limitedWriter acquires tokens before each write, splitting large writes into burst-sized pieces
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *Limiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > lw.l.burst {
+			n = lw.l.burst
+		}
+		if err := lw.l.limiter.WaitN(lw.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := lw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,63 @@
+package throttle
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterThroughput(t *testing.T) {
+	const bytesPerSecond = 1024 * 1024
+	const total = 512 * 1024
+	limiter := NewLimiter(bytesPerSecond)
+
+	// Two writers share the same budget
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := limiter.Writer(io.Discard)
+			data := make([]byte, 64*1024)
+			for written := 0; written < total/2; written += len(data) {
+				if _, err := w.Write(data); err != nil {
+					t.Errorf("Unexpected write error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// 512KB at 1MB/s takes ~500ms, less the initial burst of ~100KB
+	throughput := float64(total) / elapsed.Seconds()
+	if throughput > 1.5*bytesPerSecond {
+		t.Errorf("Throughput %.0f B/s exceeds the %d B/s cap", throughput, bytesPerSecond)
+	}
+	if elapsed < 300*time.Millisecond {
+		t.Errorf("Expected writes to be throttled, finished in %s", elapsed)
+	}
+}
+
+func TestLimiterWriterPassesData(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLimiter(100 * 1024 * 1024).Writer(&buf)
+	data := bytes.Repeat([]byte("imgmkr"), 1000)
+	n, err := w.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Expected %d bytes written, got %d (err: %v)", len(data), n, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("Data was altered by the limited writer")
+	}
+
+	// A nil limiter does not wrap
+	var nilLimiter *Limiter
+	if nilLimiter.Writer(&buf) != &buf {
+		t.Error("Expected a nil limiter to return the writer unchanged")
+	}
+}
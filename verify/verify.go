@@ -0,0 +1,70 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/jlbutler/imgmkr/manifest"
+)
+
+// File re-reads the file at path and checks that its size and SHA-256 match what was written
+func File(path string, expectedSize int64, expectedSum []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for verification: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s for verification: %w", path, err)
+	}
+
+	if n != expectedSize {
+		return fmt.Errorf("verification failed for %s: wrote %d bytes, read back %d", path, expectedSize, n)
+	}
+	if sum := hash.Sum(nil); !bytes.Equal(sum, expectedSum) {
+		return fmt.Errorf("verification failed for %s: checksum mismatch (wrote %x, read back %x)", path, expectedSum, sum)
+	}
+
+	return nil
+}
+
+// DirSize walks dir and returns the bytes in its regular files, counting hardlinked files once
+func DirSize(dir string) (int64, error) {
+	var total int64
+	var links manifest.Hardlinks
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if _, ok := links.Seen(path, info); !ok {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to size %s: %w", dir, err)
+	}
+	return total, nil
+}
+
+// WithinTolerance reports whether actual differs from expected by at most tolerance, a fraction
+// of expected
+func WithinTolerance(actual, expected int64, tolerance float64) bool {
+	diff := float64(actual - expected)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= tolerance*float64(expected)
+}
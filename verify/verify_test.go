@@ -0,0 +1,98 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	tempDir := t.TempDir()
+	filePath := filepath.Join(tempDir, "data")
+	data := []byte("imgmkr verification data")
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	sum := sha256.Sum256(data)
+
+	// Intact file verifies
+	if err := File(filePath, int64(len(data)), sum[:]); err != nil {
+		t.Errorf("Unexpected verification error: %v", err)
+	}
+
+	// Corrupted file is detected
+	corrupted := append([]byte{}, data...)
+	corrupted[0] ^= 0xff
+	if err := os.WriteFile(filePath, corrupted, 0644); err != nil {
+		t.Fatalf("Failed to corrupt test file: %v", err)
+	}
+	err := File(filePath, int64(len(data)), sum[:])
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected checksum mismatch error, got %v", err)
+	}
+
+	// Truncated file is detected
+	if err := os.WriteFile(filePath, data[:4], 0644); err != nil {
+		t.Fatalf("Failed to truncate test file: %v", err)
+	}
+	err = File(filePath, int64(len(data)), sum[:])
+	if err == nil || !strings.Contains(err.Error(), filePath) {
+		t.Errorf("Expected truncation error identifying %s, got %v", filePath, err)
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "deeper"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	files := map[string]int{"a": 100, "sub/b": 2000, "sub/deeper/c": 30000}
+	for name, n := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, n), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	// Links add no bytes of their own
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Link(filepath.Join(dir, "sub/b"), filepath.Join(dir, "hardlink")); err != nil {
+		t.Fatalf("Failed to create hardlink: %v", err)
+	}
+
+	total, err := DirSize(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if total != 32100 {
+		t.Errorf("Expected 32100 bytes, got %d", total)
+	}
+
+	if _, err := DirSize(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
+
+func TestWithinTolerance(t *testing.T) {
+	tests := []struct {
+		actual   int64
+		expected int64
+		want     bool
+	}{
+		{1000, 1000, true},
+		{990, 1000, true},
+		{1010, 1000, true},
+		{989, 1000, false},
+		{1011, 1000, false},
+		{0, 0, true},
+		{1, 0, false},
+	}
+	for _, test := range tests {
+		if got := WithinTolerance(test.actual, test.expected, 0.01); got != test.want {
+			t.Errorf("WithinTolerance(%d, %d, 0.01) = %v, expected %v", test.actual, test.expected, got, test.want)
+		}
+	}
+}
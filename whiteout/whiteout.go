@@ -0,0 +1,85 @@
+package whiteout
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Prefix marks a file in an OCI layer as deleting the same-named entry from lower layers
+const Prefix = ".wh."
+
+// Opaque is the name of the marker that hides everything lower layers put in its directory
+const Opaque = Prefix + Prefix + ".opq"
+
+// Spec requests a whiteout for Path in layer Layer (1-based)
+type Spec struct {
+	Layer int
+	Path  string
+}
+
+// String returns the spec in the form accepted by ParseSpec
+func (s Spec) String() string {
+	return fmt.Sprintf("%d:%s", s.Layer, s.Path)
+}
+
+// ParseSpec parses a whiteout spec of the form "<layer>:<path>", where path is relative to the image root
+func ParseSpec(spec string) (Spec, error) {
+	layerStr, p, ok := strings.Cut(spec, ":")
+	if !ok {
+		return Spec{}, fmt.Errorf("invalid whiteout spec %q: expected <layer>:<path>", spec)
+	}
+	layer, err := strconv.Atoi(layerStr)
+	if err != nil || layer < 1 {
+		return Spec{}, fmt.Errorf("invalid whiteout spec %q: layer must be a positive number", spec)
+	}
+
+	// Normalize to a slash-separated path relative to the image root
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return Spec{}, fmt.Errorf("invalid whiteout spec %q: path must name a file or directory", spec)
+	}
+	return Spec{Layer: layer, Path: p}, nil
+}
+
+// Name returns the relative path of the whiteout marker that deletes p
+func Name(p string) string {
+	dir, base := path.Split(p)
+	return dir + Prefix + base
+}
+
+// Create writes the empty whiteout marker deleting p into layerDir and returns its path
+func Create(layerDir string, p string) (string, error) {
+	markerPath := filepath.Join(layerDir, filepath.FromSlash(Name(p)))
+	if err := os.MkdirAll(filepath.Dir(markerPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for whiteout %s: %w", markerPath, err)
+	}
+	if err := os.WriteFile(markerPath, nil, 0644); err != nil {
+		return "", fmt.Errorf("failed to create whiteout %s: %w", markerPath, err)
+	}
+	return markerPath, nil
+}
+
+// CreateOpaque writes the empty opaque marker for dir, relative to the image root, into layerDir
+// and returns its path
+func CreateOpaque(layerDir string, dir string) (string, error) {
+	return Create(layerDir, path.Join(dir, Prefix+".opq"))
+}
+
+// IsMarker reports whether name is a whiteout or opaque marker
+func IsMarker(name string) bool {
+	return strings.HasPrefix(path.Base(name), Prefix)
+}
+
+// ExistsIn reports whether p exists in any of the given layer directories
+func ExistsIn(layerDirs []string, p string) bool {
+	for _, layerDir := range layerDirs {
+		if _, err := os.Lstat(filepath.Join(layerDir, filepath.FromSlash(p))); err == nil {
+			return true
+		}
+	}
+	return false
+}
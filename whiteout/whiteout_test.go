@@ -0,0 +1,74 @@
+package whiteout
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected Spec
+	}{
+		{"2:dir1/1.00 KB-file", Spec{Layer: 2, Path: "dir1/1.00 KB-file"}},
+		{"3:/etc/passwd", Spec{Layer: 3, Path: "etc/passwd"}},
+		{"2:dir1/../dir2/", Spec{Layer: 2, Path: "dir2"}},
+	}
+	for _, test := range tests {
+		spec, err := ParseSpec(test.spec)
+		if err != nil {
+			t.Errorf("ParseSpec(%q): unexpected error: %v", test.spec, err)
+			continue
+		}
+		if spec != test.expected {
+			t.Errorf("ParseSpec(%q): expected %+v, got %+v", test.spec, test.expected, spec)
+		}
+	}
+
+	for _, spec := range []string{"dir1", "0:dir1", "x:dir1", "2:", "2:/"} {
+		if _, err := ParseSpec(spec); err == nil {
+			t.Errorf("ParseSpec(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(lower, "dir1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lower, "dir1", "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ExistsIn([]string{lower}, "dir1/data") || ExistsIn([]string{lower}, "dir1/missing") {
+		t.Error("ExistsIn did not match the lower layer's contents")
+	}
+
+	markerPath, err := Create(upper, "dir1/data")
+	if err != nil {
+		t.Fatalf("Unexpected error creating whiteout: %v", err)
+	}
+	if expected := filepath.Join(upper, "dir1", ".wh.data"); markerPath != expected {
+		t.Errorf("Expected whiteout at %s, got %s", expected, markerPath)
+	}
+	info, err := os.Stat(markerPath)
+	if err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty whiteout file, got %v (err: %v)", info, err)
+	}
+}
+
+func TestCreateOpaque(t *testing.T) {
+	layerDir := t.TempDir()
+	markerPath, err := CreateOpaque(layerDir, "dir1/dir2")
+	if err != nil {
+		t.Fatalf("Unexpected error creating opaque marker: %v", err)
+	}
+	if expected := filepath.Join(layerDir, "dir1", "dir2", ".wh..wh..opq"); markerPath != expected {
+		t.Errorf("Expected opaque marker at %s, got %s", expected, markerPath)
+	}
+	if !IsMarker(markerPath) || !IsMarker("dir1/.wh.data") || IsMarker("dir1/data.wh.") {
+		t.Error("IsMarker did not recognize whiteout markers by name")
+	}
+}